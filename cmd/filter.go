@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ebarti/dd-assignment/pkg/logs"
+	"github.com/ebarti/dd-assignment/pkg/reader"
+	"io"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	SamplesFlag      = "samples"
+	ExplainLimitFlag = "explain-limit"
+)
+
+var (
+	filterCmd = &cobra.Command{
+		Use:   "filter",
+		Short: "Inspect log filter queries",
+		Long:  `Inspect log filter queries such as "status:200 @http.path.section:api" before using them in metrics or monitors.`,
+	}
+	filterValidateCmd = &cobra.Command{
+		Use:   "validate <query>",
+		Short: "Parse a log filter query and print its syntax tree",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runFilterValidateCmd,
+	}
+	filterTestCmd = &cobra.Command{
+		Use:   "test <query>",
+		Short: "Run a log filter query over a file and explain why lines do not match",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runFilterTestCmd,
+	}
+	filterFilePath string
+	filterSamples  int
+	explainLimit   int
+)
+
+func init() {
+	filterTestCmd.Flags().StringVarP(&filterFilePath, FileFlag, "f", "", "Path to the CSV file to run the query over")
+	filterTestCmd.MarkFlagRequired(FileFlag)
+	filterTestCmd.Flags().IntVarP(&filterSamples, SamplesFlag, "s", 5, "Number of matching lines to print")
+	filterTestCmd.Flags().IntVarP(&explainLimit, ExplainLimitFlag, "e", 10, "Number of non-matching lines to explain, -1 explains all of them")
+	filterCmd.AddCommand(filterValidateCmd, filterTestCmd)
+	rootCmd.AddCommand(filterCmd)
+}
+
+func runFilterValidateCmd(cmd *cobra.Command, args []string) error {
+	filter, err := logs.ParseLogFilter(args[0])
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Query: %s\n", filter)
+	filter.Render(&buf)
+	buf.WriteRune('\n')
+	_, err = buf.WriteTo(cmd.OutOrStdout())
+	return err
+}
+
+func runFilterTestCmd(cmd *cobra.Command, args []string) error {
+	filter, err := logs.ParseLogFilter(args[0])
+	if err != nil {
+		return err
+	}
+	out := cmd.OutOrStdout()
+	r := reader.NewFileReader(filterFilePath, log.New(cmd.ErrOrStderr(), "", 0))
+	if err := r.Start(); err != nil {
+		return err
+	}
+	processor := GetCsvLogProcessingFunc()
+	var lineNumber, parseErrors, matched, notMatched int
+	var samples, explanations bytes.Buffer
+	for batch := range r.OutputChan {
+		for _, msg := range batch {
+			lineNumber++
+			processedLog, err := processor(msg)
+			if err != nil {
+				parseErrors++
+				continue
+			}
+			if filter.Matches(processedLog) {
+				matched++
+				if matched <= filterSamples {
+					fmt.Fprintf(&samples, "  [line %d] %s\n", lineNumber, processedLog.Message)
+				}
+				continue
+			}
+			notMatched++
+			if explainLimit >= 0 && notMatched > explainLimit {
+				continue
+			}
+			fmt.Fprintf(&explanations, "  [line %d] %s\n", lineNumber, processedLog.Message)
+			for _, result := range filter.Explain(processedLog) {
+				fmt.Fprintf(&explanations, "      %s\n", result)
+			}
+		}
+	}
+	printFilterTestReport(out, filter, lineNumber, parseErrors, matched, notMatched, &samples, &explanations)
+	return nil
+}
+
+// printFilterTestReport is a helper function that writes the result of a filter test run.
+func printFilterTestReport(out io.Writer, filter *logs.LogFilter, lines, parseErrors, matched, notMatched int, samples, explanations *bytes.Buffer) {
+	fmt.Fprintf(out, "Query: %s\n", filter)
+	fmt.Fprintf(out, "Lines read: %d\n", lines)
+	fmt.Fprintf(out, "Lines that could not be processed: %d\n", parseErrors)
+	fmt.Fprintf(out, "Matched: %d\n", matched)
+	fmt.Fprintf(out, "Not matched: %d\n", notMatched)
+	if samples.Len() > 0 {
+		fmt.Fprintf(out, "\nSample matching lines:\n%s", samples.String())
+	}
+	if explanations.Len() > 0 {
+		fmt.Fprintf(out, "\nWhy lines did not match:\n%s", explanations.String())
+	}
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+// runFilterCmd is a helper function that runs the given filter subcommand and returns its output
+func runFilterCmd(run func(cmd *cobra.Command, args []string) error, query string) (string, error) {
+	var out bytes.Buffer
+	cmd := &cobra.Command{}
+	cmd.SetOut(&out)
+	cmd.SetErr(&out)
+	err := run(cmd, []string{query})
+	return out.String(), err
+}
+
+func TestFilterValidateCmd(t *testing.T) {
+	out, err := runFilterCmd(runFilterValidateCmd, "@http.path.section:api status:200 host:10.0.0.2")
+	assert.NoError(t, err)
+	assert.Equal(t, `Query: status:200 host:10.0.0.2 @http.path.section:api
+AND
+├── top level status = "200"
+├── top level host = "10.0.0.2"
+└── attribute http.path.section = "api"
+`, out)
+
+	out, err = runFilterCmd(runFilterValidateCmd, "*")
+	assert.NoError(t, err)
+	assert.Equal(t, "Query: *\nMATCH ALL (*)\n", out)
+
+	_, err = runFilterCmd(runFilterValidateCmd, "http.path.section")
+	assert.Error(t, err)
+}
+
+func TestFilterTestCmd(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	filterFilePath, filterSamples, explainLimit = "../test_resources/short_sample_csv.txt", 1, 1
+	out, err := runFilterCmd(runFilterTestCmd, "host:10.0.0.2 @http.path.section:api")
+	assert.NoError(t, err)
+	assert.Equal(t, `Query: host:10.0.0.2 @http.path.section:api
+Lines read: 6
+Lines that could not be processed: 1
+Matched: 2
+Not matched: 3
+
+Sample matching lines:
+  [line 2] "10.0.0.2","-","apache",1549573860,"GET /api/user HTTP/1.0",200,1234
+
+Why lines did not match:
+  [line 3] "10.0.0.4","-","apache",1549573860,"GET /api/user HTTP/1.0",200,1234
+      FAIL host:10.0.0.2 (got "10.0.0.4")
+      PASS @http.path.section:api (got "api")
+`, out)
+}
@@ -5,10 +5,13 @@ import (
 	"github.com/ebarti/dd-assignment/pkg"
 	"github.com/ebarti/dd-assignment/pkg/common"
 	"github.com/ebarti/dd-assignment/pkg/errors"
+	"github.com/ebarti/dd-assignment/pkg/forwarder"
 	"github.com/ebarti/dd-assignment/pkg/logs"
 	"github.com/ebarti/dd-assignment/pkg/metrics"
 	"github.com/ebarti/dd-assignment/pkg/monitors"
 	"github.com/ebarti/dd-assignment/pkg/pipeline"
+	"github.com/ebarti/dd-assignment/pkg/sinks"
+	"github.com/ebarti/dd-assignment/pkg/storage"
 	"log"
 	"os"
 	"strconv"
@@ -19,10 +22,36 @@ import (
 )
 
 const (
-	FileFlag              = "file"
-	StatPrintIntervalFlag = "interval"
-	AlertThresholdFlag    = "threshold"
-	AlertTimeWindow       = "window"
+	FileFlag               = "file"
+	StatPrintIntervalFlag  = "interval"
+	AlertThresholdFlag     = "threshold"
+	AlertTimeWindow        = "window"
+	TopNFlag               = "top"
+	TagLimitFlag           = "tag-limit"
+	GlobalTagLimitFlag     = "global-tag-limit"
+	CardinalityStatsFlag   = "cardinality-stats"
+	DerivedMetricFlag      = "derived"
+	RetentionFlag          = "retention"
+	RollupsFlag            = "rollups"
+	DataDirFlag            = "data-dir"
+	HttpAddressFlag        = "http"
+	DogStatsDFlag          = "dogstatsd"
+	DogStatsDNamespaceFlag = "dogstatsd-namespace"
+	AllowedLatenessFlag    = "allowed-lateness"
+	OrderBufferFlag        = "order-buffer"
+	ProcessingTimeFlag     = "processing-time"
+	TimeZoneFlag           = "timezone"
+	ShardsFlag             = "shards"
+	BatchSizeFlag          = "batch-size"
+	BufferSizeFlag         = "buffer-size"
+	MonitorQueueFlag       = "monitor-queue"
+	MetricsQueueFlag       = "metrics-queue"
+	SpillDirFlag           = "spill-dir"
+	TelemetryFlag          = "telemetry"
+	OutputFlag             = "output"
+	OutputFileFlag         = "output-file"
+	OutputMaxSizeFlag      = "output-max-size"
+	OutputMaxFilesFlag     = "output-max-files"
 )
 
 // Note: This file was bootstrapped using cobra init.
@@ -39,8 +68,34 @@ var (
 	}
 	filePath          string
 	statPrintInterval int64
-	alertThreshold    int64
+	alertThreshold    float64
 	alertTimeWindow   int64
+	topN              int
+	tagLimit          int
+	globalTagLimit    int
+	cardinalityStats  bool
+	derivedMetrics    []string
+	rawRetention      int64
+	rollups           string
+	dataDir           string
+	httpAddress       string
+	dogStatsDAddress  string
+	dogStatsDPrefix   string
+	allowedLateness   int64
+	orderBufferSize   int
+	processingTime    bool
+	timeZone          string
+	shards            int
+	batchSize         int
+	bufferSize        int
+	monitorQueue      string
+	metricsQueue      string
+	spillDir          string
+	telemetry         bool
+	outputFormat      string
+	outputFile        string
+	outputMaxSize     int64
+	outputMaxFiles    int
 )
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -56,11 +111,68 @@ func init() {
 	rootCmd.Flags().StringVarP(&filePath, FileFlag, "f", "", "Path to the CSV file to process")
 	rootCmd.MarkFlagRequired(FileFlag)
 	rootCmd.Flags().Int64VarP(&statPrintInterval, StatPrintIntervalFlag, "i", 10, "Interval at which to output statistics in seconds")
-	rootCmd.Flags().Int64VarP(&alertThreshold, AlertThresholdFlag, "t", 10, "Number of requests per second that, once aggregated over the time window, will trigger an alert")
+	rootCmd.Flags().Float64VarP(&alertThreshold, AlertThresholdFlag, "t", 10, "Number of requests per second that, once aggregated over the time window, will trigger an alert")
 	rootCmd.Flags().Int64VarP(&alertTimeWindow, AlertTimeWindow, "w", 2*60, "Time window in seconds to aggregate requests over")
+	rootCmd.Flags().IntVarP(&topN, TopNFlag, "n", 0, "Only output the top N values of every tag, the others are grouped as \"other\". 0 outputs all of them")
+	rootCmd.Flags().IntVar(&tagLimit, TagLimitFlag, metrics.DefaultPerMetricTagLimit, "Maximum number of distinct values of a tag of a metric in an interval, the others are counted as \"overflow\". 0 means no limit")
+	rootCmd.Flags().IntVar(&globalTagLimit, GlobalTagLimitFlag, metrics.DefaultGlobalTagLimit, "Maximum number of distinct tag values of all the metrics in an interval, the others are counted as \"overflow\". 0 means no limit")
+	rootCmd.Flags().StringArrayVarP(&derivedMetrics, DerivedMetricFlag, "d", nil, "Metric computed every interval with a formula over the other metrics, as name=formula. For example: 'hits per second=\"DD exercise\" / 10'. Can be repeated")
+	rootCmd.Flags().Int64Var(&rawRetention, RetentionFlag, storage.DefaultRawRetention, "Number of seconds the metric history is kept at the interval resolution")
+	rootCmd.Flags().StringVar(&rollups, RollupsFlag, storage.FormatRollups(storage.DefaultRollups), "Coarser resolutions of the metric history, as comma separated interval:retention in seconds")
+	rootCmd.Flags().StringVar(&dataDir, DataDirFlag, "", "Directory where the metric history is persisted and recovered from on startup. Empty keeps it in memory only")
+	rootCmd.Flags().StringVar(&httpAddress, HttpAddressFlag, "", "Address to serve metric queries on, e.g. localhost:8080. Once the file is processed, queries are served until interrupted. Empty disables it")
+	rootCmd.Flags().StringVar(&dogStatsDAddress, DogStatsDFlag, "", "DogStatsD server to forward the flushed metrics to, as udp://host:port or unix:///path/to/socket. Empty disables it")
+	rootCmd.Flags().StringVar(&dogStatsDPrefix, DogStatsDNamespaceFlag, "", "Namespace prepended to the name of the metrics forwarded to DogStatsD, e.g. \"logs.\"")
+	rootCmd.Flags().Int64Var(&allowedLateness, AllowedLatenessFlag, metrics.DefaultAllowedLateness, "Number of seconds an interval is kept open after the latest log timestamp reaches its end, so that out of order logs are still counted in it")
+	rootCmd.Flags().IntVar(&orderBufferSize, OrderBufferFlag, sinks.DefaultOrderedBufferSize, "Maximum number of statistics and alerts buffered to output them ordered by log timestamp. 0 outputs them as soon as they are computed, in no guaranteed order")
+	rootCmd.Flags().BoolVar(&processingTime, ProcessingTimeFlag, false, "Aggregate logs in the interval of the time they are read at and output statistics every interval even without logs, e.g. to follow live traffic from -f /dev/stdin")
+	rootCmd.Flags().StringVar(&timeZone, TimeZoneFlag, "UTC", "Time zone the intervals are aligned in, e.g. Europe/Paris, so that daily intervals start at local midnight")
+	rootCmd.Flags().IntVar(&shards, ShardsFlag, 1, "Number of goroutines the metrics are aggregated in, each owning a partition of the series, e.g. the number of cores for high volume logs")
+	rootCmd.Flags().IntVar(&batchSize, BatchSizeFlag, common.DefaultBatchSize, "Maximum number of log lines read and processed together")
+	rootCmd.Flags().IntVar(&bufferSize, BufferSizeFlag, common.DefaultBufferSize, "Number of batches of log lines or metric samples every component can have waiting for the next one")
+	rootCmd.Flags().StringVar(&monitorQueue, MonitorQueueFlag, string(pipeline.BlockPolicy), "What to do with the logs of a monitor whose buffer is full: block (waits for it, holding back the metrics), drop-oldest, drop-newest or spill (to disk)")
+	rootCmd.Flags().StringVar(&metricsQueue, MetricsQueueFlag, string(pipeline.BlockPolicy), "What to do with the logs of the metrics when their buffer is full: block, drop-oldest, drop-newest or spill")
+	rootCmd.Flags().StringVar(&spillDir, SpillDirFlag, "", "Directory the logs are spilled to with the spill queue policy. Empty uses the temporary directory")
+	rootCmd.Flags().BoolVar(&telemetry, TelemetryFlag, false, "Output internal metrics of the service, e.g. lines read, parse errors and ingestion latency, with the statistics of every interval")
+	rootCmd.Flags().StringVarP(&outputFormat, OutputFlag, "o", string(sinks.TextFormat), "Format of the statistics and alerts: text, json (one JSON object per line) or csv")
+	rootCmd.Flags().StringVar(&outputFile, OutputFileFlag, "", "File the statistics and alerts are appended to. Empty writes them to the console")
+	rootCmd.Flags().Int64Var(&outputMaxSize, OutputMaxSizeFlag, 0, "Size in bytes at which the output file is rotated. 0 never rotates it")
+	rootCmd.Flags().IntVar(&outputMaxFiles, OutputMaxFilesFlag, 5, "Number of rotated output files to keep")
+	rootCmd.Flags().BoolVar(&cardinalityStats, CardinalityStatsFlag, false, "Output the number of distinct values of every tag every interval")
 }
 
 func runRootCmd(cmd *cobra.Command, args []string) error {
+	derived, err := GetDerivedMetrics(derivedMetrics)
+	if err != nil {
+		return err
+	}
+	resolutions, err := GetRollups(rollups)
+	if err != nil {
+		return err
+	}
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return err
+	}
+	monitorPolicy, err := pipeline.ParseQueuePolicy(monitorQueue)
+	if err != nil {
+		return err
+	}
+	metricsPolicy, err := pipeline.ParseQueuePolicy(metricsQueue)
+	if err != nil {
+		return err
+	}
+	output, err := GetOutputSink(outputFormat, outputFile, outputMaxSize, outputMaxFiles)
+	if err != nil {
+		return err
+	}
+	// the rollup buckets are aligned in the time zone of the intervals
+	store := storage.NewTimeSeriesStore(rawRetention, resolutions...).WithTimeZone(location)
+	if dataDir != "" {
+		if store, err = storage.OpenTimeSeriesStore(dataDir, location, rawRetention, resolutions...); err != nil {
+			return err
+		}
+	}
 	service := pkg.NewService(
 		filePath,
 		statPrintInterval,
@@ -68,7 +180,33 @@ func runRootCmd(cmd *cobra.Command, args []string) error {
 		GetCsvCustomMetricsPipelines(statPrintInterval),
 		GetCsvLogMonitorConfig(alertTimeWindow, alertThreshold),
 		log.New(os.Stdout, "", 0),
-	)
+	).WithTopN(topN).
+		WithTagLimits(tagLimit, globalTagLimit).
+		WithCardinalityStats(cardinalityStats).
+		WithDerivedMetrics(derived...).
+		WithAllowedLateness(allowedLateness).
+		WithOrderedOutput(orderBufferSize).
+		WithProcessingTime(processingTime).
+		WithTimeZone(location).
+		WithShards(shards).
+		WithBatchSize(batchSize).
+		WithBufferSize(bufferSize).
+		WithQueuePolicies(monitorPolicy, metricsPolicy, spillDir).
+		WithTelemetry(telemetry).
+		WithStore(store)
+	if output != nil {
+		service.WithSinks(output)
+	}
+	if httpAddress != "" {
+		service.WithQueryServer(httpAddress)
+	}
+	if dogStatsDAddress != "" {
+		f, err := forwarder.NewDogStatsDForwarder(dogStatsDAddress)
+		if err != nil {
+			return err
+		}
+		service.WithDogStatsD(f.WithNamespace(dogStatsDPrefix))
+	}
 	if err := service.Start(); err != nil {
 		return err
 	}
@@ -77,23 +215,84 @@ func runRootCmd(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// GetDerivedMetrics parses derived metric definitions written as name=formula
+func GetDerivedMetrics(definitions []string) ([]*metrics.DerivedMetric, error) {
+	var derived []*metrics.DerivedMetric
+	for _, definition := range definitions {
+		name, formula := definition, ""
+		if index := strings.Index(definition, "="); index >= 0 {
+			name, formula = strings.TrimSpace(definition[:index]), definition[index+1:]
+		}
+		if name == "" || formula == "" {
+			return nil, errors.NewInvalidFormulaError(definition, 0, "expected name=formula")
+		}
+		d, err := metrics.NewDerivedMetric(name, formula)
+		if err != nil {
+			return nil, err
+		}
+		derived = append(derived, d)
+	}
+	return derived, nil
+}
+
+// GetOutputSink returns the sink writing the statistics and alerts in the given format to the file, or to the console.
+// It returns nil for text on the console, which the service prints with its logger
+func GetOutputSink(format string, file string, maxSize int64, maxFiles int) (sinks.Sink, error) {
+	f, err := sinks.ParseFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	if file != "" {
+		return sinks.NewFileSink(file, f, maxSize, maxFiles)
+	}
+	if f == sinks.TextFormat {
+		return nil, nil
+	}
+	return sinks.NewWriterSink(os.Stdout, f), nil
+}
+
+// GetRollups parses comma separated interval:retention resolutions, e.g. "60:86400,3600:2592000"
+func GetRollups(spec string) ([]storage.Resolution, error) {
+	var resolutions []storage.Resolution
+	for _, rollup := range strings.Split(spec, ",") {
+		rollup = strings.TrimSpace(rollup)
+		if rollup == "" {
+			continue
+		}
+		parts := strings.Split(rollup, ":")
+		if len(parts) != 2 {
+			return nil, errors.NewInvalidResolutionError(rollup)
+		}
+		interval, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || interval <= 0 {
+			return nil, errors.NewInvalidResolutionError(rollup)
+		}
+		retention, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || retention <= 0 {
+			return nil, errors.NewInvalidResolutionError(rollup)
+		}
+		resolutions = append(resolutions, storage.Resolution{Interval: interval, Retention: retention})
+	}
+	return resolutions, nil
+}
+
 // GetCsvLogProcessingFunc is the definition of the "high traffic monitor"
-func GetCsvLogMonitorConfig(timeWindow, threshold int64) []*monitors.LogMonitorConfig {
+func GetCsvLogMonitorConfig(timeWindow int64, threshold float64) []*monitors.LogMonitorConfig {
 	return []*monitors.LogMonitorConfig{
 		{
 			Name:           "High traffic monitor",
 			TimeWindow:     timeWindow, // two minutes
 			Filter:         "*",
-			AlertThreshold: timeWindow * threshold,
+			AlertThreshold: float64(timeWindow) * threshold,
 			AlertTemplate:  "High traffic generated an alert - hits {{value}}, triggered at {{time}}",
 			AlertTemplateContextFunc: func(m *metrics.ComputedMetric) map[string]string {
 				return map[string]string{
-					"value": strconv.FormatInt(m.Value, 10),
+					"value": metrics.FormatValue(m.Value),
 					"time":  fmt.Sprintf("%v", time.Unix(m.Timestamp, 0)),
 				}
 			},
 			RecoveryTemplate:  "Recovered from high traffic at time {{time}}",
-			RecoveryThreshold: timeWindow * threshold,
+			RecoveryThreshold: float64(timeWindow) * threshold,
 			RecoveryTemplateContextFunc: func(m *metrics.ComputedMetric) map[string]string {
 				return map[string]string{
 					"time": fmt.Sprintf("%v", time.Unix(m.Timestamp, 0)),
@@ -0,0 +1,263 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/ebarti/dd-assignment/pkg/common"
+	"github.com/ebarti/dd-assignment/pkg/metrics"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// PrometheusPath is the path of the Prometheus exposition endpoint
+	PrometheusPath = "/metrics"
+	// PrometheusContentType is the content type of the Prometheus text format
+	PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+	// OpenMetricsContentType is the content type of the OpenMetrics text format
+	OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// Types of the exposed metric families
+const (
+	counterType = "counter"
+	gaugeType   = "gauge"
+	summaryType = "summary"
+)
+
+// PrometheusExporter exposes the metrics flushed by the MetricAggregator in the Prometheus text format, or in the
+// OpenMetrics format if the scraper accepts it, and implements the metrics.MetricStore interface. Every series of a
+// metric is exposed with its tags as labels, and names are sanitized, e.g. "DD exercise" is exposed as dd_exercise_total.
+//   - counts and sums are counters, with the total of all the flushed intervals
+//   - distributions are summaries, with the total count and sum of all the flushed intervals and the quantiles of the latest one
+//   - every other aggregation is a gauge, with the value of the latest flushed interval
+//
+// Timestamps are not exposed, as logs might be replayed from the past. A metric whose sanitized name is already used by
+// another metric is not exposed. PrometheusExporter is thread-safe.
+type PrometheusExporter struct {
+	families map[string]*metricFamily // map of [sanitized name]*metricFamily
+	mu       sync.RWMutex
+}
+
+// metricFamily holds the exposed series of a metric
+type metricFamily struct {
+	name        string // sanitized name, without the _total suffix of counters
+	metric      string
+	aggregation metrics.AggregationType
+	kind        string
+	series      map[string]*exposedSeries // map of [tag set key]*exposedSeries
+}
+
+// exposedSeries holds the exposed values of a series
+type exposedSeries struct {
+	labels    []string // name="value" pairs
+	value     float64
+	count     float64
+	sum       float64
+	quantiles map[float64]float64 // quantiles of the latest flushed interval of summaries
+}
+
+// NewPrometheusExporter creates a new PrometheusExporter
+func NewPrometheusExporter() *PrometheusExporter {
+	return &PrometheusExporter{families: make(map[string]*metricFamily)}
+}
+
+// Store updates the exposed series with the metrics computed for the time interval [start, end)
+func (e *PrometheusExporter) Store(start, end int64, computedMetrics []*metrics.ComputedMetric) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, computedMetric := range computedMetrics {
+		family := e.family(computedMetric)
+		if family == nil {
+			continue
+		}
+		switch family.kind {
+		case gaugeType:
+			// only the series of the latest interval are exposed
+			family.series = make(map[string]*exposedSeries)
+		case summaryType:
+			for _, s := range family.series {
+				s.quantiles = nil
+			}
+		}
+		for _, series := range computedMetric.Series {
+			key := metrics.TagSetKey(series.Tags)
+			exposed, ok := family.series[key]
+			if !ok {
+				exposed = &exposedSeries{labels: labels(series.Tags)}
+				family.series[key] = exposed
+			}
+			switch family.kind {
+			case counterType:
+				exposed.value += series.Value
+			case summaryType:
+				exposed.count += series.Values[metrics.CountValue]
+				exposed.sum += series.Values[metrics.SumValue]
+				exposed.quantiles = make(map[float64]float64, len(metrics.DefaultPercentiles))
+				for _, p := range metrics.DefaultPercentiles {
+					exposed.quantiles[p] = series.Values[metrics.PercentileValueName(p)]
+				}
+			default:
+				exposed.value = series.Value
+			}
+		}
+	}
+}
+
+// family is a helper function that returns the family of the metric, creating it if needed.
+// It returns nil if the sanitized name of the metric is used by another metric
+func (e *PrometheusExporter) family(computedMetric *metrics.ComputedMetric) *metricFamily {
+	aggregation := computedMetric.GetAggregation()
+	kind := gaugeType
+	switch aggregation {
+	case metrics.CountAggregation, metrics.SumAggregation:
+		kind = counterType
+	case metrics.DistributionAggregation:
+		kind = summaryType
+	}
+	name := SanitizeName(computedMetric.Name)
+	if kind == counterType {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	family, ok := e.families[name]
+	if !ok {
+		family = &metricFamily{
+			name:        name,
+			metric:      computedMetric.Name,
+			aggregation: aggregation,
+			kind:        kind,
+			series:      make(map[string]*exposedSeries),
+		}
+		e.families[name] = family
+	}
+	if family.metric != computedMetric.Name || family.kind != kind {
+		return nil
+	}
+	return family
+}
+
+// ServeHTTP writes the exposed metrics in the OpenMetrics format if the request accepts it, or in the Prometheus text format
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, &ErrorResponse{Error: "only GET is allowed"})
+		return
+	}
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", OpenMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", PrometheusContentType)
+	}
+	_ = e.Write(w, openMetrics)
+}
+
+// Write writes the exposed metrics, sorted by name, in the OpenMetrics format or in the Prometheus text format
+func (e *PrometheusExporter) Write(writer io.Writer, openMetrics bool) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	w := bufio.NewWriter(writer)
+	names := make([]string, 0, len(e.families))
+	for name := range e.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := e.families[name]
+		help := fmt.Sprintf("%s of metric %q", family.aggregation, family.metric)
+		familyName := family.name
+		if family.kind == counterType && !openMetrics {
+			// the Prometheus text format names counter families after their samples
+			familyName += "_total"
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n", familyName, escapeHelp(help, openMetrics))
+		fmt.Fprintf(w, "# TYPE %s %s\n", familyName, family.kind)
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := family.series[key]
+			switch family.kind {
+			case counterType:
+				writeSample(w, family.name+"_total", s.labels, s.value)
+			case summaryType:
+				for _, p := range metrics.DefaultPercentiles {
+					if value, ok := s.quantiles[p]; ok {
+						quantile := fmt.Sprintf("quantile=%q", strconv.FormatFloat(p, 'g', -1, 64))
+						writeSample(w, family.name, append(append([]string{}, s.labels...), quantile), value)
+					}
+				}
+				writeSample(w, family.name+"_sum", s.labels, s.sum)
+				writeSample(w, family.name+"_count", s.labels, s.count)
+			default:
+				writeSample(w, family.name, s.labels, s.value)
+			}
+		}
+	}
+	if openMetrics {
+		fmt.Fprint(w, "# EOF\n")
+	}
+	return w.Flush()
+}
+
+// writeSample is a helper function that writes a sample line
+func writeSample(w io.Writer, name string, labels []string, value float64) {
+	if len(labels) == 0 {
+		fmt.Fprintf(w, "%s %s\n", name, formatSampleValue(value))
+		return
+	}
+	fmt.Fprintf(w, "%s{%s} %s\n", name, strings.Join(labels, ","), formatSampleValue(value))
+}
+
+// formatSampleValue is a helper function that formats a sample value, with the infinity and NaN spellings of the formats
+func formatSampleValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// labels is a helper function that returns the name="value" label pairs of the tags, with sanitized names and escaped values
+func labels(tags []*metrics.Tag) []string {
+	pairs := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		pairs = append(pairs, SanitizeName(tag.Name)+`="`+escapeLabelValue(tag.Value)+`"`)
+	}
+	return pairs
+}
+
+// SanitizeName returns a valid Prometheus metric or label name: it lower cases the name, replaces runs of characters
+// other than letters and digits with an underscore, and prepends an underscore to names starting with a digit.
+// For example, "DD exercise" becomes dd_exercise and http.path.section becomes http_path_section.
+// Unlike DogStatsD names, periods are not allowed, and underscores are valid first characters.
+func SanitizeName(name string) string {
+	sanitized := common.SanitizeName(name, "")
+	if sanitized == "" || (sanitized[0] >= '0' && sanitized[0] <= '9') {
+		sanitized = "_" + sanitized
+	}
+	return sanitized
+}
+
+// escapeLabelValue is a helper function that escapes backslashes, double quotes and line feeds of a label value
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// escapeHelp is a helper function that escapes a help text. OpenMetrics also escapes double quotes
+func escapeHelp(help string, openMetrics bool) string {
+	if openMetrics {
+		return escapeLabelValue(help)
+	}
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"bytes"
+	"github.com/ebarti/dd-assignment/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// flushMetric is a helper function that flushes a metric with the given samples, as value per section
+func flushMetric(t *testing.T, name string, aggregation metrics.AggregationType, samples map[string][]float64) *metrics.ComputedMetric {
+	m := metrics.NewMetric(aggregation, 10)
+	for section, values := range samples {
+		for _, value := range values {
+			assert.NoError(t, m.AddSample(&metrics.MetricSample{
+				Name:  name,
+				Value: value,
+				Tags:  []*metrics.Tag{{Name: "http.path.section", Value: section}},
+			}))
+		}
+	}
+	computed, err := m.Flush(0)
+	assert.NoError(t, err)
+	computed.Name = name
+	return computed
+}
+
+func TestSanitizeName(t *testing.T) {
+	for name, want := range map[string]string{
+		"DD exercise":       "dd_exercise",
+		"http.path.section": "http_path_section",
+		"  bytes / second ": "bytes_second",
+		"5xx":               "_5xx",
+		"":                  "_",
+	} {
+		assert.Equal(t, want, SanitizeName(name))
+	}
+}
+
+func TestPrometheusExporter(t *testing.T) {
+	e := NewPrometheusExporter()
+	e.Store(0, 10, []*metrics.ComputedMetric{
+		flushMetric(t, "DD exercise", metrics.CountAggregation, map[string][]float64{"api": {1, 1}, "report": {1}}),
+		flushMetric(t, "max bytes", metrics.MaxAggregation, map[string][]float64{"api": {10, 30}, "report": {20}}),
+		flushMetric(t, "bytes", metrics.DistributionAggregation, map[string][]float64{`say "hi"`: {100}}),
+	})
+	e.Store(10, 20, []*metrics.ComputedMetric{
+		flushMetric(t, "DD exercise", metrics.CountAggregation, map[string][]float64{"api": {1}}),
+		flushMetric(t, "max bytes", metrics.MaxAggregation, map[string][]float64{"api": {5}}),
+		// collides with the name of the count
+		flushMetric(t, "dd.exercise", metrics.GaugeAggregation, map[string][]float64{"api": {1}}),
+	})
+
+	var prometheus bytes.Buffer
+	assert.NoError(t, e.Write(&prometheus, false))
+	assert.Equal(t, `# HELP bytes distribution of metric "bytes"
+# TYPE bytes summary
+bytes{http_path_section="say \"hi\"",quantile="0.5"} 100
+bytes{http_path_section="say \"hi\"",quantile="0.75"} 100
+bytes{http_path_section="say \"hi\"",quantile="0.9"} 100
+bytes{http_path_section="say \"hi\"",quantile="0.95"} 100
+bytes{http_path_section="say \"hi\"",quantile="0.99"} 100
+bytes_sum{http_path_section="say \"hi\""} 100
+bytes_count{http_path_section="say \"hi\""} 1
+# HELP dd_exercise_total count of metric "DD exercise"
+# TYPE dd_exercise_total counter
+dd_exercise_total{http_path_section="api"} 3
+dd_exercise_total{http_path_section="report"} 1
+# HELP max_bytes max of metric "max bytes"
+# TYPE max_bytes gauge
+max_bytes{http_path_section="api"} 5
+`, prometheus.String())
+
+	var openMetrics bytes.Buffer
+	assert.NoError(t, e.Write(&openMetrics, true))
+	assert.Equal(t, `# HELP bytes distribution of metric \"bytes\"
+# TYPE bytes summary
+bytes{http_path_section="say \"hi\"",quantile="0.5"} 100
+bytes{http_path_section="say \"hi\"",quantile="0.75"} 100
+bytes{http_path_section="say \"hi\"",quantile="0.9"} 100
+bytes{http_path_section="say \"hi\"",quantile="0.95"} 100
+bytes{http_path_section="say \"hi\"",quantile="0.99"} 100
+bytes_sum{http_path_section="say \"hi\""} 100
+bytes_count{http_path_section="say \"hi\""} 1
+# HELP dd_exercise count of metric \"DD exercise\"
+# TYPE dd_exercise counter
+dd_exercise_total{http_path_section="api"} 3
+dd_exercise_total{http_path_section="report"} 1
+# HELP max_bytes max of metric \"max bytes\"
+# TYPE max_bytes gauge
+max_bytes{http_path_section="api"} 5
+# EOF
+`, openMetrics.String())
+}
+
+func TestPrometheusExporter_Summary(t *testing.T) {
+	e := NewPrometheusExporter()
+	e.Store(0, 10, []*metrics.ComputedMetric{
+		flushMetric(t, "bytes", metrics.DistributionAggregation, map[string][]float64{"api": {100, 100, 100}}),
+	})
+	var prometheus bytes.Buffer
+	assert.NoError(t, e.Write(&prometheus, false))
+	assert.Contains(t, prometheus.String(), `bytes{http_path_section="api",quantile="0.5"} `)
+	assert.Contains(t, prometheus.String(), `bytes{http_path_section="api",quantile="0.99"} `)
+	assert.Contains(t, prometheus.String(), `bytes_sum{http_path_section="api"} 300`)
+	assert.Contains(t, prometheus.String(), `bytes_count{http_path_section="api"} 3`)
+}
+
+func TestPrometheusExporter_ServeHTTP(t *testing.T) {
+	e := NewPrometheusExporter()
+	e.Store(0, 10, []*metrics.ComputedMetric{
+		flushMetric(t, "DD exercise", metrics.CountAggregation, map[string][]float64{"api": {1}}),
+	})
+	tests := []struct {
+		accept      string
+		contentType string
+		eof         bool
+	}{
+		{accept: "", contentType: PrometheusContentType},
+		{accept: "text/plain;version=0.0.4;q=0.5,*/*;q=0.1", contentType: PrometheusContentType},
+		{accept: "application/openmetrics-text;version=1.0.0,text/plain;q=0.5", contentType: OpenMetricsContentType, eof: true},
+	}
+	for _, tt := range tests {
+		t.Run("test prometheus exporter accepting "+tt.accept, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, PrometheusPath, nil)
+			request.Header.Set("Accept", tt.accept)
+			recorder := httptest.NewRecorder()
+			e.ServeHTTP(recorder, request)
+			body, _ := ioutil.ReadAll(recorder.Body)
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, tt.contentType, recorder.Header().Get("Content-Type"))
+			assert.Contains(t, string(body), `dd_exercise_total{http_path_section="api"} 1`)
+			assert.Equal(t, tt.eof, bytes.HasSuffix(body, []byte("# EOF\n")))
+		})
+	}
+}
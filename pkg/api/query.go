@@ -0,0 +1,321 @@
+package api
+
+import (
+	"fmt"
+	"github.com/ebarti/dd-assignment/pkg/errors"
+	"github.com/ebarti/dd-assignment/pkg/metrics"
+	"github.com/ebarti/dd-assignment/pkg/storage"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// SpaceAggregator combines the values of the series of a group at every timestamp
+type SpaceAggregator string
+
+const (
+	SumSpaceAggregator SpaceAggregator = "sum"
+	AvgSpaceAggregator SpaceAggregator = "avg"
+	MinSpaceAggregator SpaceAggregator = "min"
+	MaxSpaceAggregator SpaceAggregator = "max"
+)
+
+// NoTagValue is the value of a group by tag for the series that do not have it
+const NoTagValue = "N/A"
+
+// MetricQuery is a query over the history of a metric, written as `[aggregator:]metric[{tags}] [by {tags}]`, e.g.
+// `sum:"DD exercise"{section:api} by {status}`. The metric name is quoted with double quotes when it contains
+// characters other than letters, digits, '_', '-' and '.'. Only the series with all the tags between braces are
+// selected, tags without value only need to have the tag name, and `*` selects all the series. Selected series are
+// grouped by the values of the tags after `by`, and the values of the series of every group are combined at every
+// timestamp with the space aggregator: sum, avg (default), min or max.
+type MetricQuery struct {
+	SpaceAggregator SpaceAggregator
+	Metric          string
+	Tags            []*metrics.Tag
+	GroupBy         []string
+}
+
+// Series is a group of series of the result of a MetricQuery
+type Series struct {
+	Metric      string                  `json:"metric"`
+	Aggregation metrics.AggregationType `json:"aggregation"`
+	Tags        []string                `json:"tags"` // values of the group by tags, e.g. status:200
+	Points      []*Point                `json:"points"`
+}
+
+// Point is the value of a Series over the time interval [Timestamp, Timestamp+Interval)
+type Point struct {
+	Timestamp int64   `json:"timestamp"`
+	Interval  int64   `json:"interval"`
+	Value     float64 `json:"value"`
+}
+
+// ParseMetricQuery parses the given query. It returns an InvalidMetricQueryError if the query is not valid
+func ParseMetricQuery(query string) (*MetricQuery, error) {
+	p := &queryParser{query: query, runes: []rune(query)}
+	q := &MetricQuery{SpaceAggregator: AvgSpaceAggregator}
+	p.skipSpaces()
+	// the space aggregator is optional
+	if name := p.peekWord(); p.peekAt(len([]rune(name))) == ':' {
+		switch aggregator := SpaceAggregator(name); aggregator {
+		case SumSpaceAggregator, AvgSpaceAggregator, MinSpaceAggregator, MaxSpaceAggregator:
+			q.SpaceAggregator = aggregator
+			p.pos += len([]rune(name)) + 1
+		default:
+			return nil, p.errorf("unknown aggregator %q, expected sum, avg, min or max", name)
+		}
+	}
+	metric, err := p.parseMetricName()
+	if err != nil {
+		return nil, err
+	}
+	q.Metric = metric
+	p.skipSpaces()
+	if p.peekAt(0) == '{' {
+		scope, err := p.parseTagList()
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range scope {
+			if tag == "*" {
+				continue
+			}
+			name, value := tag, ""
+			if index := strings.Index(tag, ":"); index >= 0 {
+				name, value = tag[:index], tag[index+1:]
+			}
+			q.Tags = append(q.Tags, &metrics.Tag{Name: name, Value: value})
+		}
+	}
+	p.skipSpaces()
+	if p.peekWord() == "by" {
+		p.pos += 2
+		p.skipSpaces()
+		if p.peekAt(0) != '{' {
+			return nil, p.errorf("expected \"{\" after by")
+		}
+		if q.GroupBy, err = p.parseTagList(); err != nil {
+			return nil, err
+		}
+	}
+	p.skipSpaces()
+	if p.pos < len(p.runes) {
+		return nil, p.errorf("unexpected %q", p.runes[p.pos])
+	}
+	return q, nil
+}
+
+// Execute runs the query over the history of the store in the time interval [from, to). If rollup is greater than 0,
+// the points of every series are first merged into buckets of rollup seconds. Groups are sorted by their tags.
+func (q *MetricQuery) Execute(store *storage.TimeSeriesStore, from, to, rollup int64) []*Series {
+	groups := make(map[string]*seriesGroup)
+	for _, series := range store.Query(q.Metric, q.Tags, from, to) {
+		points := series.Points
+		if rollup > 0 {
+			points = storage.Rollup(series.Aggregation, points, rollup)
+		}
+		groupTags := make([]string, 0, len(q.GroupBy))
+		for _, name := range q.GroupBy {
+			value := NoTagValue
+			for _, tag := range series.Tags {
+				if tag.Name == name {
+					value = tag.Value
+					break
+				}
+			}
+			groupTags = append(groupTags, name+":"+value)
+		}
+		key := strings.Join(groupTags, ",")
+		group, ok := groups[key]
+		if !ok {
+			group = &seriesGroup{
+				series: &Series{Metric: series.Metric, Aggregation: series.Aggregation, Tags: groupTags},
+				values: make(map[int64][]float64),
+			}
+			groups[key] = group
+		}
+		for _, point := range points {
+			if _, ok := group.values[point.Start]; !ok {
+				group.intervals = append(group.intervals, [2]int64{point.Start, point.End})
+			}
+			group.values[point.Start] = append(group.values[point.Start], point.Value)
+		}
+	}
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]*Series, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, groups[key].aggregate(q.SpaceAggregator))
+	}
+	return result
+}
+
+// String returns the normalized query, e.g. `sum:"DD exercise"{section:api} by {status}`
+func (q *MetricQuery) String() string {
+	var b strings.Builder
+	b.WriteString(string(q.SpaceAggregator) + ":")
+	if isQueryWord(q.Metric) {
+		b.WriteString(q.Metric)
+	} else {
+		b.WriteString(fmt.Sprintf("%q", q.Metric))
+	}
+	tags := make([]string, 0, len(q.Tags))
+	for _, tag := range q.Tags {
+		if tag.Value == "" {
+			tags = append(tags, tag.Name)
+		} else {
+			tags = append(tags, tag.Name+":"+tag.Value)
+		}
+	}
+	if len(tags) == 0 {
+		tags = append(tags, "*")
+	}
+	b.WriteString("{" + strings.Join(tags, ",") + "}")
+	if len(q.GroupBy) > 0 {
+		b.WriteString(" by {" + strings.Join(q.GroupBy, ",") + "}")
+	}
+	return b.String()
+}
+
+// seriesGroup holds the values of the series of a group, by timestamp
+type seriesGroup struct {
+	series    *Series
+	values    map[int64][]float64
+	intervals [][2]int64 // start and end of every timestamp
+}
+
+// aggregate combines the values of every timestamp with the space aggregator, and returns the series of the group
+func (g *seriesGroup) aggregate(aggregator SpaceAggregator) *Series {
+	sort.Slice(g.intervals, func(i, j int) bool { return g.intervals[i][0] < g.intervals[j][0] })
+	g.series.Points = make([]*Point, 0, len(g.intervals))
+	for _, interval := range g.intervals {
+		values := g.values[interval[0]]
+		var value float64
+		switch aggregator {
+		case SumSpaceAggregator, AvgSpaceAggregator:
+			for _, v := range values {
+				value += v
+			}
+			if aggregator == AvgSpaceAggregator {
+				value /= float64(len(values))
+			}
+		case MinSpaceAggregator:
+			value = math.Inf(1)
+			for _, v := range values {
+				value = math.Min(value, v)
+			}
+		case MaxSpaceAggregator:
+			value = math.Inf(-1)
+			for _, v := range values {
+				value = math.Max(value, v)
+			}
+		}
+		g.series.Points = append(g.series.Points, &Point{Timestamp: interval[0], Interval: interval[1] - interval[0], Value: value})
+	}
+	return g.series
+}
+
+// queryParser is a helper to parse metric queries
+type queryParser struct {
+	query string
+	runes []rune
+	pos   int
+}
+
+// errorf returns an InvalidMetricQueryError at the current position
+func (p *queryParser) errorf(format string, args ...interface{}) error {
+	return errors.NewInvalidMetricQueryError(p.query, p.pos, fmt.Sprintf(format, args...))
+}
+
+// peekAt returns the rune at the given offset from the current position, or 0 at the end of the query
+func (p *queryParser) peekAt(offset int) rune {
+	if p.pos+offset >= len(p.runes) {
+		return 0
+	}
+	return p.runes[p.pos+offset]
+}
+
+// peekWord returns the unquoted word at the current position, without consuming it
+func (p *queryParser) peekWord() string {
+	end := p.pos
+	for end < len(p.runes) && isQueryWordRune(p.runes[end]) {
+		end++
+	}
+	return string(p.runes[p.pos:end])
+}
+
+// skipSpaces consumes the spaces at the current position
+func (p *queryParser) skipSpaces() {
+	for p.pos < len(p.runes) && unicode.IsSpace(p.runes[p.pos]) {
+		p.pos++
+	}
+}
+
+// parseMetricName parses a quoted or unquoted metric name
+func (p *queryParser) parseMetricName() (string, error) {
+	if p.peekAt(0) == '"' {
+		end := p.pos + 1
+		for end < len(p.runes) && p.runes[end] != '"' {
+			end++
+		}
+		if end == len(p.runes) {
+			return "", p.errorf("unterminated metric name")
+		}
+		name := string(p.runes[p.pos+1 : end])
+		if name == "" {
+			return "", p.errorf("empty metric name")
+		}
+		p.pos = end + 1
+		return name, nil
+	}
+	name := p.peekWord()
+	if name == "" {
+		return "", p.errorf("expected a metric name")
+	}
+	p.pos += len([]rune(name))
+	return name, nil
+}
+
+// parseTagList parses a comma separated list of tags between braces
+func (p *queryParser) parseTagList() ([]string, error) {
+	end := p.pos + 1 // after {
+	for end < len(p.runes) && p.runes[end] != '}' {
+		end++
+	}
+	if end == len(p.runes) {
+		return nil, p.errorf("expected \"}\"")
+	}
+	var tags []string
+	for _, tag := range strings.Split(string(p.runes[p.pos+1:end]), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || strings.HasPrefix(tag, ":") {
+			return nil, p.errorf("empty tag name")
+		}
+		tags = append(tags, tag)
+	}
+	p.pos = end + 1
+	return tags, nil
+}
+
+// isQueryWord returns true if the metric name can be written without quotes in a query
+func isQueryWord(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !isQueryWordRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// isQueryWordRune returns true if the rune can be part of an unquoted metric name
+func isQueryWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.'
+}
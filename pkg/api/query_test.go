@@ -0,0 +1,177 @@
+package api
+
+import (
+	"github.com/ebarti/dd-assignment/pkg/errors"
+	"github.com/ebarti/dd-assignment/pkg/metrics"
+	"github.com/ebarti/dd-assignment/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// newTestStore is a helper function that returns a store with hits per section and status every 10 seconds of [100, 130)
+func newTestStore(t *testing.T) *storage.TimeSeriesStore {
+	store := storage.NewTimeSeriesStore(storage.DefaultRawRetention)
+	for start := int64(100); start < 130; start += 10 {
+		m := metrics.NewMetric(metrics.CountAggregation, 10)
+		for _, sample := range []struct {
+			section, status string
+			hits            float64
+		}{
+			{section: "api", status: "200", hits: 3},
+			{section: "api", status: "500", hits: 1},
+			{section: "report", status: "200", hits: 2},
+		} {
+			assert.NoError(t, m.AddSample(&metrics.MetricSample{
+				Name:  "DD exercise",
+				Value: sample.hits,
+				Tags:  []*metrics.Tag{{Name: "section", Value: sample.section}, {Name: "status", Value: sample.status}},
+			}))
+		}
+		computed, err := m.Flush(start)
+		assert.NoError(t, err)
+		computed.Name = "DD exercise"
+		store.Store(start, start+10, []*metrics.ComputedMetric{computed})
+	}
+	return store
+}
+
+func TestParseMetricQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  *MetricQuery
+	}{
+		{
+			query: `sum:"DD exercise"{section:api} by {status}`,
+			want: &MetricQuery{
+				SpaceAggregator: SumSpaceAggregator,
+				Metric:          "DD exercise",
+				Tags:            []*metrics.Tag{{Name: "section", Value: "api"}},
+				GroupBy:         []string{"status"},
+			},
+		},
+		{
+			query: `http.hits`,
+			want:  &MetricQuery{SpaceAggregator: AvgSpaceAggregator, Metric: "http.hits"},
+		},
+		{
+			query: ` max:hits{*} by { section , status }`,
+			want:  &MetricQuery{SpaceAggregator: MaxSpaceAggregator, Metric: "hits", GroupBy: []string{"section", "status"}},
+		},
+		{
+			query: `min:hits{section,status:200}`,
+			want: &MetricQuery{
+				SpaceAggregator: MinSpaceAggregator,
+				Metric:          "hits",
+				Tags:            []*metrics.Tag{{Name: "section"}, {Name: "status", Value: "200"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run("test parse metric query "+tt.query, func(t *testing.T) {
+			got, err := ParseMetricQuery(tt.query)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseMetricQuery_Invalid(t *testing.T) {
+	tests := []struct {
+		query    string
+		position int
+		reason   string
+	}{
+		{query: ``, position: 0, reason: "expected a metric name"},
+		{query: `median:hits`, position: 0, reason: `unknown aggregator "median", expected sum, avg, min or max`},
+		{query: `sum:"hits`, position: 4, reason: "unterminated metric name"},
+		{query: `hits{section:api`, position: 4, reason: `expected "}"`},
+		{query: `hits{}`, position: 4, reason: "empty tag name"},
+		{query: `hits by status`, position: 8, reason: `expected "{" after by`},
+		{query: `hits{*} status`, position: 8, reason: `unexpected 's'`},
+	}
+	for _, tt := range tests {
+		t.Run("test parse invalid metric query "+tt.query, func(t *testing.T) {
+			_, err := ParseMetricQuery(tt.query)
+			assert.Equal(t, errors.NewInvalidMetricQueryError(tt.query, tt.position, tt.reason), err)
+		})
+	}
+}
+
+func TestMetricQuery_String(t *testing.T) {
+	for query, want := range map[string]string{
+		`sum:"DD exercise"{section:api} by {status}`: `sum:"DD exercise"{section:api} by {status}`,
+		`hits`:                                   `avg:hits{*}`,
+		`max:hits{section} by {status, section}`: `max:hits{section} by {status,section}`,
+	} {
+		q, err := ParseMetricQuery(query)
+		assert.NoError(t, err)
+		assert.Equal(t, want, q.String())
+	}
+}
+
+func TestMetricQuery_Execute(t *testing.T) {
+	store := newTestStore(t)
+	tests := []struct {
+		query  string
+		rollup int64
+		want   []*Series
+	}{
+		{
+			query: `sum:"DD exercise"{section:api} by {status}`,
+			want: []*Series{
+				{
+					Metric:      "DD exercise",
+					Aggregation: metrics.CountAggregation,
+					Tags:        []string{"status:200"},
+					Points:      []*Point{{100, 10, 3}, {110, 10, 3}, {120, 10, 3}},
+				},
+				{
+					Metric:      "DD exercise",
+					Aggregation: metrics.CountAggregation,
+					Tags:        []string{"status:500"},
+					Points:      []*Point{{100, 10, 1}, {110, 10, 1}, {120, 10, 1}},
+				},
+			},
+		},
+		{
+			query: `"DD exercise"{status:200}`,
+			want: []*Series{
+				{
+					Metric:      "DD exercise",
+					Aggregation: metrics.CountAggregation,
+					Tags:        []string{},
+					Points:      []*Point{{100, 10, 2.5}, {110, 10, 2.5}, {120, 10, 2.5}},
+				},
+			},
+		},
+		{
+			query:  `max:"DD exercise" by {section,subsection}`,
+			rollup: 60,
+			want: []*Series{
+				{
+					Metric:      "DD exercise",
+					Aggregation: metrics.CountAggregation,
+					Tags:        []string{"section:api", "subsection:N/A"},
+					Points:      []*Point{{60, 60, 6}, {120, 60, 3}},
+				},
+				{
+					Metric:      "DD exercise",
+					Aggregation: metrics.CountAggregation,
+					Tags:        []string{"section:report", "subsection:N/A"},
+					Points:      []*Point{{60, 60, 4}, {120, 60, 2}},
+				},
+			},
+		},
+		{
+			query: `"DD exercise"{section:users}`,
+			want:  []*Series{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run("test execute metric query "+tt.query, func(t *testing.T) {
+			q, err := ParseMetricQuery(tt.query)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, q.Execute(store, 0, 200, tt.rollup))
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ebarti/dd-assignment/pkg/storage"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// QueryPath is the path of the metric query endpoint
+	QueryPath = "/api/v1/query"
+	// MetricsListPath is the path of the endpoint listing the metrics with history
+	MetricsListPath = "/api/v1/metrics"
+	// DefaultQueryRange is the number of seconds queried when the query has no from parameter
+	DefaultQueryRange = 60 * 60
+	shutdownTimeout   = 5 * time.Second
+)
+
+// QueryResponse is the JSON response of the metric query endpoint
+type QueryResponse struct {
+	Query  string    `json:"query"`
+	From   int64     `json:"from"`
+	To     int64     `json:"to"`
+	Rollup int64     `json:"rollup,omitempty"`
+	Series []*Series `json:"series"`
+}
+
+// MetricsListResponse is the JSON response of the endpoint listing the metrics with history
+type MetricsListResponse struct {
+	Metrics []string `json:"metrics"`
+}
+
+// ErrorResponse is the JSON response of the endpoints when the request is not valid
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// QueryServer serves the history of the metrics kept by a storage.TimeSeriesStore over HTTP:
+//   - GET /api/v1/query?q=<query>&from=<timestamp>&to=<timestamp>&rollup=<seconds> runs a MetricQuery over [from, to).
+//     to defaults to the end of the latest stored interval and from to an hour before to.
+//   - GET /api/v1/metrics lists the metrics with history.
+type QueryServer struct {
+	address  string
+	store    *storage.TimeSeriesStore
+	mux      *http.ServeMux
+	server   *http.Server
+	listener net.Listener
+	done     chan struct{}
+	isDone   uint32
+	logger   *log.Logger
+}
+
+// NewQueryServer creates a new QueryServer listening on the given address, e.g. localhost:8080
+func NewQueryServer(address string, store *storage.TimeSeriesStore, logger *log.Logger) *QueryServer {
+	s := &QueryServer{
+		address: address,
+		store:   store,
+		done:    make(chan struct{}),
+		logger:  logger,
+	}
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc(QueryPath, s.handleQuery)
+	s.mux.HandleFunc(MetricsListPath, s.handleMetricsList)
+	s.server = &http.Server{Handler: s.mux, ReadHeaderTimeout: 10 * time.Second}
+	return s
+}
+
+// Handle serves the given path with the handler, e.g. a PrometheusExporter. Call it before starting the QueryServer
+func (s *QueryServer) Handle(path string, handler http.Handler) *QueryServer {
+	s.mux.Handle(path, handler)
+	return s
+}
+
+// Start starts listening on the address of the QueryServer, and serves requests in the background
+func (s *QueryServer) Start() error {
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	go s.serve()
+	return nil
+}
+
+// Stop stops the QueryServer, waiting for the requests in progress
+func (s *QueryServer) Stop() {
+	if atomic.CompareAndSwapUint32(&s.isDone, 0, 1) && s.listener != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := s.server.Shutdown(ctx); err != nil {
+			s.logger.Printf("Error while stopping the query server: %s", err)
+		}
+		<-s.done
+	}
+}
+
+// IsStopped returns true if the QueryServer is stopped
+func (s *QueryServer) IsStopped() bool {
+	return atomic.LoadUint32(&s.isDone) == 1
+}
+
+// Addr returns the address the QueryServer listens on, which holds the chosen port if the address had port 0
+func (s *QueryServer) Addr() string {
+	if s.listener == nil {
+		return s.address
+	}
+	return s.listener.Addr().String()
+}
+
+// serve serves requests until the QueryServer is stopped
+func (s *QueryServer) serve() {
+	defer close(s.done)
+	if err := s.server.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+		s.logger.Printf("Error while serving queries on %s: %s", s.Addr(), err)
+		atomic.StoreUint32(&s.isDone, 1)
+	}
+}
+
+// handleQuery runs the metric query of the request
+func (s *QueryServer) handleQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, &ErrorResponse{Error: "only GET is allowed"})
+		return
+	}
+	params := r.URL.Query()
+	query, err := ParseMetricQuery(params.Get("q"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	to, err := int64Param(params.Get("to"), s.store.Latest())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	from, err := int64Param(params.Get("from"), to-DefaultQueryRange)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	rollup, err := int64Param(params.Get("rollup"), 0)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	if from >= to || rollup < 0 {
+		writeJSON(w, http.StatusBadRequest, &ErrorResponse{Error: fmt.Sprintf("invalid time range [%d, %d) or rollup %d", from, to, rollup)})
+		return
+	}
+	writeJSON(w, http.StatusOK, &QueryResponse{
+		Query:  query.String(),
+		From:   from,
+		To:     to,
+		Rollup: rollup,
+		Series: query.Execute(s.store, from, to, rollup),
+	})
+}
+
+// handleMetricsList lists the metrics with history
+func (s *QueryServer) handleMetricsList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, &ErrorResponse{Error: "only GET is allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, &MetricsListResponse{Metrics: s.store.MetricNames()})
+}
+
+// int64Param is a helper function that parses an integer parameter, or returns the default value if it is empty
+func int64Param(value string, defaultValue int64) (int64, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer %q", value)
+	}
+	return parsed, nil
+}
+
+// writeJSON is a helper function that writes the response as JSON with the given status code
+func writeJSON(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// get is a helper function that sends a GET request to the server and decodes its JSON response
+func get(t *testing.T, server *QueryServer, path string, params url.Values, response interface{}) int {
+	resp, err := http.Get("http://" + server.Addr() + path + "?" + params.Encode())
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(response))
+	return resp.StatusCode
+}
+
+func TestQueryServer(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	server := NewQueryServer("localhost:0", newTestStore(t), log.New(ioutil.Discard, "", 0))
+	assert.NoError(t, server.Start())
+	defer http.DefaultClient.CloseIdleConnections()
+
+	var query QueryResponse
+	status := get(t, server, QueryPath, url.Values{
+		"q":      {`sum:"DD exercise"{section:api} by {status}`},
+		"from":   {"110"},
+		"to":     {"130"},
+		"rollup": {"20"},
+	}, &query)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `sum:"DD exercise"{section:api} by {status}`, query.Query)
+	assert.Equal(t, int64(20), query.Rollup)
+	assert.Equal(t, 2, len(query.Series))
+	assert.Equal(t, []string{"status:200"}, query.Series[0].Tags)
+	assert.Equal(t, []*Point{{100, 20, 3}, {120, 20, 3}}, query.Series[0].Points)
+
+	// the time range defaults to the hour before the latest stored interval
+	query = QueryResponse{}
+	status = get(t, server, QueryPath, url.Values{"q": {`sum:"DD exercise"`}}, &query)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, int64(130-DefaultQueryRange), query.From)
+	assert.Equal(t, int64(130), query.To)
+	assert.Equal(t, []*Point{{100, 10, 6}, {110, 10, 6}, {120, 10, 6}}, query.Series[0].Points)
+
+	var list MetricsListResponse
+	assert.Equal(t, http.StatusOK, get(t, server, MetricsListPath, nil, &list))
+	assert.Equal(t, []string{"DD exercise"}, list.Metrics)
+
+	for _, params := range []url.Values{
+		{"q": {`sum:"DD exercise`}},
+		{"q": {`hits`}, "from": {"yesterday"}},
+		{"q": {`hits`}, "from": {"130"}, "to": {"100"}},
+		{"q": {`hits`}, "rollup": {"-1"}},
+	} {
+		var errorResponse ErrorResponse
+		assert.Equal(t, http.StatusBadRequest, get(t, server, QueryPath, params, &errorResponse))
+		assert.NotEmpty(t, errorResponse.Error)
+	}
+
+	server.Stop()
+	assert.True(t, server.IsStopped())
+}
@@ -0,0 +1,8 @@
+package common
+
+const (
+	// DefaultBatchSize is the default maximum number of log lines read, and then processed, together
+	DefaultBatchSize = 256
+	// DefaultBufferSize is the default number of batches the channel between two components can hold
+	DefaultBufferSize = 16
+)
@@ -1,13 +1,16 @@
 package common
 
+import "time"
+
 // Message represents a log line sent to the backend, with its metadata
 // See note.md for more information
 type Message struct {
 	Content            []byte
 	Origin             string
-	IngestionTimestamp int64
+	IngestionTimestamp int64     // in seconds since the epoch
+	IngestionTime      time.Time // precise time the line was read at, used to measure the latency of the pipeline
 }
 
-func NewMessage(content []byte, origin string, ingestionTimestamp int64) *Message {
-	return &Message{Content: content, Origin: origin, IngestionTimestamp: ingestionTimestamp}
+func NewMessage(content []byte, origin string, ingestionTime time.Time) *Message {
+	return &Message{Content: content, Origin: origin, IngestionTimestamp: ingestionTime.Unix(), IngestionTime: ingestionTime}
 }
@@ -0,0 +1,23 @@
+package common
+
+import "strings"
+
+// SanitizeName lower cases the name and replaces every run of characters other than letters, digits and the allowed ones
+// with a single underscore, dropping the leading and trailing runs, e.g. "DD exercise" becomes dd_exercise.
+// Callers add the rules of their own format on top, such as how a valid name must start.
+func SanitizeName(name string, allowed string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || strings.ContainsRune(allowed, r) {
+			if underscore && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			underscore = false
+			b.WriteRune(r)
+			continue
+		}
+		underscore = true
+	}
+	return b.String()
+}
@@ -0,0 +1,38 @@
+package common
+
+import "time"
+
+// Names of the internal metrics of the service
+const (
+	LinesReadMetric         = "pipeline.lines_read"                // lines read by the FileReader
+	BytesReadMetric         = "pipeline.bytes_read"                // bytes of the lines read by the FileReader
+	ParseErrorsMetric       = "pipeline.parse_errors"              // lines the LogPipeline could not process, by error type
+	LogsProcessedMetric     = "pipeline.logs_processed"            // logs processed by the LogPipeline
+	IngestionLatencyMetric  = "pipeline.ingestion_latency_ms"      // time from the ingestion of the oldest line of a batch to its processing
+	DroppedLogsMetric       = "pipeline.dropped_logs"              // logs dropped by the queue of a consumer of the LogPipeline, by consumer
+	SamplesMetric           = "pipeline.samples"                   // metric samples computed by the MetricsPipeline
+	LateSamplesMetric       = "pipeline.late_samples"              // samples dropped by the MetricAggregator as too late
+	FlushDurationMetric     = "pipeline.flush_duration_ms"         // time the MetricAggregator takes to flush an interval
+	OpenIntervalsMetric     = "pipeline.open_intervals"            // intervals of the MetricAggregator that were not flushed yet
+	MonitorLogsMetric       = "pipeline.monitor_logs"              // logs evaluated by a LogMonitor, by monitor
+	MonitorDurationMetric   = "pipeline.monitor_batch_duration_ms" // time a LogMonitor takes to evaluate a batch of logs, by monitor
+	MonitorTransitionMetric = "pipeline.monitor_transitions"       // alert and recovery transitions of a LogMonitor, by monitor and state
+	QueueDepthMetric        = "pipeline.queue_depth"               // batches waiting in the channel of a consumer, by consumer
+	GoroutinesMetric        = "pipeline.goroutines"                // number of goroutines of the service
+)
+
+// Telemetry records the internal metrics of the components of the service, e.g. a *metrics.Telemetry.
+// Tags are given as name and value pairs, e.g. "consumer", "aggregator"
+type Telemetry interface {
+	// Count adds the value to the counter with the given name and tags
+	Count(name string, value float64, tags ...string)
+	// Observe adds the value to the histogram with the given name and tags
+	Observe(name string, value float64, tags ...string)
+	// Gauge registers a gauge with the given name and tags, whose value is sampled when the metrics are flushed
+	Gauge(name string, value func() float64, tags ...string)
+}
+
+// Milliseconds returns the duration in milliseconds, the unit of the durations of the internal metrics
+func Milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -27,6 +27,41 @@ func (e CouldNotComputeMetricForTagError) Error() string {
 	return fmt.Sprintf("could not find metric value for tag: %s with value: %s", e.tagName, e.tagValue)
 }
 
+type UnknownMetricValueError struct {
+	metricName string
+	valueName  string
+}
+
+func NewUnknownMetricValueError(metricName string, valueName string) UnknownMetricValueError {
+	return UnknownMetricValueError{metricName: metricName, valueName: valueName}
+}
+func (e UnknownMetricValueError) Error() string {
+	return fmt.Sprintf("metric %s has no value named %s", e.metricName, e.valueName)
+}
+
+type UnmergeableMetricError struct {
+	metricName string
+}
+
+func NewUnmergeableMetricError(metricName string) UnmergeableMetricError {
+	return UnmergeableMetricError{metricName: metricName}
+}
+func (e UnmergeableMetricError) Error() string {
+	return fmt.Sprintf("metric %s cannot be merged", e.metricName)
+}
+
+type NoMatchingSeriesError struct {
+	metricName string
+	tags       string
+}
+
+func NewNoMatchingSeriesError(metricName string, tags string) NoMatchingSeriesError {
+	return NoMatchingSeriesError{metricName: metricName, tags: tags}
+}
+func (e NoMatchingSeriesError) Error() string {
+	return fmt.Sprintf("metric %s has no series with tags: %s", e.metricName, e.tags)
+}
+
 type UnsampledMetricError struct{}
 
 func NewUnsampledMetricError() UnsampledMetricError {
@@ -81,3 +116,84 @@ func NewInvalidRequestFormatError(request string) InvalidRequestFormatError {
 func (e InvalidRequestFormatError) Error() string {
 	return fmt.Sprintf("invalid request format: %s", e.request)
 }
+
+type InvalidFormulaError struct {
+	formula  string
+	position int
+	reason   string
+}
+
+func NewInvalidFormulaError(formula string, position int, reason string) InvalidFormulaError {
+	return InvalidFormulaError{formula: formula, position: position, reason: reason}
+}
+func (e InvalidFormulaError) Error() string {
+	return fmt.Sprintf("invalid formula %q at position %d: %s", e.formula, e.position, e.reason)
+}
+
+type DivisionByZeroError struct {
+	formula string
+}
+
+func NewDivisionByZeroError(formula string) DivisionByZeroError {
+	return DivisionByZeroError{formula: formula}
+}
+func (e DivisionByZeroError) Error() string {
+	return fmt.Sprintf("division by zero while evaluating %s", e.formula)
+}
+
+type InvalidResolutionError struct {
+	resolution string
+}
+
+func NewInvalidResolutionError(resolution string) InvalidResolutionError {
+	return InvalidResolutionError{resolution: resolution}
+}
+func (e InvalidResolutionError) Error() string {
+	return fmt.Sprintf("invalid resolution %q, expected interval:retention in seconds", e.resolution)
+}
+
+type InvalidMetricQueryError struct {
+	query    string
+	position int
+	reason   string
+}
+
+func NewInvalidMetricQueryError(query string, position int, reason string) InvalidMetricQueryError {
+	return InvalidMetricQueryError{query: query, position: position, reason: reason}
+}
+func (e InvalidMetricQueryError) Error() string {
+	return fmt.Sprintf("invalid metric query %q at position %d: %s", e.query, e.position, e.reason)
+}
+
+type InvalidOutputFormatError struct {
+	format string
+}
+
+func NewInvalidOutputFormatError(format string) InvalidOutputFormatError {
+	return InvalidOutputFormatError{format: format}
+}
+func (e InvalidOutputFormatError) Error() string {
+	return fmt.Sprintf("invalid output format %q, expected text, json or csv", e.format)
+}
+
+type ReaderStoppedError struct {
+	origin string
+}
+
+func NewReaderStoppedError(origin string) ReaderStoppedError {
+	return ReaderStoppedError{origin: origin}
+}
+func (e ReaderStoppedError) Error() string {
+	return fmt.Sprintf("reader of %s stopped", e.origin)
+}
+
+type InvalidQueuePolicyError struct {
+	policy string
+}
+
+func NewInvalidQueuePolicyError(policy string) InvalidQueuePolicyError {
+	return InvalidQueuePolicyError{policy: policy}
+}
+func (e InvalidQueuePolicyError) Error() string {
+	return fmt.Sprintf("invalid queue policy %q, expected block, drop-oldest, drop-newest or spill", e.policy)
+}
@@ -0,0 +1,170 @@
+package forwarder
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ebarti/dd-assignment/pkg/common"
+	"github.com/ebarti/dd-assignment/pkg/metrics"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultUDPPacketSize is the default maximum size of a UDP datagram, which fits in the usual MTU of 1500 bytes
+	DefaultUDPPacketSize = 1432
+	// DefaultUnixPacketSize is the default maximum size of a Unix socket datagram
+	DefaultUnixPacketSize = 8192
+)
+
+// DogStatsDForwarder forwards the metrics flushed by the MetricAggregator to a DogStatsD server, over UDP or a Unix
+// datagram socket, and implements the metrics.MetricStore interface. Every series of a metric is sent with its tags:
+//   - counts and sums are sent as counts, with the value of the interval
+//   - distributions are sent as distributions, with the representative value of every bucket of their sketch, sampled
+//     at a rate of 1/count so that the server counts every value of the bucket
+//   - every other aggregation is sent as a gauge
+//
+// Names are sanitized, e.g. "DD exercise" is sent as dd_exercise, and datagrams are batched up to the packet size.
+// DogStatsDForwarder is thread-safe.
+type DogStatsDForwarder struct {
+	conn       net.Conn
+	packetSize int
+	namespace  string
+	mu         sync.Mutex
+}
+
+// NewDogStatsDForwarder creates a new DogStatsDForwarder sending datagrams to the given address: udp://host:port,
+// unix:///path/to/socket, or host:port for UDP
+func NewDogStatsDForwarder(address string) (*DogStatsDForwarder, error) {
+	network, addr, packetSize := "udp", address, DefaultUDPPacketSize
+	switch {
+	case strings.HasPrefix(address, "udp://"):
+		addr = strings.TrimPrefix(address, "udp://")
+	case strings.HasPrefix(address, "unix://"):
+		network, addr, packetSize = "unixgram", strings.TrimPrefix(address, "unix://"), DefaultUnixPacketSize
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &DogStatsDForwarder{conn: conn, packetSize: packetSize}, nil
+}
+
+// WithNamespace prepends the namespace to the name of every metric, e.g. "logs." sends "DD exercise" as logs.dd_exercise
+func (f *DogStatsDForwarder) WithNamespace(namespace string) *DogStatsDForwarder {
+	f.namespace = namespace
+	return f
+}
+
+// WithPacketSize sets the maximum size of a datagram. Metrics longer than it are sent in their own datagram
+func (f *DogStatsDForwarder) WithPacketSize(size int) *DogStatsDForwarder {
+	f.packetSize = size
+	return f
+}
+
+// Store sends the metrics computed for the time interval [start, end)
+func (f *DogStatsDForwarder) Store(start, end int64, computedMetrics []*metrics.ComputedMetric) {
+	var lines []string
+	for _, computedMetric := range computedMetrics {
+		lines = append(lines, f.format(computedMetric)...)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.send(lines); err != nil {
+		log.Printf("Error while forwarding the metrics of [%d, %d) to DogStatsD: %s", start, end, err)
+	}
+}
+
+// Close closes the connection to the DogStatsD server
+func (f *DogStatsDForwarder) Close() error {
+	return f.conn.Close()
+}
+
+// format is a helper function that returns the DogStatsD lines of every series of the metric
+func (f *DogStatsDForwarder) format(computedMetric *metrics.ComputedMetric) []string {
+	name := SanitizeName(f.namespace + computedMetric.Name)
+	var lines []string
+	for _, series := range computedMetric.Series {
+		tags := formatTags(series.Tags)
+		switch computedMetric.GetAggregation() {
+		case metrics.CountAggregation, metrics.SumAggregation:
+			lines = appendLine(lines, name, series.Value, "c", "", tags)
+		case metrics.DistributionAggregation:
+			if series.Sketch == nil {
+				continue
+			}
+			series.Sketch.ForEach(func(value float64, count uint64) {
+				rate := ""
+				if count > 1 {
+					rate = "|@" + strconv.FormatFloat(1/float64(count), 'g', -1, 64)
+				}
+				lines = appendLine(lines, name, value, "d", rate, tags)
+			})
+		default:
+			lines = appendLine(lines, name, series.Value, "g", "", tags)
+		}
+	}
+	return lines
+}
+
+// send is a helper function that sends the lines, batched into datagrams of at most the packet size
+func (f *DogStatsDForwarder) send(lines []string) error {
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > f.packetSize {
+			if _, err := f.conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		if _, err := f.conn.Write(packet.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendLine is a helper function that appends a line such as `name:value|type|@rate|#tags`, unless the value is not finite
+func appendLine(lines []string, name string, value float64, metricType string, rate string, tags string) []string {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return lines
+	}
+	return append(lines, fmt.Sprintf("%s:%s|%s%s%s", name, strconv.FormatFloat(value, 'f', -1, 64), metricType, rate, tags))
+}
+
+// formatTags is a helper function that formats the tags as `|#name:value,name:value`, or an empty string without tags
+func formatTags(tags []*metrics.Tag) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	formatted := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		formatted = append(formatted, sanitizeTag(tag.Name)+":"+sanitizeTag(tag.Value))
+	}
+	return "|#" + strings.Join(formatted, ",")
+}
+
+// SanitizeName returns a valid DogStatsD metric name: lower case letters, digits, periods and single underscores,
+// starting with a letter, e.g. "DD exercise" becomes dd_exercise.
+// Unlike Prometheus names, periods separate the namespaces of the name, and names must start with a letter.
+func SanitizeName(name string) string {
+	sanitized := common.SanitizeName(name, ".")
+	if sanitized == "" || sanitized[0] < 'a' || sanitized[0] > 'z' {
+		sanitized = "metric_" + sanitized
+	}
+	return sanitized
+}
+
+// sanitizeTag is a helper function that replaces the characters of the DogStatsD syntax, and line feeds, in a tag
+func sanitizeTag(tag string) string {
+	return strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_").Replace(tag)
+}
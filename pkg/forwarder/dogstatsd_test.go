@@ -0,0 +1,118 @@
+package forwarder
+
+import (
+	"github.com/ebarti/dd-assignment/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flushMetric is a helper function that flushes a metric with the given values, as values per section
+func flushMetric(t *testing.T, name string, aggregation metrics.AggregationType, samples map[string][]float64) *metrics.ComputedMetric {
+	m := metrics.NewMetric(aggregation, 10)
+	for section, values := range samples {
+		for _, value := range values {
+			assert.NoError(t, m.AddSample(&metrics.MetricSample{
+				Name:  name,
+				Value: value,
+				Tags:  []*metrics.Tag{{Name: "section", Value: section}, {Name: "status", Value: "200"}},
+			}))
+		}
+	}
+	computed, err := m.Flush(0)
+	assert.NoError(t, err)
+	computed.Name = name
+	return computed
+}
+
+// receive is a helper function that reads the datagrams received by the listener until none arrives for a while
+func receive(t *testing.T, listener net.PacketConn) []string {
+	var packets []string
+	buf := make([]byte, 65536)
+	for {
+		assert.NoError(t, listener.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+		n, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			return packets
+		}
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	for name, want := range map[string]string{
+		"DD exercise":      "dd_exercise",
+		"logs.http.errors": "logs.http.errors",
+		"hits / second":    "hits_second",
+		"5xx":              "metric_5xx",
+	} {
+		assert.Equal(t, want, SanitizeName(name))
+	}
+}
+
+func TestDogStatsDForwarder_UDP(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	f, err := NewDogStatsDForwarder("udp://" + listener.LocalAddr().String())
+	assert.NoError(t, err)
+	defer f.Close()
+
+	f.WithNamespace("logs.").Store(0, 10, []*metrics.ComputedMetric{
+		flushMetric(t, "DD exercise", metrics.CountAggregation, map[string][]float64{"api": {1, 1}, "report,users": {1}}),
+		flushMetric(t, "max bytes", metrics.MaxAggregation, map[string][]float64{"api": {10, 30}}),
+		flushMetric(t, "bytes", metrics.DistributionAggregation, map[string][]float64{"api": {100, 100, 2000}}),
+	})
+	packets := receive(t, listener)
+	assert.Equal(t, 1, len(packets))
+	lines := strings.Split(packets[0], "\n")
+	assert.Equal(t, []string{
+		"logs.dd_exercise:2|c|#section:api,status:200",
+		"logs.dd_exercise:1|c|#section:report_users,status:200",
+		"logs.max_bytes:30|g|#section:api,status:200",
+	}, lines[:3])
+	assert.Equal(t, 2, len(lines[3:]))
+	assert.Regexp(t, `^logs\.bytes:\d+(\.\d+)?\|d\|@0\.5\|#section:api,status:200$`, lines[3])
+	assert.Regexp(t, `^logs\.bytes:2000\|d\|#section:api,status:200$`, lines[4])
+}
+
+func TestDogStatsDForwarder_Batching(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	f, err := NewDogStatsDForwarder(listener.LocalAddr().String())
+	assert.NoError(t, err)
+	defer f.Close()
+
+	samples := make(map[string][]float64)
+	for _, section := range []string{"a", "b", "c", "d", "e"} {
+		samples[section] = []float64{1}
+	}
+	// every line is 30 bytes long, so that 2 of them fit in a datagram of 64 bytes
+	f.WithPacketSize(64).Store(0, 10, []*metrics.ComputedMetric{flushMetric(t, "hits", metrics.CountAggregation, samples)})
+	packets := receive(t, listener)
+	assert.Equal(t, []string{
+		"hits:1|c|#section:a,status:200\nhits:1|c|#section:b,status:200",
+		"hits:1|c|#section:c,status:200\nhits:1|c|#section:d,status:200",
+		"hits:1|c|#section:e,status:200",
+	}, packets)
+	for _, packet := range packets {
+		assert.LessOrEqual(t, len(packet), 64)
+	}
+}
+
+func TestDogStatsDForwarder_Unix(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "dsd.socket")
+	listener, err := net.ListenPacket("unixgram", socket)
+	assert.NoError(t, err)
+	defer listener.Close()
+	f, err := NewDogStatsDForwarder("unix://" + socket)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	f.Store(0, 10, []*metrics.ComputedMetric{flushMetric(t, "hits", metrics.GaugeAggregation, map[string][]float64{"api": {3}})})
+	assert.Equal(t, []string{"hits:3|g|#section:api,status:200"}, receive(t, listener))
+}
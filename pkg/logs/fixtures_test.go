@@ -8,6 +8,8 @@ var aProcessedLog = &ProcessedLog{
 	Message:   "aMessage",
 	Attributes: map[string]interface{}{
 		"aMeasurableAttribute": "1",
+		"aFloatAttribute":      "0.123",
+		"aNaNAttribute":        "NaN",
 		"nested": map[string]interface{}{
 			"aMeasurableAttribute": "2",
 			"nested": map[string]interface{}{
@@ -1,8 +1,11 @@
 package logs
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/ebarti/dd-assignment/pkg/errors"
 	"log"
+	"sort"
 	"strings"
 )
 
@@ -14,6 +17,46 @@ type LogFilter struct {
 	attributes map[string]string
 }
 
+// FilterClause is a single "key:value" term of a LogFilter query. All the clauses of a query are ANDed together.
+type FilterClause struct {
+	Key         string // status, host, service or the attribute path when IsAttribute is set
+	Value       string
+	IsAttribute bool
+}
+
+// String returns the query representation of the clause, e.g. "status:200" or "@http.path.section:api"
+func (c *FilterClause) String() string {
+	if c.IsAttribute {
+		return fmt.Sprintf("@%s:%s", c.Key, c.Value)
+	}
+	return fmt.Sprintf("%s:%s", c.Key, c.Value)
+}
+
+// Matches returns true if the given log satisfies the clause
+func (c *FilterClause) Matches(log *ProcessedLog) bool {
+	return log.HasAttributeWithValue(c.Key, c.Value)
+}
+
+// ClauseResult is the outcome of evaluating a single FilterClause against a log
+type ClauseResult struct {
+	Clause  *FilterClause
+	Matched bool
+	Got     *string // the value found in the log, nil if the log does not have the attribute
+}
+
+// String returns a human-readable explanation of the result, e.g. `FAIL status:200 (got "404")`
+func (r *ClauseResult) String() string {
+	outcome := "PASS"
+	if !r.Matched {
+		outcome = "FAIL"
+	}
+	got := "<missing>"
+	if r.Got != nil {
+		got = fmt.Sprintf("%q", *r.Got)
+	}
+	return fmt.Sprintf("%s %s (got %s)", outcome, r.Clause, got)
+}
+
 // NewLogFilter parses the query string and returns an LogFilter
 // filter is of the format "service:MyService status:200 @http.path.section:mysection"
 // NOTE:
@@ -21,13 +64,23 @@ type LogFilter struct {
 // 	 Filtering for message content is NOT supported - e.g. querying datadog logs with "myQuery"
 //   Wildcard filtering is NOT supported
 func NewLogFilter(query string) *LogFilter {
-	a := &LogFilter{}
-	if err := a.build(query); err != nil {
+	a, err := ParseLogFilter(query)
+	if err != nil {
 		log.Fatalf("could not build aggregation filter query: %v", err)
 	}
 	return a
 }
 
+// ParseLogFilter parses the query string and returns an LogFilter, or an error if the query is invalid.
+// Use it instead of NewLogFilter when the query comes from user input.
+func ParseLogFilter(query string) (*LogFilter, error) {
+	a := &LogFilter{}
+	if err := a.build(query); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
 func (a *LogFilter) build(query string) error {
 	if query == "*" {
 		a.matchAll = true
@@ -39,13 +92,13 @@ func (a *LogFilter) build(query string) error {
 	}
 	for _, q := range querySplit {
 		if strings.HasPrefix(q, "status:") {
-			trimmedQuery := strings.TrimSuffix(q, "status:")
+			trimmedQuery := strings.TrimPrefix(q, "status:")
 			a.status = &trimmedQuery
 		} else if strings.HasPrefix(q, "host:") {
-			trimmedQuery := strings.TrimSuffix(q, "host:")
+			trimmedQuery := strings.TrimPrefix(q, "host:")
 			a.host = &trimmedQuery
 		} else if strings.HasPrefix(q, "service:") {
-			trimmedQuery := strings.TrimSuffix(q, "service:")
+			trimmedQuery := strings.TrimPrefix(q, "service:")
 			a.service = &trimmedQuery
 		} else if strings.HasPrefix(q, "@") {
 			if !strings.Contains(q, ":") {
@@ -96,3 +149,82 @@ func (a *LogFilter) matchAttributes(log *ProcessedLog) bool {
 	}
 	return true
 }
+
+// MatchesAll returns true if the filter is the "*" query
+func (a *LogFilter) MatchesAll() bool {
+	return a.matchAll
+}
+
+// Clauses returns the clauses of the filter in a deterministic order: top level attributes first,
+// then log attributes sorted by path. A "*" filter has no clauses.
+func (a *LogFilter) Clauses() []*FilterClause {
+	var clauses []*FilterClause
+	if a.matchAll {
+		return clauses
+	}
+	if a.status != nil {
+		clauses = append(clauses, &FilterClause{Key: "status", Value: *a.status})
+	}
+	if a.host != nil {
+		clauses = append(clauses, &FilterClause{Key: "host", Value: *a.host})
+	}
+	if a.service != nil {
+		clauses = append(clauses, &FilterClause{Key: "service", Value: *a.service})
+	}
+	paths := make([]string, 0, len(a.attributes))
+	for path := range a.attributes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		clauses = append(clauses, &FilterClause{Key: path, Value: a.attributes[path], IsAttribute: true})
+	}
+	return clauses
+}
+
+// Explain evaluates every clause of the filter against the given log, so callers can tell which clause failed
+func (a *LogFilter) Explain(log *ProcessedLog) []*ClauseResult {
+	clauses := a.Clauses()
+	results := make([]*ClauseResult, 0, len(clauses))
+	for _, clause := range clauses {
+		results = append(results, &ClauseResult{
+			Clause:  clause,
+			Matched: clause.Matches(log),
+			Got:     log.GetAttribute(clause.Key),
+		})
+	}
+	return results
+}
+
+// String returns the normalized query of the filter
+func (a *LogFilter) String() string {
+	if a.matchAll {
+		return "*"
+	}
+	var terms []string
+	for _, clause := range a.Clauses() {
+		terms = append(terms, clause.String())
+	}
+	return strings.Join(terms, " ")
+}
+
+// Render writes the syntax tree of the filter on the provided buffer.
+func (a *LogFilter) Render(buf *bytes.Buffer) {
+	if a.matchAll {
+		buf.WriteString("MATCH ALL (*)")
+		return
+	}
+	clauses := a.Clauses()
+	buf.WriteString("AND")
+	for ii, clause := range clauses {
+		branch := "├──"
+		if ii == len(clauses)-1 {
+			branch = "└──"
+		}
+		kind := "top level"
+		if clause.IsAttribute {
+			kind = "attribute"
+		}
+		fmt.Fprintf(buf, "\n%s %s %s = %q", branch, kind, clause.Key, clause.Value)
+	}
+}
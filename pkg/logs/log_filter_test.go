@@ -1,6 +1,7 @@
 package logs
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/ebarti/dd-assignment/pkg/errors"
 	"github.com/stretchr/testify/assert"
@@ -183,3 +184,127 @@ func TestLogFilter_build(t *testing.T) {
 		})
 	}
 }
+
+func TestLogFilter_buildTopLevel(t *testing.T) {
+	tests := []struct {
+		query       string
+		wantStatus  string
+		wantHost    string
+		wantService string
+	}{
+		{
+			query:      "status:200",
+			wantStatus: "200",
+		},
+		{
+			query:    "host:meow",
+			wantHost: "meow",
+		},
+		{
+			query:       "service:api",
+			wantService: "api",
+		},
+		{
+			query:       "service:api host:meow status:404",
+			wantStatus:  "404",
+			wantHost:    "meow",
+			wantService: "api",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("test log filter build keeps only the value of query %s", tt.query), func(t *testing.T) {
+			a := &LogFilter{}
+			assert.NoError(t, a.build(tt.query))
+			assert.Equal(t, tt.wantStatus, stringValue(a.status))
+			assert.Equal(t, tt.wantHost, stringValue(a.host))
+			assert.Equal(t, tt.wantService, stringValue(a.service))
+		})
+	}
+}
+
+// stringValue is a helper function that returns the value of the given string pointer, or "" if it is nil
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func TestParseLogFilter(t *testing.T) {
+	tests := []struct {
+		query      string
+		wantString string
+		wantMatch  bool
+		wantErr    bool
+	}{
+		{
+			query:      "*",
+			wantString: "*",
+			wantMatch:  true,
+		},
+		{
+			query:      "status:200",
+			wantString: "status:200",
+			wantMatch:  true,
+		},
+		{
+			query:      "@http.path.section:api host:aHost status:200",
+			wantString: "status:200 host:aHost @http.path.section:api",
+			wantMatch:  false,
+		},
+		{
+			query:   "http.path.section",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("test parse log filter with query %s", tt.query), func(t *testing.T) {
+			got, err := ParseLogFilter(tt.query)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Nil(t, got)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.wantString, got.String())
+				assert.Equal(t, tt.wantMatch, got.Matches(aProcessedLog))
+			}
+		})
+	}
+}
+
+func TestLogFilter_Explain(t *testing.T) {
+	filter, err := ParseLogFilter("status:200 host:bHost @nested.aMeasurableAttribute:2 @missing:1")
+	assert.NoError(t, err)
+	assert.False(t, filter.Matches(aProcessedLog))
+
+	got := filter.Explain(aProcessedLog)
+	want := []string{
+		`PASS status:200 (got "200")`,
+		`FAIL host:bHost (got "aHost")`,
+		`FAIL @missing:1 (got <missing>)`,
+		`PASS @nested.aMeasurableAttribute:2 (got "2")`,
+	}
+	assert.Equal(t, len(want), len(got))
+	for ii, result := range got {
+		assert.Equal(t, want[ii], result.String())
+	}
+
+	matchAll, err := ParseLogFilter("*")
+	assert.NoError(t, err)
+	assert.Empty(t, matchAll.Explain(aProcessedLog))
+}
+
+func TestLogFilter_Render(t *testing.T) {
+	filter, err := ParseLogFilter("status:200 @http.path.section:api")
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	filter.Render(&buf)
+	expected := "AND\n├── top level status = \"200\"\n└── attribute http.path.section = \"api\""
+	assert.Equal(t, expected, buf.String())
+
+	matchAll, err := ParseLogFilter("*")
+	assert.NoError(t, err)
+	buf.Reset()
+	matchAll.Render(&buf)
+	assert.Equal(t, "MATCH ALL (*)", buf.String())
+}
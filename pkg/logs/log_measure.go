@@ -1,6 +1,7 @@
 package logs
 
 import (
+	"math"
 	"strconv"
 )
 
@@ -20,15 +21,15 @@ func NewLogMeasure(measure *string) *LogMeasure {
 	return &LogMeasure{name: *measure}
 }
 
-// Measure resolves the dimension for the given log. It returns an int pointer as the
+// Measure resolves the dimension for the given log. It returns a float pointer as the
 // dimension might not exist for the given log
-func (d *LogMeasure) Measure(log *ProcessedLog) *int64 {
+func (d *LogMeasure) Measure(log *ProcessedLog) *float64 {
 	val := log.GetAttribute(d.name)
 	if val == nil {
 		return nil
 	}
-	parsedVal, err := strconv.ParseInt(*val, 10, 64)
-	if err != nil {
+	parsedVal, err := strconv.ParseFloat(*val, 64)
+	if err != nil || math.IsNaN(parsedVal) || math.IsInf(parsedVal, 0) {
 		return nil
 	}
 
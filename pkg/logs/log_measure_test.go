@@ -9,7 +9,7 @@ import (
 func TestLogMeasure_Measure(t *testing.T) {
 	tests := []struct {
 		measure      string
-		want         int64
+		want         float64
 		isMeasurable bool
 	}{
 		{
@@ -38,7 +38,16 @@ func TestLogMeasure_Measure(t *testing.T) {
 			want:         4,
 			isMeasurable: true,
 		},
+		{
+			measure:      "aFloatAttribute",
+			want:         0.123,
+			isMeasurable: true,
+		},
 		// Non-measurable attributes
+		{
+			measure:      "aNaNAttribute",
+			isMeasurable: false,
+		},
 		{
 			measure:      "host",
 			isMeasurable: false,
@@ -0,0 +1,526 @@
+package metrics
+
+import (
+	"github.com/ebarti/dd-assignment/pkg/errors"
+	"sort"
+	"strings"
+)
+
+// AggregationType defines how the samples of a metric are reduced to a single value every interval
+type AggregationType string
+
+const (
+	CountAggregation AggregationType = "count" // number of samples
+	SumAggregation   AggregationType = "sum"   // sum of the sample values
+	AvgAggregation   AggregationType = "avg"   // average of the sample values
+	MinAggregation   AggregationType = "min"   // minimum sample value
+	MaxAggregation   AggregationType = "max"   // maximum sample value
+	GaugeAggregation AggregationType = "gauge" // value of the most recent sample
+	RateAggregation  AggregationType = "rate"  // sum of the sample values per second over the interval
+	// DistributionAggregation computes the count, sum, min, max, avg and percentiles of the sample values
+	DistributionAggregation AggregationType = "distribution"
+	// CardinalityAggregation estimates the number of distinct values of an attribute
+	CardinalityAggregation AggregationType = "cardinality"
+	// DerivedAggregation is the aggregation of the metrics computed by a DerivedMetric from other metrics
+	DerivedAggregation AggregationType = "formula"
+)
+
+// NewMetric creates the Metric implementation for the given aggregation type. The interval, in seconds,
+// is only used by rate metrics. Unknown aggregation types default to a CountMetric.
+func NewMetric(aggregation AggregationType, interval int64) Metric {
+	switch aggregation {
+	case SumAggregation:
+		return NewSumMetric()
+	case AvgAggregation:
+		return NewAvgMetric()
+	case MinAggregation:
+		return NewMinMetric()
+	case MaxAggregation:
+		return NewMaxMetric()
+	case GaugeAggregation:
+		return NewGaugeMetric()
+	case RateAggregation:
+		return NewRateMetric(interval)
+	case DistributionAggregation:
+		return NewDistributionMetric()
+	case CardinalityAggregation:
+		return NewCardinalityMetric()
+	default:
+		return NewCountMetric()
+	}
+}
+
+// accumulator reduces the values of the samples of a single series between two flushes
+type accumulator interface {
+	AddSample(sample *MetricSample)
+	// Merge adds the samples of another accumulator of the same type, without modifying it
+	Merge(other accumulator)
+	Flush() float64
+	// Rank returns the value the series is ranked by in a top N, without clearing it
+	Rank() float64
+}
+
+// series is the accumulator of the samples that share the exact same set of tags
+type series struct {
+	tags []*Tag
+	acc  accumulator
+}
+
+// groupedMetric holds the logic shared by all aggregated metrics: it keeps an accumulator per series, i.e. per
+// combination of tags, so that after a flush the metric can be queried by any tag or combination of tags.
+// With a top N, it only keeps the accumulators of the series and tag values its rankings track, and aggregates the other
+// ones, so that its memory does not grow with the cardinality of its tags.
+type groupedMetric struct {
+	aggregation    AggregationType
+	newAccumulator func() accumulator
+	series         map[string]*series // map of [tagSetKey]*series, without top N
+	topN           int
+	seriesRanking  *ranking            // ranks the series when topN is set
+	tagRankings    map[string]*ranking // map of [tagName]*ranking, ranks the tag values when topN is set
+}
+
+// OtherGroupName is the name of the group that holds the tag values and series that are not in the top N
+const OtherGroupName = "other"
+
+// rankable is implemented by the metrics that can keep only their top N groups
+type rankable interface {
+	setTopN(n int)
+}
+
+// setTopN makes the metric keep only the top N tag values of every tag name, and the top N series, ranked by their value.
+// The remaining ones are aggregated in an OtherGroupName group. It must be called before adding samples.
+func (g *groupedMetric) setTopN(n int) {
+	g.topN = n
+}
+
+// shardable is implemented by the metrics that can be merged with the same metric aggregated by another shard
+type shardable interface {
+	grouped() *groupedMetric
+}
+
+// grouped returns the groupedMetric of the metric
+func (g *groupedMetric) grouped() *groupedMetric {
+	return g
+}
+
+// mergeShard moves the series and rankings of the same metric aggregated by another shard into this one, and clears
+// the other one. Series with the same tags in both are merged.
+func (g *groupedMetric) mergeShard(other *groupedMetric) {
+	if g.series == nil && other.series != nil {
+		g.series = make(map[string]*series)
+	}
+	for key, s := range other.series {
+		if existing, ok := g.series[key]; ok {
+			existing.acc.Merge(s.acc)
+			continue
+		}
+		g.series[key] = s
+	}
+	if other.seriesRanking != nil {
+		g.initRankings()
+		g.seriesRanking.merge(g, other.seriesRanking)
+		for tagName, tagRanking := range other.tagRankings {
+			if _, ok := g.tagRankings[tagName]; !ok {
+				g.tagRankings[tagName] = newRanking(g.seriesRanking.hitters.capacity)
+			}
+			g.tagRankings[tagName].merge(g, tagRanking)
+		}
+	}
+	other.series, other.seriesRanking, other.tagRankings = nil, nil, nil
+}
+
+// newGroupedMetric creates a new groupedMetric that uses the given function to create its accumulators
+func newGroupedMetric(aggregation AggregationType, newAccumulator func() accumulator) groupedMetric {
+	return groupedMetric{
+		aggregation:    aggregation,
+		newAccumulator: newAccumulator,
+	}
+}
+
+// AddSample adds a sample to the metric
+func (g *groupedMetric) AddSample(sample *MetricSample) error {
+	key := TagSetKey(sample.Tags)
+	if g.topN > 0 {
+		g.initRankings()
+		g.seriesRanking.add(g, key, sample.Tags, sample)
+		for _, tag := range sample.Tags {
+			if _, ok := g.tagRankings[tag.Name]; !ok {
+				g.tagRankings[tag.Name] = newRanking(g.seriesRanking.hitters.capacity)
+			}
+			g.tagRankings[tag.Name].add(g, tag.Value, []*Tag{tag}, sample)
+		}
+		return nil
+	}
+	if g.series == nil {
+		g.series = make(map[string]*series)
+	}
+	if _, ok := g.series[key]; !ok {
+		g.series[key] = &series{
+			tags: sortedTags(sample.Tags),
+			acc:  g.newAccumulator(),
+		}
+	}
+	g.series[key].acc.AddSample(sample)
+	return nil
+}
+
+// initRankings is a helper function that creates the rankings of the series and tag values, if needed
+func (g *groupedMetric) initRankings() {
+	if g.seriesRanking != nil {
+		return
+	}
+	// a capacity well above N keeps the top N exact unless the cardinality is very high
+	capacity := 10 * g.topN
+	if capacity < 100 {
+		capacity = 100
+	}
+	g.seriesRanking = newRanking(capacity)
+	g.tagRankings = make(map[string]*ranking)
+}
+
+// isSum returns true if the value of the metric is a sum of the sample values, which is ranked with the Space-Saving algorithm
+func (g *groupedMetric) isSum() bool {
+	return g.aggregation == CountAggregation || g.aggregation == SumAggregation || g.aggregation == RateAggregation
+}
+
+// sampleRank is a helper function that returns the rank of a group holding only the given sample
+func (g *groupedMetric) sampleRank(sample *MetricSample) float64 {
+	if g.aggregation == CardinalityAggregation {
+		return 1
+	}
+	return sample.Value
+}
+
+// ranking keeps the accumulators of the groups, i.e. series or tag values, tracked by its HeavyHitters, and aggregates
+// the samples of the other groups into a single one. Sums are ranked by the Space-Saving algorithm, which replaces the
+// group with the lowest sum by every new group. Other aggregations are ranked by the value of their groups, e.g. their
+// maximum, average or p99, and a new group only replaces the lowest one if its first sample ranks higher.
+// The value of a group only holds the samples added since it is tracked, the previous ones are in the other group.
+type ranking struct {
+	hitters *HeavyHitters
+	groups  map[string]*series // map of [key]*series, for the tracked keys
+	other   *series            // samples of the groups not tracked, with the OtherGroupName value for all their tag names
+}
+
+// newRanking creates a new ranking that tracks at most capacity groups
+func newRanking(capacity int) *ranking {
+	return &ranking{
+		hitters: NewHeavyHitters(capacity),
+		groups:  make(map[string]*series),
+	}
+}
+
+// add adds the sample to the group of the key, with the given tags, or to the other group if the key is not tracked
+func (r *ranking) add(g *groupedMetric, key string, tags []*Tag, sample *MetricSample) {
+	if g.isSum() {
+		r.evict(g, r.hitters.Add(key, sample.Value))
+		r.group(g, key, tags).acc.AddSample(sample)
+		return
+	}
+	if s, ok := r.groups[key]; ok {
+		s.acc.AddSample(sample)
+		r.hitters.Offer(key, s.acc.Rank())
+		return
+	}
+	tracked, replaced := r.hitters.Offer(key, g.sampleRank(sample))
+	r.evict(g, replaced)
+	if !tracked {
+		r.otherGroup(g, tags).acc.AddSample(sample)
+		return
+	}
+	r.group(g, key, tags).acc.AddSample(sample)
+}
+
+// merge moves the groups of the other ranking into this one. Groups with the same key in both are merged
+func (r *ranking) merge(g *groupedMetric, other *ranking) {
+	for _, hitter := range other.hitters.Top(-1) {
+		s := other.groups[hitter.Key]
+		if g.isSum() {
+			r.evict(g, r.hitters.Add(hitter.Key, hitter.Count))
+			r.mergeGroup(hitter.Key, s)
+			continue
+		}
+		if existing, ok := r.groups[hitter.Key]; ok {
+			existing.acc.Merge(s.acc)
+			r.hitters.Offer(hitter.Key, existing.acc.Rank())
+			continue
+		}
+		tracked, replaced := r.hitters.Offer(hitter.Key, s.acc.Rank())
+		r.evict(g, replaced)
+		if tracked {
+			r.groups[hitter.Key] = s
+		} else {
+			r.otherGroup(g, s.tags).acc.Merge(s.acc)
+		}
+	}
+	if other.other != nil {
+		r.otherGroup(g, other.other.tags).acc.Merge(other.other.acc)
+	}
+}
+
+// mergeGroup is a helper function that merges the group into the tracked group of the key, or moves it if there is none
+func (r *ranking) mergeGroup(key string, s *series) {
+	if existing, ok := r.groups[key]; ok {
+		existing.acc.Merge(s.acc)
+		return
+	}
+	r.groups[key] = s
+}
+
+// group is a helper function that returns the tracked group of the key, creating it if needed
+func (r *ranking) group(g *groupedMetric, key string, tags []*Tag) *series {
+	s, ok := r.groups[key]
+	if !ok {
+		s = &series{tags: sortedTags(tags), acc: g.newAccumulator()}
+		r.groups[key] = s
+	}
+	return s
+}
+
+// evict is a helper function that aggregates the group replaced in the HeavyHitters, if any, into the other group
+func (r *ranking) evict(g *groupedMetric, replaced *HeavyHitter) {
+	if replaced == nil {
+		return
+	}
+	if s, ok := r.groups[replaced.Key]; ok {
+		delete(r.groups, replaced.Key)
+		r.otherGroup(g, s.tags).acc.Merge(s.acc)
+	}
+}
+
+// otherGroup is a helper function that returns the other group, with the OtherGroupName value for the given tag names
+func (r *ranking) otherGroup(g *groupedMetric, tags []*Tag) *series {
+	if r.other == nil {
+		r.other = &series{acc: g.newAccumulator()}
+	}
+	for _, tag := range tags {
+		found := false
+		for _, otherTag := range r.other.tags {
+			if otherTag.Name == tag.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			r.other.tags = sortedTags(append(r.other.tags, &Tag{Name: tag.Name, Value: OtherGroupName}))
+		}
+	}
+	return r.other
+}
+
+// allGroups returns the tracked groups and the other group, if any, by key
+func (r *ranking) allGroups() map[string]*series {
+	all := make(map[string]*series, len(r.groups)+1)
+	for key, s := range r.groups {
+		all[key] = s
+	}
+	if r.other != nil {
+		all[TagSetKey(r.other.tags)] = r.other
+	}
+	return all
+}
+
+// Flush computes the metric and clears it. It returns error if the metric is not sampled
+// The computed metric holds every series, as well as the metric aggregated per tag name and per tag value.
+// With a top N, the series and tag values that are not tracked are aggregated in a series and a tag value of their own,
+// with the OtherGroupName value.
+func (g *groupedMetric) Flush(timestamp int64) (*ComputedMetric, error) {
+	seriesByKey := g.series
+	if g.seriesRanking != nil {
+		seriesByKey = g.seriesRanking.allGroups()
+	}
+	if len(seriesByKey) == 0 {
+		return nil, errors.NewUnsampledMetricError()
+	}
+	computedMetric := &ComputedMetric{
+		Aggregation:    g.aggregation,
+		Timestamp:      timestamp,
+		newAccumulator: g.newAccumulator,
+	}
+	for key, s := range seriesByKey {
+		seriesMetric := &ComputedMetric{
+			Name:      key,
+			Tags:      s.tags,
+			Timestamp: timestamp,
+			acc:       s.acc,
+		}
+		flushAccumulator(computedMetric.mergeSeries([]*ComputedMetric{seriesMetric}), seriesMetric)
+		computedMetric.Series = append(computedMetric.Series, seriesMetric)
+	}
+	g.series = nil
+	sort.Slice(computedMetric.Series, func(i, j int) bool {
+		return computedMetric.Series[i].Name < computedMetric.Series[j].Name
+	})
+	flushAccumulator(computedMetric.mergeSeries(computedMetric.Series), computedMetric)
+
+	// aggregate the series per tag name and per tag value, or take the tag values of the rankings
+	seriesByTagValue := make(map[string]map[string][]*ComputedMetric) // map of [tagName][tagValue][]*ComputedMetric
+	if g.tagRankings == nil {
+		for _, s := range computedMetric.Series {
+			for _, tag := range s.Tags {
+				if _, ok := seriesByTagValue[tag.Name]; !ok {
+					seriesByTagValue[tag.Name] = make(map[string][]*ComputedMetric)
+				}
+				seriesByTagValue[tag.Name][tag.Value] = append(seriesByTagValue[tag.Name][tag.Value], s)
+			}
+		}
+	}
+	for tagName, tagRanking := range g.tagRankings {
+		seriesByTagValue[tagName] = make(map[string][]*ComputedMetric)
+		for key, s := range tagRanking.groups {
+			seriesByTagValue[tagName][key] = []*ComputedMetric{{acc: s.acc}}
+		}
+		if tagRanking.other != nil {
+			seriesByTagValue[tagName][OtherGroupName] = []*ComputedMetric{{acc: tagRanking.other.acc}}
+		}
+	}
+	tagNames := make([]string, 0, len(seriesByTagValue))
+	for tagName := range seriesByTagValue {
+		tagNames = append(tagNames, tagName)
+	}
+	sort.Strings(tagNames)
+	for _, tagName := range tagNames {
+		tagGroup := &ComputedMetric{
+			Name:      tagName,
+			Timestamp: timestamp,
+			Groups:    make([]*ComputedMetric, 0),
+		}
+		var tagHitters *HeavyHitters
+		if tagRanking, ok := g.tagRankings[tagName]; ok {
+			tagHitters = tagRanking.hitters
+		}
+		tagValues, otherTagValues := g.rankedKeys(tagHitters, seriesByTagValue[tagName])
+		var tagSeries, otherSeries []*ComputedMetric
+		for _, tagValue := range tagValues {
+			tagValueGroup := &ComputedMetric{
+				Name:      tagValue,
+				Timestamp: timestamp,
+			}
+			flushAccumulator(computedMetric.mergeSeries(seriesByTagValue[tagName][tagValue]), tagValueGroup)
+			tagGroup.Groups = append(tagGroup.Groups, tagValueGroup)
+			tagSeries = append(tagSeries, seriesByTagValue[tagName][tagValue]...)
+		}
+		for _, tagValue := range otherTagValues {
+			otherSeries = append(otherSeries, seriesByTagValue[tagName][tagValue]...)
+		}
+		if len(otherSeries) > 0 {
+			otherGroup := &ComputedMetric{
+				Name:      OtherGroupName,
+				Timestamp: timestamp,
+			}
+			flushAccumulator(computedMetric.mergeSeries(otherSeries), otherGroup)
+			tagGroup.Groups = append(tagGroup.Groups, otherGroup)
+			tagSeries = append(tagSeries, otherSeries...)
+		}
+		flushAccumulator(computedMetric.mergeSeries(tagSeries), tagGroup)
+		computedMetric.Groups = append(computedMetric.Groups, tagGroup)
+	}
+	if g.topN > 0 {
+		computedMetric.TopSeries = g.topSeries(computedMetric, timestamp)
+	}
+	g.seriesRanking, g.tagRankings = nil, nil
+	return computedMetric, nil
+}
+
+// rankedKeys is a helper function that splits the keys of a map into the top N ones, in ranking order,
+// and the other ones. Without top N, all the keys are returned in increasing order.
+func (g *groupedMetric) rankedKeys(hitters *HeavyHitters, m map[string][]*ComputedMetric) (top []string, other []string) {
+	if g.topN <= 0 || hitters == nil {
+		for key := range m {
+			top = append(top, key)
+		}
+		sort.Strings(top)
+		return top, nil
+	}
+	inTop := make(map[string]bool)
+	for _, hitter := range hitters.Top(g.topN) {
+		if _, ok := m[hitter.Key]; ok {
+			top = append(top, hitter.Key)
+			inTop[hitter.Key] = true
+		}
+	}
+	for key := range m {
+		if !inTop[key] {
+			other = append(other, key)
+		}
+	}
+	sort.Strings(other)
+	return top, other
+}
+
+// topSeries is a helper function that returns the top N series of the computed metric in ranking order,
+// followed by an OtherGroupName series that aggregates the remaining ones, if any.
+func (g *groupedMetric) topSeries(computedMetric *ComputedMetric, timestamp int64) []*ComputedMetric {
+	seriesByKey := make(map[string][]*ComputedMetric)
+	for _, s := range computedMetric.Series {
+		seriesByKey[s.Name] = []*ComputedMetric{s}
+	}
+	var seriesHitters *HeavyHitters
+	if g.seriesRanking != nil {
+		seriesHitters = g.seriesRanking.hitters
+	}
+	keys, otherKeys := g.rankedKeys(seriesHitters, seriesByKey)
+	top := make([]*ComputedMetric, 0, len(keys)+1)
+	for _, key := range keys {
+		top = append(top, seriesByKey[key][0])
+	}
+	if len(otherKeys) == 0 {
+		return top
+	}
+	var otherSeries []*ComputedMetric
+	for _, key := range otherKeys {
+		otherSeries = append(otherSeries, seriesByKey[key][0])
+	}
+	other := &ComputedMetric{
+		Name:      OtherGroupName,
+		Timestamp: timestamp,
+	}
+	flushAccumulator(computedMetric.mergeSeries(otherSeries), other)
+	return append(top, other)
+}
+
+// flushAccumulator is a helper function that flushes the accumulator into the computed metric.
+// Accumulators backed by a mergeable structure keep it in the computed metric, sketches also set its named values.
+func flushAccumulator(acc accumulator, computedMetric *ComputedMetric) {
+	switch a := acc.(type) {
+	case sketchAccumulator:
+		sketch := a.FlushSketch()
+		computedMetric.Sketch = sketch
+		computedMetric.Values = sketch.Summary()
+		computedMetric.Value = computedMetric.Values[CountValue]
+	case hyperLogLogAccumulator:
+		hll := a.FlushHyperLogLog()
+		computedMetric.HyperLogLog = hll
+		computedMetric.Value = float64(hll.Estimate())
+	default:
+		computedMetric.Value = acc.Flush()
+	}
+}
+
+// TagSetKey returns the canonical key of a set of tags, e.g. "http.path.section:api,status:200".
+// Tags are sorted by name so that the key does not depend on the order of the tags.
+func TagSetKey(tags []*Tag) string {
+	var buf strings.Builder
+	for ii, tag := range sortedTags(tags) {
+		if ii > 0 {
+			buf.WriteRune(',')
+		}
+		buf.WriteString(tag.Name)
+		buf.WriteRune(':')
+		buf.WriteString(tag.Value)
+	}
+	return buf.String()
+}
+
+// sortedTags is a helper function that returns a copy of the tags sorted by name and value
+func sortedTags(tags []*Tag) []*Tag {
+	sorted := make([]*Tag, len(tags))
+	copy(sorted, tags)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		return sorted[i].Value < sorted[j].Value
+	})
+	return sorted
+}
@@ -0,0 +1,187 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var measuredMetricSamples = []*MetricSample{
+	{
+		Name:      "a_metric",
+		Value:     10,
+		Timestamp: 101,
+		Tags:      []*Tag{section1Tag},
+	},
+	{
+		Name:      "a_metric",
+		Value:     40,
+		Timestamp: 103,
+		Tags:      []*Tag{section2Tag},
+	},
+	{
+		Name:      "a_metric",
+		Value:     30,
+		Timestamp: 102, // out of order
+		Tags:      []*Tag{section1Tag},
+	},
+}
+
+func TestNewMetric(t *testing.T) {
+	tests := []struct {
+		aggregation AggregationType
+		want        float64
+		wantSection float64 // value for section1Tag
+	}{
+		{aggregation: CountAggregation, want: 80, wantSection: 40},
+		{aggregation: "", want: 80, wantSection: 40},
+		{aggregation: SumAggregation, want: 80, wantSection: 40},
+		{aggregation: AvgAggregation, want: 80.0 / 3, wantSection: 20},
+		{aggregation: MinAggregation, want: 10, wantSection: 10},
+		{aggregation: MaxAggregation, want: 40, wantSection: 30},
+		{aggregation: GaugeAggregation, want: 40, wantSection: 30},
+		{aggregation: RateAggregation, want: 8, wantSection: 4},
+	}
+	for _, tt := range tests {
+		t.Run("test metric with aggregation "+string(tt.aggregation), func(t *testing.T) {
+			m := NewMetric(tt.aggregation, 10)
+			_, err := m.Flush(aFlushTime)
+			assert.Error(t, err)
+			for _, sample := range measuredMetricSamples {
+				assert.NoError(t, m.AddSample(sample))
+			}
+			got, err := m.Flush(aFlushTime)
+			assert.NoError(t, err)
+			wantAggregation := tt.aggregation
+			if wantAggregation == "" {
+				wantAggregation = CountAggregation
+			}
+			assert.Equal(t, wantAggregation, got.GetAggregation())
+			assert.Equal(t, tt.want, got.Value)
+			val, err := got.GetValue(section1Tag)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantSection, val)
+			// the tag group is aggregated over all the samples with the tag, not over the tag values
+			val, err = got.GetValue(&Tag{Name: section1Tag.Name})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, val)
+		})
+	}
+}
+
+func TestComputedMetric_RenderAggregation(t *testing.T) {
+	m := NewAvgMetric()
+	for _, sample := range aMetricSamples {
+		assert.NoError(t, m.AddSample(sample))
+	}
+	got, err := m.Flush(aFlushTime)
+	assert.NoError(t, err)
+	got.Name = "test"
+	var buf bytes.Buffer
+	got.Render(&buf)
+	assert.Equal(t, "Metric test avg: 1", buf.String())
+}
+
+func TestGroupedMetric_TopN(t *testing.T) {
+	m := NewSumMetric()
+	m.setTopN(1)
+	for _, sample := range multiTaggedMetricSamples {
+		assert.NoError(t, m.AddSample(sample))
+	}
+	got, err := m.Flush(aFlushTime)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(150), got.Value)
+	// series are kept so that queries are still exact
+	assert.Equal(t, 4, len(got.Series))
+	query, err := got.Query(section1Tag, status200Tag)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(30), query.Value)
+
+	var buf bytes.Buffer
+	got.Name = "test"
+	got.Render(&buf)
+	expected := "Metric test sum: 150" +
+		"\n\tWith tag name http.path.section: 150\n\t\tsection2: 90\n\t\tother: 60" +
+		"\n\tWith tag name status: 100\n\t\t500: 70\n\t\tother: 30" +
+		"\n\tBy tag combination:" +
+		"\n\t\thttp.path.section:section2: 50" +
+		"\n\t\tother: 100"
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestGroupedMetric_TopNByValue(t *testing.T) {
+	// section1 has more samples, but section2 has the highest maximum, average and p99
+	for _, aggregation := range []AggregationType{MaxAggregation, AvgAggregation, DistributionAggregation} {
+		t.Run(string(aggregation), func(t *testing.T) {
+			m := NewMetric(aggregation, 10)
+			m.(rankable).setTopN(1)
+			for _, sample := range measuredMetricSamples {
+				assert.NoError(t, m.AddSample(sample))
+			}
+			got, err := m.Flush(aFlushTime)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, len(got.Groups))
+			assert.Equal(t, []string{section2Tag.Value, OtherGroupName}, []string{got.Groups[0].Groups[0].Name, got.Groups[0].Groups[1].Name})
+			assert.Equal(t, "http.path.section:section2", got.TopSeries[0].Name)
+		})
+	}
+}
+
+func TestGroupedMetric_TopNBounded(t *testing.T) {
+	m := NewMaxMetric()
+	m.setTopN(1)
+	// a long tail of 10000 sections, with increasing values every 100 sections
+	var want float64
+	for ii := 0; ii < 10000; ii++ {
+		value := float64(ii / 100)
+		want = value
+		tags := []*Tag{{Name: "http.path.section", Value: fmt.Sprintf("section-%d", ii)}, {Name: "status", Value: "200"}}
+		assert.NoError(t, m.AddSample(&MetricSample{Name: "a_metric", Value: value, Tags: tags}))
+	}
+	// only the tracked series and tag values are kept, the other ones are aggregated in an other series and tag value
+	assert.LessOrEqual(t, len(m.seriesRanking.groups), 100)
+	assert.LessOrEqual(t, len(m.tagRankings["http.path.section"].groups), 100)
+	got, err := m.Flush(aFlushTime)
+	assert.NoError(t, err)
+	assert.Equal(t, want, got.Value)
+	assert.LessOrEqual(t, len(got.Series), 101)
+	query, err := got.Query(&Tag{Name: "http.path.section", Value: OtherGroupName}, &Tag{Name: "status", Value: OtherGroupName})
+	assert.NoError(t, err)
+	assert.Less(t, query.Value, want)
+	section, err := got.GetValue(&Tag{Name: "http.path.section"})
+	assert.NoError(t, err)
+	assert.Equal(t, want, section)
+	assert.Equal(t, want, got.TopSeries[0].Value)
+	assert.Equal(t, want, got.Groups[0].Groups[0].Value)
+	status, err := got.GetValue(&Tag{Name: "status", Value: "200"})
+	assert.NoError(t, err)
+	assert.Equal(t, want, status)
+
+	// sums are ranked with the Space-Saving algorithm: a heavy section is tracked among a long tail seen once
+	sum := NewSumMetric()
+	sum.setTopN(1)
+	for ii := 0; ii < 10000; ii++ {
+		assert.NoError(t, sum.AddSample(&MetricSample{Name: "a_metric", Value: 1, Tags: []*Tag{{Name: "http.path.section", Value: fmt.Sprintf("section-%d", ii)}}}))
+		if ii%10 == 0 {
+			assert.NoError(t, sum.AddSample(&MetricSample{Name: "a_metric", Value: 1, Tags: []*Tag{section1Tag}}))
+		}
+	}
+	assert.LessOrEqual(t, len(sum.seriesRanking.groups), 100)
+	got, err = sum.Flush(aFlushTime)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(11000), got.Value)
+	assert.Equal(t, section1Tag.Value, got.Groups[0].Groups[0].Name)
+	assert.Equal(t, "http.path.section:section1", got.TopSeries[0].Name)
+}
+
+func TestMetricAggregator_WithTopN(t *testing.T) {
+	agg := NewMetricAggregator(nil, 10).WithTopN(1)
+	sample := &MetricSample{Name: "a_metric", Value: 1, Timestamp: 100}
+	m := agg.newMetric(sample)
+	assert.Equal(t, 1, m.(*CountMetric).topN)
+	// the pipeline top N has precedence over the aggregator one
+	sample.TopN = 3
+	m = agg.newMetric(sample)
+	assert.Equal(t, 3, m.(*CountMetric).topN)
+}
@@ -1,23 +1,79 @@
 package metrics
 
 import (
-	"bytes"
-	"fmt"
+	"github.com/ebarti/dd-assignment/pkg/common"
+	"github.com/ebarti/dd-assignment/pkg/errors"
 	"log"
+	"math"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+const (
+	// DefaultPerMetricTagLimit is the default number of distinct values a tag of a metric can have in an interval
+	DefaultPerMetricTagLimit = 1000
+	// DefaultGlobalTagLimit is the default number of distinct tag values all the metrics can have in an interval
+	DefaultGlobalTagLimit = 10000
+	// DefaultAllowedLateness is the default number of seconds an interval is kept open for out of order samples
+	DefaultAllowedLateness = 5
+	// ProcessingTimeTick is how often the MetricAggregator checks for intervals to flush in processing time mode
+	ProcessingTimeTick = time.Second
+)
+
+// MetricStore stores the metrics flushed by the MetricAggregator for every time interval [start, end)
+type MetricStore interface {
+	Store(start, end int64, computedMetrics []*ComputedMetric)
+}
+
+// LateSampleFunc is a customizable function that receives the samples dropped because their interval was already flushed.
+type LateSampleFunc func(sample *MetricSample)
+
 // MetricAggregator is the engine that collects metrics and reports them out every interval.
+// Intervals are aligned on multiples of the interval since the epoch, e.g. on :00, :10, :20... for 10 seconds, so that
+// the output of different runs and hosts can be compared and merged.
+// Intervals are flushed in event time: the watermark is the latest sample timestamp minus the allowed lateness, and an
+// interval is flushed once the watermark reaches its end. Samples of an interval that was already flushed are too late
+// and are dropped.
+// In processing time mode, samples are aggregated in the interval of the wall clock time they arrive at instead, and
+// intervals are flushed on schedule, even without samples.
+// The MetricAggregator goroutine owns its state: it adds the samples and flushes the intervals one at a time, and calls the
+// stores and sinks. With shards, every shard goroutine owns the metrics of its series until their interval is flushed.
+// MetricsByInterval is guarded by a lock; LateSamples, OpenIntervals and IsStopped are safe to call while it is running.
 type MetricAggregator struct {
 	logger            *log.Logger
-	InputChan         chan []*MetricSample // all metrics in the array will have the same timestamp as they come from the same log
+	InputChan         chan []*MetricSample // batches of the samples of one or more logs, in the order of the logs
 	interval          int64
-	firstSampled      int64
-	lastFlushed       int64
-	currentTime       int64
-	MetricsByInterval map[int64]map[string]Metric // map of [interval][metricName]Metric
+	topN              int
+	perMetricTagLimit int
+	globalTagLimit    int
+	cardinalityStats  bool
+	derivedMetrics    []*DerivedMetric
+	stores            []MetricStore
+	sinks             []StatsSink
+	allowedLateness   int64
+	lateSampleFunc    LateSampleFunc
+	lateSamples       int64                         // total number of samples dropped as too late
+	unreportedLate    int64                         // number of samples dropped as too late since the last flushed interval
+	limiters          map[int64]*CardinalityLimiter // map of [interval]*CardinalityLimiter
+	limitersMu        sync.Mutex
+	location          *time.Location // time zone the intervals are aligned in, UTC if nil
+	currentTime       int64          // latest sample timestamp
+	watermark         int64
+	processingTime    bool
+	knownMetrics      map[string]AggregationType // aggregation of every metric sampled, flushed as zero in processing time mode
+	knownSeries       map[string][][]*Tag        // tag sets of the series of every metric in the last interval it was flushed in
+	nextBucket        int64                      // next interval bucket to flush in processing time mode
+	now               func() time.Time
+	ticks             <-chan time.Time            // ticks of the processing time mode, created on Start if not set
+	MetricsByInterval map[int64]map[string]Metric // map of [interval][metricName]Metric. Flushed intervals are evicted. Unused with shards
+	metricsMu         sync.Mutex
+	shardCount        int
+	shards            []*aggregatorShard
+	shardsWg          sync.WaitGroup
+	openBuckets       map[int64]struct{} // interval buckets with samples in the shards
+	telemetry         *Telemetry
 	done              chan struct{}
 	isDone            uint32
 }
@@ -29,10 +85,131 @@ func NewMetricAggregator(logger *log.Logger, interval int64) *MetricAggregator {
 		InputChan:         make(chan []*MetricSample),
 		interval:          interval,
 		MetricsByInterval: make(map[int64]map[string]Metric),
+		perMetricTagLimit: DefaultPerMetricTagLimit,
+		globalTagLimit:    DefaultGlobalTagLimit,
+		allowedLateness:   DefaultAllowedLateness,
+		limiters:          make(map[int64]*CardinalityLimiter),
+		currentTime:       math.MinInt64,
+		watermark:         math.MinInt64,
+		knownMetrics:      make(map[string]AggregationType),
+		knownSeries:       make(map[string][][]*Tag),
+		openBuckets:       make(map[int64]struct{}),
+		now:               time.Now,
 		done:              make(chan struct{}),
 	}
 }
 
+// WithTopN makes every metric keep only its top N tag values and series, unless its CustomMetricPipeline sets its own.
+func (s *MetricAggregator) WithTopN(n int) *MetricAggregator {
+	s.topN = n
+	return s
+}
+
+// WithTagLimits sets the number of distinct values a tag of a metric, and all the tags of all the metrics, can have in an interval.
+// Tag values over the limits are counted as OverflowTagValue. A limit of 0 means no limit.
+func (s *MetricAggregator) WithTagLimits(perMetric, global int) *MetricAggregator {
+	s.perMetricTagLimit = perMetric
+	s.globalTagLimit = global
+	return s
+}
+
+// WithCardinalityStats makes the MetricAggregator output the number of distinct values of every tag every interval.
+func (s *MetricAggregator) WithCardinalityStats(enabled bool) *MetricAggregator {
+	s.cardinalityStats = enabled
+	return s
+}
+
+// WithDerivedMetrics adds metrics computed every interval from the other metrics of the interval.
+// A derived metric can use the derived metrics added before it.
+func (s *MetricAggregator) WithDerivedMetrics(derivedMetrics ...*DerivedMetric) *MetricAggregator {
+	s.derivedMetrics = append(s.derivedMetrics, derivedMetrics...)
+	return s
+}
+
+// WithStore makes the MetricAggregator store the metrics of every interval it flushes, so that their history can be queried.
+// Every added store receives the flushed metrics.
+func (s *MetricAggregator) WithStore(store MetricStore) *MetricAggregator {
+	s.stores = append(s.stores, store)
+	return s
+}
+
+// WithSinks makes the MetricAggregator write the statistics of every interval it flushes to the sinks,
+// instead of rendering them as text to its logger.
+func (s *MetricAggregator) WithSinks(sinks ...StatsSink) *MetricAggregator {
+	s.sinks = append(s.sinks, sinks...)
+	return s
+}
+
+// WithAllowedLateness keeps every interval open for the given number of seconds after the latest sample timestamp
+// reaches its end, so that samples arriving out of order within that delay are still aggregated in their interval.
+// It defaults to DefaultAllowedLateness.
+func (s *MetricAggregator) WithAllowedLateness(seconds int64) *MetricAggregator {
+	s.allowedLateness = seconds
+	return s
+}
+
+// WithLateSamples makes the MetricAggregator pass the samples it drops as too late to the given function.
+func (s *MetricAggregator) WithLateSamples(f LateSampleFunc) *MetricAggregator {
+	s.lateSampleFunc = f
+	return s
+}
+
+// WithProcessingTime makes the MetricAggregator aggregate the samples in the interval of the wall clock time they arrive
+// at, and flush every interval once the wall clock reaches its end. Intervals without samples are flushed too, with
+// zero-valued counts, sums, rates and cardinalities of the metrics sampled before.
+func (s *MetricAggregator) WithProcessingTime(enabled bool) *MetricAggregator {
+	s.processingTime = enabled
+	return s
+}
+
+// WithTimeZone aligns the intervals on multiples of the interval in the local time of the given time zone, e.g. on
+// midnight for daily intervals, instead of UTC. Around daylight saving time changes, intervals are shorter or longer.
+func (s *MetricAggregator) WithTimeZone(location *time.Location) *MetricAggregator {
+	s.location = location
+	return s
+}
+
+// WithShards partitions the samples across n goroutines by metric name and tags, each aggregating its own series, so that
+// aggregation scales with the number of cores. Shards are merged when an interval is flushed. With n <= 1, samples are
+// aggregated by the MetricAggregator goroutine.
+func (s *MetricAggregator) WithShards(n int) *MetricAggregator {
+	s.shardCount = n
+	return s
+}
+
+// WithTelemetry makes the MetricAggregator record its internal metrics to the Telemetry, and output the internal metrics
+// of all the components recorded to it with the statistics of every interval it flushes.
+func (s *MetricAggregator) WithTelemetry(telemetry *Telemetry) *MetricAggregator {
+	s.telemetry = telemetry
+	telemetry.Gauge(common.OpenIntervalsMetric, func() float64 { return float64(len(s.OpenIntervals())) })
+	telemetry.Gauge(common.QueueDepthMetric, func() float64 { return float64(len(s.InputChan)) }, "consumer", "aggregator")
+	return s
+}
+
+// LateSamples returns the number of samples dropped because their interval was already flushed.
+func (s *MetricAggregator) LateSamples() int64 {
+	return atomic.LoadInt64(&s.lateSamples)
+}
+
+// OpenIntervals returns the start times of the intervals that have samples and were not flushed yet, in increasing order.
+func (s *MetricAggregator) OpenIntervals() []int64 {
+	s.metricsMu.Lock()
+	buckets := make([]int64, 0, len(s.MetricsByInterval)+len(s.openBuckets))
+	for bucket := range s.MetricsByInterval {
+		buckets = append(buckets, bucket)
+	}
+	for bucket := range s.openBuckets {
+		buckets = append(buckets, bucket)
+	}
+	s.metricsMu.Unlock()
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	starts := make([]int64, len(buckets))
+	for ii, bucket := range buckets {
+		starts[ii] = s.bucketStart(bucket)
+	}
+	return starts
+}
+
 // From is used to set the input channel for the MetricAggregator.
 func (s *MetricAggregator) From(inputChan chan []*MetricSample) {
 	s.InputChan = inputChan
@@ -40,7 +217,16 @@ func (s *MetricAggregator) From(inputChan chan []*MetricSample) {
 
 // Start starts the MetricAggregator.
 func (s *MetricAggregator) Start() error {
-	go s.run()
+	var stopTicker func()
+	if s.processingTime {
+		s.nextBucket = s.getBucket(s.now().Unix())
+		if s.ticks == nil {
+			ticker := time.NewTicker(ProcessingTimeTick)
+			s.ticks, stopTicker = ticker.C, ticker.Stop
+		}
+	}
+	s.startShards()
+	go s.run(stopTicker)
 	return nil
 }
 
@@ -64,92 +250,333 @@ func (s *MetricAggregator) cleanUp() {
 }
 
 // run is the main loop of the MetricAggregator.
-func (s *MetricAggregator) run() {
+func (s *MetricAggregator) run(stopTicker func()) {
 	defer s.cleanUp()
-	for input := range s.InputChan {
-		if len(input) == 0 {
-			continue
+	defer s.stopShards()
+	defer s.notifyWatermark(math.MaxInt64)
+	if stopTicker != nil {
+		defer stopTicker()
+	}
+	for {
+		select {
+		case input, ok := <-s.InputChan:
+			if !ok {
+				s.drain()
+				return
+			}
+			if s.processingTime {
+				s.addSamples(input)
+				continue
+			}
+			// the watermark advances after every run of samples with the same timestamp, i.e. of the same log, as if
+			// the logs had come one at a time
+			for start := 0; start < len(input); {
+				end := start + 1
+				for end < len(input) && input[end].Timestamp == input[start].Timestamp {
+					end++
+				}
+				// samples are added before the watermark advances, so that the first sample of an interval is not late
+				s.addSamples(input[start:end])
+				s.advanceWatermark(input[start].Timestamp)
+				start = end
+			}
+		case tick := <-s.ticks:
+			// ticks is nil, and never ready, in event time mode
+			s.flushUntil(tick.Unix())
 		}
-		wg := sync.WaitGroup{}
-		wg.Add(2)
-		// spawn a goroutine to update the samples
-		go func() {
-			defer wg.Done()
-			s.addSamples(input)
-		}()
-		// spawn a goroutine to update the current time
-		go func() {
-			defer wg.Done()
-			// all samples have the same timestamp as they come from the same log -> just get the first
-			s.flushStats(input[0].Timestamp)
-		}()
-		wg.Wait()
-	}
-}
-
-// addSamples is a helper function that adds the samples to the MetricAggregator.
+	}
+}
+
+// addSamples is a helper function that adds the samples to the MetricAggregator, dropping the late ones.
 func (s *MetricAggregator) addSamples(samples []*MetricSample) {
+	if len(s.shards) > 0 {
+		s.addToShards(samples)
+		return
+	}
+	s.metricsMu.Lock()
+	defer s.metricsMu.Unlock()
+	var arrival int64
+	if s.processingTime {
+		arrival = s.now().Unix()
+	}
 	for _, sample := range samples {
-		bucket := s.getBucket(sample.Timestamp)
+		timestamp := sample.Timestamp
+		if s.processingTime {
+			timestamp = arrival
+		}
+		bucket := s.getBucket(timestamp)
+		if s.bucketEnd(bucket) <= s.watermark {
+			s.dropLateSample(sample)
+			continue
+		}
 		if _, ok := s.MetricsByInterval[bucket]; !ok {
 			s.MetricsByInterval[bucket] = make(map[string]Metric)
 		}
 		if _, ok := s.MetricsByInterval[bucket][sample.Name]; !ok {
-			s.MetricsByInterval[bucket][sample.Name] = NewCountMetric()
+			s.MetricsByInterval[bucket][sample.Name] = s.newMetric(sample)
+			s.knownMetrics[sample.Name] = sample.Aggregation
 		}
+		s.getLimiter(bucket).Limit(sample)
 		s.MetricsByInterval[bucket][sample.Name].AddSample(sample)
 	}
 }
 
-// flushStats computes the statistics for a given interval if they have not been flushed yet.
-func (s *MetricAggregator) flushStats(timestamp int64) {
-	intervalStart := atomic.LoadInt64(&s.lastFlushed)
-	if timestamp < intervalStart+s.interval {
+// dropLateSample is a helper function that counts a sample whose interval was already flushed, and passes it to the
+// late sample function if set.
+func (s *MetricAggregator) dropLateSample(sample *MetricSample) {
+	atomic.AddInt64(&s.lateSamples, 1)
+	s.telemetry.Count(common.LateSamplesMetric, 1)
+	s.unreportedLate++
+	if s.lateSampleFunc != nil {
+		s.lateSampleFunc(sample)
+	}
+}
+
+// getLimiter returns the CardinalityLimiter of the given interval bucket, creating it if needed.
+func (s *MetricAggregator) getLimiter(bucket int64) *CardinalityLimiter {
+	s.limitersMu.Lock()
+	defer s.limitersMu.Unlock()
+	if _, ok := s.limiters[bucket]; !ok {
+		s.limiters[bucket] = NewCardinalityLimiter(s.perMetricTagLimit, s.globalTagLimit)
+	}
+	return s.limiters[bucket]
+}
+
+// newMetric is a helper function that creates the metric for the given sample, keeping its top N if set.
+func (s *MetricAggregator) newMetric(sample *MetricSample) Metric {
+	metric := NewMetric(sample.Aggregation, s.interval)
+	topN := sample.TopN
+	if topN == 0 {
+		topN = s.topN
+	}
+	if r, ok := metric.(rankable); ok && topN > 0 {
+		r.setTopN(topN)
+	}
+	return metric
+}
+
+// advanceWatermark moves the watermark to the given timestamp minus the allowed lateness, if it is the latest one,
+// and flushes the intervals that end before it.
+func (s *MetricAggregator) advanceWatermark(timestamp int64) {
+	if timestamp <= s.currentTime {
 		return
 	}
-	intervalEnd := atomic.AddInt64(&s.lastFlushed, s.interval)
-	metricsByName := s.MetricsByInterval[s.getBucket(timestamp)-1]
-	if len(metricsByName) == 0 {
+	s.currentTime = timestamp
+	s.watermark = timestamp - s.allowedLateness
+	for _, bucket := range s.evictClosedBuckets() {
+		s.flushStats(bucket.index, bucket.metrics, timestamp)
+	}
+	s.notifyWatermark(timestamp)
+}
+
+// flushUntil flushes the intervals that ended before the given wall clock time in processing time mode, including the
+// ones without samples.
+func (s *MetricAggregator) flushUntil(now int64) {
+	if now > s.currentTime {
+		s.currentTime = now
+	}
+	for last := s.getBucket(now) - 1; s.nextBucket <= last; s.nextBucket++ {
+		s.flushStats(s.nextBucket, s.evictBucket(s.nextBucket), now)
+	}
+	s.notifyWatermark(now)
+}
+
+// drain flushes the intervals still open once the input is closed, as no more samples can arrive.
+// In processing time mode, the interval of the current wall clock time is flushed as partial.
+func (s *MetricAggregator) drain() {
+	if s.processingTime {
+		now := s.now().Unix()
+		s.flushUntil(now)
+		s.flushStats(s.nextBucket, s.evictBucket(s.nextBucket), now)
+		s.nextBucket++
 		return
 	}
-	var computedMetrics []*ComputedMetric
-	for name, metric := range metricsByName {
-		computedMetric, err := metric.Flush(timestamp)
+	s.watermark = math.MaxInt64
+	for _, bucket := range s.evictClosedBuckets() {
+		s.flushStats(bucket.index, bucket.metrics, s.currentTime)
+	}
+}
+
+// notifyWatermark notifies the sinks that order their output of the latest sample timestamp processed.
+func (s *MetricAggregator) notifyWatermark(timestamp int64) {
+	for _, sink := range s.sinks {
+		if w, ok := sink.(watermarkSink); ok {
+			w.AdvanceWatermark(timestamp)
+		}
+	}
+}
+
+// flushStats computes and outputs the statistics of an interval bucket. An interval flushed before the latest sample
+// timestamp reached its end is partial, and ends after the second of the latest sample.
+func (s *MetricAggregator) flushStats(bucket int64, metricsByName map[string]Metric, timestamp int64) {
+	if s.telemetry != nil {
+		defer func(start time.Time) {
+			s.telemetry.Observe(common.FlushDurationMetric, common.Milliseconds(time.Since(start)))
+		}(time.Now())
+	}
+	// compute statistics for each series
+	computedMetrics := s.flushMetrics(metricsByName, timestamp)
+	if s.processingTime {
+		computedMetrics = append(computedMetrics, s.zeroMetrics(computedMetrics, timestamp)...)
+	}
+	computedMetrics = append(computedMetrics, s.telemetry.Flush(timestamp)...)
+	for _, derivedMetric := range s.derivedMetrics {
+		computedMetric, err := derivedMetric.Compute(computedMetrics, timestamp)
 		if err != nil {
-			log.Printf("error while processing metric %s: %s", name, err)
+			if _, ok := err.(errors.UnsampledMetricError); !ok {
+				log.Printf("error while processing metric %s: %s", derivedMetric.GetName(), err)
+			}
 			continue
 		}
-		computedMetric.Name = name
-		// compute statistics for each series
 		computedMetrics = append(computedMetrics, computedMetric)
 	}
-	// flush stats to the writer
-	s.logger.Println(s.format(intervalStart, intervalEnd, timestamp, computedMetrics))
+	bucketStart, bucketEnd := s.bucketStart(bucket), s.bucketEnd(bucket)
+	end := bucketEnd
+	if s.currentTime < end-1 {
+		end = s.currentTime + 1
+	}
+	for _, store := range s.stores {
+		store.Store(bucketStart, end, computedMetrics)
+	}
+	// flush stats to the sinks
+	s.writeStats(&IntervalStats{
+		Start:            bucketStart,
+		End:              end,
+		Partial:          end < bucketEnd,
+		Timestamp:        timestamp,
+		Metrics:          computedMetrics,
+		TagCardinality:   s.getLimiter(bucket).Stats(),
+		CardinalityStats: s.cardinalityStats,
+		LateSamples:      s.unreportedLate,
+	})
+	s.unreportedLate = 0
+	s.limitersMu.Lock()
+	delete(s.limiters, bucket)
+	s.limitersMu.Unlock()
 }
 
-// format is a helper function that formats the computed metrics into a string.
-func (s *MetricAggregator) format(start, end, timestamp int64, computedMetrics []*ComputedMetric) string {
-	var buf bytes.Buffer
-	flushTime := time.Unix(timestamp, 0)
-	startTime := time.Unix(start, 0)
-	endTime := time.Unix(end, 0)
+// zeroMetrics returns a zero-valued computed metric for every count, sum, rate and cardinality metric sampled before that
+// has no samples in the interval, sorted by name. Each zero metric has a zero series for every tag set the metric had in the
+// last interval it was flushed in, or a single untagged series if it had none, so that the stores and the exporters see it.
+func (s *MetricAggregator) zeroMetrics(computedMetrics []*ComputedMetric, timestamp int64) []*ComputedMetric {
+	s.metricsMu.Lock()
+	defer s.metricsMu.Unlock()
+	flushed := make(map[string]bool, len(computedMetrics))
+	for _, computedMetric := range computedMetrics {
+		flushed[computedMetric.Name] = true
+		tagSets := make([][]*Tag, 0, len(computedMetric.Series))
+		for _, series := range computedMetric.Series {
+			if len(series.Tags) > 0 {
+				tagSets = append(tagSets, series.Tags)
+			}
+		}
+		s.knownSeries[computedMetric.Name] = tagSets
+	}
+	var zeros []*ComputedMetric
+	for name, aggregation := range s.knownMetrics {
+		if flushed[name] {
+			continue
+		}
+		switch aggregation {
+		case CountAggregation, SumAggregation, RateAggregation, CardinalityAggregation, "":
+			zero := &ComputedMetric{Name: name, Aggregation: aggregation, Timestamp: timestamp}
+			for _, tags := range s.knownSeries[name] {
+				zero.Series = append(zero.Series, &ComputedMetric{Name: TagSetKey(tags), Tags: tags, Timestamp: timestamp})
+			}
+			if len(zero.Series) == 0 {
+				zero.Series = []*ComputedMetric{{Name: TagSetKey(nil), Timestamp: timestamp}}
+			}
+			zeros = append(zeros, zero)
+		}
+	}
+	sort.Slice(zeros, func(i, j int) bool {
+		return zeros[i].Name < zeros[j].Name
+	})
+	return zeros
+}
 
-	fmt.Fprintf(&buf, "[%v] Statistics for time interval %v-%v\n", flushTime, startTime, endTime)
+// writeStats writes the statistics of an interval to the sinks, or to the logger if there are none.
+func (s *MetricAggregator) writeStats(stats *IntervalStats) {
+	if len(s.sinks) == 0 {
+		s.logger.Println(stats.String())
+		return
+	}
+	for _, sink := range s.sinks {
+		if err := sink.WriteStats(stats); err != nil {
+			log.Printf("error while writing the statistics of interval %d-%d: %s", stats.Start, stats.End, err)
+		}
+	}
+}
+
+// metricBucket holds the metrics of an interval bucket
+type metricBucket struct {
+	index   int64
+	metrics map[string]Metric
+}
 
-	for _, metric := range computedMetrics {
-		metric.Render(&buf)
-		buf.WriteRune('\n')
+// evictClosedBuckets removes the interval buckets that end before the watermark from the MetricsByInterval map so that
+// its size stays bounded. It returns them by increasing start time.
+func (s *MetricAggregator) evictClosedBuckets() []*metricBucket {
+	isClosed := func(bucket int64) bool { return s.bucketEnd(bucket) <= s.watermark }
+	var closed []*metricBucket
+	if len(s.shards) > 0 {
+		for bucket, metricsByName := range s.evictFromShards(isClosed) {
+			closed = append(closed, &metricBucket{index: bucket, metrics: metricsByName})
+		}
+	} else {
+		s.metricsMu.Lock()
+		for bucket, metricsByName := range s.MetricsByInterval {
+			if isClosed(bucket) {
+				closed = append(closed, &metricBucket{index: bucket, metrics: metricsByName})
+				delete(s.MetricsByInterval, bucket)
+			}
+		}
+		s.metricsMu.Unlock()
+	}
+	sort.Slice(closed, func(i, j int) bool { return closed[i].index < closed[j].index })
+	return closed
+}
+
+// evictBucket removes the given interval bucket from the MetricsByInterval map, and returns its metrics.
+func (s *MetricAggregator) evictBucket(bucket int64) map[string]Metric {
+	if len(s.shards) > 0 {
+		return s.evictFromShards(func(b int64) bool { return b == bucket })[bucket]
 	}
-	return buf.String()
+	s.metricsMu.Lock()
+	defer s.metricsMu.Unlock()
+	metricsByName := s.MetricsByInterval[bucket]
+	delete(s.MetricsByInterval, bucket)
+	return metricsByName
 }
 
-// getBucket gets the interval bucket for a given timestamp.
+// getBucket gets the interval bucket for a given timestamp. Buckets are aligned on multiples of the interval since the
+// epoch, in the local time of the time zone.
 func (s *MetricAggregator) getBucket(timestamp int64) int64 {
-	// no need to atomically read the firstSampled or the interval as they are only written once
-	if s.firstSampled == 0 {
-		s.firstSampled = timestamp
-		// init last flushed time
-		atomic.StoreInt64(&s.lastFlushed, timestamp)
+	local := timestamp + s.zoneOffset(timestamp)
+	if local < 0 {
+		return (local - s.interval + 1) / s.interval
+	}
+	return local / s.interval
+}
+
+// bucketStart returns the start time of the given interval bucket.
+func (s *MetricAggregator) bucketStart(bucket int64) int64 {
+	local := bucket * s.interval
+	// the offset at the start is the one of the local time, unless the offset changes right before it
+	start := local - s.zoneOffset(local)
+	return local - s.zoneOffset(start)
+}
+
+// bucketEnd returns the end time of the given interval bucket, which is the start time of the next one.
+func (s *MetricAggregator) bucketEnd(bucket int64) int64 {
+	return s.bucketStart(bucket + 1)
+}
+
+// zoneOffset returns the offset of the time zone at the given timestamp, in seconds east of UTC.
+func (s *MetricAggregator) zoneOffset(timestamp int64) int64 {
+	if s.location == nil {
+		return 0
 	}
-	return (timestamp - s.firstSampled) / s.interval
+	_, offset := time.Unix(timestamp, 0).In(s.location).Zone()
+	return int64(offset)
 }
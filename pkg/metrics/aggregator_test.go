@@ -2,10 +2,13 @@ package metrics
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/goleak"
 	"log"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestMetricAggregator(t *testing.T) {
@@ -13,7 +16,8 @@ func TestMetricAggregator(t *testing.T) {
 	buf := bytes.Buffer{}
 	logger := log.New(&buf, "", 0)
 	inputChan := make(chan []*MetricSample)
-	agg := NewMetricAggregator(logger, 2)
+	store := &recordingStore{}
+	agg := NewMetricAggregator(logger, 2).WithStore(store)
 	agg.From(inputChan)
 
 	assert.NoError(t, agg.Start())
@@ -21,23 +25,481 @@ func TestMetricAggregator(t *testing.T) {
 		inputChan <- sample
 	}
 	agg.Stop()
-	assert.Equal(t, 4, len(agg.MetricsByInterval))
+	// flushed intervals are evicted and stored
+	assert.Equal(t, 0, len(agg.MetricsByInterval))
+	assert.Equal(t, []int64{1641316850, 1641316852, 1641316854, 1641316856}, store.starts)
 	// FIRST INTERVAL t = [1641316850 to 1641316852)
-	assert.Equal(t, 2, len(agg.MetricsByInterval[0]))
-	assert.Contains(t, agg.MetricsByInterval[0], "a_metric")
-	assert.Contains(t, agg.MetricsByInterval[0], "b_metric")
+	assert.ElementsMatch(t, []string{"a_metric", "b_metric"}, store.metricNames[1641316850])
 
 	// SECOND INTERVAL t = [1641316852 to 1641316854)
-	assert.Equal(t, 2, len(agg.MetricsByInterval[1]))
-	assert.Contains(t, agg.MetricsByInterval[1], "a_metric")
-	assert.Contains(t, agg.MetricsByInterval[1], "b_metric")
+	assert.ElementsMatch(t, []string{"a_metric", "b_metric"}, store.metricNames[1641316852])
 
 	// THIRD INTERVAL t = [1641316854 to 1641316856)
-	assert.Equal(t, 2, len(agg.MetricsByInterval[2]))
-	assert.Contains(t, agg.MetricsByInterval[2], "a_metric")
-	assert.Contains(t, agg.MetricsByInterval[2], "c_metric")
+	assert.ElementsMatch(t, []string{"a_metric", "c_metric"}, store.metricNames[1641316854])
 
-	// FOURTH INTERVAL t = [1641316856 to now)
-	assert.Equal(t, 1, len(agg.MetricsByInterval[3]))
-	assert.Contains(t, agg.MetricsByInterval[3], "c_metric")
+	// FOURTH INTERVAL t = [1641316856 to 1641316857) is flushed once the input is closed
+	assert.ElementsMatch(t, []string{"c_metric"}, store.metricNames[1641316856])
+}
+
+// recordingStore is a MetricStore that records the names and the series values of the metrics stored for every interval
+type recordingStore struct {
+	starts      []int64
+	metricNames map[int64][]string
+	series      map[int64]map[string]float64 // map of [interval][metricName{tags}]value
+}
+
+func (r *recordingStore) Store(start, end int64, computedMetrics []*ComputedMetric) {
+	if r.metricNames == nil {
+		r.metricNames = make(map[int64][]string)
+		r.series = make(map[int64]map[string]float64)
+	}
+	r.starts = append(r.starts, start)
+	r.series[start] = make(map[string]float64)
+	for _, computedMetric := range computedMetrics {
+		r.metricNames[start] = append(r.metricNames[start], computedMetric.Name)
+		for _, series := range computedMetric.Series {
+			r.series[start][computedMetric.Name+"{"+series.Name+"}"] = series.Value
+		}
+	}
+}
+
+// recordingSink is a StatsSink that records the statistics it receives
+type recordingSink struct {
+	stats []*IntervalStats
+}
+
+func (r *recordingSink) WriteStats(stats *IntervalStats) error {
+	r.stats = append(r.stats, stats)
+	return nil
+}
+
+func TestMetricAggregator_Sinks(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	buf := bytes.Buffer{}
+	logger := log.New(&buf, "", 0)
+	inputChan := make(chan []*MetricSample)
+	sink := &recordingSink{}
+	agg := NewMetricAggregator(logger, 2).WithSinks(sink)
+	agg.From(inputChan)
+
+	assert.NoError(t, agg.Start())
+	for _, sample := range aMatrixOfTaggedMetricSamples {
+		inputChan <- sample
+	}
+	agg.Stop()
+	// the statistics are written to the sink instead of the logger
+	assert.Empty(t, buf.String())
+	assert.Equal(t, 4, len(sink.stats))
+	assert.Equal(t, int64(1641316850), sink.stats[0].Start)
+	assert.Equal(t, int64(1641316852), sink.stats[0].End)
+	assert.False(t, sink.stats[0].Partial)
+	assert.Equal(t, 2, len(sink.stats[0].Metrics))
+	// the last interval is flushed as partial once the input is closed, and ends after its latest sample
+	assert.Equal(t, int64(1641316856), sink.stats[3].Start)
+	assert.Equal(t, int64(1641316857), sink.stats[3].End)
+	assert.True(t, sink.stats[3].Partial)
+}
+
+// hitsAt is a helper function that returns one count sample per timestamp
+func hitsAt(timestamps ...int64) [][]*MetricSample {
+	var samples [][]*MetricSample
+	for _, timestamp := range timestamps {
+		samples = append(samples, []*MetricSample{{Name: "hits", Aggregation: CountAggregation, Value: 1, Timestamp: timestamp}})
+	}
+	return samples
+}
+
+func TestMetricAggregator_AllowedLateness(t *testing.T) {
+	tests := []struct {
+		name            string
+		allowedLateness int64
+		wantCounts      []float64
+		wantLate        []*MetricSample
+	}{
+		{
+			name:            "late samples are dropped without allowed lateness",
+			allowedLateness: 0,
+			wantCounts:      []float64{2, 2, 1, 1},
+			wantLate:        []*MetricSample{{Name: "hits", Aggregation: CountAggregation, Value: 1, Timestamp: 108}},
+		},
+		{
+			name:            "late samples within the allowed lateness are aggregated in their interval",
+			allowedLateness: 5,
+			wantCounts:      []float64{3, 2, 1, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer goleak.VerifyNone(t)
+			inputChan := make(chan []*MetricSample)
+			sink := &recordingSink{}
+			var late []*MetricSample
+			agg := NewMetricAggregator(nil, 10).
+				WithSinks(sink).
+				WithAllowedLateness(tt.allowedLateness).
+				WithLateSamples(func(sample *MetricSample) { late = append(late, sample) })
+			agg.From(inputChan)
+			assert.NoError(t, agg.Start())
+			// 108 arrives 3 seconds after the watermark reached 110 without allowed lateness
+			for _, samples := range hitsAt(100, 105, 111, 108, 115, 121, 135) {
+				inputChan <- samples
+			}
+			agg.Stop()
+
+			var counts []float64
+			for _, stats := range sink.stats {
+				counts = append(counts, stats.Metrics[0].Value)
+			}
+			assert.Equal(t, tt.wantCounts, counts)
+			assert.Equal(t, tt.wantLate, late)
+			assert.Equal(t, int64(len(tt.wantLate)), agg.LateSamples())
+			assert.Equal(t, int64(len(tt.wantLate)), sink.stats[1].LateSamples)
+			assert.Equal(t, int64(100), sink.stats[0].Start)
+			assert.Equal(t, int64(110), sink.stats[0].End)
+		})
+	}
+}
+
+func TestMetricAggregator_Alignment(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	inputChan := make(chan []*MetricSample)
+	sink := &recordingSink{}
+	agg := NewMetricAggregator(nil, 10).WithSinks(sink).WithAllowedLateness(10)
+	agg.From(inputChan)
+	assert.NoError(t, agg.Start())
+	for _, samples := range hitsAt(105, 98, 117, 125) {
+		inputChan <- samples
+	}
+	agg.Stop()
+	// intervals are aligned on multiples of 10 seconds, whatever the first sample
+	var starts []int64
+	for _, stats := range sink.stats {
+		starts = append(starts, stats.Start)
+		assert.Equal(t, float64(1), stats.Metrics[0].Value)
+	}
+	assert.Equal(t, []int64{90, 100, 110, 120}, starts)
+}
+
+func TestMetricAggregator_TimeZone(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("time zone database not available")
+	}
+	day := int64(24 * 3600)
+	tests := []struct {
+		name      string
+		timestamp time.Time
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{
+			name:      "intervals are aligned on midnight in the time zone",
+			timestamp: time.Date(2022, 1, 4, 23, 30, 0, 0, newYork),
+			wantStart: time.Date(2022, 1, 4, 0, 0, 0, 0, newYork),
+			wantEnd:   time.Date(2022, 1, 5, 0, 0, 0, 0, newYork),
+		},
+		{
+			name:      "the day of a daylight saving time change is shorter",
+			timestamp: time.Date(2022, 3, 13, 12, 0, 0, 0, newYork),
+			wantStart: time.Date(2022, 3, 13, 0, 0, 0, 0, newYork),
+			wantEnd:   time.Date(2022, 3, 14, 0, 0, 0, 0, newYork),
+		},
+		{
+			name:      "the first day after a daylight saving time change",
+			timestamp: time.Date(2022, 3, 14, 0, 0, 0, 0, newYork),
+			wantStart: time.Date(2022, 3, 14, 0, 0, 0, 0, newYork),
+			wantEnd:   time.Date(2022, 3, 15, 0, 0, 0, 0, newYork),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agg := NewMetricAggregator(nil, day).WithTimeZone(newYork)
+			bucket := agg.getBucket(tt.timestamp.Unix())
+			assert.Equal(t, tt.wantStart.Unix(), agg.bucketStart(bucket))
+			assert.Equal(t, tt.wantEnd.Unix(), agg.bucketEnd(bucket))
+		})
+	}
+	// without time zone, intervals are aligned on midnight UTC
+	agg := NewMetricAggregator(nil, day)
+	bucket := agg.getBucket(time.Date(2022, 1, 4, 23, 30, 0, 0, time.UTC).Unix())
+	assert.Equal(t, time.Date(2022, 1, 4, 0, 0, 0, 0, time.UTC).Unix(), agg.bucketStart(bucket))
+}
+
+// fakeClock is a wall clock that only moves when it is set
+type fakeClock struct {
+	now int64
+	mu  sync.Mutex
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Unix(c.now, 0)
+}
+
+func (c *fakeClock) Set(now int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func TestMetricAggregator_ProcessingTime(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	inputChan := make(chan []*MetricSample)
+	ticks := make(chan time.Time)
+	clock := &fakeClock{now: 1000}
+	sink := &recordingSink{}
+	agg := NewMetricAggregator(nil, 10).WithSinks(sink).WithProcessingTime(true)
+	agg.now, agg.ticks = clock.Now, ticks
+	agg.From(inputChan)
+	assert.NoError(t, agg.Start())
+
+	// samples are aggregated by arrival time, whatever their timestamp
+	clock.Set(1003)
+	for _, samples := range hitsAt(50, 2000) {
+		inputChan <- samples
+	}
+	// no interval ended yet
+	ticks <- time.Unix(1009, 0)
+	clock.Set(1012)
+	inputChan <- hitsAt(1012)[0]
+	// the intervals without samples are flushed with a zero count
+	ticks <- time.Unix(1035, 0)
+	clock.Set(1037)
+	agg.Stop()
+
+	var intervals [][2]int64
+	var counts []float64
+	for _, stats := range sink.stats {
+		intervals = append(intervals, [2]int64{stats.Start, stats.End})
+		assert.Equal(t, 1, len(stats.Metrics))
+		counts = append(counts, stats.Metrics[0].Value)
+	}
+	assert.Equal(t, [][2]int64{{1000, 1010}, {1010, 1020}, {1020, 1030}, {1030, 1038}}, intervals)
+	assert.Equal(t, []float64{2, 1, 0, 0}, counts)
+	assert.Equal(t, int64(1035), sink.stats[2].Timestamp)
+	assert.True(t, sink.stats[3].Partial)
+	assert.Equal(t, int64(0), agg.LateSamples())
+}
+
+func TestMetricAggregator_ProcessingTimeZeroSeries(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	inputChan := make(chan []*MetricSample)
+	ticks := make(chan time.Time)
+	clock := &fakeClock{now: 1000}
+	store := &recordingStore{}
+	agg := NewMetricAggregator(nil, 10).WithStore(store).WithSinks(&recordingSink{}).WithProcessingTime(true)
+	agg.now, agg.ticks = clock.Now, ticks
+	agg.From(inputChan)
+	assert.NoError(t, agg.Start())
+
+	clock.Set(1003)
+	inputChan <- []*MetricSample{
+		{Name: "hits", Aggregation: CountAggregation, Value: 1, Tags: []*Tag{{Name: "host", Value: "a"}}},
+		{Name: "hits", Aggregation: CountAggregation, Value: 2, Tags: []*Tag{{Name: "host", Value: "b"}}},
+		{Name: "bytes", Aggregation: SumAggregation, Value: 10},
+	}
+	// the second interval has no samples
+	ticks <- time.Unix(1025, 0)
+	clock.Set(1026)
+	agg.Stop()
+
+	assert.Equal(t, []int64{1000, 1010, 1020}, store.starts)
+	assert.Equal(t, map[string]float64{"hits{host:a}": 1, "hits{host:b}": 2, "bytes{}": 10}, store.series[1000])
+	// every tag set of the last flushed interval gets a zero point, an untagged metric gets an untagged one
+	assert.Equal(t, map[string]float64{"hits{host:a}": 0, "hits{host:b}": 0, "bytes{}": 0}, store.series[1010])
+	assert.Equal(t, map[string]float64{"hits{host:a}": 0, "hits{host:b}": 0, "bytes{}": 0}, store.series[1020])
+}
+
+// taggedSamples is a helper function that returns the given number of logs per second, each with a count, a gauge and a distribution
+// sample tagged with one of the given number of hosts and sections
+func taggedSamples(logs int64, perSecond int64, hosts int, sections int) [][]*MetricSample {
+	var samples [][]*MetricSample
+	for ii := int64(0); ii < logs; ii++ {
+		timestamp := 100 + ii/perSecond
+		tags := []*Tag{
+			{Name: "host", Value: fmt.Sprintf("host%d", ii%int64(hosts))},
+			{Name: "section", Value: fmt.Sprintf("/section%d", ii%int64(sections))},
+		}
+		samples = append(samples, []*MetricSample{
+			{Name: "hits", Aggregation: CountAggregation, Value: 1, Timestamp: timestamp, Tags: tags},
+			{Name: "bytes", Aggregation: DistributionAggregation, Value: float64(ii % 97), Timestamp: timestamp, Tags: tags},
+			{Name: "last", Aggregation: GaugeAggregation, Value: float64(ii), Timestamp: timestamp, Tags: tags},
+		})
+	}
+	return samples
+}
+
+// renderedMetrics is a helper function that renders the metrics of every interval flushed to the sink, by metric name
+func renderedMetrics(sink *recordingSink) []map[string]string {
+	var rendered []map[string]string
+	for _, stats := range sink.stats {
+		byName := make(map[string]string)
+		for _, metric := range stats.Metrics {
+			buf := bytes.Buffer{}
+			metric.Render(&buf)
+			byName[metric.Name] = buf.String()
+		}
+		rendered = append(rendered, byName)
+	}
+	return rendered
+}
+
+func TestMetricAggregator_Shards(t *testing.T) {
+	aggregate := func(shards int) *recordingSink {
+		inputChan := make(chan []*MetricSample)
+		sink := &recordingSink{}
+		agg := NewMetricAggregator(nil, 10).WithSinks(sink).WithTopN(2).WithShards(shards)
+		agg.From(inputChan)
+		assert.NoError(t, agg.Start())
+		for _, samples := range taggedSamples(50, 1, 5, 3) {
+			inputChan <- samples
+		}
+		agg.Stop()
+		return sink
+	}
+	want := aggregate(1)
+	assert.Equal(t, 5, len(want.stats))
+	for _, shards := range []int{2, 4, 16} {
+		t.Run(fmt.Sprintf("%d shards", shards), func(t *testing.T) {
+			defer goleak.VerifyNone(t)
+			// the shards are merged into the same statistics as without shards
+			got := aggregate(shards)
+			assert.Equal(t, renderedMetrics(want), renderedMetrics(got))
+			for ii := range want.stats {
+				assert.Equal(t, want.stats[ii].Start, got.stats[ii].Start)
+				assert.Equal(t, want.stats[ii].End, got.stats[ii].End)
+			}
+		})
+	}
+}
+
+func BenchmarkMetricAggregator_Shards(b *testing.B) {
+	for _, shards := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			samples := taggedSamples(int64(b.N), 10000, 1000, 100)
+			inputChan := make(chan []*MetricSample)
+			agg := NewMetricAggregator(nil, 10).WithSinks(&recordingSink{}).WithShards(shards)
+			agg.From(inputChan)
+			b.ResetTimer()
+			start := time.Now()
+			_ = agg.Start()
+			for _, s := range samples {
+				inputChan <- s
+			}
+			agg.Stop()
+			b.ReportMetric(float64(3*b.N)/time.Since(start).Seconds(), "samples/s")
+		})
+	}
+}
+
+func BenchmarkMetricAggregator_ShardFlush(b *testing.B) {
+	// a single interval of 10000 series of 3 metrics
+	samples := taggedSamples(100000, 100000, 100, 100)
+	for _, shards := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			for ii := 0; ii < b.N; ii++ {
+				b.StopTimer()
+				inputChan := make(chan []*MetricSample)
+				agg := NewMetricAggregator(nil, 10).WithSinks(&recordingSink{}).WithShards(shards)
+				agg.From(inputChan)
+				_ = agg.Start()
+				for _, s := range samples {
+					inputChan <- s
+				}
+				// once an empty batch is received, the previous ones are added, and the shards aggregated them once they evict nothing
+				inputChan <- []*MetricSample{}
+				evicted := make(chan map[int64]map[string]Metric, len(agg.shards))
+				for _, shard := range agg.shards {
+					shard.input <- &shardRequest{evict: func(int64) bool { return false }, evicted: evicted}
+					<-evicted
+				}
+				b.StartTimer()
+				// the interval is flushed when the input is closed
+				agg.Stop()
+			}
+		})
+	}
+}
+
+func TestMetricAggregator_ConcurrentFlushes(t *testing.T) {
+	const producers, logsPerProducer = 8, 500
+	for _, processingTime := range []bool{false, true} {
+		for _, shards := range []int{1, 4} {
+			t.Run(fmt.Sprintf("processing time %t with %d shards", processingTime, shards), func(t *testing.T) {
+				defer goleak.VerifyNone(t)
+				inputChan := make(chan []*MetricSample)
+				ticks := make(chan time.Time)
+				clock := &fakeClock{now: 1000}
+				sink := &recordingSink{}
+				agg := NewMetricAggregator(nil, 2).
+					WithSinks(sink).
+					WithShards(shards).
+					WithAllowedLateness(3).
+					WithProcessingTime(processingTime)
+				agg.now, agg.ticks = clock.Now, ticks
+				agg.From(inputChan)
+				assert.NoError(t, agg.Start())
+
+				stop := make(chan struct{})
+				var background sync.WaitGroup
+				background.Add(2)
+				// the wall clock moves and ticks while the samples arrive
+				go func() {
+					defer background.Done()
+					for now := int64(1000); ; now++ {
+						clock.Set(now)
+						select {
+						case ticks <- time.Unix(now, 0):
+						case <-stop:
+							return
+						}
+					}
+				}()
+				// the state is read while the samples are added and the intervals flushed
+				go func() {
+					defer background.Done()
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+							agg.OpenIntervals()
+							agg.LateSamples()
+							agg.IsStopped()
+						}
+					}
+				}()
+				var wg sync.WaitGroup
+				for p := 0; p < producers; p++ {
+					wg.Add(1)
+					go func(p int) {
+						defer wg.Done()
+						for ii := 0; ii < logsPerProducer; ii++ {
+							// producers are a few seconds apart, so some of their samples are late
+							tags := []*Tag{{Name: "producer", Value: fmt.Sprintf("p%d", p)}}
+							inputChan <- []*MetricSample{{Name: "hits", Aggregation: CountAggregation, Value: 1, Timestamp: int64(100 + ii/10 + p), Tags: tags}}
+						}
+					}(p)
+				}
+				wg.Wait()
+				close(stop)
+				background.Wait()
+				agg.Stop()
+
+				// every sample is either aggregated in exactly one interval, or dropped as late
+				var hits float64
+				for _, stats := range sink.stats {
+					for _, metric := range stats.Metrics {
+						hits += metric.Value
+					}
+				}
+				assert.Equal(t, float64(producers*logsPerProducer), hits+float64(agg.LateSamples()))
+				assert.Empty(t, agg.OpenIntervals())
+				if processingTime {
+					assert.Equal(t, int64(0), agg.LateSamples())
+				}
+			})
+		}
+	}
 }
@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"sync"
+)
+
+// AvgMetric is a metric that averages the values of its samples and implements the Metric interface
+type AvgMetric struct {
+	groupedMetric
+}
+
+// NewAvgMetric creates a new AvgMetric
+func NewAvgMetric() *AvgMetric {
+	return &AvgMetric{
+		groupedMetric: newGroupedMetric(AvgAggregation, func() accumulator { return NewAverage() }),
+	}
+}
+
+// Average is a thread-safe average of the sample values received between 2 flushes
+type Average struct {
+	sum   float64
+	count int64
+	mu    sync.Mutex
+}
+
+// NewAverage creates a new Average
+func NewAverage() *Average {
+	return &Average{}
+}
+
+// AddSample adds a sample to the average
+func (a *Average) AddSample(sample *MetricSample) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sum += sample.Value
+	a.count++
+}
+
+// Merge adds the samples of the other Average
+func (a *Average) Merge(other accumulator) {
+	o, ok := other.(*Average)
+	if !ok {
+		return
+	}
+	o.mu.Lock()
+	sum, count := o.sum, o.count
+	o.mu.Unlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sum += sum
+	a.count += count
+}
+
+// Rank returns the current average
+func (a *Average) Rank() float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.count == 0 {
+		return 0
+	}
+	return a.sum / float64(a.count)
+}
+
+// Flush computes the average and clears it. The average of no samples is 0
+func (a *Average) Flush() float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var val float64
+	if a.count > 0 {
+		val = a.sum / float64(a.count)
+	}
+	a.sum, a.count = 0, 0
+	return val
+}
@@ -0,0 +1,143 @@
+package metrics
+
+import (
+	"github.com/ebarti/dd-assignment/pkg/errors"
+	"sync"
+)
+
+// CardinalityMetric is a metric that estimates the number of distinct values of an attribute and implements the Metric interface.
+// The computed metrics keep their HyperLogLog, so they can be merged across tags and intervals.
+type CardinalityMetric struct {
+	groupedMetric
+}
+
+// NewCardinalityMetric creates a new CardinalityMetric
+func NewCardinalityMetric() *CardinalityMetric {
+	return &CardinalityMetric{
+		groupedMetric: newGroupedMetric(CardinalityAggregation, func() accumulator { return NewCardinality() }),
+	}
+}
+
+// hyperLogLogAccumulator is an accumulator backed by a HyperLogLog
+type hyperLogLogAccumulator interface {
+	accumulator
+	FlushHyperLogLog() *HyperLogLog
+}
+
+// Cardinality is a thread-safe estimation of the number of distinct sample unique values received between 2 flushes
+type Cardinality struct {
+	hll      *HyperLogLog
+	estimate int64 // estimate of the registers, -1 once they changed
+	mu       sync.Mutex
+}
+
+// NewCardinality creates a new Cardinality
+func NewCardinality() *Cardinality {
+	return &Cardinality{hll: NewDefaultHyperLogLog(), estimate: -1}
+}
+
+// AddSample adds the unique value of the sample to the cardinality
+func (c *Cardinality) AddSample(sample *MetricSample) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hll.add(sample.UniqueValue) {
+		c.estimate = -1
+	}
+}
+
+// Merge merges the registers of the other Cardinality
+func (c *Cardinality) Merge(other accumulator) {
+	o, ok := other.(*Cardinality)
+	if !ok {
+		return
+	}
+	o.mu.Lock()
+	hll := o.hll.Copy()
+	o.mu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.hll.Merge(hll) // both have the default precision
+	c.estimate = -1
+}
+
+// Rank returns the current estimated cardinality. The estimate is only recomputed once the registers changed
+func (c *Cardinality) Rank() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.estimate < 0 {
+		c.estimate = c.hll.Estimate()
+	}
+	return float64(c.estimate)
+}
+
+// Flush returns the estimated cardinality and clears it
+func (c *Cardinality) Flush() float64 {
+	return float64(c.FlushHyperLogLog().Estimate())
+}
+
+// FlushHyperLogLog returns the HyperLogLog of the cardinality and clears it
+func (c *Cardinality) FlushHyperLogLog() *HyperLogLog {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hll := c.hll
+	c.hll = NewHyperLogLog(hll.precision)
+	c.estimate = -1
+	return hll
+}
+
+// WindowCardinalityMetric is a metric that estimates the number of distinct values of an attribute in a sliding window.
+// It keeps a HyperLogLog per second and merges the ones in the window on every flush.
+// Tags are not supported: the cardinality is computed over all the samples.
+type WindowCardinalityMetric struct {
+	timeWindow  int64
+	hllBySecond map[int64]*HyperLogLog
+	sampled     bool
+	mu          sync.Mutex
+}
+
+// NewWindowCardinalityMetric creates a new WindowCardinalityMetric with the given time window.
+func NewWindowCardinalityMetric(timeWindow int64) *WindowCardinalityMetric {
+	return &WindowCardinalityMetric{
+		timeWindow:  timeWindow,
+		hllBySecond: make(map[int64]*HyperLogLog),
+	}
+}
+
+// AddSample adds a sample to the metric.
+func (w *WindowCardinalityMetric) AddSample(sample *MetricSample) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.hllBySecond[sample.Timestamp]; !ok {
+		w.hllBySecond[sample.Timestamp] = NewDefaultHyperLogLog()
+	}
+	w.hllBySecond[sample.Timestamp].Add(sample.UniqueValue)
+	w.sampled = true
+	return nil
+}
+
+// Flush evicts the seconds older than the specified timestamp minus the window width and estimates the cardinality
+// of the remaining ones. It returns error if the metric was never sampled
+func (w *WindowCardinalityMetric) Flush(timestamp int64) (*ComputedMetric, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.sampled {
+		return nil, errors.NewUnsampledMetricError()
+	}
+	cutoff := timestamp - w.timeWindow // cutoff included in the window
+	merged := NewDefaultHyperLogLog()
+	for second, hll := range w.hllBySecond {
+		if second < cutoff {
+			delete(w.hllBySecond, second)
+			continue
+		}
+		if err := merged.Merge(hll); err != nil {
+			return nil, err
+		}
+	}
+	return &ComputedMetric{
+		Aggregation: CardinalityAggregation,
+		Timestamp:   timestamp,
+		Value:       float64(merged.Estimate()),
+		HyperLogLog: merged,
+	}, nil
+}
@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+)
+
+// OverflowTagValue is the tag value that replaces the values seen after a tag reached its cardinality limit
+const OverflowTagValue = "overflow"
+
+// TagCardinality holds the cardinality statistics of a tag of a metric
+type TagCardinality struct {
+	Metric            string
+	Tag               string
+	DistinctValues    int
+	OverflowedSamples int64 // samples whose tag value was replaced by OverflowTagValue
+	LimitReached      bool
+}
+
+// CardinalityLimiter bounds the number of distinct tag values that metrics can hold, so that grouping by a
+// high-cardinality attribute (e.g. an uri or a client IP) cannot exhaust the memory of the process.
+// Once a tag of a metric has perMetricLimit distinct values, or all the tags of all the metrics have globalLimit
+// distinct values, new values are replaced by OverflowTagValue. A limit of 0 means no limit.
+type CardinalityLimiter struct {
+	perMetricLimit int
+	globalLimit    int
+	values         map[string]map[string]map[string]struct{} // map of [metricName][tagName][tagValue]
+	overflowed     map[string]map[string]int64               // map of [metricName][tagName]overflowedSamples
+	total          int
+	mu             sync.Mutex
+}
+
+// NewCardinalityLimiter creates a new CardinalityLimiter with the given limits
+func NewCardinalityLimiter(perMetricLimit, globalLimit int) *CardinalityLimiter {
+	return &CardinalityLimiter{
+		perMetricLimit: perMetricLimit,
+		globalLimit:    globalLimit,
+		values:         make(map[string]map[string]map[string]struct{}),
+		overflowed:     make(map[string]map[string]int64),
+	}
+}
+
+// Limit replaces the tag values of the sample that are over the limits by OverflowTagValue.
+// The sample tags are replaced, not modified, as they might be shared with other samples.
+func (l *CardinalityLimiter) Limit(sample *MetricSample) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var limited []*Tag
+	for ii, tag := range sample.Tags {
+		if l.allow(sample.Name, tag) {
+			continue
+		}
+		if limited == nil {
+			limited = make([]*Tag, len(sample.Tags))
+			copy(limited, sample.Tags)
+		}
+		limited[ii] = &Tag{Name: tag.Name, Value: OverflowTagValue}
+		l.overflowed[sample.Name][tag.Name]++
+	}
+	if limited != nil {
+		sample.Tags = limited
+	}
+}
+
+// allow returns true if the tag value was already seen for the metric or if it can be added within the limits
+func (l *CardinalityLimiter) allow(metricName string, tag *Tag) bool {
+	if _, ok := l.values[metricName]; !ok {
+		l.values[metricName] = make(map[string]map[string]struct{})
+		l.overflowed[metricName] = make(map[string]int64)
+	}
+	tagValues, ok := l.values[metricName][tag.Name]
+	if !ok {
+		tagValues = make(map[string]struct{})
+		l.values[metricName][tag.Name] = tagValues
+	}
+	if _, ok := tagValues[tag.Value]; ok {
+		return true
+	}
+	if l.perMetricLimit > 0 && len(tagValues) >= l.perMetricLimit {
+		return false
+	}
+	if l.globalLimit > 0 && l.total >= l.globalLimit {
+		return false
+	}
+	tagValues[tag.Value] = struct{}{}
+	l.total++
+	return true
+}
+
+// Stats returns the cardinality statistics of every tag of every metric, sorted by metric and tag name
+func (l *CardinalityLimiter) Stats() []*TagCardinality {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var stats []*TagCardinality
+	for metricName, tags := range l.values {
+		for tagName, tagValues := range tags {
+			overflowed := l.overflowed[metricName][tagName]
+			stats = append(stats, &TagCardinality{
+				Metric:            metricName,
+				Tag:               tagName,
+				DistinctValues:    len(tagValues),
+				OverflowedSamples: overflowed,
+				LimitReached:      overflowed > 0,
+			})
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Metric != stats[j].Metric {
+			return stats[i].Metric < stats[j].Metric
+		}
+		return stats[i].Tag < stats[j].Tag
+	})
+	return stats
+}
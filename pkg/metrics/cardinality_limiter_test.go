@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func uriSample(uri string) *MetricSample {
+	return &MetricSample{
+		Name:      "a_metric",
+		Value:     1,
+		Tags:      []*Tag{{Name: "uri", Value: uri}, {Name: "status", Value: "200"}},
+		Timestamp: 100,
+	}
+}
+
+func TestCardinalityLimiter_PerMetricLimit(t *testing.T) {
+	limiter := NewCardinalityLimiter(2, 0)
+	var got []string
+	for _, uri := range []string{"/a", "/b", "/c", "/a", "/d"} {
+		sample := uriSample(uri)
+		limiter.Limit(sample)
+		got = append(got, sample.Tags[0].Value)
+		assert.Equal(t, "200", sample.Tags[1].Value)
+	}
+	assert.Equal(t, []string{"/a", "/b", OverflowTagValue, "/a", OverflowTagValue}, got)
+	assert.Equal(t, []*TagCardinality{
+		{Metric: "a_metric", Tag: "status", DistinctValues: 1},
+		{Metric: "a_metric", Tag: "uri", DistinctValues: 2, OverflowedSamples: 2, LimitReached: true},
+	}, limiter.Stats())
+}
+
+func TestCardinalityLimiter_GlobalLimit(t *testing.T) {
+	limiter := NewCardinalityLimiter(0, 3)
+	for ii := 0; ii < 5; ii++ {
+		limiter.Limit(uriSample(fmt.Sprintf("/%d", ii)))
+	}
+	// uri:/0 and status:200 are seen first, so only one more uri fits in the global limit
+	assert.Equal(t, []*TagCardinality{
+		{Metric: "a_metric", Tag: "status", DistinctValues: 1},
+		{Metric: "a_metric", Tag: "uri", DistinctValues: 2, OverflowedSamples: 3, LimitReached: true},
+	}, limiter.Stats())
+}
+
+func TestCardinalityLimiter_DoesNotModifySharedTags(t *testing.T) {
+	limiter := NewCardinalityLimiter(1, 0)
+	limiter.Limit(uriSample("/a"))
+	sample := uriSample("/b")
+	tags := sample.Tags
+	limiter.Limit(sample)
+	assert.Equal(t, OverflowTagValue, sample.Tags[0].Value)
+	assert.Equal(t, "/b", tags[0].Value)
+}
+
+func TestCardinalityLimiter_Unlimited(t *testing.T) {
+	limiter := NewCardinalityLimiter(0, 0)
+	for ii := 0; ii < 100; ii++ {
+		sample := uriSample(fmt.Sprintf("/%d", ii))
+		limiter.Limit(sample)
+		assert.NotEqual(t, OverflowTagValue, sample.Tags[0].Value)
+	}
+}
+
+func TestMetricAggregator_TagLimits(t *testing.T) {
+	agg := NewMetricAggregator(nil, 10).WithTagLimits(1, 0).WithCardinalityStats(true)
+	limiter := agg.getLimiter(0)
+	for _, uri := range []string{"/a", "/b", "/c"} {
+		limiter.Limit(uriSample(uri))
+	}
+	stats := &IntervalStats{Start: 100, End: 110, Timestamp: 110, TagCardinality: limiter.Stats(), CardinalityStats: agg.cardinalityStats}
+	out := stats.String()
+	// the header holds local times, only check what follows it
+	expected := "Tag cardinality:\n" +
+		"\tMetric a_metric tag status: 1 distinct values, 0 overflowed samples\n" +
+		"\tMetric a_metric tag uri: 1 distinct values, 2 overflowed samples\n" +
+		"Warning: tag uri of metric a_metric reached its cardinality limit with 1 distinct values, 2 samples were counted as \"overflow\"\n"
+	assert.Equal(t, expected, out[strings.Index(out, "\n")+1:])
+}
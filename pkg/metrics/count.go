@@ -1,81 +1,25 @@
 package metrics
 
 import (
-	"github.com/ebarti/dd-assignment/pkg/errors"
+	"math"
 	"sync/atomic" // Atomic operations are fast because they use an atomic CPU instruction, rather than relying on external locks
 )
 
 // CountMetric is a count-based metric and implements the Metric interface
 type CountMetric struct {
-	value  *Count
-	values map[string]map[string]*Count // map of [tagName][tagValue]*Count
+	groupedMetric
 }
 
 // NewCountMetric creates a new CountMetric
 func NewCountMetric() *CountMetric {
-	return &CountMetric{}
-}
-
-// AddSample adds a sample to the metric
-func (c *CountMetric) AddSample(sample *MetricSample) error {
-	if c.value == nil {
-		c.value = NewCount()
-	}
-	if c.values == nil {
-		c.values = make(map[string]map[string]*Count)
-	}
-
-	c.value.AddSample(sample)
-	for _, tag := range sample.Tags {
-		if _, ok := c.values[tag.Name]; !ok {
-			c.values[tag.Name] = make(map[string]*Count)
-		}
-		if _, ok := c.values[tag.Name][tag.Value]; !ok {
-			c.values[tag.Name][tag.Value] = NewCount()
-		}
-		c.values[tag.Name][tag.Value].AddSample(sample)
-	}
-	return nil
-}
-
-// Flush computes the metric and clears it. It returns error if the metric is not sampled
-func (c *CountMetric) Flush(timestamp int64) (*ComputedMetric, error) {
-	if c.value == nil {
-		return nil, errors.NewUnsampledMetricError()
-	}
-	computedMetric := &ComputedMetric{
-		Value:     c.value.Flush(),
-		Timestamp: timestamp,
-	}
-
-	var tagGroups []*ComputedMetric
-	for tagName, countPerTagValue := range c.values {
-		var groupValue int64
-		tagValueGroups := make([]*ComputedMetric, 0)
-		for tagValue, count := range countPerTagValue {
-			val := count.Flush()
-			groupValue += val
-			tagValueGroups = append(tagValueGroups, &ComputedMetric{
-				Name:      tagValue,
-				Value:     val,
-				Timestamp: timestamp,
-			})
-		}
-		tagGroups = append(tagGroups, &ComputedMetric{
-			Name:      tagName,
-			Value:     groupValue,
-			Timestamp: timestamp,
-			Groups:    tagValueGroups,
-		})
-
+	return &CountMetric{
+		groupedMetric: newGroupedMetric(CountAggregation, func() accumulator { return NewCount() }),
 	}
-	computedMetric.Groups = tagGroups
-	return computedMetric, nil
 }
 
 // Count is a thread-safe counter used to count the number of events that occur between 2 flushes
 type Count struct {
-	value int64
+	bits uint64 // bits of the float64 count, as there are no atomic operations on floats
 }
 
 // NewCount creates a new Count
@@ -85,11 +29,33 @@ func NewCount() *Count {
 
 // AddSample adds a sample to the count
 func (c *Count) AddSample(sample *MetricSample) {
-	atomic.AddInt64(&c.value, sample.Value)
+	addFloat64(&c.bits, sample.Value)
+}
+
+// Merge adds the count of the other Count
+func (c *Count) Merge(other accumulator) {
+	if o, ok := other.(*Count); ok {
+		addFloat64(&c.bits, math.Float64frombits(atomic.LoadUint64(&o.bits)))
+	}
 }
 
 // Flush computes the count and clears it
-func (c *Count) Flush() int64 {
-	val := atomic.SwapInt64(&c.value, 0)
+func (c *Count) Flush() float64 {
+	val := math.Float64frombits(atomic.SwapUint64(&c.bits, 0))
 	return val
 }
+
+// Rank returns the current count
+func (c *Count) Rank() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+// addFloat64 atomically adds delta to the float64 whose bits are stored in addr
+func addFloat64(addr *uint64, delta float64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		if atomic.CompareAndSwapUint64(addr, old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
@@ -9,10 +9,11 @@ import (
 func TestCountMetric(t *testing.T) {
 	flushtime := int64(105)
 	tests := []struct {
-		name    string
-		samples []*MetricSample
-		wantErr bool
-		want    *ComputedMetric
+		name       string
+		samples    []*MetricSample
+		wantErr    bool
+		want       *ComputedMetric
+		wantSeries []*ComputedMetric
 	}{
 		{
 			name:    "test CountMetric return error when no samples",
@@ -22,11 +23,19 @@ func TestCountMetric(t *testing.T) {
 			name:    "test CountMetric without tags",
 			samples: aMetricSamples,
 			want:    aMetricSamplesComputed,
+			wantSeries: []*ComputedMetric{
+				{Timestamp: aFlushTime, Value: 4},
+			},
 		},
 		{
 			name:    "test CountMetric with tags",
 			samples: aTaggedMetricSamples,
 			want:    aTaggedMetricSamplesComputed,
+			wantSeries: []*ComputedMetric{
+				{Name: "host:host1", Tags: []*Tag{host1Tag}, Timestamp: aFlushTime, Value: 2},
+				{Name: "host:host1,http.path.section:section1", Tags: []*Tag{host1Tag, section1Tag}, Timestamp: aFlushTime, Value: 1},
+				{Name: "host:host2,http.path.section:section2", Tags: []*Tag{host2Tag, section2Tag}, Timestamp: aFlushTime, Value: 1},
+			},
 		},
 	}
 
@@ -41,7 +50,9 @@ func TestCountMetric(t *testing.T) {
 				assert.Error(t, err)
 			} else {
 				assert.NoError(t, err)
-				assert.True(t, tt.want.Equals(got))
+				want := *tt.want
+				want.Series = tt.wantSeries
+				assert.True(t, want.Equals(got))
 			}
 		})
 	}
@@ -49,21 +60,25 @@ func TestCountMetric(t *testing.T) {
 
 func TestCountSampling(t *testing.T) {
 	tests := []struct {
-		sampleValues []int64
-		want         int64
+		sampleValues []float64
+		want         float64
 	}{
 		{
 			sampleValues: nil,
 			want:         0,
 		},
 		{
-			sampleValues: []int64{12},
+			sampleValues: []float64{12},
 			want:         12,
 		},
 		{
-			sampleValues: []int64{1, 2, 5, 0, 8, 3},
+			sampleValues: []float64{1, 2, 5, 0, 8, 3},
 			want:         19,
 		},
+		{
+			sampleValues: []float64{0.5, 0.25, 1.125},
+			want:         1.875,
+		},
 	}
 	for _, tt := range tests {
 		name := fmt.Sprintf("test count with sample values %v", tt.sampleValues)
@@ -0,0 +1,184 @@
+package metrics
+
+import (
+	"github.com/ebarti/dd-assignment/pkg/errors"
+	"sort"
+)
+
+// DerivedMetric is a metric computed from the computed metrics of an interval with a Formula, e.g. `errors / hits * 100`.
+// The formula is evaluated on the metric values, on every tag name and tag value group and on every series,
+// so that the derived metric has the same shape as the metrics it is computed from. Metrics missing from a group
+// or a series count as 0, and groups or series whose evaluation divides by zero are left out.
+type DerivedMetric struct {
+	name    string
+	formula *Formula
+}
+
+// NewDerivedMetric creates a new DerivedMetric. It returns error if the formula is not valid
+func NewDerivedMetric(name string, formula string) (*DerivedMetric, error) {
+	f, err := ParseFormula(formula)
+	if err != nil {
+		return nil, err
+	}
+	return &DerivedMetric{name: name, formula: f}, nil
+}
+
+// GetName returns the name of the derived metric
+func (d *DerivedMetric) GetName() string {
+	return d.name
+}
+
+// GetFormula returns the formula of the derived metric
+func (d *DerivedMetric) GetFormula() *Formula {
+	return d.formula
+}
+
+// Compute evaluates the formula with the given computed metrics. It returns error if none of the metrics
+// of the formula were computed, or if the evaluation of the metric values divides by zero
+func (d *DerivedMetric) Compute(computedMetrics []*ComputedMetric, timestamp int64) (*ComputedMetric, error) {
+	operands := make(map[string]*ComputedMetric)
+	for _, name := range d.formula.MetricNames() {
+		for _, computedMetric := range computedMetrics {
+			if computedMetric.Name == name {
+				operands[name] = computedMetric
+				break
+			}
+		}
+	}
+	if len(operands) == 0 {
+		return nil, errors.NewUnsampledMetricError()
+	}
+	value, err := d.evaluate(operands)
+	if err != nil {
+		return nil, err
+	}
+	derived := &ComputedMetric{
+		Name:        d.name,
+		Aggregation: DerivedAggregation,
+		Timestamp:   timestamp,
+		Value:       value,
+		derivation:  &derivation{formula: d.formula, operands: operands},
+	}
+
+	// evaluate the formula per tag name and per tag value
+	groupsByTagName := make(map[string]map[string]*ComputedMetric) // map of [tagName][metricName]*ComputedMetric
+	for name, operand := range operands {
+		for _, group := range operand.Groups {
+			addOperand(groupsByTagName, group.Name, name, group)
+		}
+	}
+	for _, tagName := range sortedOperandKeys(groupsByTagName) {
+		tagGroup, err := d.evaluateGroup(groupsByTagName[tagName], tagName, timestamp)
+		if err != nil {
+			continue
+		}
+		groupsByTagValue := make(map[string]map[string]*ComputedMetric) // map of [tagValue][metricName]*ComputedMetric
+		for name, group := range groupsByTagName[tagName] {
+			for _, tagValueGroup := range group.Groups {
+				addOperand(groupsByTagValue, tagValueGroup.Name, name, tagValueGroup)
+			}
+		}
+		tagGroup.Groups = make([]*ComputedMetric, 0, len(groupsByTagValue))
+		for _, tagValue := range sortedOperandKeys(groupsByTagValue) {
+			if tagValueGroup, err := d.evaluateGroup(groupsByTagValue[tagValue], tagValue, timestamp); err == nil {
+				tagGroup.Groups = append(tagGroup.Groups, tagValueGroup)
+			}
+		}
+		derived.Groups = append(derived.Groups, tagGroup)
+	}
+
+	// evaluate the formula per series
+	seriesByKey := make(map[string]map[string]*ComputedMetric) // map of [seriesKey][metricName]*ComputedMetric
+	for name, operand := range operands {
+		for _, series := range operand.Series {
+			addOperand(seriesByKey, series.Name, name, series)
+		}
+	}
+	for _, key := range sortedOperandKeys(seriesByKey) {
+		series, err := d.evaluateGroup(seriesByKey[key], key, timestamp)
+		if err != nil {
+			continue
+		}
+		for _, operand := range seriesByKey[key] {
+			series.Tags = operand.Tags
+			break
+		}
+		derived.Series = append(derived.Series, series)
+	}
+	return derived, nil
+}
+
+// evaluate is a helper function that evaluates the formula with the values of the given computed metrics, by metric name
+func (d *DerivedMetric) evaluate(operands map[string]*ComputedMetric) (float64, error) {
+	values := make(map[string]float64, len(operands))
+	for name, operand := range operands {
+		values[name] = operand.Value
+	}
+	return d.formula.Evaluate(values)
+}
+
+// evaluateGroup is a helper function that evaluates the formula for a group or a series of the operands
+func (d *DerivedMetric) evaluateGroup(operands map[string]*ComputedMetric, name string, timestamp int64) (*ComputedMetric, error) {
+	value, err := d.evaluate(operands)
+	if err != nil {
+		return nil, err
+	}
+	return &ComputedMetric{
+		Name:      name,
+		Timestamp: timestamp,
+		Value:     value,
+	}, nil
+}
+
+// derivation holds what a derived computed metric was computed from, so that it can be queried like any other metric
+type derivation struct {
+	formula  *Formula
+	operands map[string]*ComputedMetric
+}
+
+// query evaluates the formula on the series of the operands that have the given tags
+func (d *derivation) query(derived *ComputedMetric, tags []*Tag) (*ComputedMetric, error) {
+	values := make(map[string]float64, len(d.operands))
+	for name, operand := range d.operands {
+		queried, err := operand.Query(tags...)
+		if err != nil {
+			if _, ok := err.(errors.NoMatchingSeriesError); ok {
+				continue
+			}
+			return nil, err
+		}
+		values[name] = queried.Value
+	}
+	if len(values) == 0 {
+		return nil, errors.NewNoMatchingSeriesError(derived.Name, TagSetKey(tags))
+	}
+	value, err := d.formula.Evaluate(values)
+	if err != nil {
+		return nil, err
+	}
+	return &ComputedMetric{
+		Name:        derived.Name,
+		Aggregation: derived.Aggregation,
+		Timestamp:   derived.Timestamp,
+		Tags:        sortedTags(tags),
+		Value:       value,
+	}, nil
+}
+
+// addOperand is a helper function that adds the computed metric of an operand to the map of operands by key
+func addOperand(operandsByKey map[string]map[string]*ComputedMetric, key string, name string, operand *ComputedMetric) {
+	if _, ok := operandsByKey[key]; !ok {
+		operandsByKey[key] = make(map[string]*ComputedMetric)
+	}
+	operandsByKey[key][name] = operand
+}
+
+// sortedOperandKeys is a helper function that returns the keys of a map of operands in increasing order
+func sortedOperandKeys(operandsByKey map[string]map[string]*ComputedMetric) []string {
+	keys := make([]string, 0, len(operandsByKey))
+	for key := range operandsByKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+	"log"
+	"testing"
+)
+
+// countSamples is a helper function that flushes a count of the samples renamed to name
+func countSamples(t *testing.T, name string, samples []*MetricSample) *ComputedMetric {
+	m := NewCountMetric()
+	for _, sample := range samples {
+		counted := *sample
+		counted.Name, counted.Value = name, 1
+		assert.NoError(t, m.AddSample(&counted))
+	}
+	computed, err := m.Flush(aFlushTime)
+	assert.NoError(t, err)
+	computed.Name = name
+	return computed
+}
+
+// errorsAndHits is a helper function that returns a count of all multiTaggedMetricSamples as hits and of the ones
+// with status 500 as errors
+func errorsAndHits(t *testing.T) []*ComputedMetric {
+	var errorSamples []*MetricSample
+	for _, sample := range multiTaggedMetricSamples {
+		for _, tag := range sample.Tags {
+			if tag == status500Tag {
+				errorSamples = append(errorSamples, sample)
+			}
+		}
+	}
+	return []*ComputedMetric{
+		countSamples(t, "hits", multiTaggedMetricSamples),
+		countSamples(t, "errors", errorSamples),
+	}
+}
+
+func TestDerivedMetric_Compute(t *testing.T) {
+	d, err := NewDerivedMetric("error rate", "errors / hits * 100")
+	assert.NoError(t, err)
+	got, err := d.Compute(errorsAndHits(t), aFlushTime)
+	assert.NoError(t, err)
+	assert.Equal(t, DerivedAggregation, got.GetAggregation())
+	assert.Equal(t, float64(40), got.Value)
+
+	var buf bytes.Buffer
+	got.Render(&buf)
+	expected := "Metric error rate formula: 40" +
+		"\n\tWith tag name http.path.section: 40\n\t\tsection1: 33.333\n\t\tsection2: 50" +
+		"\n\tWith tag name status: 50\n\t\t200: 0\n\t\t500: 100" +
+		"\n\tBy tag combination:" +
+		"\n\t\thttp.path.section:section1,status:200: 0" +
+		"\n\t\thttp.path.section:section1,status:500: 100" +
+		"\n\t\thttp.path.section:section2: 0" +
+		"\n\t\thttp.path.section:section2,status:500: 100"
+	assert.Equal(t, expected, buf.String())
+
+	// derived metrics are queried on the metrics they are computed from
+	queried, err := got.Query(section1Tag)
+	assert.NoError(t, err)
+	assert.InDelta(t, 100.0/3, queried.Value, 1e-9)
+	queried, err = got.Query(status200Tag)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(0), queried.Value)
+	_, err = got.Query(&Tag{Name: "host", Value: "aHost"})
+	assert.Error(t, err)
+}
+
+func TestDerivedMetric_DivisionByZero(t *testing.T) {
+	d, err := NewDerivedMetric("hits per error", "hits / errors")
+	assert.NoError(t, err)
+	got, err := d.Compute(errorsAndHits(t), aFlushTime)
+	assert.NoError(t, err)
+	assert.Equal(t, 2.5, got.Value)
+	// the series without errors are left out
+	assert.Equal(t, 2, len(got.Series))
+	for _, series := range got.Series {
+		assert.True(t, series.hasTags([]*Tag{status500Tag}))
+	}
+	_, err = got.Query(status200Tag)
+	assert.Error(t, err)
+
+	d, err = NewDerivedMetric("hits per miss", "hits / misses")
+	assert.NoError(t, err)
+	_, err = d.Compute(errorsAndHits(t), aFlushTime)
+	assert.Error(t, err)
+}
+
+func TestDerivedMetric_Unsampled(t *testing.T) {
+	d, err := NewDerivedMetric("miss rate", "misses / requests")
+	assert.NoError(t, err)
+	_, err = d.Compute(errorsAndHits(t), aFlushTime)
+	assert.Error(t, err)
+	_, err = NewDerivedMetric("invalid", "errors /")
+	assert.Error(t, err)
+}
+
+func TestMetricAggregator_WithDerivedMetrics(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	buf := bytes.Buffer{}
+	errorRate, err := NewDerivedMetric("error rate", "errors / hits * 100")
+	assert.NoError(t, err)
+	// derived metrics can use the ones added before them
+	successRate, err := NewDerivedMetric("success rate", `100 - "error rate"`)
+	assert.NoError(t, err)
+	agg := NewMetricAggregator(log.New(&buf, "", 0), 10).WithDerivedMetrics(errorRate, successRate)
+	inputChan := make(chan []*MetricSample)
+	agg.From(inputChan)
+	assert.NoError(t, agg.Start())
+	inputChan <- []*MetricSample{
+		{Name: "hits", Value: 1, Timestamp: 100},
+		{Name: "errors", Value: 1, Timestamp: 100},
+	}
+	inputChan <- []*MetricSample{{Name: "hits", Value: 1, Timestamp: 101}}
+	inputChan <- []*MetricSample{{Name: "hits", Value: 1, Timestamp: 110}} // flush the first interval
+	agg.Stop()
+	assert.Contains(t, buf.String(), "Metric error rate formula: 50\n")
+	assert.Contains(t, buf.String(), "Metric success rate formula: 50\n")
+}
@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"github.com/ebarti/dd-assignment/pkg/errors"
+	"sync"
+)
+
+// DistributionMetric is a metric that computes the count, sum, min, max, avg and percentiles of its sample values
+// and implements the Metric interface. The computed metrics keep their sketch, so they can be merged across tags and intervals.
+type DistributionMetric struct {
+	groupedMetric
+}
+
+// NewDistributionMetric creates a new DistributionMetric
+func NewDistributionMetric() *DistributionMetric {
+	return &DistributionMetric{
+		groupedMetric: newGroupedMetric(DistributionAggregation, func() accumulator { return NewDistribution() }),
+	}
+}
+
+// rankingQuantile is the quantile distributions are ranked by in a top N
+const rankingQuantile = 0.99
+
+// sketchAccumulator is an accumulator backed by a quantile sketch
+type sketchAccumulator interface {
+	accumulator
+	FlushSketch() *DDSketch
+}
+
+// Distribution is a thread-safe quantile sketch of the sample values received between 2 flushes
+type Distribution struct {
+	sketch *DDSketch
+	mu     sync.Mutex
+}
+
+// NewDistribution creates a new Distribution
+func NewDistribution() *Distribution {
+	return &Distribution{sketch: NewDefaultDDSketch()}
+}
+
+// AddSample adds a sample to the distribution
+func (d *Distribution) AddSample(sample *MetricSample) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sketch.Add(sample.Value)
+}
+
+// Merge merges the sketch of the other Distribution
+func (d *Distribution) Merge(other accumulator) {
+	o, ok := other.(*Distribution)
+	if !ok {
+		return
+	}
+	o.mu.Lock()
+	sketch := o.sketch.Copy()
+	o.mu.Unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_ = d.sketch.Merge(sketch) // both sketches have the default relative accuracy
+}
+
+// Rank returns the current rankingQuantile of the distribution
+func (d *Distribution) Rank() float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.sketch.Quantile(rankingQuantile)
+}
+
+// Flush returns the number of samples in the distribution and clears it
+func (d *Distribution) Flush() float64 {
+	return float64(d.FlushSketch().Count())
+}
+
+// FlushSketch returns the sketch of the distribution and clears it
+func (d *Distribution) FlushSketch() *DDSketch {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sketch := d.sketch
+	d.sketch = NewDDSketch(sketch.relativeAccuracy)
+	return sketch
+}
+
+// WindowDistributionMetric is a metric that computes the distribution of the sample values in a sliding window.
+// It keeps a DDSketch per second, so that samples coming out of order leave the window on time, and merges the ones in
+// the window on every flush.
+// Tags are not supported: the distribution is computed over all the samples.
+type WindowDistributionMetric struct {
+	timeWindow     int64
+	sketchBySecond map[int64]*DDSketch
+	mu             sync.Mutex
+}
+
+// NewWindowDistributionMetric creates a new WindowDistributionMetric with the given time window.
+func NewWindowDistributionMetric(timeWindow int64) *WindowDistributionMetric {
+	return &WindowDistributionMetric{
+		timeWindow:     timeWindow,
+		sketchBySecond: make(map[int64]*DDSketch),
+	}
+}
+
+// AddSample adds a sample to the metric.
+func (w *WindowDistributionMetric) AddSample(sample *MetricSample) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.sketchBySecond[sample.Timestamp]; !ok {
+		w.sketchBySecond[sample.Timestamp] = NewDefaultDDSketch()
+	}
+	w.sketchBySecond[sample.Timestamp].Add(sample.Value)
+	return nil
+}
+
+// Flush evicts the seconds older than the specified timestamp minus the window width and computes the distribution
+// of the remaining ones. It returns error if the metric has no samples
+func (w *WindowDistributionMetric) Flush(timestamp int64) (*ComputedMetric, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.sketchBySecond) == 0 {
+		return nil, errors.NewUnsampledMetricError()
+	}
+	cutoff := timestamp - w.timeWindow // cutoff included in the window
+	sketch := NewDefaultDDSketch()
+	for second, secondSketch := range w.sketchBySecond {
+		if second < cutoff {
+			delete(w.sketchBySecond, second)
+			continue
+		}
+		if err := sketch.Merge(secondSketch); err != nil {
+			return nil, err
+		}
+	}
+	values := sketch.Summary()
+	return &ComputedMetric{
+		Aggregation: DistributionAggregation,
+		Timestamp:   timestamp,
+		Value:       values[CountValue],
+		Values:      values,
+		Sketch:      sketch,
+	}, nil
+}
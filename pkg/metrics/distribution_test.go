@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDistributionMetric(t *testing.T) {
+	m := NewDistributionMetric()
+	_, err := m.Flush(aFlushTime)
+	assert.Error(t, err)
+	for _, sample := range measuredMetricSamples {
+		assert.NoError(t, m.AddSample(sample))
+	}
+	got, err := m.Flush(aFlushTime)
+	assert.NoError(t, err)
+	assert.Equal(t, DistributionAggregation, got.GetAggregation())
+	assert.Equal(t, float64(3), got.Value)
+	wantValues := map[string]float64{
+		CountValue: 3, SumValue: 80, MinValue: 10, MaxValue: 40, AvgValue: 80.0 / 3,
+		"p50": 30, "p75": 30, "p90": 30, "p95": 30, "p99": 30,
+	}
+	assert.Equal(t, len(wantValues), len(got.Values))
+	for name, want := range wantValues {
+		assertWithinRelativeAccuracy(t, want, got.Values[name])
+	}
+
+	val, err := got.GetNamedValue(section1Tag, MaxValue)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(30), val)
+	_, err = got.GetNamedValue(nil, "p42")
+	assert.Error(t, err)
+
+	var buf bytes.Buffer
+	got.Name = "bytes"
+	got.Groups = nil
+	got.Render(&buf)
+	assert.Equal(t, "Metric bytes distribution: 3 {count: 3, sum: 80, min: 10, max: 40, avg: 26.667, p50: 30.267, p75: 30.267, p90: 30.267, p95: 30.267, p99: 30.267}", buf.String())
+}
+
+func TestComputedMetric_Merge(t *testing.T) {
+	first, second := NewDistributionMetric(), NewDistributionMetric()
+	for ii := int64(1); ii <= 100; ii++ {
+		sample := &MetricSample{Name: "a_metric", Value: float64(ii), Timestamp: 100 + ii}
+		if ii <= 50 {
+			assert.NoError(t, first.AddSample(sample))
+		} else {
+			assert.NoError(t, second.AddSample(sample))
+		}
+	}
+	firstInterval, err := first.Flush(150)
+	assert.NoError(t, err)
+	secondInterval, err := second.Flush(200)
+	assert.NoError(t, err)
+
+	assert.NoError(t, firstInterval.Merge(secondInterval))
+	assert.Equal(t, float64(100), firstInterval.Values[CountValue])
+	assert.Equal(t, float64(1), firstInterval.Values[MinValue])
+	assert.Equal(t, float64(100), firstInterval.Values[MaxValue])
+	assertWithinRelativeAccuracy(t, 50, firstInterval.Values["p50"])
+	assertWithinRelativeAccuracy(t, 99, firstInterval.Values["p99"])
+
+	assert.Error(t, firstInterval.Merge(aMetricSamplesComputed))
+}
+
+func TestWindowDistributionMetric(t *testing.T) {
+	m := NewWindowDistributionMetric(2)
+	_, err := m.Flush(aFlushTime)
+	assert.Error(t, err)
+	for _, sample := range measuredMetricSamples[:2] {
+		assert.NoError(t, m.AddSample(sample))
+	}
+	got, err := m.Flush(103)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(2), got.Values[CountValue])
+	assert.Equal(t, float64(40), got.Values[MaxValue])
+
+	// the first sample (t=101) leaves the window
+	got, err = m.Flush(104)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), got.Values[CountValue])
+	assertWithinRelativeAccuracy(t, 40, got.Values["p50"])
+}
+
+func TestWindowDistributionMetric_OutOfOrder(t *testing.T) {
+	m := NewWindowDistributionMetric(2)
+	for _, sample := range []*MetricSample{
+		{Name: "a_metric", Value: 50, Timestamp: 105},
+		{Name: "a_metric", Value: 10, Timestamp: 101},
+		{Name: "a_metric", Value: 40, Timestamp: 104},
+	} {
+		assert.NoError(t, m.AddSample(sample))
+	}
+	// the late sample (t=101) leaves the window, even though it arrived after one still in it
+	got, err := m.Flush(106)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(2), got.Values[CountValue])
+	assertWithinRelativeAccuracy(t, 40, got.Values[MinValue])
+	assertWithinRelativeAccuracy(t, 50, got.Values[MaxValue])
+
+	// the sample at t=104 leaves the window after the one at t=105 arrived
+	got, err = m.Flush(107)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), got.Values[CountValue])
+	assertWithinRelativeAccuracy(t, 50, got.Values["p50"])
+}
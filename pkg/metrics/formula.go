@@ -0,0 +1,346 @@
+package metrics
+
+import (
+	"fmt"
+	"github.com/ebarti/dd-assignment/pkg/errors"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Formula is an arithmetic expression over metric names, e.g. `errors / hits * 100`.
+// It supports +, -, *, / and parentheses with the usual precedence, unary minus and decimal numbers.
+// Metric names are either bare identifiers made of letters, digits, '_' and '.' (e.g. http.errors), or quoted
+// with double quotes when they contain other characters (e.g. "DD exercise").
+type Formula struct {
+	source      string
+	root        formulaNode
+	metricNames []string
+}
+
+// ParseFormula parses the given formula. It returns error if the formula is not valid
+func ParseFormula(source string) (*Formula, error) {
+	p := &formulaParser{source: source}
+	if err := p.tokenize(); err != nil {
+		return nil, err
+	}
+	root, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != endToken {
+		return nil, p.errorf("unexpected %s", p.peek())
+	}
+	names := make(map[string]struct{})
+	root.collectMetricNames(names)
+	metricNames := make([]string, 0, len(names))
+	for name := range names {
+		metricNames = append(metricNames, name)
+	}
+	sort.Strings(metricNames)
+	return &Formula{source: source, root: root, metricNames: metricNames}, nil
+}
+
+// Evaluate computes the formula with the given metric values. Metrics missing from values count as 0.
+// It returns a DivisionByZeroError if a divisor evaluates to 0.
+func (f *Formula) Evaluate(values map[string]float64) (float64, error) {
+	return f.root.evaluate(values)
+}
+
+// MetricNames returns the names of the metrics used by the formula, sorted and without duplicates
+func (f *Formula) MetricNames() []string {
+	return f.metricNames
+}
+
+// String returns the normalized formula, e.g. `errors / hits * 100`
+func (f *Formula) String() string {
+	return f.root.String()
+}
+
+// formulaNode is a node of the syntax tree of a formula
+type formulaNode interface {
+	evaluate(values map[string]float64) (float64, error)
+	collectMetricNames(names map[string]struct{})
+	String() string
+}
+
+// numberNode is a constant
+type numberNode struct {
+	value float64
+}
+
+func (n *numberNode) evaluate(map[string]float64) (float64, error) { return n.value, nil }
+
+func (n *numberNode) collectMetricNames(map[string]struct{}) {}
+
+func (n *numberNode) String() string { return strconv.FormatFloat(n.value, 'f', -1, 64) }
+
+// metricNode is the value of a metric
+type metricNode struct {
+	name string
+}
+
+func (n *metricNode) evaluate(values map[string]float64) (float64, error) { return values[n.name], nil }
+
+func (n *metricNode) collectMetricNames(names map[string]struct{}) { names[n.name] = struct{}{} }
+
+func (n *metricNode) String() string {
+	if isIdentifier(n.name) {
+		return n.name
+	}
+	return strconv.Quote(n.name)
+}
+
+// negateNode is the unary minus of its operand
+type negateNode struct {
+	operand formulaNode
+}
+
+func (n *negateNode) evaluate(values map[string]float64) (float64, error) {
+	val, err := n.operand.evaluate(values)
+	return -val, err
+}
+
+func (n *negateNode) collectMetricNames(names map[string]struct{}) {
+	n.operand.collectMetricNames(names)
+}
+
+func (n *negateNode) String() string { return "-" + n.operand.String() }
+
+// binaryNode is an arithmetic operation between two operands
+type binaryNode struct {
+	operator    rune
+	left, right formulaNode
+}
+
+func (n *binaryNode) evaluate(values map[string]float64) (float64, error) {
+	left, err := n.left.evaluate(values)
+	if err != nil {
+		return 0, err
+	}
+	right, err := n.right.evaluate(values)
+	if err != nil {
+		return 0, err
+	}
+	switch n.operator {
+	case '+':
+		return left + right, nil
+	case '-':
+		return left - right, nil
+	case '*':
+		return left * right, nil
+	default:
+		if right == 0 {
+			return 0, errors.NewDivisionByZeroError(n.String())
+		}
+		return left / right, nil
+	}
+}
+
+func (n *binaryNode) collectMetricNames(names map[string]struct{}) {
+	n.left.collectMetricNames(names)
+	n.right.collectMetricNames(names)
+}
+
+func (n *binaryNode) String() string {
+	return fmt.Sprintf("%s %c %s", n.operandString(n.left, false), n.operator, n.operandString(n.right, true))
+}
+
+// operandString is a helper function that wraps the operand in parentheses if its operator has a lower precedence,
+// or the same precedence on the right side, e.g. `a - (b - c)`
+func (n *binaryNode) operandString(operand formulaNode, isRight bool) string {
+	b, ok := operand.(*binaryNode)
+	if !ok {
+		return operand.String()
+	}
+	if precedence(b.operator) < precedence(n.operator) || (isRight && precedence(b.operator) == precedence(n.operator)) {
+		return "(" + b.String() + ")"
+	}
+	return b.String()
+}
+
+// precedence returns the precedence of an operator
+func precedence(operator rune) int {
+	if operator == '*' || operator == '/' {
+		return 2
+	}
+	return 1
+}
+
+// isIdentifier returns true if the name can be written without quotes in a formula
+func isIdentifier(name string) bool {
+	if name == "" {
+		return false
+	}
+	for ii, r := range name {
+		if !isIdentifierRune(r) || (ii == 0 && unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// isIdentifierRune returns true if the rune can be part of an unquoted metric name
+func isIdentifierRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.'
+}
+
+type formulaTokenKind int
+
+const (
+	endToken formulaTokenKind = iota
+	numberToken
+	nameToken
+	operatorToken
+)
+
+// formulaToken is a token of a formula, with its position in the source
+type formulaToken struct {
+	kind     formulaTokenKind
+	text     string
+	position int
+}
+
+func (t formulaToken) String() string {
+	if t.kind == endToken {
+		return "end of formula"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// formulaParser is a recursive descent parser of formulas
+type formulaParser struct {
+	source string
+	tokens []formulaToken
+	next   int
+}
+
+// tokenize splits the source into tokens
+func (p *formulaParser) tokenize() error {
+	runes := []rune(p.source)
+	for ii := 0; ii < len(runes); {
+		r := runes[ii]
+		switch {
+		case unicode.IsSpace(r):
+			ii++
+		case strings.ContainsRune("+-*/()", r):
+			p.tokens = append(p.tokens, formulaToken{kind: operatorToken, text: string(r), position: ii})
+			ii++
+		case r == '"':
+			end := ii + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return errors.NewInvalidFormulaError(p.source, ii, "unterminated metric name")
+			}
+			p.tokens = append(p.tokens, formulaToken{kind: nameToken, text: string(runes[ii+1 : end]), position: ii})
+			ii = end + 1
+		case unicode.IsDigit(r):
+			end := ii
+			for end < len(runes) && (unicode.IsDigit(runes[end]) || runes[end] == '.') {
+				end++
+			}
+			p.tokens = append(p.tokens, formulaToken{kind: numberToken, text: string(runes[ii:end]), position: ii})
+			ii = end
+		case isIdentifierRune(r):
+			end := ii
+			for end < len(runes) && isIdentifierRune(runes[end]) {
+				end++
+			}
+			p.tokens = append(p.tokens, formulaToken{kind: nameToken, text: string(runes[ii:end]), position: ii})
+			ii = end
+		default:
+			return errors.NewInvalidFormulaError(p.source, ii, fmt.Sprintf("unexpected character %q", r))
+		}
+	}
+	p.tokens = append(p.tokens, formulaToken{kind: endToken, position: len(runes)})
+	return nil
+}
+
+// peek returns the next token without consuming it
+func (p *formulaParser) peek() formulaToken {
+	return p.tokens[p.next]
+}
+
+// consume returns the next token and moves to the following one
+func (p *formulaParser) consume() formulaToken {
+	token := p.tokens[p.next]
+	if token.kind != endToken {
+		p.next++
+	}
+	return token
+}
+
+// errorf returns an InvalidFormulaError at the position of the next token
+func (p *formulaParser) errorf(format string, args ...interface{}) error {
+	return errors.NewInvalidFormulaError(p.source, p.peek().position, fmt.Sprintf(format, args...))
+}
+
+// parseExpression parses a sum or a difference of terms
+func (p *formulaParser) parseExpression() (formulaNode, error) {
+	return p.parseBinary(p.parseTerm, "+-")
+}
+
+// parseTerm parses a product or a division of factors
+func (p *formulaParser) parseTerm() (formulaNode, error) {
+	return p.parseBinary(p.parseFactor, "*/")
+}
+
+// parseBinary parses left associative operations between operands parsed by parseOperand
+func (p *formulaParser) parseBinary(parseOperand func() (formulaNode, error), operators string) (formulaNode, error) {
+	left, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == operatorToken && strings.Contains(operators, p.peek().text) {
+		operator := []rune(p.consume().text)[0]
+		right, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{operator: operator, left: left, right: right}
+	}
+	return left, nil
+}
+
+// parseFactor parses a number, a metric name, a negated factor or an expression in parentheses
+func (p *formulaParser) parseFactor() (formulaNode, error) {
+	token := p.peek()
+	switch {
+	case token.kind == numberToken:
+		p.consume()
+		value, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, errors.NewInvalidFormulaError(p.source, token.position, fmt.Sprintf("invalid number %q", token.text))
+		}
+		return &numberNode{value: value}, nil
+	case token.kind == nameToken:
+		p.consume()
+		if token.text == "" {
+			return nil, errors.NewInvalidFormulaError(p.source, token.position, "empty metric name")
+		}
+		return &metricNode{name: token.text}, nil
+	case token.kind == operatorToken && token.text == "-":
+		p.consume()
+		operand, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return &negateNode{operand: operand}, nil
+	case token.kind == operatorToken && token.text == "(":
+		p.consume()
+		expression, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != operatorToken || p.peek().text != ")" {
+			return nil, p.errorf("expected \")\" but got %s", p.peek())
+		}
+		p.consume()
+		return expression, nil
+	default:
+		return nil, p.errorf("expected a number or a metric name but got %s", token)
+	}
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"github.com/ebarti/dd-assignment/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseFormula(t *testing.T) {
+	values := map[string]float64{"errors": 5, "hits": 20, "DD exercise": 40, "http.bytes": 3}
+	tests := []struct {
+		formula         string
+		want            float64
+		wantString      string
+		wantMetricNames []string
+		wantErr         bool
+	}{
+		{formula: "errors / hits * 100", want: 25, wantString: "errors / hits * 100", wantMetricNames: []string{"errors", "hits"}},
+		{formula: "errors/(hits*100)", want: 0.0025, wantString: "errors / (hits * 100)", wantMetricNames: []string{"errors", "hits"}},
+		{formula: "hits - errors - 1", want: 14, wantString: "hits - errors - 1", wantMetricNames: []string{"errors", "hits"}},
+		{formula: "hits - (errors - 1)", want: 16, wantString: "hits - (errors - 1)", wantMetricNames: []string{"errors", "hits"}},
+		{formula: "1 + 2 * 3", want: 7, wantString: "1 + 2 * 3", wantMetricNames: []string{}},
+		{formula: `"DD exercise" / hits`, want: 2, wantString: `"DD exercise" / hits`, wantMetricNames: []string{"DD exercise", "hits"}},
+		{formula: "-errors + http.bytes * 0.5", want: -3.5, wantString: "-errors + http.bytes * 0.5", wantMetricNames: []string{"errors", "http.bytes"}},
+		{formula: "errors + errors + missing", want: 10, wantString: "errors + errors + missing", wantMetricNames: []string{"errors", "missing"}},
+		{formula: "", wantErr: true},
+		{formula: "errors /", wantErr: true},
+		{formula: "(errors / hits", wantErr: true},
+		{formula: "errors hits", wantErr: true},
+		{formula: "errors % hits", wantErr: true},
+		{formula: `"unterminated / hits`, wantErr: true},
+		{formula: "1.2.3 * hits", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run("test formula "+tt.formula, func(t *testing.T) {
+			f, err := ParseFormula(tt.formula)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.IsType(t, errors.InvalidFormulaError{}, err)
+				return
+			}
+			assert.NoError(t, err)
+			got, err := f.Evaluate(values)
+			assert.NoError(t, err)
+			assert.InDelta(t, tt.want, got, 1e-9)
+			assert.Equal(t, tt.wantString, f.String())
+			assert.Equal(t, tt.wantMetricNames, f.MetricNames())
+		})
+	}
+}
+
+func TestFormula_DivisionByZero(t *testing.T) {
+	f, err := ParseFormula("errors / hits * 100")
+	assert.NoError(t, err)
+	_, err = f.Evaluate(map[string]float64{"errors": 1})
+	assert.IsType(t, errors.DivisionByZeroError{}, err)
+	_, err = f.Evaluate(map[string]float64{"errors": 1, "hits": 0})
+	assert.Error(t, err)
+}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"sync"
+)
+
+// GaugeMetric is a metric that reports the value of its most recent sample and implements the Metric interface
+type GaugeMetric struct {
+	groupedMetric
+}
+
+// NewGaugeMetric creates a new GaugeMetric
+func NewGaugeMetric() *GaugeMetric {
+	return &GaugeMetric{
+		groupedMetric: newGroupedMetric(GaugeAggregation, func() accumulator { return NewGauge() }),
+	}
+}
+
+// Gauge is a thread-safe last value of the samples received between 2 flushes
+type Gauge struct {
+	value     float64
+	timestamp int64
+	mu        sync.Mutex
+}
+
+// NewGauge creates a new Gauge
+func NewGauge() *Gauge {
+	return &Gauge{}
+}
+
+// AddSample sets the gauge value. As logs might come out of order, samples older than the current value are ignored
+func (g *Gauge) AddSample(sample *MetricSample) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if sample.Timestamp >= g.timestamp {
+		g.value = sample.Value
+		g.timestamp = sample.Timestamp
+	}
+}
+
+// Merge keeps the most recent value of both Gauge
+func (g *Gauge) Merge(other accumulator) {
+	o, ok := other.(*Gauge)
+	if !ok {
+		return
+	}
+	o.mu.Lock()
+	value, timestamp := o.value, o.timestamp
+	o.mu.Unlock()
+	g.AddSample(&MetricSample{Value: value, Timestamp: timestamp})
+}
+
+// Rank returns the current gauge value
+func (g *Gauge) Rank() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
+
+// Flush returns the gauge value and clears it
+func (g *Gauge) Flush() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	val := g.value
+	g.value, g.timestamp = 0, 0
+	return val
+}
@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// HeavyHitter is a key tracked by HeavyHitters, with its estimated count and the maximum overestimation of that count
+type HeavyHitter struct {
+	Key   string
+	Count float64
+	Error float64
+	index int // index in the heap
+}
+
+// HeavyHitters finds the most frequent keys of a stream using the Space-Saving algorithm
+// (https://www.cs.ucsb.edu/sites/default/files/documents/2005-23.pdf): it tracks at most capacity keys and, when full,
+// replaces the key with the lowest count. Any key whose count is higher than total/capacity is guaranteed to be tracked.
+// Ties are broken by key so that the result does not depend on map ordering. Keys ranked by a value that is not a sum,
+// e.g. a maximum, are offered with their value instead, and only replace the lowest one if their value is higher.
+// HeavyHitters is not thread-safe.
+type HeavyHitters struct {
+	capacity int
+	counters map[string]*HeavyHitter
+	heap     heavyHitterHeap
+}
+
+// NewHeavyHitters creates a new HeavyHitters that tracks at most capacity keys
+func NewHeavyHitters(capacity int) *HeavyHitters {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &HeavyHitters{
+		capacity: capacity,
+		counters: make(map[string]*HeavyHitter),
+	}
+}
+
+// Add adds weight occurrences of the key. It returns the key it replaced, if any
+func (h *HeavyHitters) Add(key string, weight float64) *HeavyHitter {
+	if counter, ok := h.counters[key]; ok {
+		counter.Count += weight
+		heap.Fix(&h.heap, counter.index)
+		return nil
+	}
+	if len(h.counters) < h.capacity {
+		h.push(key, weight)
+		return nil
+	}
+	// replace the key with the lowest count, the new key might have been seen up to that many times
+	lowest := h.heap[0]
+	return h.replace(lowest, key, lowest.Count+weight, lowest.Count)
+}
+
+// Offer sets the count of the key if it is tracked. Otherwise, the key is tracked if there is room, or if its count is
+// higher than the lowest one, whose key it replaces. It returns whether the key is tracked, and the key it replaced if any
+func (h *HeavyHitters) Offer(key string, count float64) (bool, *HeavyHitter) {
+	if counter, ok := h.counters[key]; ok {
+		counter.Count = count
+		heap.Fix(&h.heap, counter.index)
+		return true, nil
+	}
+	if len(h.counters) < h.capacity {
+		h.push(key, count)
+		return true, nil
+	}
+	if lowest := h.heap[0]; count > lowest.Count {
+		return true, h.replace(lowest, key, count, 0)
+	}
+	return false, nil
+}
+
+// Contains returns true if the key is tracked
+func (h *HeavyHitters) Contains(key string) bool {
+	_, ok := h.counters[key]
+	return ok
+}
+
+// push is a helper function that tracks a new key
+func (h *HeavyHitters) push(key string, count float64) {
+	counter := &HeavyHitter{Key: key, Count: count}
+	h.counters[key] = counter
+	heap.Push(&h.heap, counter)
+}
+
+// replace is a helper function that replaces the key of the counter, and returns a copy of the replaced one
+func (h *HeavyHitters) replace(counter *HeavyHitter, key string, count, overestimation float64) *HeavyHitter {
+	replaced := &HeavyHitter{Key: counter.Key, Count: counter.Count, Error: counter.Error}
+	delete(h.counters, counter.Key)
+	counter.Key, counter.Count, counter.Error = key, count, overestimation
+	h.counters[key] = counter
+	heap.Fix(&h.heap, counter.index)
+	return replaced
+}
+
+// Merge adds the counts of the keys tracked by another HeavyHitters, without modifying it
+func (h *HeavyHitters) Merge(other *HeavyHitters) {
+	for _, counter := range other.Top(-1) {
+		h.Add(counter.Key, counter.Count)
+	}
+}
+
+// Top returns up to n keys with the highest counts, in decreasing order of count and increasing order of key on ties
+func (h *HeavyHitters) Top(n int) []*HeavyHitter {
+	top := make([]*HeavyHitter, 0, len(h.counters))
+	for _, counter := range h.counters {
+		top = append(top, &HeavyHitter{Key: counter.Key, Count: counter.Count, Error: counter.Error})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Key < top[j].Key
+	})
+	if n >= 0 && n < len(top) {
+		top = top[:n]
+	}
+	return top
+}
+
+// heavyHitterHeap is a min-heap of HeavyHitter by count. On ties, the greatest key is the first to be evicted
+type heavyHitterHeap []*HeavyHitter
+
+func (h heavyHitterHeap) Len() int { return len(h) }
+
+func (h heavyHitterHeap) Less(i, j int) bool {
+	if h[i].Count != h[j].Count {
+		return h[i].Count < h[j].Count
+	}
+	return h[i].Key > h[j].Key
+}
+
+func (h heavyHitterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *heavyHitterHeap) Push(x interface{}) {
+	counter := x.(*HeavyHitter)
+	counter.index = len(*h)
+	*h = append(*h, counter)
+}
+
+func (h *heavyHitterHeap) Pop() interface{} {
+	old := *h
+	counter := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return counter
+}
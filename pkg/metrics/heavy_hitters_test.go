@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHeavyHitters(t *testing.T) {
+	h := NewHeavyHitters(3)
+	for _, key := range []string{"a", "b", "a", "c", "b", "a"} {
+		h.Add(key, 1)
+	}
+	assert.Equal(t, []*HeavyHitter{
+		{Key: "a", Count: 3},
+		{Key: "b", Count: 2},
+		{Key: "c", Count: 1},
+	}, h.Top(-1))
+	assert.Equal(t, 2, len(h.Top(2)))
+
+	// "d" replaces "c", the key with the lowest count, and inherits its count as error
+	h.Add("d", 1)
+	assert.Equal(t, []*HeavyHitter{
+		{Key: "a", Count: 3},
+		{Key: "b", Count: 2},
+		{Key: "d", Count: 2, Error: 1},
+	}, h.Top(-1))
+}
+
+func TestHeavyHitters_Offer(t *testing.T) {
+	h := NewHeavyHitters(2)
+	for _, key := range []string{"a", "b"} {
+		tracked, replaced := h.Offer(key, 10)
+		assert.True(t, tracked)
+		assert.Nil(t, replaced)
+	}
+	// a tracked key takes the offered value, even if lower
+	tracked, _ := h.Offer("a", 5)
+	assert.True(t, tracked)
+	// a new key only replaces the lowest one if it ranks higher
+	tracked, replaced := h.Offer("c", 5)
+	assert.False(t, tracked)
+	assert.Nil(t, replaced)
+	assert.False(t, h.Contains("c"))
+	tracked, replaced = h.Offer("c", 20)
+	assert.True(t, tracked)
+	assert.Equal(t, &HeavyHitter{Key: "a", Count: 5}, replaced)
+	assert.Equal(t, []*HeavyHitter{{Key: "c", Count: 20}, {Key: "b", Count: 10}}, h.Top(-1))
+
+	// Add returns the key it replaced
+	assert.Equal(t, &HeavyHitter{Key: "b", Count: 10}, h.Add("d", 1))
+	assert.Nil(t, h.Add("d", 1))
+}
+
+func TestHeavyHitters_Ties(t *testing.T) {
+	// ties are broken by key, whatever the insertion order
+	for _, keys := range [][]string{{"b", "c", "a"}, {"c", "a", "b"}} {
+		h := NewHeavyHitters(10)
+		for _, key := range keys {
+			h.Add(key, 5)
+		}
+		top := h.Top(2)
+		assert.Equal(t, "a", top[0].Key)
+		assert.Equal(t, "b", top[1].Key)
+	}
+}
+
+func TestHeavyHitters_Merge(t *testing.T) {
+	h, other := NewHeavyHitters(10), NewHeavyHitters(10)
+	for _, key := range []string{"a", "b", "a"} {
+		h.Add(key, 1)
+	}
+	for _, key := range []string{"b", "b", "c"} {
+		other.Add(key, 1)
+	}
+	h.Merge(other)
+	assert.Equal(t, []*HeavyHitter{
+		{Key: "b", Count: 3},
+		{Key: "a", Count: 2},
+		{Key: "c", Count: 1},
+	}, h.Top(-1))
+	// the other HeavyHitters is not modified
+	assert.Equal(t, 2, len(other.Top(-1)))
+}
+
+func TestHeavyHitters_HighCardinality(t *testing.T) {
+	h := NewHeavyHitters(50)
+	// a long tail of 10000 keys seen once, and 5 heavy hitters seen 1000 times each
+	for ii := 0; ii < 10000; ii++ {
+		h.Add(fmt.Sprintf("tail-%d", ii), 1)
+		if ii%10 == 0 {
+			for jj := 0; jj < 5; jj++ {
+				h.Add(fmt.Sprintf("heavy-%d", jj), 1)
+			}
+		}
+	}
+	top := h.Top(5)
+	for ii, hitter := range top {
+		assert.Equal(t, fmt.Sprintf("heavy-%d", ii), hitter.Key)
+		assert.GreaterOrEqual(t, hitter.Count, float64(1000))
+	}
+}
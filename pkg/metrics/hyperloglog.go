@@ -0,0 +1,183 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// DefaultHyperLogLogPrecision is the precision of a HyperLogLog created with NewDefaultHyperLogLog.
+// It uses 2^12 registers (4KB) for a standard error of 1.04/sqrt(2^12) ~= 1.6%
+const DefaultHyperLogLogPrecision = 12
+
+// HyperLogLog estimates the number of distinct values added to it, as described in
+// http://algo.inria.fr/flajolet/Publications/FlFuGaMe07.pdf. Two HyperLogLog with the same precision can be merged.
+// HyperLogLog is not thread-safe.
+type HyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+// NewHyperLogLog creates a new HyperLogLog with 2^precision registers. The precision must be in [4, 18]
+func NewHyperLogLog(precision uint8) *HyperLogLog {
+	if precision < 4 || precision > 18 {
+		precision = DefaultHyperLogLogPrecision
+	}
+	return &HyperLogLog{
+		precision: precision,
+		registers: make([]uint8, 1<<precision),
+	}
+}
+
+// NewDefaultHyperLogLog creates a new HyperLogLog with the DefaultHyperLogLogPrecision
+func NewDefaultHyperLogLog() *HyperLogLog {
+	return NewHyperLogLog(DefaultHyperLogLogPrecision)
+}
+
+// Add adds a value to the HyperLogLog
+func (h *HyperLogLog) Add(value string) {
+	h.add(value)
+}
+
+// add adds a value to the HyperLogLog, and returns true if it changed a register, i.e. the estimate
+func (h *HyperLogLog) add(value string) bool {
+	hash := hashString(value)
+	index := hash >> (64 - h.precision)
+	// rank of the first set bit in the remaining bits. The sentinel bit caps it when they are all zeros
+	remaining := hash<<h.precision | 1<<(h.precision-1)
+	rank := uint8(bits.LeadingZeros64(remaining)) + 1
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+		return true
+	}
+	return false
+}
+
+// Merge merges the other HyperLogLog into this one. Both must have the same precision.
+func (h *HyperLogLog) Merge(other *HyperLogLog) error {
+	if other == nil {
+		return nil
+	}
+	if h.precision != other.precision {
+		return fmt.Errorf("cannot merge hyperloglogs with precisions %d and %d", h.precision, other.precision)
+	}
+	for ii, rank := range other.registers {
+		if rank > h.registers[ii] {
+			h.registers[ii] = rank
+		}
+	}
+	return nil
+}
+
+// Copy returns a deep copy of the HyperLogLog
+func (h *HyperLogLog) Copy() *HyperLogLog {
+	c := NewHyperLogLog(h.precision)
+	copy(c.registers, h.registers)
+	return c
+}
+
+// Estimate returns the estimated number of distinct values added to the HyperLogLog
+func (h *HyperLogLog) Estimate() int64 {
+	m := float64(len(h.registers))
+	var sum float64
+	var zeros int
+	for _, rank := range h.registers {
+		sum += 1 / float64(uint64(1)<<rank)
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := alpha(m) * m * m / sum
+	// small range correction: linear counting is more accurate while there are empty registers
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(estimate))
+}
+
+// MarshalBinary encodes the precision and the non empty registers of the HyperLogLog, as the difference with the index of
+// the previous one and their rank
+func (h *HyperLogLog) MarshalBinary() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	var b [binary.MaxVarintLen64]byte
+	buf.WriteByte(h.precision)
+	var nonEmpty uint64
+	for _, rank := range h.registers {
+		if rank > 0 {
+			nonEmpty++
+		}
+	}
+	buf.Write(b[:binary.PutUvarint(b[:], nonEmpty)])
+	previous := 0
+	for ii, rank := range h.registers {
+		if rank > 0 {
+			buf.Write(b[:binary.PutUvarint(b[:], uint64(ii-previous))])
+			buf.WriteByte(rank)
+			previous = ii
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a HyperLogLog encoded with MarshalBinary into this one, replacing its registers
+func (h *HyperLogLog) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	precision, err := r.ReadByte()
+	if err != nil || precision < 4 || precision > 18 {
+		return fmt.Errorf("cannot decode hyperloglog: invalid precision")
+	}
+	decoded := NewHyperLogLog(precision)
+	nonEmpty, err := binary.ReadUvarint(r)
+	index := uint64(0)
+	for ii := uint64(0); ii < nonEmpty && err == nil; ii++ {
+		var delta uint64
+		var rank byte
+		if delta, err = binary.ReadUvarint(r); err != nil {
+			break
+		}
+		if rank, err = r.ReadByte(); err != nil {
+			break
+		}
+		index += delta
+		if index >= uint64(len(decoded.registers)) {
+			return fmt.Errorf("cannot decode hyperloglog: register %d out of range", index)
+		}
+		decoded.registers[index] = rank
+	}
+	if err != nil {
+		return fmt.Errorf("cannot decode hyperloglog: %w", err)
+	}
+	*h = *decoded
+	return nil
+}
+
+// alpha is the bias correction constant of HyperLogLog for m registers
+func alpha(m float64) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	default:
+		return 0.7213 / (1 + 1.079/m)
+	}
+}
+
+// hashString is a helper function that hashes a string into 64 well distributed bits.
+// FNV-1a is finalized with the murmur3 mixer, as FNV alone does not spread similar inputs (e.g. IPs) well enough
+func hashString(value string) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(value))
+	hash := hasher.Sum64()
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
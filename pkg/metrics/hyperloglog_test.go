@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestHyperLogLog_Estimate(t *testing.T) {
+	for _, distinct := range []int{0, 1, 10, 1000, 100000} {
+		t.Run(fmt.Sprintf("test hyperloglog estimate with %d distinct values", distinct), func(t *testing.T) {
+			hll := NewDefaultHyperLogLog()
+			for ii := 0; ii < distinct; ii++ {
+				ip := fmt.Sprintf("10.%d.%d.%d", ii>>16&0xff, ii>>8&0xff, ii&0xff)
+				// duplicates must not change the estimate
+				hll.Add(ip)
+				hll.Add(ip)
+			}
+			assertWithinHyperLogLogError(t, int64(distinct), hll.Estimate())
+		})
+	}
+}
+
+func TestHyperLogLog_Merge(t *testing.T) {
+	first, second, all := NewDefaultHyperLogLog(), NewDefaultHyperLogLog(), NewDefaultHyperLogLog()
+	for ii := 0; ii < 3000; ii++ {
+		value := fmt.Sprintf("value-%d", ii)
+		all.Add(value)
+		// both halves share a third of their values
+		if ii < 2000 {
+			first.Add(value)
+		}
+		if ii >= 1000 {
+			second.Add(value)
+		}
+	}
+	merged := first.Copy()
+	assert.NoError(t, merged.Merge(second))
+	assert.Equal(t, all.Estimate(), merged.Estimate())
+	assertWithinHyperLogLogError(t, 3000, merged.Estimate())
+	// merging does not modify the copied HyperLogLog
+	assert.Equal(t, first.Estimate(), first.Copy().Estimate())
+	assert.Error(t, merged.Merge(NewHyperLogLog(10)))
+}
+
+func TestHyperLogLog_MarshalBinary(t *testing.T) {
+	hll := NewHyperLogLog(10)
+	for ii := 0; ii < 500; ii++ {
+		hll.Add(fmt.Sprintf("value-%d", ii))
+	}
+	data, err := hll.MarshalBinary()
+	assert.NoError(t, err)
+	decoded := NewDefaultHyperLogLog()
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Equal(t, hll, decoded)
+
+	empty, err := NewDefaultHyperLogLog().MarshalBinary()
+	assert.NoError(t, err)
+	assert.NoError(t, decoded.UnmarshalBinary(empty))
+	assert.EqualValues(t, 0, decoded.Estimate())
+	assert.Error(t, decoded.UnmarshalBinary(data[:len(data)-1]))
+}
+
+func TestCardinalityMetric(t *testing.T) {
+	m := NewMetric(CardinalityAggregation, 10)
+	_, err := m.Flush(aFlushTime)
+	assert.Error(t, err)
+	for ii := 0; ii < 100; ii++ {
+		tag := section1Tag
+		if ii%2 == 0 {
+			tag = section2Tag
+		}
+		assert.NoError(t, m.AddSample(&MetricSample{
+			Name:        "unique_ips",
+			Aggregation: CardinalityAggregation,
+			Value:       1,
+			UniqueValue: fmt.Sprintf("10.0.0.%d", ii%20),
+			Timestamp:   100,
+			Tags:        []*Tag{tag},
+		}))
+	}
+	got, err := m.Flush(aFlushTime)
+	assert.NoError(t, err)
+	assert.Equal(t, CardinalityAggregation, got.GetAggregation())
+	assert.Equal(t, float64(20), got.Value)
+	val, err := got.GetValue(section1Tag)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(10), val)
+
+	// merge across tags
+	section1, err := got.getGroup(section1Tag)
+	assert.NoError(t, err)
+	section2, err := got.getGroup(section2Tag)
+	assert.NoError(t, err)
+	assert.NoError(t, section1.Merge(section2))
+	assert.Equal(t, float64(20), section1.Value)
+}
+
+func TestWindowCardinalityMetric(t *testing.T) {
+	m := NewWindowCardinalityMetric(2)
+	_, err := m.Flush(aFlushTime)
+	assert.Error(t, err)
+	for ii, value := range []string{"a", "b", "a", "c"} {
+		assert.NoError(t, m.AddSample(&MetricSample{UniqueValue: value, Timestamp: int64(100 + ii)}))
+	}
+	got, err := m.Flush(103)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(3), got.Value)
+	// only "a" at 102 and "c" at 103 are left in the window
+	got, err = m.Flush(104)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(2), got.Value)
+}
+
+// assertWithinHyperLogLogError is a helper function that checks that got is within 3 standard errors of want
+func assertWithinHyperLogLogError(t *testing.T, want, got int64) {
+	standardError := 1.04 / math.Sqrt(float64(int(1)<<DefaultHyperLogLogPrecision))
+	assert.LessOrEqualf(t, math.Abs(float64(got-want)), 3*standardError*float64(want), "expected %d to be close to %d", got, want)
+}
@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/ebarti/dd-assignment/pkg/errors"
+	"math"
+	"sort"
+	"strconv"
 )
 
 // Metric defines an interface that a metric must implement.
@@ -14,10 +17,21 @@ type Metric interface {
 
 // ComputedMetric is a struct that contains the computed metric, generated after a flush.
 type ComputedMetric struct {
-	Name      string
-	Timestamp int64
-	Value     int64
-	Groups    []*ComputedMetric
+	Name        string
+	Aggregation AggregationType // only set on the top level metric, defaults to CountAggregation
+	Timestamp   int64
+	Value       float64
+	Values      map[string]float64 // named values of distributions, e.g. count, avg or p99. Value holds the count
+	Sketch      *DDSketch          // sketch of distributions, used to merge them
+	HyperLogLog *HyperLogLog       // registers of cardinality metrics, used to merge them
+	Tags        []*Tag             // tags of a series
+	Groups      []*ComputedMetric
+	Series      []*ComputedMetric // one per combination of tags, sorted by name
+	TopSeries   []*ComputedMetric // top N series by rank followed by an OtherGroupName series, set if the metric keeps its top N
+
+	acc            accumulator        // accumulator of a series, used to aggregate series
+	newAccumulator func() accumulator // creates the accumulators used to aggregate series
+	derivation     *derivation        // formula and metrics a derived metric was computed from, used to query it
 }
 
 // Equals returns true if the two computed metrics are equal.
@@ -25,19 +39,50 @@ func (c *ComputedMetric) Equals(other *ComputedMetric) bool {
 	if c.Name != other.Name {
 		return false
 	}
+	if c.GetAggregation() != other.GetAggregation() {
+		return false
+	}
 	if c.Timestamp != other.Timestamp {
 		return false
 	}
 	if c.Value != other.Value {
 		return false
 	}
+	if len(c.Values) != len(other.Values) {
+		return false
+	}
+	for name, value := range c.Values {
+		if otherValue, ok := other.Values[name]; !ok || otherValue != value {
+			return false
+		}
+	}
 	if len(c.Groups) != len(other.Groups) {
 		return false
 	}
 
-	for _, group := range c.Groups {
+	if len(c.Series) != len(other.Series) {
+		return false
+	}
+	if len(c.Tags) != len(other.Tags) || TagSetKey(c.Tags) != TagSetKey(other.Tags) {
+		return false
+	}
+	if len(c.TopSeries) != len(other.TopSeries) {
+		return false
+	}
+	// the top series are ranked, so their order matters
+	for ii, topSeries := range c.TopSeries {
+		if !topSeries.Equals(other.TopSeries[ii]) {
+			return false
+		}
+	}
+	return containsAll(c.Groups, other.Groups) && containsAll(c.Series, other.Series)
+}
+
+// containsAll is a helper function that returns true if every computed metric has an equal one in others
+func containsAll(computedMetrics []*ComputedMetric, others []*ComputedMetric) bool {
+	for _, group := range computedMetrics {
 		found := false
-		for _, otherGroup := range other.Groups {
+		for _, otherGroup := range others {
 			if group.Equals(otherGroup) {
 				found = true
 				break
@@ -47,47 +92,226 @@ func (c *ComputedMetric) Equals(other *ComputedMetric) bool {
 			return false
 		}
 	}
-
 	return true
 }
 
 // Render writes the string representation of the computed metric on the provided buffer.
 func (c *ComputedMetric) Render(buf *bytes.Buffer) {
-	fmt.Fprintf(buf, "Metric %s count: %d", c.Name, c.Value)
+	fmt.Fprintf(buf, "Metric %s %s: %s", c.Name, c.GetAggregation(), FormatValue(c.Value))
+	renderValues(buf, c.Values)
 	for _, group := range c.Groups {
-		fmt.Fprintf(buf, "\n\tWith tag name %s: %d", group.Name, group.Value)
+		fmt.Fprintf(buf, "\n\tWith tag name %s: %s", group.Name, FormatValue(group.Value))
+		renderValues(buf, group.Values)
 		for _, subGroup := range group.Groups {
-			fmt.Fprintf(buf, "\n\t\t%s: %d", subGroup.Name, subGroup.Value)
+			fmt.Fprintf(buf, "\n\t\t%s: %s", subGroup.Name, FormatValue(subGroup.Value))
+			renderValues(buf, subGroup.Values)
+		}
+	}
+	// series are only worth rendering if they combine several tags, otherwise they are the tag values above
+	if !c.hasMultiTagSeries() {
+		return
+	}
+	buf.WriteString("\n\tBy tag combination:")
+	renderedSeries := c.Series
+	if len(c.TopSeries) > 0 {
+		renderedSeries = c.TopSeries
+	}
+	for _, series := range renderedSeries {
+		name := series.Name
+		if name == "" {
+			name = "(no tags)"
+		}
+		fmt.Fprintf(buf, "\n\t\t%s: %s", name, FormatValue(series.Value))
+		renderValues(buf, series.Values)
+	}
+}
+
+// hasMultiTagSeries returns true if any of the series of the computed metric has more than one tag
+func (c *ComputedMetric) hasMultiTagSeries() bool {
+	for _, series := range c.Series {
+		if len(series.Tags) > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// renderValues is a helper function that writes the named values, if any, as " {count: 3, sum: 6, ...}"
+func renderValues(buf *bytes.Buffer, values map[string]float64) {
+	if len(values) == 0 {
+		return
+	}
+	buf.WriteString(" {")
+	for ii, name := range sortedValueNames(values) {
+		if ii > 0 {
+			buf.WriteString(", ")
 		}
+		fmt.Fprintf(buf, "%s: %s", name, FormatValue(values[name]))
 	}
+	buf.WriteRune('}')
+}
+
+// FormatValue formats a metric value with up to 3 decimals and without trailing zeros, so that integers render as such
+func FormatValue(value float64) string {
+	return strconv.FormatFloat(math.Round(value*1000)/1000, 'f', -1, 64)
+}
+
+// sortedValueNames returns the value names in rendering order: count, sum, min, max and avg, then the percentiles in increasing order
+func sortedValueNames(values map[string]float64) []string {
+	order := map[string]int{CountValue: 0, SumValue: 1, MinValue: 2, MaxValue: 3, AvgValue: 4}
+	for ii, p := range DefaultPercentiles {
+		order[PercentileValueName(p)] = len(order) + ii
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		iOrder, iKnown := order[names[i]]
+		jOrder, jKnown := order[names[j]]
+		if iKnown && jKnown {
+			return iOrder < jOrder
+		}
+		if iKnown != jKnown {
+			return iKnown
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// GetAggregation returns the aggregation type of the computed metric.
+func (c *ComputedMetric) GetAggregation() AggregationType {
+	if c.Aggregation == "" {
+		return CountAggregation
+	}
+	return c.Aggregation
 }
 
 // GetValue returns the value of the computed metric.
-func (c *ComputedMetric) GetValue(tag *Tag) (int64, error) {
+func (c *ComputedMetric) GetValue(tag *Tag) (float64, error) {
+	return c.GetNamedValue(tag, "")
+}
+
+// GetNamedValue returns a named value of the computed metric, e.g. "p99" for distributions. An empty name returns its value.
+func (c *ComputedMetric) GetNamedValue(tag *Tag, name string) (float64, error) {
+	group, err := c.getGroup(tag)
+	if err != nil {
+		return 0, err
+	}
+	if name == "" {
+		return group.Value, nil
+	}
+	value, ok := group.Values[name]
+	if !ok {
+		return 0, errors.NewUnknownMetricValueError(c.Name, name)
+	}
+	return value, nil
+}
+
+// getGroup returns the computed metric for the given tag: the whole metric if the tag is nil,
+// the tag group if the tag has no value, or the tag value group otherwise.
+func (c *ComputedMetric) getGroup(tag *Tag) (*ComputedMetric, error) {
 	if tag == nil {
-		return c.Value, nil
+		return c, nil
 	}
 	for _, group := range c.Groups {
 		if group.Name == tag.Name {
 			if tag.Value == "" {
-				return group.Value, nil
+				return group, nil
 			}
 			for _, tagGroup := range group.Groups {
 				if tagGroup.Name == tag.Value {
-					return tagGroup.Value, nil
+					return tagGroup, nil
 				}
 			}
 		}
 	}
-	return 0, errors.NewCouldNotComputeMetricForTagError(tag.Name, tag.Value)
+	return nil, errors.NewCouldNotComputeMetricForTagError(tag.Name, tag.Value)
+}
+
+// Query returns the metric aggregated over the series that have all the given tags, e.g. section:api and status:500.
+// A tag without value matches the series with that tag name, whatever their value. It returns error if no series matches.
+// Derived metrics evaluate their formula on the queried metrics they were computed from.
+func (c *ComputedMetric) Query(tags ...*Tag) (*ComputedMetric, error) {
+	if c.derivation != nil {
+		return c.derivation.query(c, tags)
+	}
+	var matching []*ComputedMetric
+	for _, series := range c.Series {
+		if series.hasTags(tags) {
+			matching = append(matching, series)
+		}
+	}
+	if len(matching) == 0 || c.newAccumulator == nil {
+		return nil, errors.NewNoMatchingSeriesError(c.Name, TagSetKey(tags))
+	}
+	queried := &ComputedMetric{
+		Name:        c.Name,
+		Aggregation: c.Aggregation,
+		Timestamp:   c.Timestamp,
+		Tags:        sortedTags(tags),
+	}
+	flushAccumulator(c.mergeSeries(matching), queried)
+	return queried, nil
+}
+
+// hasTags returns true if the series has all the given tags. Tags without value only need to match the tag name
+func (c *ComputedMetric) hasTags(tags []*Tag) bool {
+	for _, tag := range tags {
+		found := false
+		for _, seriesTag := range c.Tags {
+			if seriesTag.Name == tag.Name && (tag.Value == "" || seriesTag.Value == tag.Value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeSeries is a helper function that merges the accumulators of the given series into a new accumulator
+func (c *ComputedMetric) mergeSeries(series []*ComputedMetric) accumulator {
+	acc := c.newAccumulator()
+	for _, s := range series {
+		acc.Merge(s.acc)
+	}
+	return acc
+}
+
+// Merge merges the other distribution or cardinality metric into this one, recomputing its values.
+// Only distributions and cardinality metrics can be merged.
+func (c *ComputedMetric) Merge(other *ComputedMetric) error {
+	switch {
+	case c.Sketch != nil && other.Sketch != nil:
+		if err := c.Sketch.Merge(other.Sketch); err != nil {
+			return err
+		}
+		c.Values = c.Sketch.Summary()
+		c.Value = c.Values[CountValue]
+	case c.HyperLogLog != nil && other.HyperLogLog != nil:
+		if err := c.HyperLogLog.Merge(other.HyperLogLog); err != nil {
+			return err
+		}
+		c.Value = float64(c.HyperLogLog.Estimate())
+	default:
+		return errors.NewUnmergeableMetricError(c.Name)
+	}
+	return nil
 }
 
 // MetricSample represents a metric extracted from a log.
 type MetricSample struct {
-	Name      string
-	Tags      []*Tag
-	Value     int64
-	Timestamp int64
+	Name        string
+	Aggregation AggregationType
+	Tags        []*Tag
+	Value       float64
+	UniqueValue string // value counted by cardinality metrics
+	TopN        int    // number of tag values and series kept by the aggregated metric, 0 keeps all of them
+	Timestamp   int64
 }
 
 // Tag represents a tag name and its value for a given log.
@@ -57,7 +57,7 @@ var computedMetricSample = &ComputedMetric{
 func TestComputedMetric_GetValue(t *testing.T) {
 	tests := []struct {
 		tag     *Tag
-		want    int64
+		want    float64
 		wantErr bool
 	}{
 		{
@@ -216,6 +216,40 @@ func TestComputedMetric_Equals(t *testing.T) {
 	assert.False(t, computedMetricSample1.Equals(computedMetricSample2))
 }
 
+func TestComputedMetric_EqualsAggregationAndTopSeries(t *testing.T) {
+	newComputedMetric := func() *ComputedMetric {
+		return &ComputedMetric{
+			Name:      "test",
+			Timestamp: 1641308532,
+			Value:     12,
+			TopSeries: []*ComputedMetric{
+				{Name: "host:host1", Timestamp: 1641308532, Value: 8},
+				{Name: OtherGroupName, Timestamp: 1641308532, Value: 4},
+			},
+		}
+	}
+	computedMetric, other := newComputedMetric(), newComputedMetric()
+	assert.True(t, computedMetric.Equals(other))
+
+	// an unset aggregation is a count
+	other.Aggregation = CountAggregation
+	assert.True(t, computedMetric.Equals(other))
+	other.Aggregation = SumAggregation
+	assert.False(t, computedMetric.Equals(other))
+	other.Aggregation = ""
+
+	other.TopSeries[0].Value = 7
+	assert.False(t, computedMetric.Equals(other))
+	other.TopSeries[0].Value = 8
+
+	// the top series are ranked, so their order matters
+	other.TopSeries[0], other.TopSeries[1] = other.TopSeries[1], other.TopSeries[0]
+	assert.False(t, computedMetric.Equals(other))
+
+	other.TopSeries = other.TopSeries[:1]
+	assert.False(t, computedMetric.Equals(other))
+}
+
 func TestComputedMetric_Render(t *testing.T) {
 	var buf bytes.Buffer
 	computedMetricSample.Render(&buf)
@@ -224,3 +258,79 @@ func TestComputedMetric_Render(t *testing.T) {
 	fmt.Println(buf.String())
 	assert.Equal(t, expected, buf.String())
 }
+
+var status200Tag = &Tag{Name: "status", Value: "200"}
+var status500Tag = &Tag{Name: "status", Value: "500"}
+
+var multiTaggedMetricSamples = []*MetricSample{
+	{Name: "a_metric", Value: 10, Timestamp: 100, Tags: []*Tag{section1Tag, status200Tag}},
+	{Name: "a_metric", Value: 20, Timestamp: 101, Tags: []*Tag{status200Tag, section1Tag}}, // tag order does not matter
+	{Name: "a_metric", Value: 30, Timestamp: 101, Tags: []*Tag{section1Tag, status500Tag}},
+	{Name: "a_metric", Value: 40, Timestamp: 102, Tags: []*Tag{section2Tag, status500Tag}},
+	{Name: "a_metric", Value: 50, Timestamp: 103, Tags: []*Tag{section2Tag}},
+}
+
+func TestComputedMetric_Query(t *testing.T) {
+	tests := []struct {
+		aggregation AggregationType
+		tags        []*Tag
+		want        float64
+		wantErr     bool
+	}{
+		{aggregation: SumAggregation, tags: nil, want: 150},
+		{aggregation: SumAggregation, tags: []*Tag{section1Tag, status500Tag}, want: 30},
+		{aggregation: SumAggregation, tags: []*Tag{status500Tag, section1Tag}, want: 30},
+		{aggregation: SumAggregation, tags: []*Tag{section1Tag}, want: 60},
+		{aggregation: SumAggregation, tags: []*Tag{{Name: "status"}}, want: 100},
+		{aggregation: SumAggregation, tags: []*Tag{section2Tag, {Name: "status"}}, want: 40},
+		{aggregation: SumAggregation, tags: []*Tag{section2Tag, status200Tag}, wantErr: true},
+		{aggregation: AvgAggregation, tags: []*Tag{section1Tag}, want: 20},
+		{aggregation: AvgAggregation, tags: []*Tag{status500Tag}, want: 35},
+		{aggregation: MaxAggregation, tags: []*Tag{section1Tag, status200Tag}, want: 20},
+		{aggregation: GaugeAggregation, tags: []*Tag{section2Tag}, want: 50},
+		{aggregation: DistributionAggregation, tags: []*Tag{status500Tag}, want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("test %s query for tags %s", tt.aggregation, TagSetKey(tt.tags)), func(t *testing.T) {
+			m := NewMetric(tt.aggregation, 10)
+			for _, sample := range multiTaggedMetricSamples {
+				assert.NoError(t, m.AddSample(sample))
+			}
+			computed, err := m.Flush(aFlushTime)
+			assert.NoError(t, err)
+			assert.Equal(t, 4, len(computed.Series))
+			got, err := computed.Query(tt.tags...)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got.Value)
+			assert.Equal(t, TagSetKey(tt.tags), TagSetKey(got.Tags))
+		})
+	}
+	// computed metrics that were not flushed by a metric cannot be queried
+	_, err := computedMetricSample.Query(host1Tag)
+	assert.Error(t, err)
+}
+
+func TestComputedMetric_RenderSeries(t *testing.T) {
+	m := NewSumMetric()
+	for _, sample := range multiTaggedMetricSamples {
+		assert.NoError(t, m.AddSample(sample))
+	}
+	computed, err := m.Flush(aFlushTime)
+	assert.NoError(t, err)
+	computed.Name = "test"
+	var buf bytes.Buffer
+	computed.Render(&buf)
+	expected := "Metric test sum: 150" +
+		"\n\tWith tag name http.path.section: 150\n\t\tsection1: 60\n\t\tsection2: 90" +
+		"\n\tWith tag name status: 100\n\t\t200: 30\n\t\t500: 70" +
+		"\n\tBy tag combination:" +
+		"\n\t\thttp.path.section:section1,status:200: 30" +
+		"\n\t\thttp.path.section:section1,status:500: 30" +
+		"\n\t\thttp.path.section:section2: 50" +
+		"\n\t\thttp.path.section:section2,status:500: 40"
+	assert.Equal(t, expected, buf.String())
+}
@@ -1,15 +1,18 @@
 package metrics
 
 import (
+	"github.com/ebarti/dd-assignment/pkg/common"
 	"github.com/ebarti/dd-assignment/pkg/logs"
 	"sync/atomic"
 )
 
-// MetricsPipeline is a pipeline that computes metrics based on logs.ProcessedLog
+// MetricsPipeline is a pipeline that computes metrics based on batches of logs.ProcessedLog. It outputs the samples of
+// all the logs of a batch together, in the order of the logs.
 type MetricsPipeline struct {
-	inputChan     chan *logs.ProcessedLog
+	inputChan     chan []*logs.ProcessedLog
 	OutputChan    chan []*MetricSample
 	customMetrics []*CustomMetricPipeline
+	telemetry     common.Telemetry
 	done          chan struct{}
 	isDone        uint32
 }
@@ -17,18 +20,30 @@ type MetricsPipeline struct {
 // NewMetricsPipeline creates a new MetricsPipeline
 func NewMetricsPipeline(customMetrics []*CustomMetricPipeline) *MetricsPipeline {
 	return &MetricsPipeline{
-		inputChan:     make(chan *logs.ProcessedLog),
-		OutputChan:    make(chan []*MetricSample),
+		inputChan:     make(chan []*logs.ProcessedLog),
+		OutputChan:    make(chan []*MetricSample, common.DefaultBufferSize),
 		customMetrics: customMetrics,
 		done:          make(chan struct{}),
 	}
 }
 
 // From is used to set the input channel for the MetricsPipeline
-func (m *MetricsPipeline) From(inputChan chan *logs.ProcessedLog) {
+func (m *MetricsPipeline) From(inputChan chan []*logs.ProcessedLog) {
 	m.inputChan = inputChan
 }
 
+// WithBufferSize sets the number of batches its output channel can hold. It replaces the output channel.
+func (m *MetricsPipeline) WithBufferSize(n int) *MetricsPipeline {
+	m.OutputChan = make(chan []*MetricSample, n)
+	return m
+}
+
+// WithTelemetry makes the MetricsPipeline record its internal metrics to the Telemetry.
+func (m *MetricsPipeline) WithTelemetry(telemetry common.Telemetry) *MetricsPipeline {
+	m.telemetry = telemetry
+	return m
+}
+
 // Start starts the MetricsPipeline
 func (m *MetricsPipeline) Start() error {
 	go m.run()
@@ -52,9 +67,20 @@ func (m *MetricsPipeline) IsStopped() bool {
 func (m *MetricsPipeline) run() {
 	defer m.cleanUp()
 	for input := range m.inputChan {
-		var metrics []*MetricSample
-		for _, metric := range m.customMetrics {
-			metrics = append(metrics, metric.Compute(input))
+		metrics := make([]*MetricSample, 0, len(input)*len(m.customMetrics))
+		for _, log := range input {
+			for _, metric := range m.customMetrics {
+				// a custom metric does not produce a sample if the log does not match its filter or has no measure
+				if sample := metric.Compute(log); sample != nil {
+					metrics = append(metrics, sample)
+				}
+			}
+		}
+		if len(metrics) == 0 {
+			continue
+		}
+		if m.telemetry != nil {
+			m.telemetry.Count(common.SamplesMetric, float64(len(metrics)))
 		}
 		m.OutputChan <- metrics
 	}
@@ -69,24 +95,47 @@ func (m *MetricsPipeline) cleanUp() {
 
 // CustomMetricPipeline is a customizable pipeline that computes metrics based on logs.ProcessedLog
 type CustomMetricPipeline struct {
-	name       string
-	filter     *logs.LogFilter
-	measure    *logs.LogMeasure
-	groupBy    []string
-	timeWindow int64
+	name        string
+	filter      *logs.LogFilter
+	measure     *logs.LogMeasure
+	aggregation AggregationType
+	groupBy     []string
+	topN        int
+	timeWindow  int64
 }
 
 // NewCustomMetricPipeline creates a new CustomMetricPipeline with the given name, filter, measure, groupBy and timeWindow
+// The pipeline counts the matching logs, or sums their measure if it has one. Use WithAggregation to aggregate them differently.
 func NewCustomMetricPipeline(metricName string, filter string, timeWindow int64, measure *string, groupBy []string) *CustomMetricPipeline {
+	aggregation := CountAggregation
+	if measure != nil {
+		aggregation = SumAggregation
+	}
 	return &CustomMetricPipeline{
-		name:       metricName,
-		filter:     logs.NewLogFilter(filter),
-		measure:    logs.NewLogMeasure(measure),
-		groupBy:    groupBy,
-		timeWindow: timeWindow,
+		name:        metricName,
+		filter:      logs.NewLogFilter(filter),
+		measure:     logs.NewLogMeasure(measure),
+		aggregation: aggregation,
+		groupBy:     groupBy,
+		timeWindow:  timeWindow,
 	}
 }
 
+// WithAggregation sets how the samples of the pipeline are aggregated every interval.
+// Except for CountAggregation, which counts the matching logs, the aggregations are computed over the pipeline measure.
+// CardinalityAggregation uses the measure as the attribute whose distinct values are counted, e.g. "host".
+func (s *CustomMetricPipeline) WithAggregation(aggregation AggregationType) *CustomMetricPipeline {
+	s.aggregation = aggregation
+	return s
+}
+
+// WithTopN makes the aggregated metric keep only the top N values of every groupBy tag, and the top N tag combinations,
+// ranked by hits. The remaining ones are aggregated in an "other" group.
+func (s *CustomMetricPipeline) WithTopN(n int) *CustomMetricPipeline {
+	s.topN = n
+	return s
+}
+
 // Compute computes the metrics based on the given logs.ProcessedLog
 func (s *CustomMetricPipeline) Compute(log *logs.ProcessedLog) *MetricSample {
 	// Check if we need to process the log for this aggregate
@@ -94,20 +143,34 @@ func (s *CustomMetricPipeline) Compute(log *logs.ProcessedLog) *MetricSample {
 		return nil
 	}
 	sample := &MetricSample{
-		Name:      s.name,
-		Timestamp: log.Timestamp,
+		Name:        s.name,
+		Aggregation: s.aggregation,
+		TopN:        s.topN,
+		Timestamp:   log.Timestamp,
+	}
+	// Cardinality metrics count the distinct values of the measure attribute instead of measuring it
+	if s.aggregation == CardinalityAggregation {
+		if s.measure == nil {
+			return nil
+		}
+		uniqueValue := log.GetAttribute(s.measure.GetName())
+		if uniqueValue == nil {
+			return nil
+		}
+		sample.UniqueValue = *uniqueValue
 	}
 	// If we need to measure the log, do it
-	var value int64
-	value = 1
-	if s.measure != nil {
+	value := 1.0
+	if s.measure != nil && s.aggregation != CardinalityAggregation {
 		measuredLog := s.measure.Measure(log)
-		if measuredLog != nil {
-			value = *measuredLog
-		} else {
+		if measuredLog == nil {
 			// Could not measure log
 			return nil
 		}
+		// counts only need to know that the log has the measure
+		if s.aggregation != CountAggregation {
+			value = *measuredLog
+		}
 	}
 	sample.Value = value
 	// Enrich log with the required tags if we are grouping by
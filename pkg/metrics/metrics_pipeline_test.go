@@ -7,7 +7,7 @@ import (
 )
 
 func TestMetricsPipeline(t *testing.T) {
-	inputChan := make(chan *logs.ProcessedLog)
+	inputChan := make(chan []*logs.ProcessedLog)
 	outpuChan := make(chan []*MetricSample, len(processedLogsForTest)+1)
 
 	// create a custom metric pipeline to get an overall request count grouped by host
@@ -20,18 +20,19 @@ func TestMetricsPipeline(t *testing.T) {
 	// start the pipeline
 	assert.NoError(t, metricsPipeline.Start())
 
-	// send the logs to the pipeline
-	for _, log := range processedLogsForTest {
-		inputChan <- log
-	}
+	// send the logs to the pipeline, in a batch of one log and a batch of the others
+	inputChan <- processedLogsForTest[:1]
+	inputChan <- processedLogsForTest[1:]
 	metricsPipeline.Stop()
 
 	// check the output
-	ii := 0
+	var samples []*MetricSample
 	for output := range outpuChan {
-		// since we only have a single custom metric, we expect to get one metric sample per output
-		assert.Equal(t, 1, len(output))
-		gotMetric := output[0]
+		samples = append(samples, output...)
+	}
+	// since we only have a single custom metric, we expect to get one metric sample per log, in the order of the logs
+	assert.Equal(t, len(processedLogsForTest), len(samples))
+	for ii, gotMetric := range samples {
 		assert.Equal(t, "test", gotMetric.Name)
 		assert.Equal(t, len(groupBy), len(gotMetric.Tags))
 		for _, group := range groupBy {
@@ -48,7 +49,6 @@ func TestMetricsPipeline(t *testing.T) {
 			wantValue := *processedLogsForTest[ii].GetAttribute(group)
 			assert.Equalf(t, wantValue, gotValue, "expected %s to be %s", gotValue, wantValue)
 		}
-		ii++
 	}
 
 }
@@ -100,3 +100,102 @@ var processedLogsForTest = []*logs.ProcessedLog{
 		Host:      "aHost",
 	},
 }
+
+func TestCustomMetricPipeline_WithAggregation(t *testing.T) {
+	bytesMeasure := "bytes"
+	section := "http.path.section"
+	measuredLogs := []*logs.ProcessedLog{
+		{Timestamp: 100, Attributes: map[string]interface{}{"bytes": "100", "http": map[string]interface{}{"path": map[string]interface{}{"section": "api"}}}},
+		{Timestamp: 101, Attributes: map[string]interface{}{"bytes": "300", "http": map[string]interface{}{"path": map[string]interface{}{"section": "api"}}}},
+		{Timestamp: 102, Attributes: map[string]interface{}{"bytes": "50", "http": map[string]interface{}{"path": map[string]interface{}{"section": "report"}}}},
+		{Timestamp: 103, Attributes: map[string]interface{}{"http": map[string]interface{}{"path": map[string]interface{}{"section": "report"}}}}, // no measure
+	}
+	tests := []struct {
+		aggregation AggregationType
+		wantValues  []float64
+	}{
+		{aggregation: CountAggregation, wantValues: []float64{1, 1, 1}},
+		{aggregation: AvgAggregation, wantValues: []float64{100, 300, 50}},
+	}
+	for _, tt := range tests {
+		t.Run("test custom metric pipeline with aggregation "+string(tt.aggregation), func(t *testing.T) {
+			pipeline := NewCustomMetricPipeline("bytes per section", "*", 10, &bytesMeasure, []string{section}).WithAggregation(tt.aggregation)
+			metric := NewMetric(tt.aggregation, 10)
+			var gotValues []float64
+			for _, l := range measuredLogs {
+				sample := pipeline.Compute(l)
+				if sample == nil {
+					continue
+				}
+				assert.Equal(t, tt.aggregation, sample.Aggregation)
+				gotValues = append(gotValues, sample.Value)
+				assert.NoError(t, metric.AddSample(sample))
+			}
+			assert.Equal(t, tt.wantValues, gotValues)
+			if tt.aggregation != AvgAggregation {
+				return
+			}
+			// average bytes per section
+			computed, err := metric.Flush(104)
+			assert.NoError(t, err)
+			val, err := computed.GetValue(&Tag{Name: section, Value: "api"})
+			assert.NoError(t, err)
+			assert.Equal(t, float64(200), val)
+			val, err = computed.GetValue(&Tag{Name: section, Value: "report"})
+			assert.NoError(t, err)
+			assert.Equal(t, float64(50), val)
+		})
+	}
+}
+
+func TestCustomMetricPipeline_Cardinality(t *testing.T) {
+	host := "host"
+	pipeline := NewCustomMetricPipeline("unique hosts", "*", 10, &host, nil).WithAggregation(CardinalityAggregation)
+	metric := NewMetric(CardinalityAggregation, 10)
+	for _, l := range processedLogsForTest {
+		sample := pipeline.Compute(l)
+		assert.Equal(t, l.Host, sample.UniqueValue)
+		assert.NoError(t, metric.AddSample(sample))
+	}
+	computed, err := metric.Flush(107)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(3), computed.Value)
+
+	// cardinality metrics need an attribute
+	assert.Nil(t, NewCustomMetricPipeline("unique nothing", "*", 10, nil, nil).WithAggregation(CardinalityAggregation).Compute(processedLogsForTest[0]))
+}
+
+func TestCustomMetricPipeline_DefaultAggregation(t *testing.T) {
+	bytesMeasure := "bytes"
+	measuredLogs := []*logs.ProcessedLog{
+		{Timestamp: 100, Attributes: map[string]interface{}{"bytes": "100"}},
+		{Timestamp: 101, Attributes: map[string]interface{}{"bytes": "300"}},
+		{Timestamp: 102, Attributes: map[string]interface{}{"bytes": "50"}},
+		{Timestamp: 103, Attributes: map[string]interface{}{}}, // no measure
+	}
+	tests := []struct {
+		name            string
+		measure         *string
+		wantAggregation AggregationType
+		want            float64
+	}{
+		// the measure is summed, as it was before the pipelines had an aggregation
+		{name: "with measure", measure: &bytesMeasure, wantAggregation: SumAggregation, want: 450},
+		{name: "without measure", wantAggregation: CountAggregation, want: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipeline := NewCustomMetricPipeline("bytes", "*", 10, tt.measure, nil)
+			metric := NewMetric(tt.wantAggregation, 10)
+			for _, l := range measuredLogs {
+				if sample := pipeline.Compute(l); sample != nil {
+					assert.Equal(t, tt.wantAggregation, sample.Aggregation)
+					assert.NoError(t, metric.AddSample(sample))
+				}
+			}
+			computed, err := metric.Flush(104)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, computed.Value)
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"sync"
+)
+
+// MinMetric is a metric that keeps the minimum value of its samples and implements the Metric interface
+type MinMetric struct {
+	groupedMetric
+}
+
+// NewMinMetric creates a new MinMetric
+func NewMinMetric() *MinMetric {
+	return &MinMetric{
+		groupedMetric: newGroupedMetric(MinAggregation, func() accumulator {
+			return NewExtremum(func(current, candidate float64) bool { return candidate < current })
+		}),
+	}
+}
+
+// MaxMetric is a metric that keeps the maximum value of its samples and implements the Metric interface
+type MaxMetric struct {
+	groupedMetric
+}
+
+// NewMaxMetric creates a new MaxMetric
+func NewMaxMetric() *MaxMetric {
+	return &MaxMetric{
+		groupedMetric: newGroupedMetric(MaxAggregation, func() accumulator {
+			return NewExtremum(func(current, candidate float64) bool { return candidate > current })
+		}),
+	}
+}
+
+// Extremum is a thread-safe minimum or maximum of the sample values received between 2 flushes
+type Extremum struct {
+	value    float64
+	sampled  bool
+	replaces func(current, candidate float64) bool
+	mu       sync.Mutex
+}
+
+// NewExtremum creates a new Extremum. The replaces function returns true if the candidate value must replace the current one
+func NewExtremum(replaces func(current, candidate float64) bool) *Extremum {
+	return &Extremum{replaces: replaces}
+}
+
+// AddSample adds a sample to the extremum
+func (e *Extremum) AddSample(sample *MetricSample) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.sampled || e.replaces(e.value, sample.Value) {
+		e.value = sample.Value
+		e.sampled = true
+	}
+}
+
+// Merge keeps the extremum of both Extremum
+func (e *Extremum) Merge(other accumulator) {
+	o, ok := other.(*Extremum)
+	if !ok {
+		return
+	}
+	o.mu.Lock()
+	value, sampled := o.value, o.sampled
+	o.mu.Unlock()
+	if sampled {
+		e.AddSample(&MetricSample{Value: value})
+	}
+}
+
+// Rank returns the current extremum
+func (e *Extremum) Rank() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.value
+}
+
+// Flush returns the extremum and clears it
+func (e *Extremum) Flush() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	val := e.value
+	e.value, e.sampled = 0, false
+	return val
+}
@@ -0,0 +1,49 @@
+package metrics
+
+// RateMetric is a metric that reports the per-second rate of its sample values over the interval and implements the Metric interface
+type RateMetric struct {
+	groupedMetric
+}
+
+// NewRateMetric creates a new RateMetric for the given interval in seconds
+func NewRateMetric(interval int64) *RateMetric {
+	return &RateMetric{
+		groupedMetric: newGroupedMetric(RateAggregation, func() accumulator { return NewRate(interval) }),
+	}
+}
+
+// Rate is a thread-safe per-second rate of the sample values received between 2 flushes
+type Rate struct {
+	count    *Count
+	interval int64
+}
+
+// NewRate creates a new Rate for the given interval in seconds
+func NewRate(interval int64) *Rate {
+	if interval <= 0 {
+		interval = 1
+	}
+	return &Rate{count: NewCount(), interval: interval}
+}
+
+// AddSample adds a sample to the rate
+func (r *Rate) AddSample(sample *MetricSample) {
+	r.count.AddSample(sample)
+}
+
+// Merge adds the samples of the other Rate
+func (r *Rate) Merge(other accumulator) {
+	if o, ok := other.(*Rate); ok {
+		r.count.Merge(o.count)
+	}
+}
+
+// Rank returns the current rate
+func (r *Rate) Rank() float64 {
+	return r.count.Rank() / float64(r.interval)
+}
+
+// Flush computes the rate and clears it
+func (r *Rate) Flush() float64 {
+	return r.count.Flush() / float64(r.interval)
+}
@@ -0,0 +1,260 @@
+package metrics
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/ebarti/dd-assignment/pkg/common"
+	"github.com/ebarti/dd-assignment/pkg/errors"
+	"hash/fnv"
+	"log"
+	"sync"
+)
+
+// shardQueueSize is the number of batches of samples a shard can have waiting to be aggregated
+const shardQueueSize = 64
+
+// aggregatorShard aggregates a partition of the series of a MetricAggregator in its own goroutine.
+// It owns the metrics of its series, so that shards never contend on them. Shards are only merged when an interval is flushed.
+type aggregatorShard struct {
+	aggregator        *MetricAggregator
+	input             chan *shardRequest
+	metricsByInterval map[int64]map[string]Metric // map of [interval][metricName]Metric
+}
+
+// shardRequest is either a batch of samples to aggregate, or a request to evict the interval buckets matching evict
+type shardRequest struct {
+	samples []*bucketedSample
+	evict   func(bucket int64) bool
+	evicted chan<- map[int64]map[string]Metric
+}
+
+// bucketedSample is a sample with the interval bucket it is aggregated in
+type bucketedSample struct {
+	bucket int64
+	sample *MetricSample
+}
+
+// newAggregatorShard creates a new aggregatorShard of the given MetricAggregator
+func newAggregatorShard(aggregator *MetricAggregator) *aggregatorShard {
+	return &aggregatorShard{
+		aggregator:        aggregator,
+		input:             make(chan *shardRequest, shardQueueSize),
+		metricsByInterval: make(map[int64]map[string]Metric),
+	}
+}
+
+// run is the main loop of the aggregatorShard, until its input is closed.
+func (sh *aggregatorShard) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for request := range sh.input {
+		if request.evicted != nil {
+			request.evicted <- sh.evict(request.evict)
+			continue
+		}
+		for _, s := range request.samples {
+			if _, ok := sh.metricsByInterval[s.bucket]; !ok {
+				sh.metricsByInterval[s.bucket] = make(map[string]Metric)
+			}
+			if _, ok := sh.metricsByInterval[s.bucket][s.sample.Name]; !ok {
+				sh.metricsByInterval[s.bucket][s.sample.Name] = sh.aggregator.newMetric(s.sample)
+			}
+			sh.metricsByInterval[s.bucket][s.sample.Name].AddSample(s.sample)
+		}
+	}
+}
+
+// evict removes the interval buckets matching the function from the shard, and returns them.
+func (sh *aggregatorShard) evict(evict func(bucket int64) bool) map[int64]map[string]Metric {
+	evicted := make(map[int64]map[string]Metric)
+	for bucket, metricsByName := range sh.metricsByInterval {
+		if evict(bucket) {
+			evicted[bucket] = metricsByName
+			delete(sh.metricsByInterval, bucket)
+		}
+	}
+	return evicted
+}
+
+// startShards starts the shards of the MetricAggregator, if it has more than one.
+func (s *MetricAggregator) startShards() {
+	if s.shardCount <= 1 {
+		return
+	}
+	s.shards = make([]*aggregatorShard, s.shardCount)
+	for ii := range s.shards {
+		s.shards[ii] = newAggregatorShard(s)
+		input := s.shards[ii].input
+		s.telemetry.Gauge(common.QueueDepthMetric, func() float64 { return float64(len(input)) }, "consumer", fmt.Sprintf("shard %d", ii))
+		s.shardsWg.Add(1)
+		go s.shards[ii].run(&s.shardsWg)
+	}
+}
+
+// stopShards stops the shards and waits for them to exit.
+func (s *MetricAggregator) stopShards() {
+	for _, shard := range s.shards {
+		close(shard.input)
+	}
+	s.shardsWg.Wait()
+}
+
+// addToShards is a helper function that partitions the samples across the shards by metric name and tags, so that
+// all the samples of a series are aggregated by the same shard. Late samples are dropped.
+func (s *MetricAggregator) addToShards(samples []*MetricSample) {
+	batches := make([][]*bucketedSample, len(s.shards))
+	s.metricsMu.Lock()
+	var arrival int64
+	if s.processingTime {
+		arrival = s.now().Unix()
+	}
+	for _, sample := range samples {
+		timestamp := sample.Timestamp
+		if s.processingTime {
+			timestamp = arrival
+		}
+		bucket := s.getBucket(timestamp)
+		if s.bucketEnd(bucket) <= s.watermark {
+			s.dropLateSample(sample)
+			continue
+		}
+		s.knownMetrics[sample.Name] = sample.Aggregation
+		s.openBuckets[bucket] = struct{}{}
+		// tags over the limits are replaced before partitioning, as they change the series of the sample
+		s.getLimiter(bucket).Limit(sample)
+		shard := seriesHash(sample) % uint32(len(s.shards))
+		batches[shard] = append(batches[shard], &bucketedSample{bucket: bucket, sample: sample})
+	}
+	s.metricsMu.Unlock()
+	for ii, batch := range batches {
+		if len(batch) > 0 {
+			s.shards[ii].input <- &shardRequest{samples: batch}
+		}
+	}
+}
+
+// evictFromShards removes the interval buckets matching the function from every shard, and merges them.
+// Shards are only asked for their buckets if one of them is open, as it waits for them to aggregate all their samples.
+// The shards evict their buckets concurrently, and are then merged pairwise in parallel, in log2(shards) rounds.
+func (s *MetricAggregator) evictFromShards(evict func(bucket int64) bool) map[int64]map[string]Metric {
+	found := false
+	s.metricsMu.Lock()
+	for bucket := range s.openBuckets {
+		if evict(bucket) {
+			delete(s.openBuckets, bucket)
+			found = true
+		}
+	}
+	s.metricsMu.Unlock()
+	if !found {
+		return make(map[int64]map[string]Metric)
+	}
+	evicted := make(chan map[int64]map[string]Metric, len(s.shards))
+	for _, shard := range s.shards {
+		shard.input <- &shardRequest{evict: evict, evicted: evicted}
+	}
+	partitions := make([]map[int64]map[string]Metric, len(s.shards))
+	for ii := range partitions {
+		partitions[ii] = <-evicted
+	}
+	for step := 1; step < len(partitions); step *= 2 {
+		var wg sync.WaitGroup
+		for ii := 0; ii+step < len(partitions); ii += 2 * step {
+			wg.Add(1)
+			go func(into, from map[int64]map[string]Metric) {
+				defer wg.Done()
+				mergePartition(into, from)
+			}(partitions[ii], partitions[ii+step])
+		}
+		wg.Wait()
+	}
+	return partitions[0]
+}
+
+// mergePartition is a helper function that merges the interval buckets evicted from a shard into the ones of another shard.
+func mergePartition(into, from map[int64]map[string]Metric) {
+	for bucket, metricsByName := range from {
+		if _, ok := into[bucket]; !ok {
+			into[bucket] = metricsByName
+			continue
+		}
+		for name, metric := range metricsByName {
+			if _, ok := into[bucket][name]; !ok {
+				into[bucket][name] = metric
+				continue
+			}
+			mergeShardMetric(name, into[bucket][name], metric)
+		}
+	}
+}
+
+// flushMetrics is a helper function that flushes the metrics of an interval. With shards, the metrics are flushed by
+// as many goroutines as shards.
+func (s *MetricAggregator) flushMetrics(metricsByName map[string]Metric, timestamp int64) []*ComputedMetric {
+	names := make([]string, 0, len(metricsByName))
+	for name := range metricsByName {
+		names = append(names, name)
+	}
+	flushed := make([]*ComputedMetric, len(names))
+	flush := func(ii int) {
+		computedMetric, err := metricsByName[names[ii]].Flush(timestamp)
+		if err != nil {
+			log.Printf("error while processing metric %s: %s", names[ii], err)
+			return
+		}
+		computedMetric.Name = names[ii]
+		flushed[ii] = computedMetric
+	}
+	if len(s.shards) <= 1 {
+		for ii := range names {
+			flush(ii)
+		}
+	} else {
+		var wg sync.WaitGroup
+		for worker := 0; worker < len(s.shards) && worker < len(names); worker++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				for ii := worker; ii < len(names); ii += len(s.shards) {
+					flush(ii)
+				}
+			}(worker)
+		}
+		wg.Wait()
+	}
+	computedMetrics := make([]*ComputedMetric, 0, len(flushed))
+	for _, computedMetric := range flushed {
+		if computedMetric != nil {
+			computedMetrics = append(computedMetrics, computedMetric)
+		}
+	}
+	return computedMetrics
+}
+
+// mergeShardMetric is a helper function that merges the metric aggregated by a shard into the same metric of another shard.
+func mergeShardMetric(name string, into Metric, from Metric) {
+	i, okInto := into.(shardable)
+	f, okFrom := from.(shardable)
+	if !okInto || !okFrom {
+		log.Printf("error while processing metric %s: %s", name, errors.NewUnmergeableMetricError(name))
+		return
+	}
+	i.grouped().mergeShard(f.grouped())
+}
+
+// seriesHash returns the FNV-1a hash of the metric name and tags of the sample. It does not depend on the order of the tags,
+// as the hashes of the tags are summed before being hashed with the name.
+func seriesHash(sample *MetricSample) uint32 {
+	hasher := fnv.New32a()
+	var tagsHash uint32
+	for _, tag := range sample.Tags {
+		hasher.Reset()
+		hasher.Write([]byte(tag.Name + ":" + tag.Value))
+		tagsHash += hasher.Sum32()
+	}
+	hasher.Reset()
+	hasher.Write([]byte(sample.Name))
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], tagsHash)
+	hasher.Write(buf[:])
+	return hasher.Sum32()
+}
@@ -0,0 +1,305 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+const (
+	// DefaultRelativeAccuracy is the relative accuracy of the quantiles computed by a DDSketch created with NewDefaultDDSketch
+	DefaultRelativeAccuracy = 0.01
+	// minIndexableValue is the smallest absolute value that is stored in a bucket, smaller values are counted as zeros
+	minIndexableValue = 1e-9
+)
+
+// DefaultPercentiles are the percentiles computed for every distribution
+var DefaultPercentiles = []float64{0.5, 0.75, 0.9, 0.95, 0.99}
+
+// Names of the values computed for every distribution, on top of its percentiles
+const (
+	CountValue = "count"
+	SumValue   = "sum"
+	MinValue   = "min"
+	MaxValue   = "max"
+	AvgValue   = "avg"
+)
+
+// DDSketch is a quantile sketch with relative-error guarantees, as described in https://arxiv.org/abs/1908.10693
+// Values are mapped to logarithmically sized buckets so that any quantile is computed with a relative error
+// lower than the sketch relative accuracy. Two sketches with the same relative accuracy can be merged.
+// DDSketch is not thread-safe.
+type DDSketch struct {
+	relativeAccuracy float64
+	gamma            float64
+	logGamma         float64
+	positive         map[int]uint64 // map of [bucketIndex]count for positive values
+	negative         map[int]uint64 // map of [bucketIndex]count for the absolute value of negative values
+	zeroCount        uint64
+	count            uint64
+	sum              float64
+	min              float64
+	max              float64
+}
+
+// NewDDSketch creates a new DDSketch with the given relative accuracy, which must be in (0, 1)
+func NewDDSketch(relativeAccuracy float64) *DDSketch {
+	if relativeAccuracy <= 0 || relativeAccuracy >= 1 {
+		relativeAccuracy = DefaultRelativeAccuracy
+	}
+	gamma := (1 + relativeAccuracy) / (1 - relativeAccuracy)
+	return &DDSketch{
+		relativeAccuracy: relativeAccuracy,
+		gamma:            gamma,
+		logGamma:         math.Log(gamma),
+		positive:         make(map[int]uint64),
+		negative:         make(map[int]uint64),
+	}
+}
+
+// NewDefaultDDSketch creates a new DDSketch with the DefaultRelativeAccuracy
+func NewDefaultDDSketch() *DDSketch {
+	return NewDDSketch(DefaultRelativeAccuracy)
+}
+
+// Add adds a value to the sketch
+func (s *DDSketch) Add(value float64) {
+	switch {
+	case value > minIndexableValue:
+		s.positive[s.index(value)]++
+	case value < -minIndexableValue:
+		s.negative[s.index(-value)]++
+	default:
+		s.zeroCount++
+	}
+	if s.count == 0 || value < s.min {
+		s.min = value
+	}
+	if s.count == 0 || value > s.max {
+		s.max = value
+	}
+	s.count++
+	s.sum += value
+}
+
+// Merge merges the other sketch into this one. Both sketches must have the same relative accuracy.
+func (s *DDSketch) Merge(other *DDSketch) error {
+	if other == nil || other.count == 0 {
+		return nil
+	}
+	if s.gamma != other.gamma {
+		return fmt.Errorf("cannot merge sketches with relative accuracies %v and %v", s.relativeAccuracy, other.relativeAccuracy)
+	}
+	for index, count := range other.positive {
+		s.positive[index] += count
+	}
+	for index, count := range other.negative {
+		s.negative[index] += count
+	}
+	s.zeroCount += other.zeroCount
+	if s.count == 0 || other.min < s.min {
+		s.min = other.min
+	}
+	if s.count == 0 || other.max > s.max {
+		s.max = other.max
+	}
+	s.count += other.count
+	s.sum += other.sum
+	return nil
+}
+
+// Copy returns a deep copy of the sketch
+func (s *DDSketch) Copy() *DDSketch {
+	c := NewDDSketch(s.relativeAccuracy)
+	_ = c.Merge(s)
+	return c
+}
+
+// Quantile returns the approximate value at the given quantile, which must be in [0, 1]. It returns 0 for an empty sketch.
+func (s *DDSketch) Quantile(q float64) float64 {
+	if s.count == 0 || q < 0 || q > 1 {
+		return 0
+	}
+	// the bucket representative values might fall out of the actual range of values
+	return math.Max(s.min, math.Min(s.max, s.bucketQuantile(q)))
+}
+
+// Count returns the number of values in the sketch
+func (s *DDSketch) Count() uint64 {
+	return s.count
+}
+
+// Sum returns the sum of the values in the sketch
+func (s *DDSketch) Sum() float64 {
+	return s.sum
+}
+
+// Min returns the minimum value in the sketch
+func (s *DDSketch) Min() float64 {
+	return s.min
+}
+
+// Max returns the maximum value in the sketch
+func (s *DDSketch) Max() float64 {
+	return s.max
+}
+
+// Avg returns the average of the values in the sketch
+func (s *DDSketch) Avg() float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return s.sum / float64(s.count)
+}
+
+// Summary returns the count, sum, min, max, avg and the DefaultPercentiles of the sketch, keyed by their value name
+func (s *DDSketch) Summary() map[string]float64 {
+	values := map[string]float64{
+		CountValue: float64(s.count),
+		SumValue:   s.sum,
+		MinValue:   s.min,
+		MaxValue:   s.max,
+		AvgValue:   s.Avg(),
+	}
+	for _, p := range DefaultPercentiles {
+		values[PercentileValueName(p)] = s.Quantile(p)
+	}
+	return values
+}
+
+// ForEach calls f with the representative value and the count of every non empty bucket, in increasing order of value.
+// Representative values are clamped to the actual range of values, as for quantiles.
+func (s *DDSketch) ForEach(f func(value float64, count uint64)) {
+	clamp := func(value float64) float64 { return math.Max(s.min, math.Min(s.max, value)) }
+	for _, index := range sortedIndexes(s.negative, true) {
+		f(clamp(-s.value(index)), s.negative[index])
+	}
+	if s.zeroCount > 0 {
+		f(clamp(0), s.zeroCount)
+	}
+	for _, index := range sortedIndexes(s.positive, false) {
+		f(clamp(s.value(index)), s.positive[index])
+	}
+}
+
+// MarshalBinary encodes the relative accuracy, the statistics and the non empty buckets of the sketch
+func (s *DDSketch) MarshalBinary() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	var b [binary.MaxVarintLen64]byte
+	writeUvarint := func(value uint64) { buf.Write(b[:binary.PutUvarint(b[:], value)]) }
+	writeFloat := func(value float64) {
+		binary.LittleEndian.PutUint64(b[:8], math.Float64bits(value))
+		buf.Write(b[:8])
+	}
+	writeFloat(s.relativeAccuracy)
+	writeUvarint(s.count)
+	writeUvarint(s.zeroCount)
+	writeFloat(s.sum)
+	writeFloat(s.min)
+	writeFloat(s.max)
+	for _, buckets := range []map[int]uint64{s.positive, s.negative} {
+		writeUvarint(uint64(len(buckets)))
+		for _, index := range sortedIndexes(buckets, false) {
+			buf.Write(b[:binary.PutVarint(b[:], int64(index))])
+			writeUvarint(buckets[index])
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a sketch encoded with MarshalBinary into this one, replacing its content
+func (s *DDSketch) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	var err error
+	readUvarint := func() uint64 {
+		if err != nil {
+			return 0
+		}
+		var value uint64
+		value, err = binary.ReadUvarint(r)
+		return value
+	}
+	readFloat := func() float64 {
+		if err != nil {
+			return 0
+		}
+		var value uint64
+		err = binary.Read(r, binary.LittleEndian, &value)
+		return math.Float64frombits(value)
+	}
+	decoded := NewDDSketch(readFloat())
+	decoded.count = readUvarint()
+	decoded.zeroCount = readUvarint()
+	decoded.sum, decoded.min, decoded.max = readFloat(), readFloat(), readFloat()
+	for _, buckets := range []map[int]uint64{decoded.positive, decoded.negative} {
+		length := readUvarint()
+		for ii := uint64(0); ii < length && err == nil; ii++ {
+			var index int64
+			if index, err = binary.ReadVarint(r); err == nil {
+				buckets[int(index)] = readUvarint()
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("cannot decode sketch: %w", err)
+	}
+	*s = *decoded
+	return nil
+}
+
+// bucketQuantile returns the representative value of the bucket holding the given quantile
+func (s *DDSketch) bucketQuantile(q float64) float64 {
+	rank := uint64(q * float64(s.count-1))
+	var cumulative uint64
+	// negative values, from the most negative to the closest to zero
+	for _, index := range sortedIndexes(s.negative, true) {
+		cumulative += s.negative[index]
+		if cumulative > rank {
+			return -s.value(index)
+		}
+	}
+	cumulative += s.zeroCount
+	if cumulative > rank {
+		return 0
+	}
+	for _, index := range sortedIndexes(s.positive, false) {
+		cumulative += s.positive[index]
+		if cumulative > rank {
+			return s.value(index)
+		}
+	}
+	return s.max
+}
+
+// index returns the bucket index of a positive value
+func (s *DDSketch) index(value float64) int {
+	return int(math.Ceil(math.Log(value) / s.logGamma))
+}
+
+// value returns the representative value of a bucket, which is within the relative accuracy of all the values in the bucket
+func (s *DDSketch) value(index int) float64 {
+	return 2 * math.Pow(s.gamma, float64(index)) / (1 + s.gamma)
+}
+
+// sortedIndexes is a helper function that returns the bucket indexes in increasing order, or decreasing if reverse is set
+func sortedIndexes(buckets map[int]uint64, reverse bool) []int {
+	indexes := make([]int, 0, len(buckets))
+	for index := range buckets {
+		indexes = append(indexes, index)
+	}
+	if reverse {
+		sort.Sort(sort.Reverse(sort.IntSlice(indexes)))
+	} else {
+		sort.Ints(indexes)
+	}
+	return indexes
+}
+
+// PercentileValueName returns the value name of a percentile, e.g. "p99" for 0.99 or "p99.9" for 0.999
+func PercentileValueName(quantile float64) string {
+	// round to avoid floating point artifacts such as 28.999999999999996 for 0.29
+	return "p" + strconv.FormatFloat(math.Round(quantile*100*1e6)/1e6, 'f', -1, 64)
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestDDSketch_Quantile(t *testing.T) {
+	sketch := NewDefaultDDSketch()
+	assert.Equal(t, float64(0), sketch.Quantile(0.5))
+	for ii := 1; ii <= 1000; ii++ {
+		sketch.Add(float64(ii))
+	}
+	assert.Equal(t, uint64(1000), sketch.Count())
+	assert.Equal(t, float64(500500), sketch.Sum())
+	assert.Equal(t, float64(1), sketch.Min())
+	assert.Equal(t, float64(1000), sketch.Max())
+	for _, q := range []float64{0, 0.5, 0.75, 0.9, 0.95, 0.99, 1} {
+		t.Run(fmt.Sprintf("test ddsketch quantile %v", q), func(t *testing.T) {
+			want := 1 + math.Floor(q*999)
+			assertWithinRelativeAccuracy(t, want, sketch.Quantile(q))
+		})
+	}
+}
+
+func TestDDSketch_NegativeAndZeroValues(t *testing.T) {
+	sketch := NewDefaultDDSketch()
+	for _, v := range []float64{-100, -10, 0, 10, 100} {
+		sketch.Add(v)
+	}
+	assert.Equal(t, float64(-100), sketch.Quantile(0))
+	assertWithinRelativeAccuracy(t, -10, sketch.Quantile(0.25))
+	assert.Equal(t, float64(0), sketch.Quantile(0.5))
+	assertWithinRelativeAccuracy(t, 10, sketch.Quantile(0.75))
+	assert.Equal(t, float64(100), sketch.Quantile(1))
+}
+
+func TestDDSketch_ForEach(t *testing.T) {
+	sketch := NewDefaultDDSketch()
+	for _, v := range []float64{-10, 0, 10, 10, 100} {
+		sketch.Add(v)
+	}
+	var values []float64
+	var counts []uint64
+	sketch.ForEach(func(value float64, count uint64) {
+		values = append(values, value)
+		counts = append(counts, count)
+	})
+	assert.Equal(t, []uint64{1, 1, 2, 1}, counts)
+	assertWithinRelativeAccuracy(t, -10, values[0])
+	assert.Equal(t, float64(0), values[1])
+	assertWithinRelativeAccuracy(t, 10, values[2])
+	assert.Equal(t, float64(100), values[3])
+}
+
+func TestDDSketch_Merge(t *testing.T) {
+	even, odd, all := NewDefaultDDSketch(), NewDefaultDDSketch(), NewDefaultDDSketch()
+	for ii := 1; ii <= 1000; ii++ {
+		all.Add(float64(ii))
+		if ii%2 == 0 {
+			even.Add(float64(ii))
+		} else {
+			odd.Add(float64(ii))
+		}
+	}
+	assert.NoError(t, even.Merge(odd))
+	assert.Equal(t, all.Summary(), even.Summary())
+
+	lessAccurate := NewDDSketch(0.05)
+	lessAccurate.Add(1)
+	assert.Error(t, even.Merge(lessAccurate))
+}
+
+func TestDDSketch_MarshalBinary(t *testing.T) {
+	sketch := NewDDSketch(0.02)
+	for _, v := range []float64{-100, -10, 0, 0, 10, 100, 1000} {
+		sketch.Add(v)
+	}
+	data, err := sketch.MarshalBinary()
+	assert.NoError(t, err)
+	decoded := NewDefaultDDSketch()
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Equal(t, sketch, decoded)
+
+	assert.Error(t, decoded.UnmarshalBinary(data[:len(data)-1]))
+	// a failed decoding leaves the sketch unchanged
+	assert.Equal(t, sketch.Summary(), decoded.Summary())
+}
+
+func TestPercentileValueName(t *testing.T) {
+	assert.Equal(t, "p50", PercentileValueName(0.5))
+	assert.Equal(t, "p29", PercentileValueName(0.29))
+	assert.Equal(t, "p99.9", PercentileValueName(0.999))
+}
+
+// assertWithinRelativeAccuracy is a helper function that checks that got is within the default relative accuracy of want
+func assertWithinRelativeAccuracy(t *testing.T, want, got float64) {
+	assert.LessOrEqualf(t, math.Abs(got-want), math.Abs(want)*DefaultRelativeAccuracy, "expected %v to be within %v of %v", got, DefaultRelativeAccuracy, want)
+}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// StatsSink receives the statistics of every time interval flushed by the MetricAggregator
+type StatsSink interface {
+	WriteStats(stats *IntervalStats) error
+}
+
+// watermarkSink is implemented by the sinks that are notified of the latest sample timestamp the MetricAggregator
+// processed, so that they can order its statistics with the output of other components. The MetricAggregator notifies
+// math.MaxInt64 once it stops.
+type watermarkSink interface {
+	AdvanceWatermark(timestamp int64)
+}
+
+// IntervalStats are the statistics of a time interval [Start, End) flushed by the MetricAggregator at Timestamp
+type IntervalStats struct {
+	Start            int64
+	End              int64
+	Partial          bool // whether the interval was flushed at the end of the input, before its end
+	Timestamp        int64
+	Metrics          []*ComputedMetric
+	TagCardinality   []*TagCardinality // cardinality of every tag of every metric in the interval
+	CardinalityStats bool              // whether the cardinality of every tag is rendered, rather than only the tags that reached their limit
+	LateSamples      int64             // number of samples dropped as too late since the previous flushed interval
+}
+
+// String renders the statistics as text: every computed metric, followed by the cardinality of the tags, a warning for
+// every tag that reached its cardinality limit and a warning if samples were dropped as too late.
+func (s *IntervalStats) String() string {
+	var buf bytes.Buffer
+	flushTime := time.Unix(s.Timestamp, 0)
+	startTime := time.Unix(s.Start, 0)
+	endTime := time.Unix(s.End, 0)
+
+	if s.Partial {
+		fmt.Fprintf(&buf, "[%v] Statistics for partial time interval %v-%v\n", flushTime, startTime, endTime)
+	} else {
+		fmt.Fprintf(&buf, "[%v] Statistics for time interval %v-%v\n", flushTime, startTime, endTime)
+	}
+
+	for _, metric := range s.Metrics {
+		metric.Render(&buf)
+		buf.WriteRune('\n')
+	}
+	if s.CardinalityStats && len(s.TagCardinality) > 0 {
+		buf.WriteString("Tag cardinality:\n")
+		for _, stat := range s.TagCardinality {
+			fmt.Fprintf(&buf, "\tMetric %s tag %s: %d distinct values, %d overflowed samples\n", stat.Metric, stat.Tag, stat.DistinctValues, stat.OverflowedSamples)
+		}
+	}
+	for _, stat := range s.TagCardinality {
+		if stat.LimitReached {
+			fmt.Fprintf(&buf, "Warning: tag %s of metric %s reached its cardinality limit with %d distinct values, %d samples were counted as %q\n",
+				stat.Tag, stat.Metric, stat.DistinctValues, stat.OverflowedSamples, OverflowTagValue)
+		}
+	}
+	if s.LateSamples > 0 {
+		fmt.Fprintf(&buf, "Warning: %d samples arrived after their interval was flushed and were dropped\n", s.LateSamples)
+	}
+	return buf.String()
+}
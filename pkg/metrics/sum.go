@@ -0,0 +1,14 @@
+package metrics
+
+// SumMetric is a metric that sums the values of its samples and implements the Metric interface
+type SumMetric struct {
+	groupedMetric
+}
+
+// NewSumMetric creates a new SumMetric
+func NewSumMetric() *SumMetric {
+	return &SumMetric{
+		// a Count already adds up the sample values
+		groupedMetric: newGroupedMetric(SumAggregation, func() accumulator { return NewCount() }),
+	}
+}
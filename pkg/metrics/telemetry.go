@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"github.com/ebarti/dd-assignment/pkg/common"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// Telemetry collects the internal metrics of the components of the service: counters, histograms, and gauges sampled on
+// every flush. It is flushed with the statistics of every interval, so that the internal metrics are output, stored and
+// exposed like the other metrics. Counters and histograms hold the values recorded since the previous flush, in wall clock
+// time, whatever interval they are flushed with.
+// Telemetry implements common.Telemetry and is thread-safe. A nil Telemetry records nothing.
+type Telemetry struct {
+	metrics map[string]Metric // map of [name]Metric, recorded since the previous flush
+	gauges  []*telemetryGauge
+	mu      sync.Mutex
+}
+
+// telemetryGauge is a gauge sampled on every flush
+type telemetryGauge struct {
+	name  string
+	tags  []*Tag
+	value func() float64
+}
+
+// NewTelemetry creates a new Telemetry, which samples the number of goroutines on every flush.
+func NewTelemetry() *Telemetry {
+	t := &Telemetry{metrics: make(map[string]Metric)}
+	t.Gauge(common.GoroutinesMetric, func() float64 { return float64(runtime.NumGoroutine()) })
+	return t
+}
+
+// Count adds the value to the counter with the given name and tags, given as name and value pairs.
+func (t *Telemetry) Count(name string, value float64, tags ...string) {
+	t.record(&MetricSample{Name: name, Aggregation: SumAggregation, Value: value, Tags: pairTags(tags)})
+}
+
+// Observe adds the value to the histogram with the given name and tags, given as name and value pairs.
+func (t *Telemetry) Observe(name string, value float64, tags ...string) {
+	t.record(&MetricSample{Name: name, Aggregation: DistributionAggregation, Value: value, Tags: pairTags(tags)})
+}
+
+// Gauge registers a gauge with the given name and tags, given as name and value pairs, whose value is sampled on every flush.
+func (t *Telemetry) Gauge(name string, value func() float64, tags ...string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.gauges = append(t.gauges, &telemetryGauge{name: name, tags: pairTags(tags), value: value})
+}
+
+// Flush samples the gauges and returns the internal metrics recorded since the previous flush, sorted by name.
+func (t *Telemetry) Flush(timestamp int64) []*ComputedMetric {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	gauges := t.gauges
+	t.mu.Unlock()
+	// gauges are sampled without the lock, as they might read components that record to the Telemetry
+	for _, gauge := range gauges {
+		t.record(&MetricSample{Name: gauge.name, Aggregation: GaugeAggregation, Value: gauge.value(), Tags: gauge.tags, Timestamp: timestamp})
+	}
+	t.mu.Lock()
+	metricsByName := t.metrics
+	t.metrics = make(map[string]Metric)
+	t.mu.Unlock()
+	computedMetrics := make([]*ComputedMetric, 0, len(metricsByName))
+	for name, metric := range metricsByName {
+		computedMetric, err := metric.Flush(timestamp)
+		if err != nil {
+			continue
+		}
+		computedMetric.Name = name
+		computedMetrics = append(computedMetrics, computedMetric)
+	}
+	sort.Slice(computedMetrics, func(i, j int) bool { return computedMetrics[i].Name < computedMetrics[j].Name })
+	return computedMetrics
+}
+
+// record is a helper function that adds the sample to the metric of its name, creating it if needed.
+func (t *Telemetry) record(sample *MetricSample) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.metrics[sample.Name]; !ok {
+		t.metrics[sample.Name] = NewMetric(sample.Aggregation, 1)
+	}
+	t.metrics[sample.Name].AddSample(sample)
+}
+
+// pairTags is a helper function that returns the tags of the name and value pairs. A name without value is ignored
+func pairTags(pairs []string) []*Tag {
+	if len(pairs) < 2 {
+		return nil
+	}
+	tags := make([]*Tag, 0, len(pairs)/2)
+	for ii := 0; ii+1 < len(pairs); ii += 2 {
+		tags = append(tags, &Tag{Name: pairs[ii], Value: pairs[ii+1]})
+	}
+	return tags
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"github.com/ebarti/dd-assignment/pkg/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTelemetry(t *testing.T) {
+	telemetry := NewTelemetry()
+	depth := 3
+	telemetry.Gauge(common.QueueDepthMetric, func() float64 { return float64(depth) }, "consumer", "aggregator")
+	telemetry.Count(common.LinesReadMetric, 256)
+	telemetry.Count(common.LinesReadMetric, 10)
+	telemetry.Count(common.ParseErrorsMetric, 1, "type", "InvalidCsvLogFormatError")
+	telemetry.Count(common.ParseErrorsMetric, 2, "type", "UnableToParseDateError")
+	telemetry.Observe(common.FlushDurationMetric, 1)
+	telemetry.Observe(common.FlushDurationMetric, 3)
+
+	flushed := telemetry.Flush(100)
+	byName := make(map[string]*ComputedMetric)
+	var names []string
+	for _, computedMetric := range flushed {
+		byName[computedMetric.Name] = computedMetric
+		names = append(names, computedMetric.Name)
+	}
+	// sorted by name
+	assert.Equal(t, []string{common.FlushDurationMetric, common.GoroutinesMetric, common.LinesReadMetric, common.ParseErrorsMetric, common.QueueDepthMetric}, names)
+	assert.EqualValues(t, 266, byName[common.LinesReadMetric].Value)
+	assert.EqualValues(t, 3, byName[common.ParseErrorsMetric].Value)
+	value, err := byName[common.ParseErrorsMetric].GetValue(&Tag{Name: "type", Value: "UnableToParseDateError"})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, value)
+	assert.EqualValues(t, 2, byName[common.FlushDurationMetric].Values["count"])
+	assert.EqualValues(t, 4, byName[common.FlushDurationMetric].Values["sum"])
+	value, err = byName[common.QueueDepthMetric].GetValue(&Tag{Name: "consumer", Value: "aggregator"})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, value)
+	assert.Greater(t, byName[common.GoroutinesMetric].Value, 0.0)
+
+	// counters and histograms restart from zero, gauges are sampled again
+	depth = 5
+	telemetry.Count(common.LinesReadMetric, 1)
+	flushed = telemetry.Flush(110)
+	byName = make(map[string]*ComputedMetric)
+	for _, computedMetric := range flushed {
+		byName[computedMetric.Name] = computedMetric
+	}
+	assert.Len(t, flushed, 3)
+	assert.EqualValues(t, 1, byName[common.LinesReadMetric].Value)
+	value, err = byName[common.QueueDepthMetric].GetValue(&Tag{Name: "consumer", Value: "aggregator"})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 5, value)
+}
+
+func TestTelemetry_Nil(t *testing.T) {
+	var telemetry *Telemetry
+	// a nil Telemetry records nothing
+	telemetry.Count(common.LinesReadMetric, 1)
+	telemetry.Observe(common.FlushDurationMetric, 1)
+	telemetry.Gauge(common.QueueDepthMetric, func() float64 { return 1 })
+	assert.Empty(t, telemetry.Flush(100))
+}
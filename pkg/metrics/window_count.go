@@ -54,7 +54,7 @@ func (c *WindowCountMetric) Flush(timestamp int64) (*ComputedMetric, error) {
 
 	var tagGroups []*ComputedMetric
 	for tagName, countPerTagValue := range c.values {
-		var groupValue int64
+		var groupValue float64
 		tagValueGroups := make([]*ComputedMetric, 0)
 		for tagValue, count := range countPerTagValue {
 			val := count.Flush(timestamp)
@@ -80,7 +80,7 @@ func (c *WindowCountMetric) Flush(timestamp int64) (*ComputedMetric, error) {
 // WindowCount is a thread-safe windowed count.
 type WindowCount struct {
 	Samples     *deque.Deque
-	value       int64
+	value       float64
 	WindowWidth int64
 	mu          sync.Mutex
 }
@@ -103,7 +103,7 @@ func (w *WindowCount) AddSample(sample *MetricSample) {
 
 // Flush flushes the windowed counter. It will clear the entries older than the specified timestamp
 // minus the window width, and return the re-computed value
-func (w *WindowCount) Flush(timestamp int64) int64 {
+func (w *WindowCount) Flush(timestamp int64) float64 {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	cutoff := timestamp - w.WindowWidth // cutoff included in the window
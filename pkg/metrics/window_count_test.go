@@ -54,22 +54,22 @@ func TestWindowCountSampling(t *testing.T) {
 	tests := []struct {
 		name   string
 		window int64
-		want   int64
+		want   float64
 	}{
 		{
 			name:   "all samples in window",
 			window: int64(5),
-			want:   int64(4),
+			want:   float64(4),
 		},
 		{
 			name:   "some samples in window",
 			window: int64(3),
-			want:   int64(2),
+			want:   float64(2),
 		},
 		{
 			name:   "no samples in window",
 			window: int64(1),
-			want:   int64(0),
+			want:   float64(0),
 		},
 	}
 	for _, tt := range tests {
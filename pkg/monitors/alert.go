@@ -0,0 +1,34 @@
+package monitors
+
+import "github.com/ebarti/dd-assignment/pkg/metrics"
+
+// AlertState is the state a LogMonitor transitions to
+type AlertState string
+
+const (
+	AlertStateAlert     AlertState = "alert"
+	AlertStateRecovered AlertState = "recovered"
+)
+
+// AlertSink receives the alert and recovery transitions of the LogMonitors
+type AlertSink interface {
+	WriteAlert(event *AlertEvent) error
+}
+
+// watermarkSink is implemented by the sinks that are notified of the latest log timestamp a LogMonitor processed, so
+// that they can order its transitions with the output of other components. The LogMonitor notifies math.MaxInt64 once
+// it stops.
+type watermarkSink interface {
+	AdvanceWatermark(timestamp int64)
+}
+
+// AlertEvent is an alert or recovery transition of a LogMonitor
+type AlertEvent struct {
+	Monitor   string
+	State     AlertState
+	Timestamp int64
+	Value     float64                 // monitored value that triggered the transition
+	Threshold float64                 // alert threshold of alerts, recovery threshold of recoveries
+	Message   string                  // rendered alert or recovery template
+	Metric    *metrics.ComputedMetric // monitored metric
+}
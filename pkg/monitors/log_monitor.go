@@ -1,11 +1,16 @@
 package monitors
 
 import (
+	"github.com/ebarti/dd-assignment/pkg/common"
+	"github.com/ebarti/dd-assignment/pkg/errors"
 	"github.com/ebarti/dd-assignment/pkg/logs"
 	"github.com/ebarti/dd-assignment/pkg/metrics"
 	"github.com/hoisie/mustache"
 	"log"
+	"math"
+	"sort"
 	"sync/atomic"
+	"time"
 )
 
 // ContextExtractorFunc is a customizable function that extracts the context from a log line and is used to render the template.
@@ -16,36 +21,57 @@ type LogMonitorConfig struct {
 	Name                        string
 	TimeWindow                  int64
 	Filter                      string
-	AlertThreshold              int64
+	Measure                     *string                 // measure to aggregate, or attribute whose distinct values are counted by cardinality monitors
+	Aggregation                 metrics.AggregationType // metrics.CountAggregation (default), metrics.DistributionAggregation or metrics.CardinalityAggregation
+	Value                       string                  // named value to monitor, e.g. "p99" for distributions. Empty monitors the metric value
+	Formula                     string                  // monitors a formula over the Operands instead of the Filter, e.g. "errors / hits * 100"
+	Operands                    map[string]string       // filter of every metric of the Formula, by metric name, e.g. "errors": "status:500"
+	AlertThreshold              float64
 	AlertTemplate               string
 	AlertTemplateContextFunc    ContextExtractorFunc
-	RecoveryThreshold           int64
+	RecoveryThreshold           float64
 	RecoveryTemplate            string
 	RecoveryTemplateContextFunc ContextExtractorFunc
 }
 
 // LogMonitor is a struct that is used to monitor logs based on a log filter.
-// only counter monitors are supported - in Datadog's terms, only .rollup("count") is supported
+// only counter, distribution and cardinality monitors are supported - in Datadog's terms, .rollup("count"), a percentile of a measure
+// or a unique count of an attribute
 // no group by supported here
+// The state of the log monitor is owned by its goroutine, only its alert state can be read concurrently, with IsInAlert.
 type LogMonitor struct {
 	name                        string
 	timeWindow                  int64
-	alertThreshold              int64
+	alertThreshold              float64
 	alertTemplate               *mustache.Template // High traffic generated an alert - hits {{value}}, triggered at {{time}}
 	alertTemplateContextFunc    ContextExtractorFunc
-	recoveryThreshold           int64
+	recoveryThreshold           float64
 	recoveryTemplate            *mustache.Template
 	recoveryTemplateContextFunc ContextExtractorFunc
-	customMetric                *metrics.CustomMetricPipeline
-	metric                      *metrics.WindowCountMetric
-	IsInAlert                   bool
+	operands                    []*monitorOperand
+	formula                     *metrics.Formula
+	value                       string
+	inAlert                     uint32 // 1 while in alert, accessed atomically
 	lastChecked                 int64
+	currentTime                 int64 // latest log timestamp, or wall clock time of the latest timer evaluation
+	evaluationInterval          time.Duration
+	now                         func() time.Time
+	ticks                       <-chan time.Time // ticks of the evaluation timer, created on Start if not set
 	logger                      *log.Logger
-	InputChan                   chan *logs.ProcessedLog
+	sinks                       []AlertSink
+	telemetry                   common.Telemetry
+	InputChan                   chan []*logs.ProcessedLog // batches of logs, evaluated one log at a time
 	done                        chan struct{}
 	isDone                      uint32
 }
 
+// monitorOperand is a metric monitored by a LogMonitor, on its own or as an operand of its formula
+type monitorOperand struct {
+	name         string
+	customMetric *metrics.CustomMetricPipeline
+	metric       metrics.Metric
+}
+
 // NewLogMonitor creates a new log monitor.
 func NewLogMonitor(config *LogMonitorConfig, logger *log.Logger) *LogMonitor {
 	aTmpl, err := mustache.ParseString(config.AlertTemplate)
@@ -66,6 +92,20 @@ func NewLogMonitor(config *LogMonitorConfig, logger *log.Logger) *LogMonitor {
 	if rFunc == nil {
 		rFunc = config.AlertTemplateContextFunc
 	}
+	filters := map[string]string{config.Name: config.Filter}
+	var formula *metrics.Formula
+	if config.Formula != "" {
+		formula, err = metrics.ParseFormula(config.Formula)
+		if err != nil {
+			// we should not panic here, but we will for this exercise
+			log.Fatalf("Failed to parse formula: %s", err)
+		}
+		filters = config.Operands
+	}
+	var operands []*monitorOperand
+	for _, name := range sortedNames(filters) {
+		operands = append(operands, newMonitorOperand(name, filters[name], config))
+	}
 	return &LogMonitor{
 		name:                        config.Name,
 		logger:                      logger,
@@ -75,17 +115,85 @@ func NewLogMonitor(config *LogMonitorConfig, logger *log.Logger) *LogMonitor {
 		recoveryThreshold:           config.RecoveryThreshold,
 		recoveryTemplate:            rTmpl,
 		recoveryTemplateContextFunc: rFunc,
-		customMetric:                metrics.NewCustomMetricPipeline(config.Name, config.Filter, config.TimeWindow, nil, nil),
-		metric:                      metrics.NewWindowCountMetric(config.TimeWindow),
+		operands:                    operands,
+		formula:                     formula,
+		value:                       config.Value,
 		timeWindow:                  config.TimeWindow,
-		InputChan:                   make(chan *logs.ProcessedLog, 100),
+		InputChan:                   make(chan []*logs.ProcessedLog, common.DefaultBufferSize),
+		currentTime:                 math.MinInt64,
+		now:                         time.Now,
 		done:                        make(chan struct{}),
 	}
 }
 
+// newMonitorOperand is a helper function that creates the windowed metric of the given filter for the monitor configuration.
+func newMonitorOperand(name string, filter string, config *LogMonitorConfig) *monitorOperand {
+	aggregation := config.Aggregation
+	var metric metrics.Metric
+	switch aggregation {
+	case metrics.DistributionAggregation:
+		metric = metrics.NewWindowDistributionMetric(config.TimeWindow)
+	case metrics.CardinalityAggregation:
+		metric = metrics.NewWindowCardinalityMetric(config.TimeWindow)
+	default:
+		aggregation = metrics.CountAggregation
+		metric = metrics.NewWindowCountMetric(config.TimeWindow)
+	}
+	return &monitorOperand{
+		name:         name,
+		customMetric: metrics.NewCustomMetricPipeline(name, filter, config.TimeWindow, config.Measure, nil).WithAggregation(aggregation),
+		metric:       metric,
+	}
+}
+
+// sortedNames is a helper function that returns the keys of the map in increasing order.
+func sortedNames(m map[string]string) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Name returns the name of the log monitor.
+func (m *LogMonitor) Name() string {
+	return m.name
+}
+
+// WithSinks makes the log monitor write its alert and recovery transitions to the sinks, instead of printing their message to its logger.
+func (m *LogMonitor) WithSinks(sinks ...AlertSink) *LogMonitor {
+	m.sinks = append(m.sinks, sinks...)
+	return m
+}
+
+// WithTelemetry makes the log monitor record its internal metrics to the Telemetry, tagged with its name.
+func (m *LogMonitor) WithTelemetry(telemetry common.Telemetry) *LogMonitor {
+	m.telemetry = telemetry
+	return m
+}
+
+// WithEvaluationTimer makes the log monitor also evaluate its metric at the wall clock time every given period, so that it
+// recovers when logs stop arriving. Logs are expected to be timestamped with the wall clock time, e.g. live traffic.
+func (m *LogMonitor) WithEvaluationTimer(every time.Duration) *LogMonitor {
+	m.evaluationInterval = every
+	return m
+}
+
+// WithBufferSize sets the number of batches of logs its input channel can hold. It replaces the input channel.
+func (m *LogMonitor) WithBufferSize(n int) *LogMonitor {
+	m.InputChan = make(chan []*logs.ProcessedLog, n)
+	return m
+}
+
 // Start starts the log monitor.
 func (m *LogMonitor) Start() error {
-	go m.monitor()
+	var stopTicker func()
+	if m.evaluationInterval > 0 && m.ticks == nil {
+		ticker := time.NewTicker(m.evaluationInterval)
+		m.ticks, stopTicker = ticker.C, ticker.Stop
+	}
+	go m.monitor(stopTicker)
 	return nil
 }
 
@@ -103,37 +211,159 @@ func (m *LogMonitor) IsStopped() bool {
 }
 
 // monitor is the main loop of the log monitor.
-func (m *LogMonitor) monitor() {
+func (m *LogMonitor) monitor(stopTicker func()) {
 	defer m.cleanUp()
-	for input := range m.InputChan {
-		timestamp := input.Timestamp
-		shouldFlush := timestamp > m.lastChecked
-		metric := m.customMetric.Compute(input)
+	defer m.notifyWatermark(math.MaxInt64)
+	if stopTicker != nil {
+		defer stopTicker()
+	}
+	for {
+		select {
+		case input, ok := <-m.InputChan:
+			if !ok {
+				// evaluate the monitor one final time at the latest log timestamp, as the last logs might have come out of order
+				if m.currentTime != math.MinInt64 {
+					m.check(m.currentTime)
+				}
+				return
+			}
+			start := time.Now()
+			for _, l := range input {
+				m.process(l)
+				m.advance(l.Timestamp)
+			}
+			if m.telemetry != nil {
+				m.telemetry.Count(common.MonitorLogsMetric, float64(len(input)), "monitor", m.name)
+				m.telemetry.Observe(common.MonitorDurationMetric, common.Milliseconds(time.Since(start)), "monitor", m.name)
+			}
+		case tick := <-m.ticks:
+			// ticks is nil, and never ready, without evaluation timer
+			m.advance(tick.Unix())
+			m.check(m.currentTime)
+		}
+	}
+}
+
+// advance moves the current time of the monitor to the given timestamp if it is later, and notifies the sinks.
+func (m *LogMonitor) advance(timestamp int64) {
+	if timestamp > m.currentTime {
+		m.currentTime = timestamp
+		m.notifyWatermark(m.currentTime)
+	}
+}
+
+// process evaluates the monitor with a log, and writes its transition if it alerts or recovers.
+func (m *LogMonitor) process(input *logs.ProcessedLog) {
+	timestamp := input.Timestamp
+	shouldFlush := timestamp > m.lastChecked
+	for _, operand := range m.operands {
+		metric := operand.customMetric.Compute(input)
 		if metric != nil {
-			m.metric.AddSample(metric)
+			operand.metric.AddSample(metric)
 			// as samples might come out of order, always flush if this sample matches the alert
 			shouldFlush = true
 		}
-		if !shouldFlush {
-			continue
+	}
+	if !shouldFlush {
+		return
+	}
+	m.check(timestamp)
+}
+
+// check evaluates the monitor at the given timestamp, and writes its transition if it alerts or recovers.
+func (m *LogMonitor) check(timestamp int64) {
+	computedMetric, val, err := m.evaluate(timestamp)
+	if err != nil {
+		return
+	}
+
+	if val > m.alertThreshold && !m.IsInAlert() {
+		m.setInAlert()
+		m.writeAlert(&AlertEvent{
+			Monitor:   m.name,
+			State:     AlertStateAlert,
+			Timestamp: timestamp,
+			Value:     val,
+			Threshold: m.alertThreshold,
+			Message:   m.alertTemplate.Render(m.alertTemplateContextFunc(computedMetric)),
+			Metric:    computedMetric,
+		})
+	} else if val <= m.recoveryThreshold && m.IsInAlert() {
+		m.clearAlert()
+		m.writeAlert(&AlertEvent{
+			Monitor:   m.name,
+			State:     AlertStateRecovered,
+			Timestamp: timestamp,
+			Value:     val,
+			Threshold: m.recoveryThreshold,
+			Message:   m.recoveryTemplate.Render(m.recoveryTemplateContextFunc(computedMetric)),
+			Metric:    computedMetric,
+		})
+	}
+}
+
+// notifyWatermark notifies the sinks that order their output of the latest log timestamp processed.
+func (m *LogMonitor) notifyWatermark(timestamp int64) {
+	for _, sink := range m.sinks {
+		if w, ok := sink.(watermarkSink); ok {
+			w.AdvanceWatermark(timestamp)
 		}
-		computedMetric, err := m.metric.Flush(timestamp)
+	}
+}
+
+// writeAlert writes an alert or recovery transition to the sinks, or prints its message to the logger if there are none.
+func (m *LogMonitor) writeAlert(event *AlertEvent) {
+	if m.telemetry != nil {
+		m.telemetry.Count(common.MonitorTransitionMetric, 1, "monitor", m.name, "state", string(event.State))
+	}
+	if len(m.sinks) == 0 {
+		m.logger.Println(event.Message)
+		return
+	}
+	for _, sink := range m.sinks {
+		if err := sink.WriteAlert(event); err != nil {
+			log.Printf("error while writing the %s transition of monitor %s: %s", event.State, event.Monitor, err)
+		}
+	}
+}
+
+// evaluate flushes the monitored metrics and returns the computed metric and its monitored value.
+// Formula monitors return a computed metric holding the result of the formula, where the operands without samples count as 0.
+func (m *LogMonitor) evaluate(timestamp int64) (*metrics.ComputedMetric, float64, error) {
+	if m.formula == nil {
+		computedMetric, err := m.operands[0].metric.Flush(timestamp)
 		if err != nil {
+			return nil, 0, err
+		}
+		val, err := computedMetric.GetNamedValue(nil, m.value) // no tags supported in monitoring yet
+		return computedMetric, val, err
+	}
+	values := make(map[string]float64, len(m.operands))
+	for _, operand := range m.operands {
+		computedMetric, err := operand.metric.Flush(timestamp)
+		if _, ok := err.(errors.UnsampledMetricError); ok {
 			continue
 		}
-		val, err := computedMetric.GetValue(nil) // no tags supported in monitoring yet
 		if err != nil {
-			continue
+			return nil, 0, err
 		}
-
-		if val > m.alertThreshold && !m.IsInAlert {
-			m.setInAlert()
-			m.logger.Println(m.alertTemplate.Render(m.alertTemplateContextFunc(computedMetric)))
-		} else if val <= m.recoveryThreshold && m.IsInAlert {
-			m.clearAlert()
-			m.logger.Println(m.recoveryTemplate.Render(m.recoveryTemplateContextFunc(computedMetric)))
+		if values[operand.name], err = computedMetric.GetNamedValue(nil, m.value); err != nil {
+			return nil, 0, err
 		}
 	}
+	if len(values) == 0 {
+		return nil, 0, errors.NewUnsampledMetricError()
+	}
+	val, err := m.formula.Evaluate(values)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &metrics.ComputedMetric{
+		Name:        m.name,
+		Aggregation: metrics.DerivedAggregation,
+		Timestamp:   timestamp,
+		Value:       val,
+	}, val, nil
 }
 
 // clanUp is used to store the stopped state of the LogMonitor.
@@ -144,15 +374,15 @@ func (m *LogMonitor) cleanUp() {
 
 // setInAlert sets the log monitor to be in alert state.
 func (m *LogMonitor) setInAlert() {
-	m.IsInAlert = true
+	atomic.StoreUint32(&m.inAlert, 1)
 }
 
 // clearAlert clears the log monitor from its alert state.
 func (m *LogMonitor) clearAlert() {
-	m.IsInAlert = false
+	atomic.StoreUint32(&m.inAlert, 0)
 }
 
-// isInAlert returns true if the log monitor is in alert state.
-func (m *LogMonitor) isInAlert() bool {
-	return m.IsInAlert == true
+// IsInAlert returns true if the log monitor is in alert state. It is safe to call while the log monitor is running.
+func (m *LogMonitor) IsInAlert() bool {
+	return atomic.LoadUint32(&m.inAlert) == 1
 }
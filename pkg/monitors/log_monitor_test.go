@@ -10,14 +10,16 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestLogMonitor(t *testing.T) {
 	defer goleak.VerifyNone(t)
 	buf := bytes.Buffer{}
 	logger := log.New(&buf, "", 0)
-	inputChan := make(chan *logs.ProcessedLog)
+	inputChan := make(chan []*logs.ProcessedLog)
 	expectedOutputLines := []string{
 		"High traffic generated an alert - hits 3, triggered at 101",
 		"Recovered from high traffic at time 105",
@@ -32,7 +34,7 @@ func TestLogMonitor(t *testing.T) {
 		AlertTemplate:  "High traffic generated an alert - hits {{value}}, triggered at {{time}}",
 		AlertTemplateContextFunc: func(m *metrics.ComputedMetric) map[string]string {
 			return map[string]string{
-				"value": strconv.FormatInt(m.Value, 10),
+				"value": metrics.FormatValue(m.Value),
 				"time":  strconv.FormatInt(m.Timestamp, 10),
 			}
 		},
@@ -48,9 +50,8 @@ func TestLogMonitor(t *testing.T) {
 	logMonitor := NewLogMonitor(logMonitorConfig, logger)
 	logMonitor.InputChan = inputChan
 	assert.NoError(t, logMonitor.Start())
-	for _, l := range logsForMonitorTest {
-		inputChan <- l
-	}
+	// the logs of a batch are evaluated one at a time
+	inputChan <- logsForMonitorTest
 	logMonitor.Stop()
 	got := buf.String()
 	fmt.Println(got)
@@ -114,3 +115,355 @@ var logsForMonitorTest = []*logs.ProcessedLog{
 		Host:      "aHost",
 	},
 }
+
+func TestLogMonitor_Percentile(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	buf := bytes.Buffer{}
+	logger := log.New(&buf, "", 0)
+	inputChan := make(chan []*logs.ProcessedLog)
+	bytesMeasure := "bytes"
+	logMonitorConfig := &LogMonitorConfig{
+		Name:           "Large responses monitor",
+		TimeWindow:     2,
+		Filter:         "*",
+		Measure:        &bytesMeasure,
+		Aggregation:    metrics.DistributionAggregation,
+		Value:          "p50",
+		AlertThreshold: 1000,
+		AlertTemplate:  "median bytes {{value}} at {{time}}",
+		AlertTemplateContextFunc: func(m *metrics.ComputedMetric) map[string]string {
+			return map[string]string{
+				"value": metrics.FormatValue(m.Values["p50"]),
+				"time":  strconv.FormatInt(m.Timestamp, 10),
+			}
+		},
+		RecoveryTemplate:  "median bytes recovered at {{time}}",
+		RecoveryThreshold: 1000,
+	}
+	bytesLogs := []*logs.ProcessedLog{
+		{Timestamp: 100, Attributes: map[string]interface{}{"bytes": "100"}},
+		{Timestamp: 101, Attributes: map[string]interface{}{"bytes": "5000"}},
+		{Timestamp: 101, Attributes: map[string]interface{}{"bytes": "5000"}}, // trigger alert
+		{Timestamp: 101}, // no measure
+		{Timestamp: 102, Attributes: map[string]interface{}{"bytes": "200"}}, // recover
+	}
+
+	logMonitor := NewLogMonitor(logMonitorConfig, logger)
+	logMonitor.InputChan = inputChan
+	assert.NoError(t, logMonitor.Start())
+	for _, l := range bytesLogs {
+		inputChan <- []*logs.ProcessedLog{l}
+	}
+	logMonitor.Stop()
+	// the percentile is within the sketch relative accuracy of 5000
+	assert.Equal(t, "median bytes 4965.323 at 101\nmedian bytes recovered at 102\n", buf.String())
+}
+
+func TestLogMonitor_FractionalThreshold(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	buf := bytes.Buffer{}
+	logger := log.New(&buf, "", 0)
+	inputChan := make(chan []*logs.ProcessedLog)
+	duration := "duration"
+	logMonitorConfig := &LogMonitorConfig{
+		Name:           "Slow requests monitor",
+		TimeWindow:     2,
+		Filter:         "*",
+		Measure:        &duration,
+		Aggregation:    metrics.DistributionAggregation,
+		Value:          metrics.MaxValue,
+		AlertThreshold: 0.5,
+		AlertTemplate:  "max duration {{value}} at {{time}}",
+		AlertTemplateContextFunc: func(m *metrics.ComputedMetric) map[string]string {
+			return map[string]string{
+				"value": metrics.FormatValue(m.Values[metrics.MaxValue]),
+				"time":  strconv.FormatInt(m.Timestamp, 10),
+			}
+		},
+		RecoveryTemplate:  "max duration recovered at {{time}}",
+		RecoveryThreshold: 0.5,
+	}
+	durationLogs := []*logs.ProcessedLog{
+		{Timestamp: 100, Attributes: map[string]interface{}{"duration": "0.123"}},
+		{Timestamp: 101, Attributes: map[string]interface{}{"duration": "0.75"}}, // trigger alert
+		{Timestamp: 104, Attributes: map[string]interface{}{"duration": "0.05"}}, // recover
+	}
+
+	logMonitor := NewLogMonitor(logMonitorConfig, logger)
+	logMonitor.InputChan = inputChan
+	assert.NoError(t, logMonitor.Start())
+	for _, l := range durationLogs {
+		inputChan <- []*logs.ProcessedLog{l}
+	}
+	logMonitor.Stop()
+	assert.Equal(t, "max duration 0.75 at 101\nmax duration recovered at 104\n", buf.String())
+}
+
+func TestLogMonitor_Formula(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	buf := bytes.Buffer{}
+	logger := log.New(&buf, "", 0)
+	inputChan := make(chan []*logs.ProcessedLog)
+	logMonitorConfig := &LogMonitorConfig{
+		Name:           "Error rate monitor",
+		TimeWindow:     2,
+		Formula:        "errors / hits * 100",
+		Operands:       map[string]string{"errors": "status:500", "hits": "*"},
+		AlertThreshold: 40,
+		AlertTemplate:  "error rate {{value}}% at {{time}}",
+		AlertTemplateContextFunc: func(m *metrics.ComputedMetric) map[string]string {
+			return map[string]string{
+				"value": metrics.FormatValue(m.Value),
+				"time":  strconv.FormatInt(m.Timestamp, 10),
+			}
+		},
+		RecoveryTemplate:  "error rate recovered at {{time}}",
+		RecoveryThreshold: 40,
+	}
+	statusLogs := []*logs.ProcessedLog{
+		{Timestamp: 100, Status: "200"},
+		{Timestamp: 100, Status: "200"},
+		{Timestamp: 101, Status: "500"},
+		{Timestamp: 101, Status: "500"}, // 2 errors out of 4 hits: trigger alert
+		{Timestamp: 104, Status: "200"}, // the errors leave the window: recover
+	}
+
+	logMonitor := NewLogMonitor(logMonitorConfig, logger)
+	logMonitor.InputChan = inputChan
+	assert.NoError(t, logMonitor.Start())
+	for _, l := range statusLogs {
+		inputChan <- []*logs.ProcessedLog{l}
+	}
+	logMonitor.Stop()
+	assert.Equal(t, "error rate 50% at 101\nerror rate recovered at 104\n", buf.String())
+}
+
+func TestLogMonitor_Cardinality(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	buf := bytes.Buffer{}
+	logger := log.New(&buf, "", 0)
+	inputChan := make(chan []*logs.ProcessedLog)
+	host := "host"
+	logMonitorConfig := &LogMonitorConfig{
+		Name:           "Unique hosts monitor",
+		TimeWindow:     2,
+		Filter:         "*",
+		Measure:        &host,
+		Aggregation:    metrics.CardinalityAggregation,
+		AlertThreshold: 2,
+		AlertTemplate:  "{{value}} unique hosts at {{time}}",
+		AlertTemplateContextFunc: func(m *metrics.ComputedMetric) map[string]string {
+			return map[string]string{
+				"value": metrics.FormatValue(m.Value),
+				"time":  strconv.FormatInt(m.Timestamp, 10),
+			}
+		},
+		RecoveryTemplate:  "unique hosts recovered at {{time}}",
+		RecoveryThreshold: 2,
+	}
+
+	logMonitor := NewLogMonitor(logMonitorConfig, logger)
+	logMonitor.InputChan = inputChan
+	assert.NoError(t, logMonitor.Start())
+	for _, l := range logsForMonitorTest {
+		inputChan <- []*logs.ProcessedLog{l}
+	}
+	logMonitor.Stop()
+	assert.Equal(t, "3 unique hosts at 102\nunique hosts recovered at 105\n", buf.String())
+}
+
+// alertRecorder is an AlertSink that records the events it receives
+type alertRecorder struct {
+	events []*AlertEvent
+}
+
+func (r *alertRecorder) WriteAlert(event *AlertEvent) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+func TestLogMonitor_Sinks(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	buf := bytes.Buffer{}
+	logger := log.New(&buf, "", 0)
+	inputChan := make(chan []*logs.ProcessedLog)
+	logMonitorConfig := &LogMonitorConfig{
+		Name:           "Error rate monitor",
+		TimeWindow:     2,
+		Formula:        "errors / hits * 100",
+		Operands:       map[string]string{"errors": "status:500", "hits": "*"},
+		AlertThreshold: 40,
+		AlertTemplate:  "error rate {{value}}%",
+		AlertTemplateContextFunc: func(m *metrics.ComputedMetric) map[string]string {
+			return map[string]string{"value": metrics.FormatValue(m.Value)}
+		},
+		RecoveryTemplate:  "error rate recovered",
+		RecoveryThreshold: 30,
+	}
+	recorder := &alertRecorder{}
+	logMonitor := NewLogMonitor(logMonitorConfig, logger).WithSinks(recorder)
+	logMonitor.InputChan = inputChan
+	assert.NoError(t, logMonitor.Start())
+	for _, l := range []*logs.ProcessedLog{
+		{Timestamp: 100, Status: "200"},
+		{Timestamp: 101, Status: "500"},
+		{Timestamp: 104, Status: "200"},
+	} {
+		inputChan <- []*logs.ProcessedLog{l}
+	}
+	logMonitor.Stop()
+	assert.Empty(t, buf.String())
+	assert.Equal(t, 2, len(recorder.events))
+	alert, recovery := recorder.events[0], recorder.events[1]
+	assert.Equal(t, AlertEvent{Monitor: "Error rate monitor", State: AlertStateAlert, Timestamp: 101, Value: 50, Threshold: 40, Message: "error rate 50%"},
+		AlertEvent{Monitor: alert.Monitor, State: alert.State, Timestamp: alert.Timestamp, Value: alert.Value, Threshold: alert.Threshold, Message: alert.Message})
+	assert.Equal(t, AlertEvent{Monitor: "Error rate monitor", State: AlertStateRecovered, Timestamp: 104, Value: 0, Threshold: 30, Message: "error rate recovered"},
+		AlertEvent{Monitor: recovery.Monitor, State: recovery.State, Timestamp: recovery.Timestamp, Value: recovery.Value, Threshold: recovery.Threshold, Message: recovery.Message})
+	assert.Equal(t, float64(50), alert.Metric.Value)
+}
+
+func TestLogMonitor_FinalEvaluation(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	buf := bytes.Buffer{}
+	logger := log.New(&buf, "", 0)
+	inputChan := make(chan []*logs.ProcessedLog)
+	logMonitorConfig := &LogMonitorConfig{
+		Name:           "Errors monitor",
+		TimeWindow:     2,
+		Filter:         "status:500",
+		AlertThreshold: 2,
+		AlertTemplate:  "{{value}} errors at {{time}}",
+		AlertTemplateContextFunc: func(m *metrics.ComputedMetric) map[string]string {
+			return map[string]string{
+				"value": metrics.FormatValue(m.Value),
+				"time":  strconv.FormatInt(m.Timestamp, 10),
+			}
+		},
+		RecoveryTemplate:  "errors recovered at {{time}}",
+		RecoveryThreshold: 2,
+	}
+	logMonitor := NewLogMonitor(logMonitorConfig, logger)
+	logMonitor.InputChan = inputChan
+	assert.NoError(t, logMonitor.Start())
+	// the errors come out of order, after a log at 105
+	for _, l := range []*logs.ProcessedLog{
+		{Timestamp: 105, Status: "200"},
+		{Timestamp: 100, Status: "500"},
+		{Timestamp: 101, Status: "500"},
+		{Timestamp: 101, Status: "500"},
+	} {
+		inputChan <- []*logs.ProcessedLog{l}
+	}
+	logMonitor.Stop()
+	// the final evaluation at 105 recovers, as the errors are out of the window
+	assert.Equal(t, "3 errors at 101\nerrors recovered at 105\n", buf.String())
+}
+
+func TestLogMonitor_EvaluationTimer(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	buf := bytes.Buffer{}
+	logger := log.New(&buf, "", 0)
+	inputChan := make(chan []*logs.ProcessedLog)
+	ticks := make(chan time.Time)
+	logMonitorConfig := &LogMonitorConfig{
+		Name:           "High traffic monitor",
+		TimeWindow:     2,
+		Filter:         "*",
+		AlertThreshold: 2,
+		AlertTemplate:  "hits {{value}} at {{time}}",
+		AlertTemplateContextFunc: func(m *metrics.ComputedMetric) map[string]string {
+			return map[string]string{
+				"value": metrics.FormatValue(m.Value),
+				"time":  strconv.FormatInt(m.Timestamp, 10),
+			}
+		},
+		RecoveryTemplate:  "recovered at {{time}}",
+		RecoveryThreshold: 2,
+	}
+	logMonitor := NewLogMonitor(logMonitorConfig, logger).WithEvaluationTimer(time.Second)
+	logMonitor.InputChan, logMonitor.ticks = inputChan, ticks
+	assert.NoError(t, logMonitor.Start())
+	for _, timestamp := range []int64{100, 100, 101} {
+		inputChan <- []*logs.ProcessedLog{{Timestamp: timestamp}}
+	}
+	// no more logs arrive: the timer evaluations recover once the hits leave the window
+	ticks <- time.Unix(102, 0)
+	ticks <- time.Unix(103, 0)
+	ticks <- time.Unix(104, 0)
+	logMonitor.Stop()
+	assert.Equal(t, "hits 3 at 101\nrecovered at 103\n", buf.String())
+}
+
+func TestLogMonitor_Concurrent(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	const producers, logsPerProducer = 8, 500
+	inputChan := make(chan []*logs.ProcessedLog)
+	ticks := make(chan time.Time)
+	logMonitorConfig := &LogMonitorConfig{
+		Name:           "High traffic monitor",
+		TimeWindow:     2,
+		Filter:         "*",
+		AlertThreshold: 20,
+		AlertTemplate:  "high traffic",
+		AlertTemplateContextFunc: func(m *metrics.ComputedMetric) map[string]string {
+			return map[string]string{}
+		},
+		RecoveryThreshold: 20,
+	}
+	recorder := &alertRecorder{}
+	logMonitor := NewLogMonitor(logMonitorConfig, nil).WithSinks(recorder).WithEvaluationTimer(time.Second)
+	logMonitor.InputChan, logMonitor.ticks = inputChan, ticks
+	assert.NoError(t, logMonitor.Start())
+
+	stop := make(chan struct{})
+	var background sync.WaitGroup
+	background.Add(2)
+	// the timer evaluates the monitor while the logs arrive, at the start of the logs so that it does not run ahead of them
+	go func() {
+		defer background.Done()
+		for ii := int64(0); ; ii++ {
+			select {
+			case ticks <- time.Unix(100+ii%5, 0):
+			case <-stop:
+				return
+			}
+		}
+	}()
+	// the alert state is read while the monitor alerts and recovers
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				logMonitor.IsInAlert()
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for ii := 0; ii < logsPerProducer; ii++ {
+				inputChan <- []*logs.ProcessedLog{{Timestamp: int64(100 + ii/10 + p)}}
+			}
+		}(p)
+	}
+	wg.Wait()
+	close(stop)
+	background.Wait()
+	logMonitor.Stop()
+
+	// transitions alternate between alert and recovery, whatever the interleaving
+	assert.NotEmpty(t, recorder.events)
+	for ii, event := range recorder.events {
+		want := AlertStateAlert
+		if ii%2 == 1 {
+			want = AlertStateRecovered
+		}
+		assert.Equal(t, want, event.State)
+	}
+	assert.Equal(t, len(recorder.events)%2 == 1, logMonitor.IsInAlert())
+}
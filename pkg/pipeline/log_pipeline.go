@@ -1,22 +1,35 @@
 package pipeline
 
 import (
+	"fmt"
 	"github.com/ebarti/dd-assignment/pkg/common"
 	"github.com/ebarti/dd-assignment/pkg/logs"
 	"github.com/ebarti/dd-assignment/pkg/monitors"
-	"sync"
+	"os"
+	"strings"
 	"sync/atomic"
+	"time"
 )
 
+// OutputConsumer is the name of the consumer of the output channel of the LogPipeline in its QueueStats
+const OutputConsumer = "metrics"
+
 // LogProcessorFunc is the message processing function that runs for every message received
 type LogProcessorFunc func(*common.Message) (*logs.ProcessedLog, error)
 
-// LogPipeline is a pipeline that processes read log lines as *common.Message and returns *logs.ProcessedLog
+// LogPipeline is a pipeline that processes batches of read log lines as *common.Message and returns batches of *logs.ProcessedLog
+// Every consumer, i.e. its output channel and every observing monitor, has a queue whose QueuePolicy decides what happens
+// when it is full, so that a slow consumer does not have to hold back the others.
 type LogPipeline struct {
-	inputChan        chan *common.Message
-	monitors         []chan *logs.ProcessedLog
-	OutputChan       chan *logs.ProcessedLog
+	inputChan        chan []*common.Message
+	monitors         []*consumerQueue
+	monitorPolicy    QueuePolicy
+	output           *consumerQueue
+	outputPolicy     QueuePolicy
+	spillDir         string
+	OutputChan       chan []*logs.ProcessedLog
 	logProcessorFunc LogProcessorFunc
+	telemetry        common.Telemetry
 	done             chan struct{}
 	isDone           uint32
 }
@@ -24,33 +37,90 @@ type LogPipeline struct {
 // NewLogPipeline creates a new LogPipeline
 func NewLogPipeline(logProcessorFunc LogProcessorFunc) *LogPipeline {
 	return &LogPipeline{
-		inputChan:        make(chan *common.Message),
-		OutputChan:       make(chan *logs.ProcessedLog),
+		inputChan:        make(chan []*common.Message),
+		OutputChan:       make(chan []*logs.ProcessedLog, common.DefaultBufferSize),
 		logProcessorFunc: logProcessorFunc,
+		monitorPolicy:    BlockPolicy,
+		outputPolicy:     BlockPolicy,
+		spillDir:         os.TempDir(),
 		done:             make(chan struct{}),
 	}
 }
 
 // From is used to set the input channel for the pipeline
-func (i *LogPipeline) From(inputChan chan *common.Message) {
+func (i *LogPipeline) From(inputChan chan []*common.Message) {
 	i.inputChan = inputChan
 }
 
+// WithBufferSize sets the number of batches its output channel can hold. It replaces the output channel.
+func (i *LogPipeline) WithBufferSize(n int) *LogPipeline {
+	i.OutputChan = make(chan []*logs.ProcessedLog, n)
+	return i
+}
+
+// WithMonitorPolicy sets the policy of the queues of the monitors added with AddMonitors after it.
+func (i *LogPipeline) WithMonitorPolicy(policy QueuePolicy) *LogPipeline {
+	i.monitorPolicy = policy
+	return i
+}
+
+// WithOutputPolicy sets the policy of the queue of the output channel.
+func (i *LogPipeline) WithOutputPolicy(policy QueuePolicy) *LogPipeline {
+	i.outputPolicy = policy
+	return i
+}
+
+// WithSpillDir sets the directory the queues with SpillPolicy write their batches to, the temporary directory by default.
+func (i *LogPipeline) WithSpillDir(dir string) *LogPipeline {
+	i.spillDir = dir
+	return i
+}
+
+// WithTelemetry makes the pipeline record its internal metrics, and the ones of the queues of its consumers, to the Telemetry.
+func (i *LogPipeline) WithTelemetry(telemetry common.Telemetry) *LogPipeline {
+	i.telemetry = telemetry
+	return i
+}
+
 // AddMonitors is used to add an array of *monitors.LogMonitor to the pipeline
 func (i *LogPipeline) AddMonitors(logMonitor []*monitors.LogMonitor) {
 	for _, monitor := range logMonitor {
-		i.addMonitoredChannel(monitor.InputChan)
+		i.AddMonitor(monitor, i.monitorPolicy)
 	}
 }
 
+// AddMonitor is used to add a *monitors.LogMonitor to the pipeline, with the given policy for its queue
+func (i *LogPipeline) AddMonitor(monitor *monitors.LogMonitor, policy QueuePolicy) {
+	i.monitors = append(i.monitors, newConsumerQueue(monitor.Name(), monitor.InputChan, policy))
+}
+
 // addMonitoredChannel is a helper function that adds a monitor input chan to the monitors array
 // used to make the pipeline testable
-func (i *LogPipeline) addMonitoredChannel(c chan *logs.ProcessedLog) {
-	i.monitors = append(i.monitors, c)
+func (i *LogPipeline) addMonitoredChannel(c chan []*logs.ProcessedLog, policy QueuePolicy) {
+	i.monitors = append(i.monitors, newConsumerQueue(fmt.Sprintf("monitor %d", len(i.monitors)), c, policy))
+}
+
+// QueueStats returns the counters of the queues of the consumers, the output channel first.
+// It is safe to call while the pipeline is running, once it is started.
+func (i *LogPipeline) QueueStats() []*QueueStats {
+	stats := []*QueueStats{i.output.stats()}
+	for _, monitor := range i.monitors {
+		stats = append(stats, monitor.stats())
+	}
+	return stats
 }
 
 // Start starts the pipeline
 func (i *LogPipeline) Start() error {
+	i.output = newConsumerQueue(OutputConsumer, i.OutputChan, i.outputPolicy)
+	for _, queue := range append([]*consumerQueue{i.output}, i.monitors...) {
+		if err := queue.open(i.spillDir); err != nil {
+			return err
+		}
+		if i.telemetry != nil {
+			queue.withTelemetry(i.telemetry)
+		}
+	}
 	go i.run()
 	return nil
 }
@@ -78,31 +148,49 @@ func (i *LogPipeline) run() {
 
 // cleanUp closes the output channel, the input channel of the observing monitors and stores the done state
 func (i *LogPipeline) cleanUp() {
-	close(i.OutputChan)
-	for _, output := range i.monitors {
-		close(output)
+	i.output.close()
+	for _, monitor := range i.monitors {
+		monitor.close()
 	}
 	atomic.StoreUint32(&i.isDone, 1)
 	close(i.done)
 }
 
-// process is the main function that processes a message and forwards the logs.ProcessedLog to all observing channels in a non-blocking fashion
-func (i *LogPipeline) process(msg *common.Message) {
-	log, err := i.logProcessorFunc(msg)
-	if err != nil {
+// process is the main function that processes a batch of messages and forwards the batch of logs.ProcessedLog to all observing channels.
+// Lines that cannot be processed are skipped. The batch is only read by the observers, so they all share it.
+func (i *LogPipeline) process(msgs []*common.Message) {
+	// lines are read in order, so the first line of the batch waited the longest
+	if i.telemetry != nil && len(msgs) > 0 && !msgs[0].IngestionTime.IsZero() {
+		i.telemetry.Observe(common.IngestionLatencyMetric, common.Milliseconds(time.Since(msgs[0].IngestionTime)))
+	}
+	processed := make([]*logs.ProcessedLog, 0, len(msgs))
+	for _, msg := range msgs {
+		log, err := i.logProcessorFunc(msg)
+		if err != nil {
+			if i.telemetry != nil {
+				i.telemetry.Count(common.ParseErrorsMetric, 1, "type", errorType(err))
+			}
+			continue
+		}
+		if log == nil {
+			continue
+		}
+		processed = append(processed, log)
+	}
+	if i.telemetry != nil {
+		i.telemetry.Count(common.LogsProcessedMetric, float64(len(processed)))
+	}
+	if len(processed) == 0 {
 		return
 	}
-	wg := sync.WaitGroup{}
-	wg.Add(len(i.monitors) + 1)
-	for _, output := range i.monitors {
-		go func(output chan *logs.ProcessedLog) {
-			defer wg.Done()
-			output <- log
-		}(output)
+	for _, monitor := range i.monitors {
+		monitor.push(processed)
 	}
-	go func() {
-		defer wg.Done()
-		i.OutputChan <- log
-	}()
-	wg.Wait()
+	i.output.push(processed)
+}
+
+// errorType is a helper function that returns the name of the type of the error, without its package, e.g. InvalidCsvLogFormatError
+func errorType(err error) string {
+	name := fmt.Sprintf("%T", err)
+	return strings.TrimPrefix(name[strings.LastIndex(name, ".")+1:], "*")
 }
@@ -4,6 +4,7 @@ import (
 	"github.com/ebarti/dd-assignment/pkg/common"
 	"github.com/ebarti/dd-assignment/pkg/errors"
 	"github.com/ebarti/dd-assignment/pkg/logs"
+	"github.com/ebarti/dd-assignment/pkg/metrics"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/goleak"
 	"strconv"
@@ -34,17 +35,18 @@ func TestLogPipeline(t *testing.T) {
 		})
 	}
 
-	inputChan := make(chan *common.Message)
-	outputChan := make(chan *logs.ProcessedLog, len(msgs)+1)
-	monitorChan := make(chan *logs.ProcessedLog, len(msgs)+1)
+	inputChan := make(chan []*common.Message)
+	outputChan := make(chan []*logs.ProcessedLog, len(msgs)+1)
+	monitorChan := make(chan []*logs.ProcessedLog, len(msgs)+1)
 	logPipeline := NewLogPipeline(csvLogProcessor)
 	logPipeline.OutputChan = outputChan
 	logPipeline.From(inputChan)
-	logPipeline.addMonitoredChannel(monitorChan)
+	logPipeline.addMonitoredChannel(monitorChan, BlockPolicy)
 	assert.NoError(t, logPipeline.Start())
-	for _, msg := range msgs {
-		inputChan <- msg
-	}
+	// the header line cannot be processed and is skipped
+	header := &common.Message{Content: []byte("\"remotehost\",\"rfc931\",\"authuser\",\"date\",\"request\",\"status\",\"bytes\""), Origin: "test"}
+	inputChan <- append([]*common.Message{header}, msgs[:2]...)
+	inputChan <- msgs[2:]
 	logPipeline.Stop()
 
 	ii := 0
@@ -82,12 +84,16 @@ func TestLogPipeline(t *testing.T) {
 		}
 	}
 	for output := range outputChan {
-		// check that both output and monitored output are the same and match the expected output
+		// check that both output and monitored output are the same batches and match the expected output
 		monitored := <-monitorChan
-		outPutChecker(ii, output)
-		outPutChecker(ii, monitored)
-		ii++
+		assert.Equal(t, len(output), len(monitored))
+		for jj := range output {
+			outPutChecker(ii, output[jj])
+			outPutChecker(ii, monitored[jj])
+			ii++
+		}
 	}
+	assert.Equal(t, len(lines), ii)
 }
 
 var csvLogProcessor LogProcessorFunc = func(msg *common.Message) (*logs.ProcessedLog, error) {
@@ -152,3 +158,41 @@ var csvLogProcessor LogProcessorFunc = func(msg *common.Message) (*logs.Processe
 	log.Attributes["http"] = httpAttributes
 	return log, nil
 }
+
+func TestLogPipeline_Telemetry(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	telemetry := metrics.NewTelemetry()
+	inputChan := make(chan []*common.Message)
+	logPipeline := NewLogPipeline(csvLogProcessor).WithTelemetry(telemetry)
+	logPipeline.From(inputChan)
+	assert.NoError(t, logPipeline.Start())
+	msg := func(line string) *common.Message {
+		return &common.Message{Content: []byte(line), Origin: "test", IngestionTime: time.Now().Add(-time.Second)}
+	}
+	inputChan <- []*common.Message{
+		msg("\"10.0.0.2\",\"-\",\"apache\",1549573860,\"GET /api/user HTTP/1.0\",200,1234"),
+		msg("\"10.0.0.2\",\"-\",\"apache\",1549573860,\"GET /api/user HTTP/1.0\",200"),
+		msg("\"10.0.0.2\",\"-\",\"apache\",yesterday,\"GET /api/user HTTP/1.0\",200,1234"),
+		msg("\"10.0.0.2\",\"-\",\"apache\",1549573860,\"GET\",200,1234"),
+	}
+	<-logPipeline.OutputChan
+	logPipeline.Stop()
+
+	byName := make(map[string]*metrics.ComputedMetric)
+	for _, computedMetric := range telemetry.Flush(1549573860) {
+		byName[computedMetric.Name] = computedMetric
+	}
+	assert.EqualValues(t, 1, byName[common.LogsProcessedMetric].Value)
+	assert.EqualValues(t, 3, byName[common.ParseErrorsMetric].Value)
+	for _, errorType := range []string{"InvalidCsvLogFormatError", "UnableToParseDateError", "InvalidRequestFormatError"} {
+		value, err := byName[common.ParseErrorsMetric].GetValue(&metrics.Tag{Name: "type", Value: errorType})
+		assert.NoError(t, err)
+		assert.EqualValuesf(t, 1, value, "expected 1 parse error of type %s", errorType)
+	}
+	// the batch was ingested a second ago
+	assert.EqualValues(t, 1, byName[common.IngestionLatencyMetric].Values["count"])
+	assert.GreaterOrEqual(t, byName[common.IngestionLatencyMetric].Values["min"], 990.0)
+	value, err := byName[common.QueueDepthMetric].GetValue(&metrics.Tag{Name: "consumer", Value: OutputConsumer})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, value)
+}
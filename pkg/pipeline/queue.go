@@ -0,0 +1,292 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"github.com/ebarti/dd-assignment/pkg/common"
+	"github.com/ebarti/dd-assignment/pkg/errors"
+	"github.com/ebarti/dd-assignment/pkg/logs"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// QueuePolicy defines what the LogPipeline does with a batch of logs when the queue of one of its consumers is full
+type QueuePolicy string
+
+const (
+	// BlockPolicy waits for the consumer, which also holds back the LogPipeline and all its other consumers
+	BlockPolicy QueuePolicy = "block"
+	// DropOldestPolicy drops the oldest batch of the queue to make room for the new one
+	DropOldestPolicy QueuePolicy = "drop-oldest"
+	// DropNewestPolicy drops the new batch
+	DropNewestPolicy QueuePolicy = "drop-newest"
+	// SpillPolicy writes the batches to a file on disk until the consumer catches up, without dropping any
+	SpillPolicy QueuePolicy = "spill"
+)
+
+// ParseQueuePolicy returns the QueuePolicy with the given name
+func ParseQueuePolicy(policy string) (QueuePolicy, error) {
+	switch QueuePolicy(policy) {
+	case BlockPolicy, DropOldestPolicy, DropNewestPolicy, SpillPolicy:
+		return QueuePolicy(policy), nil
+	}
+	return "", errors.NewInvalidQueuePolicyError(policy)
+}
+
+// QueueStats are the counters of the queue of a consumer of the LogPipeline
+type QueueStats struct {
+	Consumer string
+	Policy   QueuePolicy
+	Dropped  int64 // number of logs dropped because the queue was full
+	Spilled  int64 // number of logs written to disk because the queue was full
+}
+
+// consumerQueue delivers the batches of logs of the LogPipeline to the channel of a consumer, according to its policy
+type consumerQueue struct {
+	name      string
+	policy    QueuePolicy
+	output    chan []*logs.ProcessedLog
+	spill     *spillQueue // only set with SpillPolicy, once opened
+	dropped   int64
+	spilled   int64
+	telemetry common.Telemetry
+}
+
+// newConsumerQueue creates a new consumerQueue for the channel of a consumer
+func newConsumerQueue(name string, output chan []*logs.ProcessedLog, policy QueuePolicy) *consumerQueue {
+	if policy == "" {
+		policy = BlockPolicy
+	}
+	return &consumerQueue{name: name, policy: policy, output: output}
+}
+
+// open creates the file the batches are spilled to in the given directory, if the queue spills to disk.
+func (q *consumerQueue) open(spillDir string) error {
+	if q.policy != SpillPolicy {
+		return nil
+	}
+	spill, err := newSpillQueue(spillDir, q.output)
+	if err != nil {
+		return err
+	}
+	q.spill = spill
+	go spill.run()
+	return nil
+}
+
+// withTelemetry makes the queue record its dropped logs, and its depth, to the Telemetry.
+func (q *consumerQueue) withTelemetry(telemetry common.Telemetry) {
+	q.telemetry = telemetry
+	telemetry.Gauge(common.QueueDepthMetric, func() float64 { return float64(q.depth()) }, "consumer", q.name)
+}
+
+// push delivers a batch of logs to the consumer, or drops it or spills it if its queue is full.
+func (q *consumerQueue) push(batch []*logs.ProcessedLog) {
+	switch q.policy {
+	case DropNewestPolicy:
+		select {
+		case q.output <- batch:
+		default:
+			q.drop(len(batch))
+		}
+	case DropOldestPolicy:
+		for {
+			select {
+			case q.output <- batch:
+				return
+			default:
+			}
+			select {
+			case oldest := <-q.output:
+				q.drop(len(oldest))
+			default:
+				// without buffer, there is no oldest batch to drop
+				if cap(q.output) == 0 {
+					q.drop(len(batch))
+					return
+				}
+			}
+		}
+	case SpillPolicy:
+		spilled, err := q.spill.push(batch)
+		if err != nil {
+			log.Printf("error while spilling logs of %s to disk: %s", q.name, err)
+			q.drop(len(batch))
+			return
+		}
+		if spilled {
+			atomic.AddInt64(&q.spilled, int64(len(batch)))
+		}
+	default:
+		q.output <- batch
+	}
+}
+
+// drop counts the logs of a dropped batch
+func (q *consumerQueue) drop(n int) {
+	atomic.AddInt64(&q.dropped, int64(n))
+	if q.telemetry != nil {
+		q.telemetry.Count(common.DroppedLogsMetric, float64(n), "consumer", q.name)
+	}
+}
+
+// depth returns the number of batches waiting to be delivered to the consumer, in its channel or spilled to disk
+func (q *consumerQueue) depth() int {
+	depth := len(q.output)
+	if q.spill != nil {
+		q.spill.mu.Lock()
+		depth += q.spill.pending
+		q.spill.mu.Unlock()
+	}
+	return depth
+}
+
+// close closes the channel of the consumer, once the batches spilled to disk are delivered.
+func (q *consumerQueue) close() {
+	if q.spill != nil {
+		q.spill.close()
+		return
+	}
+	close(q.output)
+}
+
+// stats returns the counters of the queue
+func (q *consumerQueue) stats() *QueueStats {
+	return &QueueStats{
+		Consumer: q.name,
+		Policy:   q.policy,
+		Dropped:  atomic.LoadInt64(&q.dropped),
+		Spilled:  atomic.LoadInt64(&q.spilled),
+	}
+}
+
+// spillQueue delivers batches of logs to a channel, writing them to a file while the channel is full. Once a batch is
+// spilled, the following ones are spilled too until the file is delivered, so that the consumer receives them in order.
+type spillQueue struct {
+	output  chan []*logs.ProcessedLog
+	writer  *os.File
+	reader  *os.File
+	encoder *json.Encoder
+	decoder *json.Decoder
+	pending int // number of batches in the file that were not delivered yet
+	mu      sync.Mutex
+	ready   chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// newSpillQueue creates a new spillQueue backed by a temporary file in the given directory
+func newSpillQueue(dir string, output chan []*logs.ProcessedLog) (*spillQueue, error) {
+	writer, err := ioutil.TempFile(dir, "spill-*.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	reader, err := os.Open(writer.Name())
+	if err != nil {
+		writer.Close()
+		os.Remove(writer.Name())
+		return nil, err
+	}
+	return &spillQueue{
+		output:  output,
+		writer:  writer,
+		reader:  reader,
+		encoder: json.NewEncoder(writer),
+		decoder: json.NewDecoder(reader),
+		ready:   make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// push sends the batch to the channel if nothing is spilled and the channel has room, and spills it otherwise.
+func (s *spillQueue) push(batch []*logs.ProcessedLog) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == 0 {
+		select {
+		case s.output <- batch:
+			return false, nil
+		default:
+		}
+	}
+	if err := s.encoder.Encode(batch); err != nil {
+		return false, err
+	}
+	s.pending++
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// run delivers the spilled batches to the channel, until the spillQueue is closed and every batch is delivered.
+func (s *spillQueue) run() {
+	defer close(s.done)
+	for {
+		s.deliver()
+		select {
+		case <-s.ready:
+		case <-s.closing:
+			// batches spilled before closing were signaled, the last ones are delivered before the channel is closed
+			s.deliver()
+			close(s.output)
+			return
+		}
+	}
+}
+
+// deliver sends the spilled batches to the channel, in order. A batch is only counted as delivered once it is sent, so
+// that push does not send a newer batch before it.
+func (s *spillQueue) deliver() {
+	for {
+		s.mu.Lock()
+		if s.pending == 0 {
+			s.mu.Unlock()
+			return
+		}
+		var batch []*logs.ProcessedLog
+		err := s.decoder.Decode(&batch)
+		s.mu.Unlock()
+		if err != nil {
+			log.Printf("error while reading logs spilled to disk: %s", err)
+		} else {
+			s.output <- batch
+		}
+		s.mu.Lock()
+		s.pending--
+		if s.pending == 0 {
+			s.reset()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// reset empties the file once every batch is delivered, so that it does not grow forever. It must be called with the lock held.
+func (s *spillQueue) reset() {
+	if err := s.writer.Truncate(0); err != nil {
+		log.Printf("error while truncating the spill file %s: %s", s.writer.Name(), err)
+		return
+	}
+	if _, err := s.writer.Seek(0, 0); err != nil {
+		log.Printf("error while truncating the spill file %s: %s", s.writer.Name(), err)
+		return
+	}
+	if _, err := s.reader.Seek(0, 0); err != nil {
+		log.Printf("error while truncating the spill file %s: %s", s.writer.Name(), err)
+		return
+	}
+	s.decoder = json.NewDecoder(s.reader)
+}
+
+// close delivers the spilled batches, closes the channel and removes the file.
+func (s *spillQueue) close() {
+	close(s.closing)
+	<-s.done
+	s.reader.Close()
+	s.writer.Close()
+	os.Remove(s.writer.Name())
+}
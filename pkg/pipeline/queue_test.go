@@ -0,0 +1,135 @@
+package pipeline
+
+import (
+	"github.com/ebarti/dd-assignment/pkg/common"
+	"github.com/ebarti/dd-assignment/pkg/logs"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+	"io/ioutil"
+	"testing"
+)
+
+// batchOf is a helper function that returns a batch of logs with the given timestamps
+func batchOf(timestamps ...int64) []*logs.ProcessedLog {
+	var batch []*logs.ProcessedLog
+	for _, timestamp := range timestamps {
+		batch = append(batch, &logs.ProcessedLog{Timestamp: timestamp, Attributes: map[string]interface{}{"http": map[string]interface{}{"method": "GET"}}})
+	}
+	return batch
+}
+
+// timestampsOf is a helper function that returns the timestamps of the logs of the batches
+func timestampsOf(batches ...[]*logs.ProcessedLog) []int64 {
+	var timestamps []int64
+	for _, batch := range batches {
+		for _, l := range batch {
+			timestamps = append(timestamps, l.Timestamp)
+		}
+	}
+	return timestamps
+}
+
+func TestConsumerQueue_Drop(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      QueuePolicy
+		buffer      int
+		wantQueued  []int64
+		wantDropped int64
+	}{
+		{name: "drop newest keeps the first batches", policy: DropNewestPolicy, buffer: 1, wantQueued: []int64{1}, wantDropped: 5},
+		{name: "drop oldest keeps the last batches", policy: DropOldestPolicy, buffer: 1, wantQueued: []int64{4, 5, 6}, wantDropped: 3},
+		{name: "drop oldest without buffer drops the new batches", policy: DropOldestPolicy, buffer: 0, wantDropped: 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := make(chan []*logs.ProcessedLog, tt.buffer)
+			queue := newConsumerQueue("slow", output, tt.policy)
+			assert.NoError(t, queue.open(t.TempDir()))
+			// the consumer does not read its channel, the queue never blocks
+			queue.push(batchOf(1))
+			queue.push(batchOf(2, 3))
+			queue.push(batchOf(4, 5, 6))
+			queue.close()
+			var queued []int64
+			for batch := range output {
+				queued = append(queued, timestampsOf(batch)...)
+			}
+			assert.Equal(t, tt.wantQueued, queued)
+			assert.Equal(t, &QueueStats{Consumer: "slow", Policy: tt.policy, Dropped: tt.wantDropped}, queue.stats())
+		})
+	}
+}
+
+func TestConsumerQueue_Spill(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	dir := t.TempDir()
+	output := make(chan []*logs.ProcessedLog, 1)
+	queue := newConsumerQueue("slow", output, SpillPolicy)
+	assert.NoError(t, queue.open(dir))
+
+	// the first batch fills the channel, the next ones are spilled to disk
+	for ii := int64(0); ii < 5; ii++ {
+		queue.push(batchOf(2*ii, 2*ii+1))
+	}
+	assert.Equal(t, int64(8), queue.stats().Spilled)
+	var received [][]*logs.ProcessedLog
+	for ii := 0; ii < 5; ii++ {
+		received = append(received, <-output)
+	}
+	// the batches pushed while the spilled ones are delivered keep their order
+	queue.push(batchOf(10))
+	queue.close()
+	for batch := range output {
+		received = append(received, batch)
+	}
+	assert.Equal(t, []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, timestampsOf(received...))
+	assert.Equal(t, "GET", *received[3][0].GetAttribute("http.method"))
+	assert.Equal(t, int64(0), queue.stats().Dropped)
+	// the spill file is removed once closed
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestParseQueuePolicy(t *testing.T) {
+	for _, policy := range []QueuePolicy{BlockPolicy, DropOldestPolicy, DropNewestPolicy, SpillPolicy} {
+		got, err := ParseQueuePolicy(string(policy))
+		assert.NoError(t, err)
+		assert.Equal(t, policy, got)
+	}
+	_, err := ParseQueuePolicy("drop")
+	assert.Error(t, err)
+}
+
+func TestLogPipeline_SlowMonitor(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	inputChan := make(chan []*common.Message)
+	outputChan := make(chan []*logs.ProcessedLog)
+	slowMonitor := make(chan []*logs.ProcessedLog, 1)
+	logPipeline := NewLogPipeline(func(msg *common.Message) (*logs.ProcessedLog, error) {
+		return &logs.ProcessedLog{Message: string(msg.Content)}, nil
+	})
+	logPipeline.OutputChan = outputChan
+	logPipeline.From(inputChan)
+	logPipeline.addMonitoredChannel(slowMonitor, DropNewestPolicy)
+	assert.NoError(t, logPipeline.Start())
+
+	// the monitor never reads its logs, the output still gets all of them
+	go func() {
+		for ii := 0; ii < 10; ii++ {
+			inputChan <- []*common.Message{{Content: []byte("line")}}
+		}
+		logPipeline.Stop()
+	}()
+	received := 0
+	for batch := range outputChan {
+		received += len(batch)
+	}
+	assert.Equal(t, 10, received)
+	assert.Equal(t, []*QueueStats{
+		{Consumer: OutputConsumer, Policy: BlockPolicy},
+		{Consumer: "monitor 0", Policy: DropNewestPolicy, Dropped: 9},
+	}, logPipeline.QueueStats())
+	assert.Equal(t, 1, len(<-slowMonitor))
+}
@@ -3,6 +3,8 @@ package reader
 import (
 	"bufio"
 	"github.com/ebarti/dd-assignment/pkg/common"
+	"github.com/ebarti/dd-assignment/pkg/errors"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -12,12 +14,17 @@ import (
 
 const defaultContentLenLimit = 256 * 1000
 
-// FileReader is a reader that reads a file from a directory
+// FileReader is a reader that reads a file from a directory. It sends the lines in batches of up to its batch size, and
+// sends a partial batch whenever it would wait for more lines, so that lines written slowly to the file are not delayed.
 type FileReader struct {
 	filePath   string
 	osFile     *os.File
 	scanner    *bufio.Scanner
-	OutputChan chan *common.Message
+	batchSize  int
+	batch      []*common.Message
+	content    []byte // content of the lines of the batch
+	OutputChan chan []*common.Message
+	telemetry  common.Telemetry
 	stop       chan struct{}
 	done       chan struct{}
 	isDone     uint32
@@ -28,13 +35,36 @@ type FileReader struct {
 func NewFileReader(filePath string, logger *log.Logger) *FileReader {
 	return &FileReader{
 		filePath:   filePath,
-		OutputChan: make(chan *common.Message),
+		batchSize:  common.DefaultBatchSize,
+		OutputChan: make(chan []*common.Message, common.DefaultBufferSize),
 		stop:       make(chan struct{}),
 		done:       make(chan struct{}),
 		logger:     logger,
 	}
 }
 
+// WithBatchSize sets the maximum number of lines the FileReader sends together.
+func (f *FileReader) WithBatchSize(n int) *FileReader {
+	if n < 1 {
+		n = 1
+	}
+	f.batchSize = n
+	return f
+}
+
+// WithBufferSize sets the number of batches its output channel can hold. It replaces the output channel.
+func (f *FileReader) WithBufferSize(n int) *FileReader {
+	f.OutputChan = make(chan []*common.Message, n)
+	return f
+}
+
+// WithTelemetry makes the FileReader record its internal metrics to the Telemetry.
+func (f *FileReader) WithTelemetry(telemetry common.Telemetry) *FileReader {
+	f.telemetry = telemetry
+	telemetry.Gauge(common.QueueDepthMetric, func() float64 { return float64(len(f.OutputChan)) }, "consumer", "log pipeline")
+	return f
+}
+
 // Start starts the FileReader
 func (f *FileReader) Start() error {
 	if err := f.setup(); err != nil {
@@ -57,24 +87,65 @@ func (f *FileReader) IsStopped() bool {
 	return atomic.LoadUint32(&f.isDone) == 1
 }
 
-// readFile reads the file line by line, builds a common.Message for each line and sends it to the FileReader's OutputChan
+// readFile reads the file line by line, builds a common.Message for each line and sends them in batches to the FileReader's OutputChan
 func (f *FileReader) readFile() {
 	defer f.cleanUp()
 	origin := f.osFile.Name()
 	for {
 		if !f.scanner.Scan() {
-			if err := f.scanner.Err(); err != nil {
+			err := f.scanner.Err()
+			if _, ok := err.(errors.ReaderStoppedError); ok {
+				return
+			}
+			if err != nil {
 				f.logger.Panicf("Error while reading file %s: %s", origin, err)
 			}
+			f.flush()
 			return
 		}
-		select {
-		case f.OutputChan <- common.NewMessage(f.scanner.Bytes(), origin, time.Now().Unix()):
-			continue
-		case <-f.stop:
-			return
+		// the scanner reuses its buffer, so the content is copied to the buffer of the batch
+		start := len(f.content)
+		f.content = append(f.content, f.scanner.Bytes()...)
+		f.batch = append(f.batch, common.NewMessage(f.content[start:len(f.content):len(f.content)], origin, time.Now()))
+		if len(f.batch) >= f.batchSize {
+			if err := f.flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// flush sends the lines read since the previous batch to the FileReader's OutputChan, unless the FileReader is stopped.
+func (f *FileReader) flush() error {
+	if len(f.batch) == 0 {
+		return nil
+	}
+	select {
+	case f.OutputChan <- f.batch:
+		if f.telemetry != nil {
+			f.telemetry.Count(common.LinesReadMetric, float64(len(f.batch)))
+			f.telemetry.Count(common.BytesReadMetric, float64(len(f.content)))
 		}
+		f.batch = make([]*common.Message, 0, f.batchSize)
+		f.content = make([]byte, 0, cap(f.content))
+		return nil
+	case <-f.stop:
+		return errors.NewReaderStoppedError(f.filePath)
+	}
+}
+
+// flushingReader is an io.Reader that flushes the lines read so far before every read of the underlying file, i.e. whenever
+// the scanner ran out of buffered lines and the read might wait for more.
+type flushingReader struct {
+	reader     io.Reader
+	fileReader *FileReader
+}
+
+func (r *flushingReader) Read(p []byte) (int, error) {
+	if err := r.fileReader.flush(); err != nil {
+		return 0, err
 	}
+	return r.reader.Read(p)
 }
 
 // cleanUp closes the FileReader's osFile, as well as its OutputChan and stores the done state
@@ -95,8 +166,14 @@ func (f *FileReader) setup() error {
 	if err != nil {
 		return err
 	}
-	f.scanner = bufio.NewScanner(f.osFile)
+	f.setupScanner()
+	return nil
+}
+
+// setupScanner sets up the scanner of the FileReader's osFile with the defaultContentLenLimit as the buffer size
+func (f *FileReader) setupScanner() {
+	f.scanner = bufio.NewScanner(&flushingReader{reader: f.osFile, fileReader: f})
 	buffer := make([]byte, 0, defaultContentLenLimit)
 	f.scanner.Buffer(buffer, defaultContentLenLimit)
-	return nil
+	f.batch = make([]*common.Message, 0, f.batchSize)
 }
@@ -25,17 +25,20 @@ func TestFileReader_readFile(t *testing.T) {
 
 	buf := bytes.Buffer{}
 	logger := log.New(&buf, "", 0)
-	outputChan := make(chan *common.Message)
+	outputChan := make(chan []*common.Message)
 
-	fileReader := NewFileReader(testFilePath, logger)
+	fileReader := NewFileReader(testFilePath, logger).WithBatchSize(100)
 	fileReader.OutputChan = outputChan
 
 	assert.NoErrorf(t, fileReader.Start(), "error starting file reader")
 	var gotOutput []byte
-	for input := range outputChan {
-		content := input.Content
-		content = append(content, '\n')
-		gotOutput = append(gotOutput, content...)
+	for batch := range outputChan {
+		assert.LessOrEqual(t, len(batch), 100)
+		for _, input := range batch {
+			content := input.Content
+			content = append(content, '\n')
+			gotOutput = append(gotOutput, content...)
+		}
 	}
 	assert.Equal(t, fileSize, int64(len(gotOutput)))
 	assert.Equal(t, fileContent, gotOutput)
@@ -45,7 +48,7 @@ func TestFileReader_readFile(t *testing.T) {
 func TestFileReader_Stop(t *testing.T) {
 	// as we deal with goroutines, ensure there are no unexpected goroutines at the end of the test
 	defer goleak.VerifyNone(t)
-	outputChan := make(chan *common.Message, 1)
+	outputChan := make(chan []*common.Message, 1)
 	buf := bytes.Buffer{}
 	logger := log.New(&buf, "", 0)
 	fileReader := NewFileReader(testFilePath, logger)
@@ -61,6 +64,34 @@ func TestFileReader_Stop(t *testing.T) {
 	assert.Equal(t, true, fileReader.IsStopped())
 }
 
+func TestFileReader_PartialBatch(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	reader, writer, err := os.Pipe()
+	assert.NoError(t, err)
+	buf := bytes.Buffer{}
+	logger := log.New(&buf, "", 0)
+	fileReader := NewFileReader("", logger)
+	fileReader.osFile = reader
+	fileReader.setupScanner()
+	go fileReader.readFile()
+
+	// the lines written so far are sent without waiting for the batch to be full
+	_, err = writer.WriteString("first\nsecond\n")
+	assert.NoError(t, err)
+	batch := <-fileReader.OutputChan
+	assert.Equal(t, 2, len(batch))
+	assert.Equal(t, "first", string(batch[0].Content))
+	assert.Equal(t, "second", string(batch[1].Content))
+
+	_, err = writer.WriteString("third\n")
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	batch = <-fileReader.OutputChan
+	assert.Equal(t, "third", string(batch[0].Content))
+	_, ok := <-fileReader.OutputChan
+	assert.False(t, ok)
+}
+
 func getFileSizeInBytes(t *testing.T, path string) int64 {
 	file, err := os.Open(path)
 	if err != nil {
@@ -1,15 +1,23 @@
 package pkg
 
 import (
+	"github.com/ebarti/dd-assignment/pkg/api"
+	"github.com/ebarti/dd-assignment/pkg/forwarder"
 	"github.com/ebarti/dd-assignment/pkg/metrics"
 	"github.com/ebarti/dd-assignment/pkg/monitors"
 	"github.com/ebarti/dd-assignment/pkg/pipeline"
 	"github.com/ebarti/dd-assignment/pkg/reader"
+	"github.com/ebarti/dd-assignment/pkg/sinks"
+	"github.com/ebarti/dd-assignment/pkg/storage"
 	"log"
 	"os"
 	"os/signal"
+	"time"
 )
 
+// stoppedPollInterval is how often Wait checks whether the components are stopped
+const stoppedPollInterval = 10 * time.Millisecond
+
 // Service is the main struct of the service that holds all the components created to solve this Datadog's take home exercise
 type Service struct {
 	reader           *reader.FileReader
@@ -17,7 +25,16 @@ type Service struct {
 	metricsPipeline  *metrics.MetricsPipeline
 	metricAggregator *metrics.MetricAggregator
 	monitors         []*monitors.LogMonitor
+	store            *storage.TimeSeriesStore
+	defaultStore     bool // whether the store was created by WithQueryServer, and follows WithTimeZone
+	location         *time.Location
+	queryServer      *api.QueryServer
+	dogStatsD        *forwarder.DogStatsDForwarder
+	sinks            []sinks.Sink
+	orderedOutput    *sinks.OrderedSink
+	orderBufferSize  int
 	sigChan          chan os.Signal
+	logger           *log.Logger
 }
 
 // NewService creates a new Service
@@ -29,28 +46,19 @@ func NewService(
 	monitorConfigs []*monitors.LogMonitorConfig,
 	logger *log.Logger,
 ) *Service {
-	r := reader.NewFileReader(filePath, logger)
-	logPipeline := pipeline.NewLogPipeline(logProcessor)
-	logPipeline.From(r.OutputChan)
-	metricsPipeline := metrics.NewMetricsPipeline(customMetrics)
-	metricsPipeline.From(logPipeline.OutputChan)
-	aggregator := metrics.NewMetricAggregator(logger, interval)
-	aggregator.From(metricsPipeline.OutputChan)
 	var m []*monitors.LogMonitor
-	if len(monitorConfigs) > 0 {
-		for _, config := range monitorConfigs {
-			m = append(m, monitors.NewLogMonitor(config, logger))
-		}
-		logPipeline.AddMonitors(m)
+	for _, config := range monitorConfigs {
+		m = append(m, monitors.NewLogMonitor(config, logger))
 	}
-
+	// the components are connected on Start, once their channels are set
 	return &Service{
-		reader:           r,
-		logPipeline:      logPipeline,
-		metricsPipeline:  metricsPipeline,
-		metricAggregator: aggregator,
+		reader:           reader.NewFileReader(filePath, logger),
+		logPipeline:      pipeline.NewLogPipeline(logProcessor),
+		metricsPipeline:  metrics.NewMetricsPipeline(customMetrics),
+		metricAggregator: metrics.NewMetricAggregator(logger, interval),
 		monitors:         m,
 		sigChan:          make(chan os.Signal, 1),
+		logger:           logger,
 	}
 }
 
@@ -62,8 +70,159 @@ func (s *Service) CancelOnSignal(signals ...os.Signal) *Service {
 	return s
 }
 
+// WithTopN : only output the top N tag values and tag combinations of every metric
+func (s *Service) WithTopN(n int) *Service {
+	s.metricAggregator.WithTopN(n)
+	return s
+}
+
+// WithTagLimits : limit the number of distinct values a tag of a metric, and all the tags of all the metrics, can have in an interval
+func (s *Service) WithTagLimits(perMetric, global int) *Service {
+	s.metricAggregator.WithTagLimits(perMetric, global)
+	return s
+}
+
+// WithCardinalityStats : output the number of distinct values of every tag every interval
+func (s *Service) WithCardinalityStats(enabled bool) *Service {
+	s.metricAggregator.WithCardinalityStats(enabled)
+	return s
+}
+
+// WithDerivedMetrics : output metrics computed with a formula over the other metrics every interval
+func (s *Service) WithDerivedMetrics(derivedMetrics ...*metrics.DerivedMetric) *Service {
+	s.metricAggregator.WithDerivedMetrics(derivedMetrics...)
+	return s
+}
+
+// WithAllowedLateness : keep every interval open for the given number of seconds of event time, so that out of order logs are still aggregated
+func (s *Service) WithAllowedLateness(seconds int64) *Service {
+	s.metricAggregator.WithAllowedLateness(seconds)
+	return s
+}
+
+// WithProcessingTime : aggregate the logs in the interval of the wall clock time they are read at, and flush every interval on schedule even
+// without logs. Monitors are evaluated every second, so that they recover when logs stop arriving. Meant for live traffic
+func (s *Service) WithProcessingTime(enabled bool) *Service {
+	s.metricAggregator.WithProcessingTime(enabled)
+	if enabled {
+		for _, m := range s.monitors {
+			m.WithEvaluationTimer(time.Second)
+		}
+	}
+	return s
+}
+
+// WithTimeZone : align the intervals on multiples of the interval in the local time of the time zone, e.g. on midnight for daily intervals
+func (s *Service) WithTimeZone(location *time.Location) *Service {
+	s.location = location
+	s.metricAggregator.WithTimeZone(location)
+	if s.defaultStore {
+		s.store.WithTimeZone(location)
+	}
+	return s
+}
+
+// WithShards : aggregate the metrics in n goroutines, each owning a partition of the series, so that aggregation scales with the cores
+func (s *Service) WithShards(n int) *Service {
+	s.metricAggregator.WithShards(n)
+	return s
+}
+
+// WithBatchSize : read and process the log lines in batches of up to n lines
+func (s *Service) WithBatchSize(n int) *Service {
+	s.reader.WithBatchSize(n)
+	return s
+}
+
+// WithBufferSize : let every channel between two components hold up to n batches, so that a component does not wait for the next one
+// to be ready
+func (s *Service) WithBufferSize(n int) *Service {
+	s.reader.WithBufferSize(n)
+	s.logPipeline.WithBufferSize(n)
+	s.metricsPipeline.WithBufferSize(n)
+	for _, m := range s.monitors {
+		m.WithBufferSize(n)
+	}
+	return s
+}
+
+// WithQueuePolicies : set what the log pipeline does with the logs of the monitors, and of the metrics, when they fall behind.
+// Batches are spilled to files in spillDir with pipeline.SpillPolicy, the temporary directory if empty
+func (s *Service) WithQueuePolicies(monitorPolicy, metricsPolicy pipeline.QueuePolicy, spillDir string) *Service {
+	s.logPipeline.WithMonitorPolicy(monitorPolicy).WithOutputPolicy(metricsPolicy)
+	if spillDir != "" {
+		s.logPipeline.WithSpillDir(spillDir)
+	}
+	return s
+}
+
+// WithTelemetry : output the internal metrics of every component with the statistics of every interval, so that they are
+// stored, served and forwarded like the other metrics
+func (s *Service) WithTelemetry(enabled bool) *Service {
+	if !enabled {
+		return s
+	}
+	telemetry := metrics.NewTelemetry()
+	s.reader.WithTelemetry(telemetry)
+	s.logPipeline.WithTelemetry(telemetry)
+	s.metricsPipeline.WithTelemetry(telemetry)
+	s.metricAggregator.WithTelemetry(telemetry)
+	for _, m := range s.monitors {
+		m.WithTelemetry(telemetry)
+	}
+	return s
+}
+
+// WithStore : keep the history of the flushed metrics in the store, whose rollups should be aligned in the time zone of the intervals
+func (s *Service) WithStore(store *storage.TimeSeriesStore) *Service {
+	s.store = store
+	s.metricAggregator.WithStore(store)
+	return s
+}
+
+// WithQueryServer : serve queries over the history of the store, and the latest metrics for Prometheus, on the given address.
+// Without a store, one with the default rollups is created, aligned in the time zone of the intervals whenever it is set.
+// Once the file is processed, the service keeps serving them until it is interrupted
+func (s *Service) WithQueryServer(address string) *Service {
+	if s.store == nil {
+		s.WithStore(storage.NewTimeSeriesStore(storage.DefaultRawRetention, storage.DefaultRollups...).WithTimeZone(s.location))
+		s.defaultStore = true
+	}
+	exporter := api.NewPrometheusExporter()
+	s.metricAggregator.WithStore(exporter)
+	s.queryServer = api.NewQueryServer(address, s.store, s.logger).Handle(api.PrometheusPath, exporter)
+	return s
+}
+
+// WithDogStatsD : forward the flushed metrics to a DogStatsD server
+func (s *Service) WithDogStatsD(f *forwarder.DogStatsDForwarder) *Service {
+	s.dogStatsD = f
+	s.metricAggregator.WithStore(f)
+	return s
+}
+
+// WithSinks : write the statistics of every interval and the alert and recovery transitions to the sinks instead of the logger
+func (s *Service) WithSinks(outputs ...sinks.Sink) *Service {
+	s.sinks = append(s.sinks, outputs...)
+	return s
+}
+
+// WithOrderedOutput : order the statistics and the alert and recovery transitions by log timestamp, buffering up to bufferSize of them.
+// Without sinks, they are written as text to the logger
+func (s *Service) WithOrderedOutput(bufferSize int) *Service {
+	s.orderBufferSize = bufferSize
+	return s
+}
+
 // Start : start the service
 func (s *Service) Start() error {
+	s.connect()
+	s.attachSinks()
+	if s.queryServer != nil {
+		if err := s.queryServer.Start(); err != nil {
+			return err
+		}
+	}
 	// start services backwards
 	if err := s.metricAggregator.Start(); err != nil {
 		return err
@@ -88,9 +247,75 @@ func (s *Service) Start() error {
 // Wait : wait for the service to be cancelled
 func (s *Service) Wait() {
 	for !s.IsStopped() {
-		// block
+		// poll rather than spin, so that the components get the cores
+		time.Sleep(stoppedPollInterval)
 	}
 	close(s.sigChan)
+	for _, stats := range s.logPipeline.QueueStats() {
+		if stats.Dropped > 0 {
+			log.Printf("Warning: %d logs were dropped as %s fell behind", stats.Dropped, stats.Consumer)
+		}
+	}
+	if s.queryServer != nil {
+		s.logger.Printf("Serving metric queries on http://%s%s until interrupted", s.queryServer.Addr(), api.QueryPath)
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		<-interrupt
+		signal.Stop(interrupt)
+		s.queryServer.Stop()
+	}
+	if s.dogStatsD != nil {
+		if err := s.dogStatsD.Close(); err != nil {
+			log.Printf("Error while closing the DogStatsD connection: %s", err)
+		}
+	}
+	if s.orderedOutput != nil {
+		// closes the sinks it writes to
+		if err := s.orderedOutput.Close(); err != nil {
+			log.Printf("Error while closing the output: %s", err)
+		}
+	} else {
+		for _, sink := range s.sinks {
+			if err := sink.Close(); err != nil {
+				log.Printf("Error while closing the output: %s", err)
+			}
+		}
+	}
+	if s.store != nil {
+		if err := s.store.Close(); err != nil {
+			log.Printf("Error while closing the metric store: %s", err)
+		}
+	}
+}
+
+// connect : make every component read the output channel of the previous one
+func (s *Service) connect() {
+	s.logPipeline.From(s.reader.OutputChan)
+	s.logPipeline.AddMonitors(s.monitors)
+	s.metricsPipeline.From(s.logPipeline.OutputChan)
+	s.metricAggregator.From(s.metricsPipeline.OutputChan)
+}
+
+// attachSinks : make the aggregator and the monitors write to the sinks, through an ordered output if enabled
+func (s *Service) attachSinks() {
+	if s.orderBufferSize <= 0 {
+		for _, sink := range s.sinks {
+			s.metricAggregator.WithSinks(sink)
+			for _, m := range s.monitors {
+				m.WithSinks(sink)
+			}
+		}
+		return
+	}
+	outputs := s.sinks
+	if len(outputs) == 0 {
+		outputs = []sinks.Sink{sinks.NewWriterSink(s.logger.Writer(), sinks.TextFormat)}
+	}
+	s.orderedOutput = sinks.NewOrderedSink(s.orderBufferSize, outputs...)
+	s.metricAggregator.WithSinks(s.orderedOutput.Producer())
+	for _, m := range s.monitors {
+		m.WithSinks(s.orderedOutput.Producer())
+	}
 }
 
 // IsStopped : check if the service is stopped
@@ -8,13 +8,19 @@ import (
 	"github.com/ebarti/dd-assignment/pkg/logs"
 	"github.com/ebarti/dd-assignment/pkg/metrics"
 	"github.com/ebarti/dd-assignment/pkg/monitors"
+	"github.com/ebarti/dd-assignment/pkg/storage"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/goleak"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestService(t *testing.T) {
@@ -41,6 +47,50 @@ func TestService(t *testing.T) {
 	}
 }
 
+func TestService_OrderedOutput(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	filePath := "../test_resources/service_test_csv.txt"
+	run := func() string {
+		buf := bytes.Buffer{}
+		logger := log.New(&buf, "", 0)
+		// without lateness, every interval is flushed as soon as a log of the next one arrives
+		service := NewService(filePath, 2, logPipelineForTest, []*metrics.CustomMetricPipeline{customMetricPipelineForTest}, []*monitors.LogMonitorConfig{logMonitorConfigForTest}, logger).
+			WithAllowedLateness(0).
+			WithOrderedOutput(100)
+		assert.NoError(t, service.Start())
+		service.Wait()
+		return buf.String()
+	}
+	output := run()
+	var transcript []string
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "High traffic") || strings.HasPrefix(line, "Recovered") || strings.Contains(line, "Statistics for time interval") {
+			transcript = append(transcript, line)
+		}
+	}
+	// the statistics and the alerts are ordered by log timestamp
+	statsLine := func(timestamp, start, end int64) string {
+		return fmt.Sprintf("[%v] Statistics for time interval %v-%v", time.Unix(timestamp, 0), time.Unix(start, 0), time.Unix(end, 0))
+	}
+	assert.Equal(t, []string{
+		"High traffic generated an alert - hits 3, triggered at 101",
+		statsLine(102, 100, 102),
+		statsLine(105, 102, 104),
+		"Recovered from high traffic at time 105",
+		// at the same timestamp, the statistics go before the alerts
+		statsLine(106, 104, 106),
+		"High traffic generated an alert - hits 3, triggered at 106",
+		statsLine(108, 106, 108),
+		// the last interval is flushed at the end of the file
+		statsLine(109, 108, 110),
+		"Recovered from high traffic at time 109",
+	}, transcript)
+	// a replay produces the same transcript
+	for ii := 0; ii < 5; ii++ {
+		assert.Equal(t, output, run())
+	}
+}
+
 var logPipelineForTest = func(msg *common.Message) (*logs.ProcessedLog, error) {
 	header := "\"remotehost\",\"rfc931\",\"authuser\",\"date\",\"request\",\"status\",\"bytes\""
 	headerLen := len(strings.Split(header, ","))
@@ -115,7 +165,7 @@ var logMonitorConfigForTest = &monitors.LogMonitorConfig{
 	AlertTemplate:  "High traffic generated an alert - hits {{value}}, triggered at {{time}}",
 	AlertTemplateContextFunc: func(m *metrics.ComputedMetric) map[string]string {
 		return map[string]string{
-			"value": strconv.FormatInt(m.Value, 10),
+			"value": metrics.FormatValue(m.Value),
 			"time":  fmt.Sprintf("%v", strconv.FormatInt(m.Timestamp, 10)),
 		}
 	},
@@ -127,3 +177,136 @@ var logMonitorConfigForTest = &monitors.LogMonitorConfig{
 		}
 	},
 }
+
+// scaledSampleFile is a helper function that writes the sample file repeated the given number of times, each copy shifted
+// after the previous one, and returns its path and number of lines
+func scaledSampleFile(b *testing.B, copies int) (string, int) {
+	content, err := ioutil.ReadFile("../test_resources/sample_csv.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	header, body := lines[0], lines[1:]
+	var buf bytes.Buffer
+	buf.WriteString(header + "\n")
+	for ii := 0; ii < copies; ii++ {
+		for _, line := range body {
+			fields := strings.Split(line, ",")
+			timestamp, err := strconv.ParseInt(fields[3], 10, 64)
+			if err != nil {
+				b.Fatal(err)
+			}
+			fields[3] = strconv.FormatInt(timestamp+int64(ii)*3600, 10)
+			buf.WriteString(strings.Join(fields, ",") + "\n")
+		}
+	}
+	path := filepath.Join(b.TempDir(), "sample_csv.txt")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		b.Fatal(err)
+	}
+	return path, 1 + copies*len(body)
+}
+
+func BenchmarkService(b *testing.B) {
+	filePath, lines := scaledSampleFile(b, 20)
+	for _, batchSize := range []int{1, 16, common.DefaultBatchSize} {
+		b.Run(fmt.Sprintf("batch size %d", batchSize), func(b *testing.B) {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			start := time.Now()
+			for ii := 0; ii < b.N; ii++ {
+				service := NewService(filePath, 10, logPipelineForTest, []*metrics.CustomMetricPipeline{customMetricPipelineForTest}, []*monitors.LogMonitorConfig{logMonitorConfigForTest}, log.New(ioutil.Discard, "", 0)).
+					WithBatchSize(batchSize)
+				if err := service.Start(); err != nil {
+					b.Fatal(err)
+				}
+				service.Wait()
+			}
+			elapsed := time.Since(start)
+			runtime.ReadMemStats(&after)
+			total := float64(lines * b.N)
+			b.ReportMetric(total/elapsed.Seconds(), "lines/s")
+			b.ReportMetric(float64(after.Mallocs-before.Mallocs)/total, "allocs/line")
+		})
+	}
+}
+
+func TestService_Telemetry(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	filePath := "../test_resources/service_test_csv.txt"
+	content, err := ioutil.ReadFile(filePath)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	buf := bytes.Buffer{}
+	logger := log.New(&buf, "", 0)
+	store := storage.NewTimeSeriesStore(storage.DefaultRawRetention)
+	service := NewService(filePath, 2, logPipelineForTest, []*metrics.CustomMetricPipeline{customMetricPipelineForTest}, []*monitors.LogMonitorConfig{logMonitorConfigForTest}, logger).
+		WithStore(store).
+		WithTelemetry(true)
+	assert.NoError(t, service.Start())
+	service.Wait()
+
+	// the internal metrics are flushed with the statistics of every interval, and stored like the other metrics
+	total := func(metricName string) float64 {
+		var sum float64
+		for _, series := range store.Query(metricName, nil, 0, math.MaxInt64) {
+			for _, point := range series.Points {
+				sum += point.Value
+			}
+		}
+		return sum
+	}
+	assert.EqualValues(t, len(lines), total(common.LinesReadMetric))
+	assert.EqualValues(t, len(content)-len(lines), total(common.BytesReadMetric))
+	assert.EqualValues(t, len(lines), total(common.LogsProcessedMetric))
+	// the monitors might still evaluate the last logs when the last interval is flushed
+	assert.LessOrEqual(t, total(common.MonitorLogsMetric), float64(len(lines)))
+	assert.LessOrEqual(t, total(common.MonitorTransitionMetric), 4.0)
+	assert.NotEmpty(t, store.Query(common.FlushDurationMetric, nil, 0, math.MaxInt64))
+	assert.Contains(t, buf.String(), "Metric "+common.GoroutinesMetric+" gauge")
+}
+
+func TestService_DefaultAllowedLateness(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	// the logs of the sample file are up to 2 seconds out of order
+	filePath := "../test_resources/sample_csv.txt"
+	run := func(service *Service) int64 {
+		assert.NoError(t, service.Start())
+		service.Wait()
+		return service.metricAggregator.LateSamples()
+	}
+	newService := func() *Service {
+		logger := log.New(ioutil.Discard, "", 0)
+		return NewService(filePath, 10, logPipelineForTest, []*metrics.CustomMetricPipeline{customMetricPipelineForTest}, []*monitors.LogMonitorConfig{logMonitorConfigForTest}, logger)
+	}
+	assert.Zero(t, run(newService()))
+	// without lateness, the out of order logs are dropped
+	assert.Greater(t, run(newService().WithAllowedLateness(0)), int64(0))
+}
+
+func TestService_QueryServerTimeZone(t *testing.T) {
+	// a time zone half an hour ahead of UTC, whose hourly rollups start at :30 UTC
+	location := time.FixedZone("UTC+00:30", 30*60)
+	newService := func() *Service {
+		logger := log.New(ioutil.Discard, "", 0)
+		return NewService("../test_resources/sample_csv.txt", 10, logPipelineForTest, nil, nil, logger)
+	}
+	hourlyStart := func(service *Service) int64 {
+		day := int64(24 * 60 * 60)
+		for _, start := range []int64{0, 2 * day} {
+			service.store.Store(start, start+60, []*metrics.ComputedMetric{{
+				Name:        "hits",
+				Aggregation: metrics.CountAggregation,
+				Value:       1,
+				Series:      []*metrics.ComputedMetric{{Value: 1}},
+			}})
+		}
+		// the first point is older than the retention of the 1 minute rollup, so it is queried from the hourly one
+		got := service.store.Query("hits", nil, 0, 60)
+		assert.Equal(t, 1, len(got))
+		return got[0].Points[0].Start
+	}
+	assert.Equal(t, int64(-30*60), hourlyStart(newService().WithTimeZone(location).WithQueryServer("localhost:0")))
+	assert.Equal(t, int64(-30*60), hourlyStart(newService().WithQueryServer("localhost:0").WithTimeZone(location)))
+	assert.Equal(t, int64(0), hourlyStart(newService().WithQueryServer("localhost:0")))
+}
@@ -0,0 +1,177 @@
+package sinks
+
+import (
+	"container/heap"
+	"github.com/ebarti/dd-assignment/pkg/metrics"
+	"github.com/ebarti/dd-assignment/pkg/monitors"
+	"log"
+	"math"
+	"sync"
+)
+
+// DefaultOrderedBufferSize is the default number of events an OrderedSink buffers before it releases the oldest one
+// without waiting for the watermark
+const DefaultOrderedBufferSize = 10000
+
+// OrderedSink orders the events written by several producers, e.g. the MetricAggregator and the LogMonitors, by event
+// time before writing them to its sinks, so that the output of a replay is always the same.
+// Every producer writes through its own OrderedProducer, which is notified of the latest log timestamp the producer
+// processed. An event is keyed by that timestamp when it is written, and is released once every producer has processed
+// a later log. Events with the same key are released in the order the producers were created in, and then in the order
+// they were written. Once the buffer is full, the oldest event is released without waiting. OrderedSink is thread-safe.
+type OrderedSink struct {
+	sinks       []Sink
+	maxBuffered int
+	events      orderedEvents
+	producers   []*OrderedProducer
+	seq         uint64
+	mu          sync.Mutex
+}
+
+// OrderedProducer is the Sink a producer writes its events to an OrderedSink through
+type OrderedProducer struct {
+	sink      *OrderedSink
+	index     int
+	watermark int64 // latest log timestamp processed by the producer
+}
+
+// orderedEvent is an event buffered by an OrderedSink
+type orderedEvent struct {
+	key      int64
+	producer int
+	seq      uint64
+	stats    *metrics.IntervalStats
+	alert    *monitors.AlertEvent
+}
+
+// NewOrderedSink creates a new OrderedSink that buffers up to maxBuffered events before writing them to the sinks
+func NewOrderedSink(maxBuffered int, sinks ...Sink) *OrderedSink {
+	return &OrderedSink{sinks: sinks, maxBuffered: maxBuffered}
+}
+
+// Producer returns the Sink of a new producer. Events are only released once all the producers have processed a later log,
+// so every producer must be created before the first event is written, and closed or notified of math.MaxInt64 when it stops
+func (o *OrderedSink) Producer() *OrderedProducer {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p := &OrderedProducer{sink: o, index: len(o.producers), watermark: math.MinInt64}
+	o.producers = append(o.producers, p)
+	return p
+}
+
+// Close releases the buffered events and closes the sinks
+func (o *OrderedSink) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.release(math.MaxInt64)
+	var err error
+	for _, sink := range o.sinks {
+		if closeErr := sink.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// write buffers an event of the producer, and releases the oldest event if the buffer is full
+func (o *OrderedSink) write(p *OrderedProducer, key int64, event *orderedEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if key < p.watermark {
+		key = p.watermark
+	}
+	event.key, event.producer, event.seq = key, p.index, o.seq
+	o.seq++
+	heap.Push(&o.events, event)
+	for o.events.Len() > o.maxBuffered {
+		o.writeEvent(heap.Pop(&o.events).(*orderedEvent))
+	}
+}
+
+// advance moves the watermark of the producer, and releases the events every producer is past
+func (o *OrderedSink) advance(p *OrderedProducer, timestamp int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if timestamp <= p.watermark {
+		return
+	}
+	p.watermark = timestamp
+	watermark := int64(math.MaxInt64)
+	for _, producer := range o.producers {
+		if producer.watermark < watermark {
+			watermark = producer.watermark
+		}
+	}
+	o.release(watermark)
+}
+
+// release is a helper function that writes the buffered events whose key is before the watermark, or all of them if
+// the watermark is math.MaxInt64, as every producer stopped
+func (o *OrderedSink) release(watermark int64) {
+	for o.events.Len() > 0 && (o.events[0].key < watermark || watermark == math.MaxInt64) {
+		o.writeEvent(heap.Pop(&o.events).(*orderedEvent))
+	}
+}
+
+// writeEvent is a helper function that writes an event to the sinks
+func (o *OrderedSink) writeEvent(event *orderedEvent) {
+	for _, sink := range o.sinks {
+		var err error
+		if event.stats != nil {
+			err = sink.WriteStats(event.stats)
+		} else {
+			err = sink.WriteAlert(event.alert)
+		}
+		if err != nil {
+			log.Printf("error while writing the output: %s", err)
+		}
+	}
+}
+
+// WriteStats buffers the statistics of an interval, keyed by the latest sample timestamp processed when they were flushed
+func (p *OrderedProducer) WriteStats(stats *metrics.IntervalStats) error {
+	p.sink.write(p, stats.Timestamp, &orderedEvent{stats: stats})
+	return nil
+}
+
+// WriteAlert buffers an alert or recovery transition, keyed by the latest log timestamp processed when it was triggered
+func (p *OrderedProducer) WriteAlert(event *monitors.AlertEvent) error {
+	p.sink.write(p, event.Timestamp, &orderedEvent{alert: event})
+	return nil
+}
+
+// AdvanceWatermark notifies the OrderedSink of the latest log timestamp the producer processed
+func (p *OrderedProducer) AdvanceWatermark(timestamp int64) {
+	p.sink.advance(p, timestamp)
+}
+
+// Close notifies the OrderedSink that the producer stopped. It does not close the sinks of the OrderedSink
+func (p *OrderedProducer) Close() error {
+	p.sink.advance(p, math.MaxInt64)
+	return nil
+}
+
+// orderedEvents is a min heap of events by key, producer and write order
+type orderedEvents []*orderedEvent
+
+func (h orderedEvents) Len() int { return len(h) }
+func (h orderedEvents) Less(i, j int) bool {
+	if h[i].key != h[j].key {
+		return h[i].key < h[j].key
+	}
+	if h[i].producer != h[j].producer {
+		return h[i].producer < h[j].producer
+	}
+	return h[i].seq < h[j].seq
+}
+func (h orderedEvents) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *orderedEvents) Push(x interface{}) {
+	*h = append(*h, x.(*orderedEvent))
+}
+func (h *orderedEvents) Pop() interface{} {
+	old := *h
+	n := len(old)
+	event := old[n-1]
+	*h = old[:n-1]
+	return event
+}
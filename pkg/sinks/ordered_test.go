@@ -0,0 +1,81 @@
+package sinks
+
+import (
+	"bytes"
+	"github.com/ebarti/dd-assignment/pkg/metrics"
+	"github.com/ebarti/dd-assignment/pkg/monitors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// alertAt is a helper function that returns an alert with the given message
+func alertAt(timestamp int64, message string) *monitors.AlertEvent {
+	return &monitors.AlertEvent{Monitor: "monitor", State: monitors.AlertStateAlert, Timestamp: timestamp, Message: message}
+}
+
+// lines is a helper function that returns the lines written to the buffer
+func lines(buf *bytes.Buffer) []string {
+	if buf.Len() == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+}
+
+func TestOrderedSink(t *testing.T) {
+	var buf bytes.Buffer
+	o := NewOrderedSink(DefaultOrderedBufferSize, NewWriterSink(&buf, TextFormat))
+	aggregator, monitor := o.Producer(), o.Producer()
+
+	// the monitor is ahead of the aggregator
+	monitor.AdvanceWatermark(100)
+	assert.NoError(t, monitor.WriteAlert(alertAt(101, "alert at 101")))
+	monitor.AdvanceWatermark(101)
+	assert.NoError(t, monitor.WriteAlert(alertAt(105, "alert at 105")))
+	monitor.AdvanceWatermark(105)
+	assert.Nil(t, lines(&buf))
+
+	// the statistics flushed at 103 go between the alerts
+	aggregator.AdvanceWatermark(100)
+	assert.NoError(t, aggregator.WriteStats(&metrics.IntervalStats{Start: 90, End: 100, Timestamp: 103}))
+	aggregator.AdvanceWatermark(103)
+	assert.Equal(t, []string{"alert at 101"}, lines(&buf))
+	aggregator.AdvanceWatermark(104)
+	assert.Equal(t, 3, len(lines(&buf)))
+	assert.True(t, strings.HasPrefix(lines(&buf)[1], "[1970-01-01 00:01:43"))
+
+	// out of order logs are keyed by the latest timestamp of their producer
+	assert.NoError(t, monitor.WriteAlert(alertAt(102, "alert at 102")))
+	assert.NoError(t, monitor.Close())
+	assert.Equal(t, 3, len(lines(&buf)))
+	assert.NoError(t, aggregator.Close())
+	assert.Equal(t, []string{"alert at 105", "alert at 102"}, lines(&buf)[3:])
+	assert.NoError(t, o.Close())
+}
+
+func TestOrderedSink_SameTimestamp(t *testing.T) {
+	var buf bytes.Buffer
+	o := NewOrderedSink(DefaultOrderedBufferSize, NewWriterSink(&buf, TextFormat))
+	first, second := o.Producer(), o.Producer()
+	// events with the same key are released by producer, then in the order they were written
+	assert.NoError(t, second.WriteAlert(alertAt(10, "second a")))
+	assert.NoError(t, first.WriteAlert(alertAt(10, "first a")))
+	assert.NoError(t, second.WriteAlert(alertAt(10, "second b")))
+	assert.NoError(t, first.WriteAlert(alertAt(10, "first b")))
+	assert.NoError(t, o.Close())
+	assert.Equal(t, []string{"first a", "first b", "second a", "second b"}, lines(&buf))
+}
+
+func TestOrderedSink_BufferFull(t *testing.T) {
+	var buf bytes.Buffer
+	o := NewOrderedSink(2, NewWriterSink(&buf, TextFormat))
+	p, _ := o.Producer(), o.Producer()
+	assert.NoError(t, p.WriteAlert(alertAt(12, "12")))
+	assert.NoError(t, p.WriteAlert(alertAt(10, "10")))
+	assert.Nil(t, lines(&buf))
+	// the oldest event is released once the buffer is full, without waiting for the other producer
+	assert.NoError(t, p.WriteAlert(alertAt(11, "11")))
+	assert.Equal(t, []string{"10"}, lines(&buf))
+	assert.NoError(t, o.Close())
+	assert.Equal(t, []string{"10", "11", "12"}, lines(&buf))
+}
@@ -0,0 +1,118 @@
+package sinks
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is a file that is rotated once it reaches its maximum size: path is renamed to path.1, path.1 to path.2,
+// and so on up to maxFiles rotated files, the oldest being removed, and a new file is created at path with the header.
+// Writes are never split across files. RotatingFile is thread-safe.
+type RotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	header   []byte
+	file     *os.File
+	size     int64
+	mu       sync.Mutex
+}
+
+// NewRotatingFile creates a new RotatingFile. A maxSize of 0 never rotates the file
+func NewRotatingFile(path string, maxSize int64, maxFiles int) *RotatingFile {
+	return &RotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+}
+
+// WithHeader sets the header written at the beginning of every new file, e.g. a CSV header
+func (f *RotatingFile) WithHeader(header []byte) *RotatingFile {
+	f.header = header
+	return f
+}
+
+// Open opens the file, appending to it if it exists
+func (f *RotatingFile) Open() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.open()
+}
+
+// Write writes the data to the file, rotating it first if the data does not fit in it
+func (f *RotatingFile) Write(data []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.maxSize > 0 && f.size > int64(len(f.header)) && f.size+int64(len(data)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the file
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// open is a helper function that opens the file in append mode, and writes the header if it is empty
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	if f.size == 0 && len(f.header) > 0 {
+		n, err := f.file.Write(f.header)
+		f.size += int64(n)
+		return err
+	}
+	return nil
+}
+
+// rotate is a helper function that closes the file, shifts the rotated files and opens a new file
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	if f.maxFiles <= 0 {
+		if err := os.Remove(f.path); err != nil {
+			return err
+		}
+		return f.open()
+	}
+	// the oldest rotated file is overwritten by the rename
+	for ii := f.maxFiles - 1; ii > 0; ii-- {
+		if err := os.Rename(f.rotatedPath(ii), f.rotatedPath(ii+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(f.path, f.rotatedPath(1)); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// rotatedPath is a helper function that returns the path of the nth rotated file
+func (f *RotatingFile) rotatedPath(n int) string {
+	return fmt.Sprintf("%s.%d", f.path, n)
+}
@@ -0,0 +1,61 @@
+package sinks
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output.log")
+	f := NewRotatingFile(path, 10, 2)
+	for _, line := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		n, err := f.Write([]byte(line))
+		assert.NoError(t, err)
+		assert.Equal(t, len(line), n)
+	}
+	assert.NoError(t, f.Close())
+
+	for file, want := range map[string]string{path: "dddddd\n", path + ".1": "cccccc\n", path + ".2": "bbbbbb\n"} {
+		content, err := ioutil.ReadFile(file)
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(content))
+	}
+	_, err := os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRotatingFile_Append(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output.csv")
+	f := NewRotatingFile(path, 0, 0).WithHeader([]byte("a,b\n"))
+	assert.NoError(t, f.Open())
+	_, err := f.Write([]byte("1,2\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	// reopening the file appends to it, without writing the header again
+	f = NewRotatingFile(path, 0, 0).WithHeader([]byte("a,b\n"))
+	_, err = f.Write([]byte("3,4\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	content, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "a,b\n1,2\n3,4\n", string(content))
+}
+
+func TestRotatingFile_NoRotatedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output.log")
+	f := NewRotatingFile(path, 4, 0)
+	for _, line := range []string{"aaa\n", "bbb\n"} {
+		_, err := f.Write([]byte(line))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, f.Close())
+	content, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "bbb\n", string(content))
+	_, err = os.Stat(path + ".1")
+	assert.True(t, os.IsNotExist(err))
+}
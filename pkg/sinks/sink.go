@@ -0,0 +1,325 @@
+package sinks
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/ebarti/dd-assignment/pkg/errors"
+	"github.com/ebarti/dd-assignment/pkg/metrics"
+	"github.com/ebarti/dd-assignment/pkg/monitors"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Format is the format a Sink writes its events in
+type Format string
+
+const (
+	// TextFormat renders the statistics and the alert messages as text, as printed to the console
+	TextFormat Format = "text"
+	// JSONFormat writes every event as a JSON object on its own line
+	JSONFormat Format = "json"
+	// CSVFormat writes every value of the statistics, and every alert, as a CSV row
+	CSVFormat Format = "csv"
+)
+
+// csvHeader is the header of the CSV format. Statistics have one row per value of every series, alerts one row each
+var csvHeader = []string{"type", "timestamp", "start", "end", "name", "aggregation", "tags", "value_name", "value", "state", "threshold", "message"}
+
+// Sink receives the statistics of every interval flushed by the MetricAggregator and the alert and recovery
+// transitions of the LogMonitors
+type Sink interface {
+	metrics.StatsSink
+	monitors.AlertSink
+	io.Closer
+}
+
+// ParseFormat returns the Format with the given name. It returns an InvalidOutputFormatError for unknown formats
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(name); format {
+	case TextFormat, JSONFormat, CSVFormat:
+		return format, nil
+	}
+	return "", errors.NewInvalidOutputFormatError(name)
+}
+
+// WriterSink is a Sink that writes the events to a writer in the given format. Every event is written with a single
+// call to Write. WriterSink is thread-safe.
+type WriterSink struct {
+	writer        io.Writer
+	closer        io.Closer // closed on Close, if the sink owns the writer
+	format        Format
+	headerWritten bool
+	mu            sync.Mutex
+}
+
+// NewWriterSink creates a new WriterSink. The CSV header is written before the first event.
+// The writer is not closed on Close, so that it can be os.Stdout
+func NewWriterSink(writer io.Writer, format Format) *WriterSink {
+	return &WriterSink{writer: writer, format: format}
+}
+
+// NewFileSink creates a new WriterSink that appends the events to the file at the given path, which is rotated once
+// it reaches maxSize bytes, keeping maxFiles rotated files. A maxSize of 0 never rotates the file
+func NewFileSink(path string, format Format, maxSize int64, maxFiles int) (*WriterSink, error) {
+	file := NewRotatingFile(path, maxSize, maxFiles)
+	if format == CSVFormat {
+		header, err := formatCSV([][]string{csvHeader})
+		if err != nil {
+			return nil, err
+		}
+		file.WithHeader(header)
+	}
+	if err := file.Open(); err != nil {
+		return nil, err
+	}
+	// the rotating file writes the header of every file it opens
+	return &WriterSink{writer: file, closer: file, format: format, headerWritten: true}, nil
+}
+
+// WriteStats writes the statistics of an interval
+func (s *WriterSink) WriteStats(stats *metrics.IntervalStats) error {
+	var data []byte
+	var err error
+	switch s.format {
+	case JSONFormat:
+		data, err = formatJSON(newStatsView(stats))
+	case CSVFormat:
+		data, err = formatCSV(statsRows(stats))
+	default:
+		data = []byte(stats.String() + "\n")
+	}
+	if err != nil {
+		return err
+	}
+	return s.write(data)
+}
+
+// WriteAlert writes an alert or recovery transition
+func (s *WriterSink) WriteAlert(event *monitors.AlertEvent) error {
+	var data []byte
+	var err error
+	switch s.format {
+	case JSONFormat:
+		data, err = formatJSON(newAlertView(event))
+	case CSVFormat:
+		data, err = formatCSV([][]string{alertRow(event)})
+	default:
+		data = []byte(event.Message + "\n")
+	}
+	if err != nil {
+		return err
+	}
+	return s.write(data)
+}
+
+// Close closes the writer if the sink owns it
+func (s *WriterSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// write is a helper function that writes the data of an event, preceded by the CSV header the first time
+func (s *WriterSink) write(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.headerWritten && s.format == CSVFormat {
+		header, err := formatCSV([][]string{csvHeader})
+		if err != nil {
+			return err
+		}
+		data = append(header, data...)
+	}
+	s.headerWritten = true
+	_, err := s.writer.Write(data)
+	return err
+}
+
+// statsView is the JSON representation of the statistics of an interval
+type statsView struct {
+	Type           string            `json:"type"`
+	Start          int64             `json:"start"`
+	End            int64             `json:"end"`
+	Partial        bool              `json:"partial,omitempty"`
+	Timestamp      int64             `json:"timestamp"`
+	Metrics        []*metricView     `json:"metrics"`
+	TagCardinality []*tagCardinality `json:"tag_cardinality,omitempty"`
+	LateSamples    int64             `json:"late_samples,omitempty"`
+}
+
+// metricView is the JSON representation of a computed metric and of its series
+type metricView struct {
+	Name        string                  `json:"name,omitempty"`
+	Aggregation metrics.AggregationType `json:"aggregation,omitempty"`
+	Tags        map[string]string       `json:"tags,omitempty"`
+	Value       *float64                `json:"value"`
+	Values      map[string]*float64     `json:"values,omitempty"`
+	Series      []*metricView           `json:"series,omitempty"`
+}
+
+// tagCardinality is the JSON representation of the cardinality of a tag
+type tagCardinality struct {
+	Metric            string `json:"metric"`
+	Tag               string `json:"tag"`
+	DistinctValues    int    `json:"distinct_values"`
+	OverflowedSamples int64  `json:"overflowed_samples"`
+	LimitReached      bool   `json:"limit_reached"`
+}
+
+// alertView is the JSON representation of an alert or recovery transition
+type alertView struct {
+	Type      string              `json:"type"`
+	Monitor   string              `json:"monitor"`
+	State     monitors.AlertState `json:"state"`
+	Timestamp int64               `json:"timestamp"`
+	Value     *float64            `json:"value"`
+	Threshold *float64            `json:"threshold"`
+	Message   string              `json:"message"`
+}
+
+// newStatsView is a helper function that returns the JSON representation of the statistics
+func newStatsView(stats *metrics.IntervalStats) *statsView {
+	view := &statsView{
+		Type:        "stats",
+		Start:       stats.Start,
+		End:         stats.End,
+		Partial:     stats.Partial,
+		Timestamp:   stats.Timestamp,
+		Metrics:     []*metricView{},
+		LateSamples: stats.LateSamples,
+	}
+	for _, computedMetric := range stats.Metrics {
+		metric := &metricView{
+			Name:        computedMetric.Name,
+			Aggregation: computedMetric.GetAggregation(),
+			Value:       jsonValue(computedMetric.Value),
+			Values:      jsonValues(computedMetric.Values),
+		}
+		for _, series := range computedMetric.Series {
+			tags := make(map[string]string, len(series.Tags))
+			for _, tag := range series.Tags {
+				tags[tag.Name] = tag.Value
+			}
+			metric.Series = append(metric.Series, &metricView{Tags: tags, Value: jsonValue(series.Value), Values: jsonValues(series.Values)})
+		}
+		view.Metrics = append(view.Metrics, metric)
+	}
+	for _, stat := range stats.TagCardinality {
+		view.TagCardinality = append(view.TagCardinality, &tagCardinality{
+			Metric:            stat.Metric,
+			Tag:               stat.Tag,
+			DistinctValues:    stat.DistinctValues,
+			OverflowedSamples: stat.OverflowedSamples,
+			LimitReached:      stat.LimitReached,
+		})
+	}
+	return view
+}
+
+// newAlertView is a helper function that returns the JSON representation of the transition
+func newAlertView(event *monitors.AlertEvent) *alertView {
+	return &alertView{
+		Type:      "alert",
+		Monitor:   event.Monitor,
+		State:     event.State,
+		Timestamp: event.Timestamp,
+		Value:     jsonValue(event.Value),
+		Threshold: jsonValue(event.Threshold),
+		Message:   event.Message,
+	}
+}
+
+// jsonValue is a helper function that returns the value, or nil if it is not finite as JSON cannot represent it
+func jsonValue(value float64) *float64 {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+	return &value
+}
+
+// jsonValues is a helper function that returns the named values with jsonValue
+func jsonValues(values map[string]float64) map[string]*float64 {
+	if len(values) == 0 {
+		return nil
+	}
+	converted := make(map[string]*float64, len(values))
+	for name, value := range values {
+		converted[name] = jsonValue(value)
+	}
+	return converted
+}
+
+// formatJSON is a helper function that encodes the value as a JSON line
+func formatJSON(value interface{}) ([]byte, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// statsRows is a helper function that returns the CSV rows of the statistics: one per value and named value of every
+// series of every metric, or of the metric itself if it has no series, and one with the number of late samples if any
+func statsRows(stats *metrics.IntervalStats) [][]string {
+	var rows [][]string
+	timestamp, start, end := formatInt(stats.Timestamp), formatInt(stats.Start), formatInt(stats.End)
+	for _, computedMetric := range stats.Metrics {
+		aggregation := string(computedMetric.GetAggregation())
+		series := computedMetric.Series
+		if len(series) == 0 {
+			series = []*metrics.ComputedMetric{computedMetric}
+		}
+		for _, s := range series {
+			tags := metrics.TagSetKey(s.Tags)
+			row := func(valueName string, value float64) []string {
+				return []string{"stats", timestamp, start, end, computedMetric.Name, aggregation, tags, valueName, formatFloat(value), "", "", ""}
+			}
+			rows = append(rows, row("", s.Value))
+			names := make([]string, 0, len(s.Values))
+			for name := range s.Values {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				rows = append(rows, row(name, s.Values[name]))
+			}
+		}
+	}
+	if stats.LateSamples > 0 {
+		rows = append(rows, []string{"stats", timestamp, start, end, "", "", "", "late_samples", formatInt(stats.LateSamples), "", "", ""})
+	}
+	return rows
+}
+
+// alertRow is a helper function that returns the CSV row of the transition
+func alertRow(event *monitors.AlertEvent) []string {
+	return []string{"alert", formatInt(event.Timestamp), "", "", event.Monitor, "", "", "", formatFloat(event.Value),
+		string(event.State), formatFloat(event.Threshold), event.Message}
+}
+
+// formatCSV is a helper function that encodes the rows as CSV
+func formatCSV(rows [][]string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.WriteAll(rows); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// formatInt is a helper function that formats an integer in base 10
+func formatInt(value int64) string {
+	return strconv.FormatInt(value, 10)
+}
+
+// formatFloat is a helper function that formats a float with the minimal number of digits
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
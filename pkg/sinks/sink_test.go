@@ -0,0 +1,127 @@
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ebarti/dd-assignment/pkg/metrics"
+	"github.com/ebarti/dd-assignment/pkg/monitors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// flushMetric is a helper function that flushes a metric with the given values, as values per section
+func flushMetric(t *testing.T, name string, aggregation metrics.AggregationType, samples map[string][]float64) *metrics.ComputedMetric {
+	m := metrics.NewMetric(aggregation, 10)
+	for section, values := range samples {
+		for _, value := range values {
+			assert.NoError(t, m.AddSample(&metrics.MetricSample{
+				Name:  name,
+				Value: value,
+				Tags:  []*metrics.Tag{{Name: "section", Value: section}},
+			}))
+		}
+	}
+	computed, err := m.Flush(10)
+	assert.NoError(t, err)
+	computed.Name = name
+	return computed
+}
+
+// testStats is a helper function that returns the statistics of an interval with a count
+func testStats(t *testing.T) *metrics.IntervalStats {
+	return &metrics.IntervalStats{
+		Start:     0,
+		End:       10,
+		Timestamp: 10,
+		Metrics:   []*metrics.ComputedMetric{flushMetric(t, "hits", metrics.CountAggregation, map[string][]float64{"api": {1, 1}, "report": {1}})},
+	}
+}
+
+var testAlert = &monitors.AlertEvent{
+	Monitor:   "High traffic monitor",
+	State:     monitors.AlertStateAlert,
+	Timestamp: 12,
+	Value:     3,
+	Threshold: 2,
+	Message:   "High traffic generated an alert - hits 3",
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, name := range []string{"text", "json", "csv"} {
+		format, err := ParseFormat(name)
+		assert.NoError(t, err)
+		assert.Equal(t, Format(name), format)
+	}
+	_, err := ParseFormat("xml")
+	assert.EqualError(t, err, `invalid output format "xml", expected text, json or csv`)
+}
+
+func TestWriterSink_Text(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewWriterSink(&buf, TextFormat)
+	stats := testStats(t)
+	assert.NoError(t, sink.WriteStats(stats))
+	assert.NoError(t, sink.WriteAlert(testAlert))
+	assert.NoError(t, sink.Close())
+	assert.Equal(t, stats.String()+"\n"+testAlert.Message+"\n", buf.String())
+}
+
+func TestWriterSink_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewWriterSink(&buf, JSONFormat)
+	assert.NoError(t, sink.WriteStats(testStats(t)))
+	assert.NoError(t, sink.WriteAlert(testAlert))
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.JSONEq(t, `{"type":"stats","start":0,"end":10,"timestamp":10,"metrics":[{"name":"hits","aggregation":"count","value":3,
+		"series":[{"tags":{"section":"api"},"value":2},{"tags":{"section":"report"},"value":1}]}]}`, lines[0])
+	assert.JSONEq(t, `{"type":"alert","monitor":"High traffic monitor","state":"alert","timestamp":12,"value":3,"threshold":2,
+		"message":"High traffic generated an alert - hits 3"}`, lines[1])
+}
+
+func TestWriterSink_JSONDistribution(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewWriterSink(&buf, JSONFormat)
+	stats := &metrics.IntervalStats{Metrics: []*metrics.ComputedMetric{
+		flushMetric(t, "bytes", metrics.DistributionAggregation, map[string][]float64{"api": {100, 300}}),
+	}}
+	assert.NoError(t, sink.WriteStats(stats))
+	var view statsView
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &view))
+	assert.Equal(t, float64(2), *view.Metrics[0].Values[metrics.CountValue])
+	assert.Equal(t, float64(400), *view.Metrics[0].Series[0].Values[metrics.SumValue])
+}
+
+func TestWriterSink_CSV(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewWriterSink(&buf, CSVFormat)
+	assert.NoError(t, sink.WriteStats(testStats(t)))
+	assert.NoError(t, sink.WriteAlert(testAlert))
+	assert.Equal(t, `type,timestamp,start,end,name,aggregation,tags,value_name,value,state,threshold,message
+stats,10,0,10,hits,count,section:api,,2,,,
+stats,10,0,10,hits,count,section:report,,1,,,
+alert,12,,,High traffic monitor,,,,3,alert,2,High traffic generated an alert - hits 3
+`, buf.String())
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output.csv")
+	sink, err := NewFileSink(path, CSVFormat, 200, 1)
+	assert.NoError(t, err)
+	for ii := 0; ii < 3; ii++ {
+		assert.NoError(t, sink.WriteAlert(testAlert))
+	}
+	assert.NoError(t, sink.Close())
+
+	header := "type,timestamp,start,end,name,aggregation,tags,value_name,value,state,threshold,message\n"
+	row := "alert,12,,,High traffic monitor,,,,3,alert,2,High traffic generated an alert - hits 3\n"
+	current, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, header+row, string(current))
+	rotated, err := ioutil.ReadFile(path + ".1")
+	assert.NoError(t, err)
+	assert.Equal(t, header+row, string(rotated))
+}
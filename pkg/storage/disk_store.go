@@ -0,0 +1,637 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/ebarti/dd-assignment/pkg/metrics"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	// DefaultSegmentSize is the size of the write-ahead log, in bytes, after which it is compacted into a segment
+	DefaultSegmentSize = 4 << 20
+	walFileName        = "wal.log"
+	segmentExtension   = ".seg"
+	tmpExtension       = ".tmp"
+	segmentMagic       = "DDTSSEG2"
+)
+
+// DiskStore persists the points of the series stored in a TimeSeriesStore, so that their history survives restarts.
+//
+// Every stored interval is appended to a write-ahead log as a record with a sequence number and a checksum, and synced
+// before returning. Once the log is larger than the segment size, its points are compacted into an immutable segment
+// file, where the points of every series are encoded in a block with delta-of-delta timestamps and XORed values.
+// The sketches of distributions and the registers of cardinality metrics are persisted with their points, so that
+// recovered points are rolled up like the ones stored since.
+// Segments are written to a temporary file and renamed, so a crash never leaves a partial segment behind. Segments
+// record the sequence number of their last record, so that records still in the log after a crash are not recovered twice.
+// Torn records at the end of the log, from a crash while appending, are discarded on recovery. A record that could not be
+// written or synced is truncated right away, so that the records appended after it are not lost on recovery.
+type DiskStore struct {
+	dir         string
+	segmentSize int64
+	retention   int64 // segments whose points all ended before the latest point minus the retention are deleted. 0 keeps them
+	wal         walFile
+	walSize     int64
+	seq         uint64                      // sequence number of the last record of the log
+	pending     map[string]*persistedSeries // series of the points in the log, by metric and series key
+	segments    []*segmentInfo
+	latest      int64 // end of the latest persisted point
+	mu          sync.Mutex
+}
+
+// walFile is the file of the write-ahead log, an *os.File
+type walFile interface {
+	io.ReadWriteSeeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// persistedSeries is a series and its points, as persisted on disk
+type persistedSeries struct {
+	metric      string
+	aggregation metrics.AggregationType
+	tags        []*metrics.Tag
+	points      []*Point
+}
+
+// segmentInfo describes a segment file
+type segmentInfo struct {
+	path    string
+	lastSeq uint64
+	maxEnd  int64
+}
+
+// OpenDiskStore opens, or creates, the DiskStore in the given directory. Call Recover before appending to it
+func OpenDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// temporary files are segments whose write did not complete
+	tmpFiles, err := filepath.Glob(filepath.Join(dir, "*"+tmpExtension))
+	if err != nil {
+		return nil, err
+	}
+	for _, tmpFile := range tmpFiles {
+		if err := os.Remove(tmpFile); err != nil {
+			return nil, err
+		}
+	}
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &DiskStore{
+		dir:         dir,
+		segmentSize: DefaultSegmentSize,
+		wal:         wal,
+		pending:     make(map[string]*persistedSeries),
+	}, nil
+}
+
+// WithSegmentSize sets the size of the write-ahead log, in bytes, after which it is compacted into a segment
+func (d *DiskStore) WithSegmentSize(size int64) *DiskStore {
+	d.segmentSize = size
+	return d
+}
+
+// WithRetention sets the number of seconds the segments are kept after their last point. 0 keeps them forever
+func (d *DiskStore) WithRetention(retention int64) *DiskStore {
+	d.retention = retention
+	return d
+}
+
+// Recover reads the segments and the write-ahead log, and calls restore with every persisted point.
+// The points of a series are restored in order, but series and segments are not.
+func (d *DiskStore) Recover(restore func(series *persistedSeries, point *Point)) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	paths, err := filepath.Glob(filepath.Join(d.dir, "*"+segmentExtension))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		info, series, err := readSegment(path)
+		if err != nil {
+			return fmt.Errorf("could not recover segment %s: %w", path, err)
+		}
+		d.segments = append(d.segments, info)
+		if info.lastSeq > d.seq {
+			d.seq = info.lastSeq
+		}
+		if info.maxEnd > d.latest {
+			d.latest = info.maxEnd
+		}
+		for _, s := range series {
+			for _, point := range s.points {
+				restore(s, point)
+			}
+		}
+	}
+	return d.recoverWAL(restore)
+}
+
+// recoverWAL is a helper function that restores the records of the log that are not in a segment yet,
+// and truncates the log after its last valid record
+func (d *DiskStore) recoverWAL(restore func(series *persistedSeries, point *Point)) error {
+	if _, err := d.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	content, err := ioutil.ReadAll(d.wal)
+	if err != nil {
+		return err
+	}
+	var offset int64
+	reader := bytes.NewReader(content)
+	for {
+		seq, start, end, series, err := readRecord(reader)
+		if err != nil {
+			// a torn or corrupted record ends the log
+			break
+		}
+		offset = int64(len(content)) - int64(reader.Len())
+		if seq <= d.seq {
+			continue // already compacted into a segment
+		}
+		d.seq = seq
+		for _, s := range series {
+			point := s.points[0]
+			point.Start, point.End = start, end
+			d.addPending(s, point)
+			restore(s, point)
+		}
+	}
+	if err := d.wal.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := d.wal.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	d.walSize = offset
+	return d.wal.Sync()
+}
+
+// Append persists the series of the metrics computed for the time interval [start, end) in the write-ahead log,
+// and compacts the log into a segment if it is larger than the segment size
+func (d *DiskStore) Append(start, end int64, computedMetrics []*metrics.ComputedMetric) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var series []*persistedSeries
+	for _, computedMetric := range computedMetrics {
+		for _, s := range computedMetric.Series {
+			series = append(series, &persistedSeries{
+				metric:      computedMetric.Name,
+				aggregation: computedMetric.GetAggregation(),
+				tags:        s.Tags,
+				points:      []*Point{newPoint(start, end, s)},
+			})
+		}
+	}
+	if len(series) == 0 {
+		return nil
+	}
+	record := encodeRecord(d.seq+1, start, end, series)
+	if _, err := d.wal.Write(record); err != nil {
+		return d.discardRecord(err)
+	}
+	if err := d.wal.Sync(); err != nil {
+		return d.discardRecord(err)
+	}
+	d.walSize += int64(len(record))
+	d.seq++
+	for _, s := range series {
+		d.addPending(s, s.points[0])
+	}
+	if d.walSize >= d.segmentSize {
+		return d.compact()
+	}
+	return nil
+}
+
+// discardRecord is a helper function that truncates the log back to its last record after the given error while appending
+// a record, so that the next records are not appended after a torn one
+func (d *DiskStore) discardRecord(err error) error {
+	if truncErr := d.wal.Truncate(d.walSize); truncErr != nil {
+		return fmt.Errorf("%w, and could not discard the record: %s", err, truncErr)
+	}
+	if _, seekErr := d.wal.Seek(d.walSize, io.SeekStart); seekErr != nil {
+		return fmt.Errorf("%w, and could not discard the record: %s", err, seekErr)
+	}
+	return err
+}
+
+// addPending is a helper function that adds a point of the log to the series waiting to be compacted
+func (d *DiskStore) addPending(series *persistedSeries, point *Point) {
+	key := series.metric + "\x00" + metrics.TagSetKey(series.tags)
+	pending, ok := d.pending[key]
+	if !ok {
+		pending = &persistedSeries{metric: series.metric, aggregation: series.aggregation, tags: series.tags}
+		d.pending[key] = pending
+	}
+	pending.points = append(pending.points, point)
+	if point.End > d.latest {
+		d.latest = point.End
+	}
+}
+
+// compact writes the points of the log into a new segment, empties the log and deletes the expired segments
+func (d *DiskStore) compact() error {
+	if len(d.pending) > 0 {
+		info, err := d.writeSegment()
+		if err != nil {
+			return err
+		}
+		d.segments = append(d.segments, info)
+	}
+	if err := d.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := d.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := d.wal.Sync(); err != nil {
+		return err
+	}
+	d.walSize = 0
+	d.pending = make(map[string]*persistedSeries)
+	if d.retention <= 0 {
+		return nil
+	}
+	var kept []*segmentInfo
+	for _, segment := range d.segments {
+		if segment.maxEnd > d.latest-d.retention {
+			kept = append(kept, segment)
+			continue
+		}
+		if err := os.Remove(segment.path); err != nil {
+			return err
+		}
+	}
+	d.segments = kept
+	return nil
+}
+
+// writeSegment is a helper function that writes the pending series into a new segment file, atomically
+func (d *DiskStore) writeSegment() (*segmentInfo, error) {
+	keys := make([]string, 0, len(d.pending))
+	for key := range d.pending {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	info := &segmentInfo{
+		path:    filepath.Join(d.dir, fmt.Sprintf("%020d%s", d.seq, segmentExtension)),
+		lastSeq: d.seq,
+	}
+	w := &recordWriter{}
+	w.buf.WriteString(segmentMagic)
+	w.writeUvarint(d.seq)
+	w.writeUvarint(uint64(len(keys)))
+	for _, key := range keys {
+		series := d.pending[key]
+		sort.SliceStable(series.points, func(i, j int) bool { return series.points[i].Start < series.points[j].Start })
+		w.writeSeriesHeader(series)
+		valueNames := namedValues(series.points)
+		w.writeUvarint(uint64(len(valueNames)))
+		for _, name := range valueNames {
+			w.writeString(name)
+		}
+		w.writeUvarint(uint64(len(series.points)))
+		block := encodeBlock(series.points, valueNames)
+		w.writeUvarint(uint64(len(block)))
+		w.buf.Write(block)
+		for _, point := range series.points {
+			w.writeSketches(point)
+			if point.End > info.maxEnd {
+				info.maxEnd = point.End
+			}
+		}
+	}
+	w.writeUint32(crc32.ChecksumIEEE(w.buf.Bytes()))
+	content := w.buf.Bytes()
+
+	tmpPath := info.path + tmpExtension
+	if err := writeFileSync(tmpPath, content); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, info.path); err != nil {
+		return nil, err
+	}
+	return info, syncDir(d.dir)
+}
+
+// Close compacts the write-ahead log into a segment and closes it
+func (d *DiskStore) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.compact(); err != nil {
+		return err
+	}
+	return d.wal.Close()
+}
+
+// readSegment is a helper function that reads and verifies a segment file
+func readSegment(path string) (*segmentInfo, []*persistedSeries, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(content) < len(segmentMagic)+4 || string(content[:len(segmentMagic)]) != segmentMagic {
+		return nil, nil, fmt.Errorf("not a segment file")
+	}
+	payload, checksum := content[:len(content)-4], binary.LittleEndian.Uint32(content[len(content)-4:])
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, nil, fmt.Errorf("checksum mismatch")
+	}
+	r := &recordReader{r: bytes.NewReader(payload[len(segmentMagic):])}
+	info := &segmentInfo{path: path, lastSeq: r.readUvarint()}
+	count := r.readUvarint()
+	var series []*persistedSeries
+	for ii := uint64(0); ii < count && r.err == nil; ii++ {
+		s := r.readSeriesHeader()
+		valueNames := make([]string, r.readUvarint())
+		for jj := range valueNames {
+			valueNames[jj] = r.readString()
+		}
+		pointCount := int(r.readUvarint())
+		block := r.readBytes(r.readUvarint())
+		if r.err != nil {
+			break
+		}
+		if s.points, err = decodeBlock(block, pointCount, valueNames); err != nil {
+			return nil, nil, err
+		}
+		for _, point := range s.points {
+			r.readSketches(point)
+			if point.End > info.maxEnd {
+				info.maxEnd = point.End
+			}
+		}
+		series = append(series, s)
+	}
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	return info, series, nil
+}
+
+// encodeRecord is a helper function that encodes a record of the log: its length, its checksum and its content,
+// which holds the sequence number, the time interval and the value, sketch and registers of every series
+func encodeRecord(seq uint64, start, end int64, series []*persistedSeries) []byte {
+	w := &recordWriter{}
+	w.writeUvarint(seq)
+	w.writeVarint(start)
+	w.writeVarint(end)
+	w.writeUvarint(uint64(len(series)))
+	for _, s := range series {
+		w.writeSeriesHeader(s)
+		point := s.points[0]
+		w.writeFloat(point.Value)
+		valueNames := namedValues(s.points)
+		w.writeUvarint(uint64(len(valueNames)))
+		for _, name := range valueNames {
+			w.writeString(name)
+			w.writeFloat(point.Values[name])
+		}
+		w.writeSketches(point)
+	}
+	payload := w.buf.Bytes()
+	record := &recordWriter{}
+	record.writeUvarint(uint64(len(payload)))
+	record.writeUint32(crc32.ChecksumIEEE(payload))
+	record.buf.Write(payload)
+	return record.buf.Bytes()
+}
+
+// readRecord is a helper function that reads the next record of the log. It returns error if the record is torn or corrupted
+func readRecord(reader *bytes.Reader) (seq uint64, start, end int64, series []*persistedSeries, err error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return 0, 0, 0, nil, err
+	}
+	header := &recordReader{r: reader}
+	checksum := header.readUint32()
+	payload := header.readBytes(length)
+	if header.err != nil {
+		return 0, 0, 0, nil, header.err
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return 0, 0, 0, nil, fmt.Errorf("checksum mismatch")
+	}
+	r := &recordReader{r: bytes.NewReader(payload)}
+	seq = r.readUvarint()
+	start = r.readVarint()
+	end = r.readVarint()
+	count := r.readUvarint()
+	for ii := uint64(0); ii < count && r.err == nil; ii++ {
+		s := r.readSeriesHeader()
+		point := &Point{Value: r.readFloat()}
+		if valueCount := r.readUvarint(); valueCount > 0 && r.err == nil {
+			point.Values = make(map[string]float64, valueCount)
+			for jj := uint64(0); jj < valueCount && r.err == nil; jj++ {
+				name := r.readString()
+				point.Values[name] = r.readFloat()
+			}
+		}
+		r.readSketches(point)
+		s.points = []*Point{point}
+		series = append(series, s)
+	}
+	return seq, start, end, series, r.err
+}
+
+// namedValues is a helper function that returns the sorted names of the named values of the points
+func namedValues(points []*Point) []string {
+	names := make(map[string]struct{})
+	for _, point := range points {
+		for name := range point.Values {
+			names[name] = struct{}{}
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// recordWriter encodes the fields of records and segments
+type recordWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *recordWriter) writeUvarint(value uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf.Write(b[:binary.PutUvarint(b[:], value)])
+}
+
+func (w *recordWriter) writeVarint(value int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf.Write(b[:binary.PutVarint(b[:], value)])
+}
+
+func (w *recordWriter) writeUint32(value uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], value)
+	w.buf.Write(b[:])
+}
+
+func (w *recordWriter) writeFloat(value float64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(value))
+	w.buf.Write(b[:])
+}
+
+func (w *recordWriter) writeString(value string) {
+	w.writeUvarint(uint64(len(value)))
+	w.buf.WriteString(value)
+}
+
+// writeSeriesHeader writes the metric name, aggregation and tags of a series
+func (w *recordWriter) writeSeriesHeader(series *persistedSeries) {
+	w.writeString(series.metric)
+	w.writeString(string(series.aggregation))
+	w.writeUvarint(uint64(len(series.tags)))
+	for _, tag := range series.tags {
+		w.writeString(tag.Name)
+		w.writeString(tag.Value)
+	}
+}
+
+// writeSketches writes the sketch and the registers of a point, each with its length, which is 0 if the point has none
+func (w *recordWriter) writeSketches(point *Point) {
+	var sketch, hyperLogLog []byte
+	if point.sketch != nil {
+		sketch, _ = point.sketch.MarshalBinary()
+	}
+	if point.hyperLogLog != nil {
+		hyperLogLog, _ = point.hyperLogLog.MarshalBinary()
+	}
+	w.writeUvarint(uint64(len(sketch)))
+	w.buf.Write(sketch)
+	w.writeUvarint(uint64(len(hyperLogLog)))
+	w.buf.Write(hyperLogLog)
+}
+
+// recordReader decodes the fields written by a recordWriter. It keeps the first error, after which it reads zero values
+type recordReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (r *recordReader) readUvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	var value uint64
+	value, r.err = binary.ReadUvarint(r.r)
+	return value
+}
+
+func (r *recordReader) readVarint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	var value int64
+	value, r.err = binary.ReadVarint(r.r)
+	return value
+}
+
+func (r *recordReader) readUint32() uint32 {
+	b := r.readBytes(4)
+	if r.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (r *recordReader) readFloat() float64 {
+	b := r.readBytes(8)
+	if r.err != nil {
+		return 0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(b))
+}
+
+func (r *recordReader) readBytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(r.r.Len()) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := make([]byte, n)
+	_, r.err = io.ReadFull(r.r, b)
+	return b
+}
+
+func (r *recordReader) readString() string {
+	return string(r.readBytes(r.readUvarint()))
+}
+
+// readSketches reads the sketch and the registers of a point written by writeSketches
+func (r *recordReader) readSketches(point *Point) {
+	if sketch := r.readBytes(r.readUvarint()); len(sketch) > 0 {
+		point.sketch = metrics.NewDefaultDDSketch()
+		if err := point.sketch.UnmarshalBinary(sketch); err != nil && r.err == nil {
+			r.err = err
+		}
+	}
+	if hyperLogLog := r.readBytes(r.readUvarint()); len(hyperLogLog) > 0 {
+		point.hyperLogLog = metrics.NewDefaultHyperLogLog()
+		if err := point.hyperLogLog.UnmarshalBinary(hyperLogLog); err != nil && r.err == nil {
+			r.err = err
+		}
+	}
+}
+
+// readSeriesHeader reads the metric name, aggregation and tags of a series
+func (r *recordReader) readSeriesHeader() *persistedSeries {
+	series := &persistedSeries{
+		metric:      r.readString(),
+		aggregation: metrics.AggregationType(r.readString()),
+	}
+	tagCount := r.readUvarint()
+	for ii := uint64(0); ii < tagCount && r.err == nil; ii++ {
+		series.tags = append(series.tags, &metrics.Tag{Name: r.readString(), Value: r.readString()})
+	}
+	return series
+}
+
+// writeFileSync is a helper function that writes the file and syncs it to disk
+func writeFileSync(path string, content []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir is a helper function that syncs a directory, so that the files renamed in it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ebarti/dd-assignment/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// storeHits is a helper function that stores a count of hits per section every 10 seconds of [from, to)
+func storeHits(t *testing.T, store *TimeSeriesStore, from, to int64) {
+	for start := from; start < to; start += 10 {
+		store.Store(start, start+10, []*metrics.ComputedMetric{
+			flush(t, "hits", metrics.CountAggregation, float64(start/10), apiTag, reportTag),
+		})
+	}
+}
+
+func TestTimeSeriesStore_Persistence(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenTimeSeriesStore(dir, nil, DefaultRawRetention, DefaultRollups...)
+	assert.NoError(t, err)
+	storeHits(t, store, 100, 130)
+	store.Store(100, 110, []*metrics.ComputedMetric{flush(t, "bytes", metrics.DistributionAggregation, 42, apiTag)})
+	assert.NoError(t, store.Close())
+
+	store, err = OpenTimeSeriesStore(dir, nil, DefaultRawRetention, DefaultRollups...)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bytes", "hits"}, store.MetricNames())
+	got := store.Query("hits", []*metrics.Tag{apiTag}, 0, 200)
+	assert.Equal(t, 1, len(got))
+	assert.Equal(t, metrics.CountAggregation, got[0].Aggregation)
+	assert.Equal(t, map[int64]float64{100: 10, 110: 11, 120: 12}, pointValues(got[0]))
+	got = store.Query("bytes", nil, 0, 200)
+	assert.Equal(t, 42.0, got[0].Points[0].Values[metrics.MaxValue])
+
+	// recovered points are rolled up with the new ones
+	storeHits(t, store, 130, 140)
+	assert.NoError(t, store.Close())
+	store, err = OpenTimeSeriesStore(dir, nil, 0, Resolution{Interval: 60, Retention: 3600})
+	assert.NoError(t, err)
+	got = store.Query("hits", []*metrics.Tag{apiTag}, 0, 200)
+	assert.Equal(t, map[int64]float64{60: 10 + 11, 120: 12 + 13}, pointValues(got[0]))
+	got = store.Query("bytes", nil, 0, 200)
+	assert.Equal(t, 1.0, got[0].Points[0].Value)
+	assert.NoError(t, store.Close())
+}
+
+// storeLatencies is a helper function that stores, every 10 seconds of [0, 60), a distribution of 100 latencies growing
+// with every interval, and the number of distinct users, all different
+func storeLatencies(t *testing.T, store *TimeSeriesStore) {
+	for start := int64(0); start < 60; start += 10 {
+		latency, users := metrics.NewMetric(metrics.DistributionAggregation, 10), metrics.NewMetric(metrics.CardinalityAggregation, 10)
+		for ii := int64(0); ii < 100; ii++ {
+			value := float64(start*start + ii)
+			assert.NoError(t, latency.AddSample(&metrics.MetricSample{Name: "latency", Value: value}))
+			assert.NoError(t, users.AddSample(&metrics.MetricSample{Name: "users", UniqueValue: fmt.Sprintf("user-%d", start*10+ii)}))
+		}
+		flushedLatency, err := latency.Flush(start)
+		assert.NoError(t, err)
+		flushedLatency.Name = "latency"
+		flushedUsers, err := users.Flush(start)
+		assert.NoError(t, err)
+		flushedUsers.Name = "users"
+		store.Store(start, start+10, []*metrics.ComputedMetric{flushedLatency, flushedUsers})
+	}
+}
+
+func TestTimeSeriesStore_PersistedSketches(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		close bool
+	}{
+		{name: "recovered from a segment", close: true},
+		{name: "recovered from the log", close: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			rollup := Resolution{Interval: 60, Retention: 3600}
+			store, err := OpenTimeSeriesStore(dir, nil, 0, rollup)
+			assert.NoError(t, err)
+			storeLatencies(t, store)
+			p99 := store.Query("latency", nil, 0, 60)[0].Points[0].Values["p99"]
+			users := store.Query("users", nil, 0, 60)[0].Points[0].Value
+			// the rollups merge the sketches and registers of the intervals
+			assert.InEpsilon(t, 2593, p99, metrics.DefaultRelativeAccuracy)
+			assert.InEpsilon(t, 600, users, 0.05)
+			if tc.close {
+				assert.NoError(t, store.Close())
+			}
+
+			recovered, err := OpenTimeSeriesStore(dir, nil, 0, rollup)
+			assert.NoError(t, err)
+			assert.Equal(t, p99, recovered.Query("latency", nil, 0, 60)[0].Points[0].Values["p99"])
+			assert.Equal(t, users, recovered.Query("users", nil, 0, 60)[0].Points[0].Value)
+			assert.NoError(t, recovered.Close())
+			if !tc.close {
+				assert.NoError(t, store.Close())
+			}
+		})
+	}
+}
+
+func TestDiskStore_Compaction(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenTimeSeriesStore(dir, nil, DefaultRawRetention)
+	assert.NoError(t, err)
+	store.disk.WithSegmentSize(1)
+	storeHits(t, store, 0, 30)
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExtension))
+	assert.Equal(t, 3, len(segments))
+	info, err := os.Stat(filepath.Join(dir, walFileName))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+
+	// segments past the retention are deleted
+	store.disk.WithRetention(15)
+	storeHits(t, store, 30, 40)
+	segments, _ = filepath.Glob(filepath.Join(dir, "*"+segmentExtension))
+	assert.Equal(t, 2, len(segments))
+	assert.NoError(t, store.Close())
+}
+
+func TestDiskStore_TornRecord(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenTimeSeriesStore(dir, nil, DefaultRawRetention)
+	assert.NoError(t, err)
+	storeHits(t, store, 0, 30)
+	// simulate a crash while appending the last record, without closing the store
+	walPath := filepath.Join(dir, walFileName)
+	info, err := os.Stat(walPath)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(walPath, info.Size()-3))
+
+	store, err = OpenTimeSeriesStore(dir, nil, DefaultRawRetention)
+	assert.NoError(t, err)
+	got := store.Query("hits", []*metrics.Tag{apiTag}, 0, 100)
+	assert.Equal(t, map[int64]float64{0: 0, 10: 1}, pointValues(got[0]))
+	// new records are appended after the last valid one
+	storeHits(t, store, 20, 30)
+	assert.NoError(t, store.Close())
+	store, err = OpenTimeSeriesStore(dir, nil, DefaultRawRetention)
+	assert.NoError(t, err)
+	got = store.Query("hits", []*metrics.Tag{apiTag}, 0, 100)
+	assert.Equal(t, map[int64]float64{0: 0, 10: 1, 20: 2}, pointValues(got[0]))
+	assert.NoError(t, store.Close())
+}
+
+// failingWAL is a write-ahead log file whose next write only writes half of the record, or whose next sync fails
+type failingWAL struct {
+	*os.File
+	failWrite bool
+	failSync  bool
+}
+
+func (f *failingWAL) Write(p []byte) (int, error) {
+	if f.failWrite {
+		f.failWrite = false
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, errors.New("disk full")
+	}
+	return f.File.Write(p)
+}
+
+func (f *failingWAL) Sync() error {
+	if f.failSync {
+		f.failSync = false
+		return errors.New("i/o error")
+	}
+	return f.File.Sync()
+}
+
+func TestDiskStore_FailedAppend(t *testing.T) {
+	tests := []struct {
+		name string
+		wal  func(file *os.File) *failingWAL
+	}{
+		{name: "short write", wal: func(file *os.File) *failingWAL { return &failingWAL{File: file, failWrite: true} }},
+		{name: "failed sync", wal: func(file *os.File) *failingWAL { return &failingWAL{File: file, failSync: true} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			disk, err := OpenDiskStore(dir)
+			assert.NoError(t, err)
+			assert.NoError(t, disk.Recover(func(*persistedSeries, *Point) {}))
+			hits := func(value float64) []*metrics.ComputedMetric {
+				return []*metrics.ComputedMetric{flush(t, "hits", metrics.CountAggregation, value, apiTag)}
+			}
+			assert.NoError(t, disk.Append(0, 10, hits(1)))
+			wal := tt.wal(disk.wal.(*os.File))
+			disk.wal = wal
+			assert.Error(t, disk.Append(10, 20, hits(2)))
+			// the records appended after the failed one survive a crash
+			assert.NoError(t, disk.Append(20, 30, hits(3)))
+			assert.NoError(t, disk.Append(30, 40, hits(4)))
+			assert.NoError(t, wal.File.Close())
+
+			disk, err = OpenDiskStore(dir)
+			assert.NoError(t, err)
+			recovered := make(map[int64]float64)
+			assert.NoError(t, disk.Recover(func(series *persistedSeries, point *Point) {
+				recovered[point.Start] = point.Value
+			}))
+			assert.Equal(t, map[int64]float64{0: 1, 20: 3, 30: 4}, recovered)
+			assert.NoError(t, disk.Close())
+		})
+	}
+}
+
+func TestDiskStore_CrashDuringCompaction(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenTimeSeriesStore(dir, nil, DefaultRawRetention)
+	assert.NoError(t, err)
+	storeHits(t, store, 0, 30)
+	walPath := filepath.Join(dir, walFileName)
+	wal, err := os.ReadFile(walPath)
+	assert.NoError(t, err)
+	// simulate a crash after writing the segment but before emptying the log, with a leftover temporary file
+	assert.NoError(t, store.Close())
+	assert.NoError(t, os.WriteFile(walPath, wal, 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "partial"+segmentExtension+tmpExtension), []byte("partial"), 0644))
+
+	store, err = OpenTimeSeriesStore(dir, nil, DefaultRawRetention)
+	assert.NoError(t, err)
+	got := store.Query("hits", []*metrics.Tag{apiTag}, 0, 100)
+	assert.Equal(t, 3, len(got[0].Points))
+	assert.Equal(t, map[int64]float64{0: 0, 10: 1, 20: 2}, pointValues(got[0]))
+	tmpFiles, _ := filepath.Glob(filepath.Join(dir, "*"+tmpExtension))
+	assert.Empty(t, tmpFiles)
+	assert.NoError(t, store.Close())
+}
+
+func TestDiskStore_CorruptedSegment(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenTimeSeriesStore(dir, nil, DefaultRawRetention)
+	assert.NoError(t, err)
+	storeHits(t, store, 0, 30)
+	assert.NoError(t, store.Close())
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExtension))
+	content, err := os.ReadFile(segments[0])
+	assert.NoError(t, err)
+	content[len(segmentMagic)+2] ^= 0xff
+	assert.NoError(t, os.WriteFile(segments[0], content, 0644))
+
+	_, err = OpenTimeSeriesStore(dir, nil, DefaultRawRetention)
+	assert.Error(t, err)
+}
@@ -0,0 +1,334 @@
+package storage
+
+import (
+	"io"
+	"math"
+	"math/bits"
+)
+
+// The points of a series are encoded in blocks as described in the Gorilla paper (http://www.vldb.org/pvldb/vol8/p1816-teller.pdf):
+// timestamps are encoded as the difference between consecutive deltas, which is 0 for regular intervals, and values are
+// XORed with the previous one, which leaves few meaningful bits when consecutive values are close.
+
+// bitWriter writes bits into a byte slice, from the most significant bit of every byte
+type bitWriter struct {
+	buf  []byte
+	free uint8 // free bits in the last byte
+}
+
+// writeBit writes a single bit
+func (w *bitWriter) writeBit(bit bool) {
+	if w.free == 0 {
+		w.buf = append(w.buf, 0)
+		w.free = 8
+	}
+	w.free--
+	if bit {
+		w.buf[len(w.buf)-1] |= 1 << w.free
+	}
+}
+
+// writeBits writes the n least significant bits of value, from the most significant one
+func (w *bitWriter) writeBits(value uint64, n int) {
+	for ii := n - 1; ii >= 0; ii-- {
+		w.writeBit(value&(1<<uint(ii)) != 0)
+	}
+}
+
+// bytes returns the written bytes. The last byte is padded with zeros
+func (w *bitWriter) bytes() []byte {
+	return w.buf
+}
+
+// bitReader reads the bits written by a bitWriter
+type bitReader struct {
+	buf []byte
+	pos int // position of the next bit
+}
+
+// readBit reads a single bit. It returns io.ErrUnexpectedEOF if there are no bits left
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= len(r.buf)*8 {
+		return false, io.ErrUnexpectedEOF
+	}
+	bit := r.buf[r.pos/8]&(1<<(7-uint(r.pos%8))) != 0
+	r.pos++
+	return bit, nil
+}
+
+// readBits reads n bits into the least significant bits of the returned value
+func (r *bitReader) readBits(n int) (uint64, error) {
+	var value uint64
+	for ii := 0; ii < n; ii++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		value <<= 1
+		if bit {
+			value |= 1
+		}
+	}
+	return value, nil
+}
+
+// timestampEncoder encodes increasing timestamps with delta-of-delta encoding
+type timestampEncoder struct {
+	w         *bitWriter
+	count     int
+	previous  int64
+	previousD int64
+}
+
+// dodBuckets are the ranges of the delta of deltas that are written with a prefix of n ones followed by a zero and size bits.
+// Larger ones are written with a prefix of 4 ones and 64 bits
+var dodBuckets = []struct {
+	size int
+	min  int64
+	max  int64
+}{
+	{size: 7, min: -64, max: 63},
+	{size: 9, min: -256, max: 255},
+	{size: 12, min: -2048, max: 2047},
+}
+
+// encode encodes the next timestamp
+func (e *timestampEncoder) encode(timestamp int64) {
+	defer func() { e.count++ }()
+	switch e.count {
+	case 0:
+		e.w.writeBits(uint64(timestamp), 64)
+		e.previous = timestamp
+		return
+	case 1:
+		e.previousD = timestamp - e.previous
+		e.w.writeBits(uint64(e.previousD), 64)
+		e.previous = timestamp
+		return
+	}
+	delta := timestamp - e.previous
+	dod := delta - e.previousD
+	e.previous, e.previousD = timestamp, delta
+	if dod == 0 {
+		e.w.writeBit(false)
+		return
+	}
+	for _, bucket := range dodBuckets {
+		e.w.writeBit(true)
+		if dod >= bucket.min && dod <= bucket.max {
+			e.w.writeBit(false)
+			e.w.writeBits(uint64(dod), bucket.size)
+			return
+		}
+	}
+	e.w.writeBit(true)
+	e.w.writeBits(uint64(dod), 64)
+}
+
+// timestampDecoder decodes the timestamps written by a timestampEncoder
+type timestampDecoder struct {
+	r         *bitReader
+	count     int
+	previous  int64
+	previousD int64
+}
+
+// decode decodes the next timestamp
+func (d *timestampDecoder) decode() (int64, error) {
+	defer func() { d.count++ }()
+	switch d.count {
+	case 0:
+		value, err := d.r.readBits(64)
+		d.previous = int64(value)
+		return d.previous, err
+	case 1:
+		value, err := d.r.readBits(64)
+		d.previousD = int64(value)
+		d.previous += d.previousD
+		return d.previous, err
+	}
+	dod, err := d.readDeltaOfDelta()
+	if err != nil {
+		return 0, err
+	}
+	d.previousD += dod
+	d.previous += d.previousD
+	return d.previous, nil
+}
+
+// readDeltaOfDelta is a helper function that reads a delta of deltas: a zero bit for 0, or the prefix of ones of its
+// bucket followed by its value, sign extended from the bucket size
+func (d *timestampDecoder) readDeltaOfDelta() (int64, error) {
+	ones := 0
+	for ones <= len(dodBuckets) {
+		bit, err := d.r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			break
+		}
+		ones++
+	}
+	switch {
+	case ones == 0:
+		return 0, nil
+	case ones <= len(dodBuckets):
+		size := dodBuckets[ones-1].size
+		value, err := d.r.readBits(size)
+		return signExtend(value, size), err
+	default:
+		value, err := d.r.readBits(64)
+		return int64(value), err
+	}
+}
+
+// signExtend is a helper function that interprets the n least significant bits of value as a two's complement integer
+func signExtend(value uint64, n int) int64 {
+	shift := uint(64 - n)
+	return int64(value<<shift) >> shift
+}
+
+// valueEncoder encodes floats XORed with the previous one
+type valueEncoder struct {
+	w        *bitWriter
+	count    int
+	previous uint64
+	leading  int
+	trailing int
+}
+
+// encode encodes the next value
+func (e *valueEncoder) encode(value float64) {
+	current := math.Float64bits(value)
+	defer func() {
+		e.previous = current
+		e.count++
+	}()
+	if e.count == 0 {
+		e.w.writeBits(current, 64)
+		return
+	}
+	xor := current ^ e.previous
+	if xor == 0 {
+		e.w.writeBit(false)
+		return
+	}
+	e.w.writeBit(true)
+	leading, trailing := bits.LeadingZeros64(xor), bits.TrailingZeros64(xor)
+	if leading > 31 {
+		leading = 31 // the number of leading zeros is written with 5 bits
+	}
+	if e.count > 1 && leading >= e.leading && trailing >= e.trailing {
+		// the meaningful bits fit in the previous window
+		e.w.writeBit(false)
+		e.w.writeBits(xor>>uint(e.trailing), 64-e.leading-e.trailing)
+		return
+	}
+	e.leading, e.trailing = leading, trailing
+	meaningful := 64 - leading - trailing
+	e.w.writeBit(true)
+	e.w.writeBits(uint64(leading), 5)
+	e.w.writeBits(uint64(meaningful-1), 6) // 1 to 64 meaningful bits
+	e.w.writeBits(xor>>uint(trailing), meaningful)
+}
+
+// valueDecoder decodes the floats written by a valueEncoder
+type valueDecoder struct {
+	r        *bitReader
+	count    int
+	previous uint64
+	leading  int
+	trailing int
+}
+
+// decode decodes the next value
+func (d *valueDecoder) decode() (float64, error) {
+	defer func() { d.count++ }()
+	if d.count == 0 {
+		value, err := d.r.readBits(64)
+		d.previous = value
+		return math.Float64frombits(value), err
+	}
+	changed, err := d.r.readBit()
+	if err != nil || !changed {
+		return math.Float64frombits(d.previous), err
+	}
+	newWindow, err := d.r.readBit()
+	if err != nil {
+		return 0, err
+	}
+	if newWindow {
+		leading, err := d.r.readBits(5)
+		if err != nil {
+			return 0, err
+		}
+		meaningful, err := d.r.readBits(6)
+		if err != nil {
+			return 0, err
+		}
+		d.leading = int(leading)
+		d.trailing = 64 - d.leading - int(meaningful) - 1
+	}
+	xor, err := d.r.readBits(64 - d.leading - d.trailing)
+	if err != nil {
+		return 0, err
+	}
+	d.previous ^= xor << uint(d.trailing)
+	return math.Float64frombits(d.previous), nil
+}
+
+// encodeBlock encodes the points of a series, with the given named values, into a block
+func encodeBlock(points []*Point, valueNames []string) []byte {
+	w := &bitWriter{}
+	starts, ends := &timestampEncoder{w: w}, &timestampEncoder{w: w}
+	values := &valueEncoder{w: w}
+	namedValues := make([]*valueEncoder, len(valueNames))
+	for ii := range namedValues {
+		namedValues[ii] = &valueEncoder{w: w}
+	}
+	for _, p := range points {
+		starts.encode(p.Start)
+		ends.encode(p.End)
+		values.encode(p.Value)
+		for ii, name := range valueNames {
+			namedValues[ii].encode(p.Values[name])
+		}
+	}
+	return w.bytes()
+}
+
+// decodeBlock decodes count points, with the given named values, from a block
+func decodeBlock(block []byte, count int, valueNames []string) ([]*Point, error) {
+	r := &bitReader{buf: block}
+	starts, ends := &timestampDecoder{r: r}, &timestampDecoder{r: r}
+	values := &valueDecoder{r: r}
+	namedValues := make([]*valueDecoder, len(valueNames))
+	for ii := range namedValues {
+		namedValues[ii] = &valueDecoder{r: r}
+	}
+	points := make([]*Point, 0, count)
+	for ii := 0; ii < count; ii++ {
+		p := &Point{}
+		var err error
+		if p.Start, err = starts.decode(); err != nil {
+			return nil, err
+		}
+		if p.End, err = ends.decode(); err != nil {
+			return nil, err
+		}
+		if p.Value, err = values.decode(); err != nil {
+			return nil, err
+		}
+		if len(valueNames) > 0 {
+			p.Values = make(map[string]float64, len(valueNames))
+		}
+		for jj, name := range valueNames {
+			if p.Values[name], err = namedValues[jj].decode(); err != nil {
+				return nil, err
+			}
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
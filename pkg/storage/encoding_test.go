@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestBlockEncoding(t *testing.T) {
+	var points []*Point
+	// regular intervals, then irregular ones of every delta of deltas size
+	starts := []int64{1549573860, 1549573870, 1549573880, 1549573890, 1549573950, 1549574200, 1549575000, 1549590000, 1549580000, -10}
+	values := []float64{81, 81, 82.5, 0, -3, 1e-9, math.MaxFloat64, 81, 0.123, 1e300}
+	for ii, start := range starts {
+		points = append(points, &Point{
+			Start:  start,
+			End:    start + 10,
+			Value:  values[ii],
+			Values: map[string]float64{"count": float64(ii), "p99": values[len(values)-1-ii]},
+		})
+	}
+	valueNames := []string{"count", "p99"}
+	block := encodeBlock(points, valueNames)
+	got, err := decodeBlock(block, len(points), valueNames)
+	assert.NoError(t, err)
+	assert.Equal(t, points, got)
+
+	_, err = decodeBlock(block[:len(block)/2], len(points), valueNames)
+	assert.Error(t, err)
+}
+
+func TestBlockEncoding_Compression(t *testing.T) {
+	var points []*Point
+	for ii := int64(0); ii < 1000; ii++ {
+		points = append(points, &Point{Start: 1549573860 + ii*10, End: 1549573870 + ii*10, Value: float64(80 + ii%3)})
+	}
+	block := encodeBlock(points, nil)
+	// regular timestamps take 1 bit each, the values a few bits: far less than the 24 bytes of a point
+	assert.Less(t, len(block), 1000*3)
+	got, err := decodeBlock(block, len(points), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, points, got)
+}
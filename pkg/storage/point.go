@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"github.com/ebarti/dd-assignment/pkg/metrics"
+	"sort"
+)
+
+// Point is the value of a series over the time interval [Start, End)
+type Point struct {
+	Start  int64
+	End    int64
+	Value  float64
+	Values map[string]float64 // named values of distributions, e.g. count, avg or p99
+
+	sketch      *metrics.DDSketch    // sketch of distributions, used to roll them up
+	hyperLogLog *metrics.HyperLogLog // registers of cardinality metrics, used to roll them up
+}
+
+// newPoint creates a point from a flushed series. Sketches and registers are copied as they keep being merged
+func newPoint(start, end int64, series *metrics.ComputedMetric) *Point {
+	p := &Point{Start: start, End: end, Value: series.Value, Values: series.Values}
+	if series.Sketch != nil {
+		p.sketch = series.Sketch.Copy()
+	}
+	if series.HyperLogLog != nil {
+		p.hyperLogLog = series.HyperLogLog.Copy()
+	}
+	return p
+}
+
+// copy returns a copy of the point that is not modified by later rollups
+func (p *Point) copy() *Point {
+	c := *p
+	return &c
+}
+
+// PointAggregator merges the points of a series over time into a single one, according to the metric aggregation:
+// counts and sums are added, rates are weighted by the duration of the points, min, max and gauges keep
+// their extremum or latest value, distributions and cardinality metrics merge their sketches and registers,
+// and averages and derived metrics average the values of the points. Points recovered from disk keep their sketches and
+// registers. Distributions without a sketch merge their named values instead, with percentiles weighted by count, and
+// cardinality metrics without registers keep the largest estimate.
+type PointAggregator struct {
+	aggregation metrics.AggregationType
+	point       *Point
+	count       int64
+	weighted    float64 // sum of the rates multiplied by the duration of their points
+	latest      int64   // start of the latest point merged into a gauge
+	bounded     bool
+	start, end  int64
+}
+
+// NewPointAggregator creates a new PointAggregator for the given aggregation
+func NewPointAggregator(aggregation metrics.AggregationType) *PointAggregator {
+	return &PointAggregator{aggregation: aggregation}
+}
+
+// SetBounds sets the time interval of the aggregated point, e.g. a rollup bucket, instead of the one covered by the added points.
+// Rates are then computed over the whole interval, so that missing points count as 0.
+func (a *PointAggregator) SetBounds(start, end int64) *PointAggregator {
+	a.bounded, a.start, a.end = true, start, end
+	return a
+}
+
+// Add merges the point into the aggregated one
+func (a *PointAggregator) Add(p *Point) {
+	a.count++
+	if a.point == nil {
+		a.point = &Point{Start: p.Start, End: p.End, Value: p.Value}
+		if p.Values != nil {
+			a.point.Values = make(map[string]float64, len(p.Values))
+			for name, value := range p.Values {
+				a.point.Values[name] = value
+			}
+		}
+		a.weighted = p.Value * float64(p.End-p.Start)
+		a.latest = p.Start
+		if a.bounded {
+			a.point.Start, a.point.End = a.start, a.end
+		}
+		if p.sketch != nil {
+			a.point.sketch = p.sketch.Copy()
+		}
+		if p.hyperLogLog != nil {
+			a.point.hyperLogLog = p.hyperLogLog.Copy()
+		}
+		a.refresh()
+		return
+	}
+	if p.Start < a.point.Start && !a.bounded {
+		a.point.Start = p.Start
+	}
+	if p.End > a.point.End && !a.bounded {
+		a.point.End = p.End
+	}
+	a.weighted += p.Value * float64(p.End-p.Start)
+	switch a.aggregation {
+	case metrics.CountAggregation, metrics.SumAggregation, "":
+		a.point.Value += p.Value
+	case metrics.MinAggregation:
+		if p.Value < a.point.Value {
+			a.point.Value = p.Value
+		}
+	case metrics.MaxAggregation:
+		if p.Value > a.point.Value {
+			a.point.Value = p.Value
+		}
+	case metrics.GaugeAggregation:
+		if p.Start >= a.latest {
+			a.point.Value = p.Value
+			a.latest = p.Start
+		}
+	case metrics.DistributionAggregation:
+		if a.point.sketch != nil && p.sketch != nil {
+			_ = a.point.sketch.Merge(p.sketch) // all the sketches have the default relative accuracy
+		} else {
+			a.point.sketch = nil
+			a.mergeValues(p)
+		}
+	case metrics.CardinalityAggregation:
+		if a.point.hyperLogLog != nil && p.hyperLogLog != nil {
+			_ = a.point.hyperLogLog.Merge(p.hyperLogLog) // all the registers have the default precision
+		} else {
+			a.point.hyperLogLog = nil
+			if p.Value > a.point.Value {
+				a.point.Value = p.Value
+			}
+		}
+	default:
+		// running average of the values
+		a.point.Value += (p.Value - a.point.Value) / float64(a.count)
+	}
+	a.refresh()
+}
+
+// mergeValues is a helper function that merges the named values of a distribution without its sketch
+func (a *PointAggregator) mergeValues(p *Point) {
+	if a.point.Values == nil {
+		a.point.Values = make(map[string]float64, len(p.Values))
+	}
+	count, added := a.point.Values[metrics.CountValue], p.Values[metrics.CountValue]
+	for name, value := range p.Values {
+		current, ok := a.point.Values[name]
+		switch {
+		case name == metrics.CountValue || name == metrics.SumValue:
+			a.point.Values[name] = current + value
+		case !ok || count == 0:
+			a.point.Values[name] = value
+		case name == metrics.MinValue && value < current, name == metrics.MaxValue && value > current:
+			a.point.Values[name] = value
+		case name != metrics.MinValue && name != metrics.MaxValue && count+added > 0:
+			a.point.Values[name] = (current*count + value*added) / (count + added)
+		}
+	}
+	a.point.Value = a.point.Values[metrics.CountValue]
+}
+
+// refresh is a helper function that recomputes the values that depend on all the merged points
+func (a *PointAggregator) refresh() {
+	switch {
+	case a.aggregation == metrics.RateAggregation && a.point.End > a.point.Start:
+		a.point.Value = a.weighted / float64(a.point.End-a.point.Start)
+	case a.point.sketch != nil:
+		a.point.Values = a.point.sketch.Summary()
+		a.point.Value = a.point.Values[metrics.CountValue]
+	case a.point.hyperLogLog != nil:
+		a.point.Value = float64(a.point.hyperLogLog.Estimate())
+	}
+}
+
+// Point returns the aggregated point, or nil if no point was added
+func (a *PointAggregator) Point() *Point {
+	return a.point
+}
+
+// Rollup merges the points of a series of the given aggregation into buckets of interval seconds, aligned on multiples
+// of the interval like the rollups of the TimeSeriesStore. Points are assigned to the bucket of their start.
+func Rollup(aggregation metrics.AggregationType, points []*Point, interval int64) []*Point {
+	buckets := make(map[int64]*PointAggregator)
+	for _, p := range points {
+		bucketStart := p.Start - mod(p.Start, interval)
+		if _, ok := buckets[bucketStart]; !ok {
+			buckets[bucketStart] = NewPointAggregator(aggregation).SetBounds(bucketStart, bucketStart+interval)
+		}
+		buckets[bucketStart].Add(p)
+	}
+	rolledUp := make([]*Point, 0, len(buckets))
+	for _, bucket := range buckets {
+		rolledUp = append(rolledUp, bucket.Point().copy())
+	}
+	sort.Slice(rolledUp, func(i, j int) bool { return rolledUp[i].Start < rolledUp[j].Start })
+	return rolledUp
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"github.com/ebarti/dd-assignment/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPointAggregator(t *testing.T) {
+	points := []*Point{
+		{Start: 0, End: 10, Value: 4},
+		{Start: 20, End: 30, Value: 1},
+		{Start: 10, End: 20, Value: 7}, // out of order
+	}
+	tests := []struct {
+		aggregation metrics.AggregationType
+		want        float64
+	}{
+		{aggregation: metrics.CountAggregation, want: 12},
+		{aggregation: metrics.SumAggregation, want: 12},
+		{aggregation: metrics.MinAggregation, want: 1},
+		{aggregation: metrics.MaxAggregation, want: 7},
+		{aggregation: metrics.GaugeAggregation, want: 1},
+		{aggregation: metrics.AvgAggregation, want: 4},
+		{aggregation: metrics.RateAggregation, want: 4},
+		{aggregation: metrics.DerivedAggregation, want: 4},
+	}
+	for _, tt := range tests {
+		t.Run("test point aggregator with aggregation "+string(tt.aggregation), func(t *testing.T) {
+			a := NewPointAggregator(tt.aggregation)
+			assert.Nil(t, a.Point())
+			for _, p := range points {
+				a.Add(p)
+			}
+			assert.Equal(t, tt.want, a.Point().Value)
+			assert.Equal(t, int64(0), a.Point().Start)
+			assert.Equal(t, int64(30), a.Point().End)
+		})
+	}
+}
+
+func TestPointAggregator_SetBounds(t *testing.T) {
+	// rates are computed over the bounds, missing points count as 0
+	a := NewPointAggregator(metrics.RateAggregation).SetBounds(0, 60)
+	a.Add(&Point{Start: 0, End: 10, Value: 6})
+	a.Add(&Point{Start: 10, End: 20, Value: 12})
+	assert.Equal(t, float64(3), a.Point().Value)
+	assert.Equal(t, int64(60), a.Point().End)
+}
+
+func TestPointAggregator_Distribution(t *testing.T) {
+	a := NewPointAggregator(metrics.DistributionAggregation)
+	for start := int64(0); start < 30; start += 10 {
+		d := metrics.NewDistributionMetric()
+		for ii := 1; ii <= 10; ii++ {
+			assert.NoError(t, d.AddSample(&metrics.MetricSample{Value: float64(start) + float64(ii)}))
+		}
+		computed, err := d.Flush(start + 10)
+		assert.NoError(t, err)
+		a.Add(newPoint(start, start+10, computed))
+	}
+	assert.Equal(t, float64(30), a.Point().Value)
+	assert.Equal(t, float64(30), a.Point().Values[metrics.MaxValue])
+	assert.Equal(t, float64(1), a.Point().Values[metrics.MinValue])
+	assert.InDelta(t, 15, a.Point().Values["p50"], 15*metrics.DefaultRelativeAccuracy)
+}
+
+func TestRollup(t *testing.T) {
+	points := []*Point{
+		{Start: -10, End: 0, Value: 2},
+		{Start: 0, End: 10, Value: 4},
+		{Start: 10, End: 20, Value: 7},
+		{Start: 30, End: 40, Value: 1},
+	}
+	got := Rollup(metrics.CountAggregation, points, 30)
+	assert.Equal(t, 3, len(got))
+	assert.Equal(t, []int64{-30, 0, 30}, []int64{got[0].Start, got[1].Start, got[2].Start})
+	assert.Equal(t, []float64{2, 11, 1}, []float64{got[0].Value, got[1].Value, got[2].Value})
+	assert.Equal(t, int64(30), got[1].End)
+}
@@ -0,0 +1,342 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/ebarti/dd-assignment/pkg/metrics"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRawRetention is the default number of seconds the flushed intervals are kept at their original resolution
+const DefaultRawRetention = 60 * 60
+
+// DefaultRollups keeps 1 minute points for a day and 1 hour points for 30 days
+var DefaultRollups = []Resolution{
+	{Interval: 60, Retention: 24 * 60 * 60},
+	{Interval: 60 * 60, Retention: 30 * 24 * 60 * 60},
+}
+
+// Resolution is a rollup of the TimeSeriesStore: points are merged into buckets of Interval seconds,
+// aligned on multiples of the interval, which are kept for Retention seconds
+type Resolution struct {
+	Interval  int64
+	Retention int64
+}
+
+// FormatRollups returns the resolutions as comma separated interval:retention in seconds, e.g. "60:86400,3600:2592000"
+func FormatRollups(rollups []Resolution) string {
+	formatted := make([]string, 0, len(rollups))
+	for _, rollup := range rollups {
+		formatted = append(formatted, fmt.Sprintf("%d:%d", rollup.Interval, rollup.Retention))
+	}
+	return strings.Join(formatted, ",")
+}
+
+// Series is the history of a series of a metric, i.e. of a combination of tags
+type Series struct {
+	Metric      string
+	Aggregation metrics.AggregationType
+	Tags        []*metrics.Tag
+	Points      []*Point // sorted by start
+}
+
+// TimeSeriesStore keeps the history of the series of the metrics flushed by the MetricAggregator and implements
+// the metrics.MetricStore interface. Points are kept at their original resolution for the raw retention,
+// and rolled up into every Resolution for their own retention. Retention is relative to the end of the latest
+// stored interval rather than to the wall clock, as logs might be replayed from the past. TimeSeriesStore is thread-safe.
+// A TimeSeriesStore opened with OpenTimeSeriesStore also persists its points in a DiskStore, and recovers them on startup.
+type TimeSeriesStore struct {
+	tiers    []*tier        // raw tier first, then one per rollup from the finest to the coarsest
+	latest   int64          // end of the latest stored interval
+	location *time.Location // time zone the rollup buckets are aligned in, UTC if nil
+	disk     *DiskStore
+	mu       sync.RWMutex
+}
+
+// tier holds the points of all the series at a resolution
+type tier struct {
+	Resolution
+	location *time.Location
+	series   map[string]map[string]*storedSeries // map of [metricName][seriesKey]*storedSeries
+}
+
+// storedSeries holds the points of a series in a tier. Rollup tiers keep the aggregators of their buckets,
+// as points keep being merged until their bucket is complete
+type storedSeries struct {
+	metric      string
+	aggregation metrics.AggregationType
+	tags        []*metrics.Tag
+	points      []*Point           // raw points, sorted by start
+	buckets     []*PointAggregator // rolled up points, sorted by start
+}
+
+// NewTimeSeriesStore creates a new TimeSeriesStore with the given raw retention, in seconds, and rollups
+func NewTimeSeriesStore(rawRetention int64, rollups ...Resolution) *TimeSeriesStore {
+	s := &TimeSeriesStore{
+		tiers: []*tier{newTier(Resolution{Retention: rawRetention})},
+	}
+	sortedRollups := append([]Resolution{}, rollups...)
+	sort.Slice(sortedRollups, func(i, j int) bool {
+		return sortedRollups[i].Interval < sortedRollups[j].Interval
+	})
+	for _, rollup := range sortedRollups {
+		if rollup.Interval > 0 {
+			s.tiers = append(s.tiers, newTier(rollup))
+		}
+	}
+	return s
+}
+
+// WithTimeZone aligns the rollup buckets on multiples of their interval in the local time of the given time zone, as the
+// MetricAggregator aligns its intervals, instead of UTC. It must be set before any point is stored.
+func (s *TimeSeriesStore) WithTimeZone(location *time.Location) *TimeSeriesStore {
+	s.location = location
+	for _, t := range s.tiers {
+		t.location = location
+	}
+	return s
+}
+
+// OpenTimeSeriesStore creates a new TimeSeriesStore that persists its points in the given directory,
+// and recovers the points persisted by previous runs into rollup buckets aligned in the given time zone, UTC if nil
+func OpenTimeSeriesStore(dir string, location *time.Location, rawRetention int64, rollups ...Resolution) (*TimeSeriesStore, error) {
+	s := NewTimeSeriesStore(rawRetention, rollups...).WithTimeZone(location)
+	disk, err := OpenDiskStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	var maxRetention int64
+	for _, t := range s.tiers {
+		if t.Retention > maxRetention {
+			maxRetention = t.Retention
+		}
+	}
+	err = disk.WithRetention(maxRetention).Recover(func(series *persistedSeries, point *Point) {
+		if point.End > s.latest {
+			s.latest = point.End
+		}
+		for _, t := range s.tiers {
+			t.add(series.metric, series.aggregation, metrics.TagSetKey(series.tags), series.tags, point)
+		}
+	})
+	if err != nil {
+		disk.Close()
+		return nil, err
+	}
+	for _, t := range s.tiers {
+		t.evict(s.latest)
+	}
+	s.disk = disk
+	return s, nil
+}
+
+// newTier creates a new tier for the given resolution
+func newTier(resolution Resolution) *tier {
+	return &tier{Resolution: resolution, series: make(map[string]map[string]*storedSeries)}
+}
+
+// Store stores the series of the metrics computed for the time interval [start, end) and evicts the points
+// that are past their retention
+func (s *TimeSeriesStore) Store(start, end int64, computedMetrics []*metrics.ComputedMetric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.disk != nil {
+		if err := s.disk.Append(start, end, computedMetrics); err != nil {
+			log.Printf("Error while persisting the metrics of [%d, %d): %s", start, end, err)
+		}
+	}
+	if end > s.latest {
+		s.latest = end
+	}
+	for _, computedMetric := range computedMetrics {
+		for _, series := range computedMetric.Series {
+			point := newPoint(start, end, series)
+			for _, t := range s.tiers {
+				t.add(computedMetric.Name, computedMetric.GetAggregation(), series.Name, series.Tags, point)
+			}
+		}
+	}
+	for _, t := range s.tiers {
+		t.evict(s.latest)
+	}
+}
+
+// add adds the point of the series to the tier, rolling it up into its bucket if the tier has a resolution
+func (t *tier) add(metricName string, aggregation metrics.AggregationType, key string, tags []*metrics.Tag, point *Point) {
+	if _, ok := t.series[metricName]; !ok {
+		t.series[metricName] = make(map[string]*storedSeries)
+	}
+	stored, ok := t.series[metricName][key]
+	if !ok {
+		stored = &storedSeries{metric: metricName, aggregation: aggregation, tags: tags}
+		t.series[metricName][key] = stored
+	}
+	if t.Interval == 0 {
+		// intervals are flushed in order, so this is usually an append
+		ii := sort.Search(len(stored.points), func(i int) bool { return stored.points[i].Start > point.Start })
+		stored.points = append(stored.points, nil)
+		copy(stored.points[ii+1:], stored.points[ii:])
+		stored.points[ii] = point
+		return
+	}
+	// buckets are aligned on multiples of the interval in the local time of the time zone
+	local := point.Start + t.zoneOffset(point.Start)
+	localStart := local - mod(local, t.Interval)
+	bucketStart := t.fromLocal(localStart)
+	ii := sort.Search(len(stored.buckets), func(i int) bool { return stored.buckets[i].start >= bucketStart })
+	if ii == len(stored.buckets) || stored.buckets[ii].start != bucketStart {
+		stored.buckets = append(stored.buckets, nil)
+		copy(stored.buckets[ii+1:], stored.buckets[ii:])
+		stored.buckets[ii] = NewPointAggregator(stored.aggregation).SetBounds(bucketStart, t.fromLocal(localStart+t.Interval))
+	}
+	stored.buckets[ii].Add(point)
+}
+
+// zoneOffset returns the offset of the time zone of the tier at the given timestamp, in seconds east of UTC
+func (t *tier) zoneOffset(timestamp int64) int64 {
+	if t.location == nil {
+		return 0
+	}
+	_, offset := time.Unix(timestamp, 0).In(t.location).Zone()
+	return int64(offset)
+}
+
+// fromLocal returns the timestamp of the given local time in the time zone of the tier
+func (t *tier) fromLocal(local int64) int64 {
+	// the offset at the timestamp is the one of the local time, unless the offset changes right before it
+	return local - t.zoneOffset(local-t.zoneOffset(local))
+}
+
+// evict removes the points that ended before the retention of the tier, and the series left without points
+func (t *tier) evict(latest int64) {
+	cutoff := latest - t.Retention
+	for metricName, seriesByKey := range t.series {
+		for key, stored := range seriesByKey {
+			// points are sorted by start, and all the points of a series have the same duration
+			for len(stored.points) > 0 && stored.points[0].End <= cutoff {
+				stored.points = stored.points[1:]
+			}
+			for len(stored.buckets) > 0 && stored.buckets[0].end <= cutoff {
+				stored.buckets = stored.buckets[1:]
+			}
+			if len(stored.points) == 0 && len(stored.buckets) == 0 {
+				delete(seriesByKey, key)
+			}
+		}
+		if len(seriesByKey) == 0 {
+			delete(t.series, metricName)
+		}
+	}
+}
+
+// Close closes the DiskStore of the TimeSeriesStore, if any, after compacting the points of its write-ahead log
+func (s *TimeSeriesStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.disk == nil {
+		return nil
+	}
+	err := s.disk.Close()
+	s.disk = nil
+	return err
+}
+
+// Query returns the series of the metric that have all the given tags, with their points that overlap the time
+// interval [from, to). Tags without value only need to match the tag name. The points come from the finest
+// resolution whose retention still holds from. Series are sorted by their tags.
+func (s *TimeSeriesStore) Query(metricName string, tags []*metrics.Tag, from, to int64) []*Series {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t := s.tierFor(from)
+	keys := make([]string, 0, len(t.series[metricName]))
+	for key, stored := range t.series[metricName] {
+		if matchesTags(stored.tags, tags) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	result := make([]*Series, 0, len(keys))
+	for _, key := range keys {
+		stored := t.series[metricName][key]
+		series := &Series{Metric: stored.metric, Aggregation: stored.aggregation, Tags: stored.tags}
+		for _, point := range stored.points {
+			if point.End > from && point.Start < to {
+				series.Points = append(series.Points, point.copy())
+			}
+		}
+		for _, bucket := range stored.buckets {
+			if bucket.end > from && bucket.start < to {
+				series.Points = append(series.Points, bucket.Point().copy())
+			}
+		}
+		if len(series.Points) > 0 {
+			result = append(result, series)
+		}
+	}
+	return result
+}
+
+// tierFor is a helper function that returns the finest tier whose retention still holds the given time, or the coarsest one
+func (s *TimeSeriesStore) tierFor(from int64) *tier {
+	for _, t := range s.tiers {
+		if from >= s.latest-t.Retention {
+			return t
+		}
+	}
+	return s.tiers[len(s.tiers)-1]
+}
+
+// Latest returns the end of the latest stored interval, or 0 if nothing was stored
+func (s *TimeSeriesStore) Latest() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.latest
+}
+
+// MetricNames returns the names of the metrics with history, sorted alphabetically
+func (s *TimeSeriesStore) MetricNames() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make(map[string]struct{})
+	for _, t := range s.tiers {
+		for name := range t.series {
+			names[name] = struct{}{}
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// matchesTags is a helper function that returns true if the series tags contain all the given tags.
+// Tags without value only need to match the tag name
+func matchesTags(seriesTags []*metrics.Tag, tags []*metrics.Tag) bool {
+	for _, tag := range tags {
+		found := false
+		for _, seriesTag := range seriesTags {
+			if seriesTag.Name == tag.Name && (tag.Value == "" || seriesTag.Value == tag.Value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// mod is a helper function that returns the euclidean modulo, so that buckets are also aligned before the epoch
+func mod(a, b int64) int64 {
+	m := a % b
+	if m < 0 {
+		m += b
+	}
+	return m
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"github.com/ebarti/dd-assignment/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var apiTag = &metrics.Tag{Name: "section", Value: "api"}
+var reportTag = &metrics.Tag{Name: "section", Value: "report"}
+
+// flush is a helper function that flushes a metric of the given aggregation with a sample of the given value per tag
+func flush(t *testing.T, name string, aggregation metrics.AggregationType, value float64, tags ...*metrics.Tag) *metrics.ComputedMetric {
+	m := metrics.NewMetric(aggregation, 10)
+	for _, tag := range tags {
+		assert.NoError(t, m.AddSample(&metrics.MetricSample{Name: name, Value: value, Tags: []*metrics.Tag{tag}}))
+	}
+	computed, err := m.Flush(0)
+	assert.NoError(t, err)
+	computed.Name = name
+	return computed
+}
+
+// pointValues is a helper function that returns the start and value of the points of a series
+func pointValues(series *Series) map[int64]float64 {
+	values := make(map[int64]float64)
+	for _, p := range series.Points {
+		values[p.Start] = p.Value
+	}
+	return values
+}
+
+func TestTimeSeriesStore_Query(t *testing.T) {
+	store := NewTimeSeriesStore(DefaultRawRetention, DefaultRollups...)
+	for start := int64(100); start < 130; start += 10 {
+		store.Store(start, start+10, []*metrics.ComputedMetric{
+			flush(t, "hits", metrics.CountAggregation, float64(start/10), apiTag, reportTag),
+		})
+	}
+	assert.Equal(t, []string{"hits"}, store.MetricNames())
+
+	got := store.Query("hits", nil, 0, 200)
+	assert.Equal(t, 2, len(got))
+	assert.Equal(t, "section:api", metrics.TagSetKey(got[0].Tags))
+	assert.Equal(t, metrics.CountAggregation, got[0].Aggregation)
+	assert.Equal(t, map[int64]float64{100: 10, 110: 11, 120: 12}, pointValues(got[0]))
+
+	got = store.Query("hits", []*metrics.Tag{reportTag}, 110, 120)
+	assert.Equal(t, 1, len(got))
+	assert.Equal(t, "section:report", metrics.TagSetKey(got[0].Tags))
+	assert.Equal(t, map[int64]float64{110: 11}, pointValues(got[0]))
+
+	assert.Empty(t, store.Query("hits", []*metrics.Tag{{Name: "status"}}, 0, 200))
+	assert.Empty(t, store.Query("misses", nil, 0, 200))
+}
+
+func TestTimeSeriesStore_Rollups(t *testing.T) {
+	store := NewTimeSeriesStore(30, Resolution{Interval: 60, Retention: 300})
+	for start := int64(0); start < 120; start += 10 {
+		store.Store(start, start+10, []*metrics.ComputedMetric{
+			flush(t, "hits", metrics.CountAggregation, 1, apiTag),
+			flush(t, "hits per second", metrics.RateAggregation, 10, apiTag),
+		})
+	}
+	// the raw points of the last 30 seconds are kept
+	got := store.Query("hits", nil, 90, 120)
+	assert.Equal(t, map[int64]float64{90: 1, 100: 1, 110: 1}, pointValues(got[0]))
+	// older points are only available in the rollup
+	got = store.Query("hits", nil, 0, 120)
+	assert.Equal(t, map[int64]float64{0: 6, 60: 6}, pointValues(got[0]))
+	assert.Equal(t, int64(60), got[0].Points[0].End)
+	got = store.Query("hits per second", nil, 0, 120)
+	assert.Equal(t, map[int64]float64{0: 1, 60: 1}, pointValues(got[0]))
+
+	// a minute without samples evicts the first rollup bucket, and the whole history after the retention
+	store.Store(360, 370, []*metrics.ComputedMetric{flush(t, "misses", metrics.CountAggregation, 1, apiTag)})
+	got = store.Query("hits", nil, 0, 400)
+	assert.Equal(t, map[int64]float64{60: 6}, pointValues(got[0]))
+	store.Store(600, 610, []*metrics.ComputedMetric{flush(t, "misses", metrics.CountAggregation, 1, apiTag)})
+	assert.Equal(t, []string{"misses"}, store.MetricNames())
+}
+
+func TestTimeSeriesStore_RollupsTimeZone(t *testing.T) {
+	day := int64(24 * 60 * 60)
+	store := NewTimeSeriesStore(0, Resolution{Interval: day, Retention: 10 * day}).WithTimeZone(time.FixedZone("UTC+2", 2*60*60))
+	for start := int64(0); start < 2*day; start += 60 * 60 {
+		store.Store(start, start+60*60, []*metrics.ComputedMetric{flush(t, "hits", metrics.CountAggregation, 1, apiTag)})
+	}
+	// daily buckets start at local midnight, 2 hours before midnight UTC
+	got := store.Query("hits", nil, 0, 2*day)
+	assert.Equal(t, map[int64]float64{-2 * 60 * 60: 22, day - 2*60*60: 24, 2*day - 2*60*60: 2}, pointValues(got[0]))
+	assert.Equal(t, day-2*60*60, got[0].Points[0].End)
+}
+
+func TestFormatRollups(t *testing.T) {
+	assert.Equal(t, "60:86400,3600:2592000", FormatRollups(DefaultRollups))
+	assert.Equal(t, "", FormatRollups(nil))
+}
+
+func TestTimeSeriesStore_OutOfOrder(t *testing.T) {
+	store := NewTimeSeriesStore(DefaultRawRetention, Resolution{Interval: 60, Retention: 3600})
+	for _, start := range []int64{120, 100, 110} {
+		store.Store(start, start+10, []*metrics.ComputedMetric{flush(t, "bytes", metrics.MaxAggregation, float64(start), apiTag)})
+	}
+	got := store.Query("bytes", nil, 0, 200)
+	assert.Equal(t, []int64{100, 110, 120}, []int64{got[0].Points[0].Start, got[0].Points[1].Start, got[0].Points[2].Start})
+}